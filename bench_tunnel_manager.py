@@ -0,0 +1,49 @@
+import json
+import os
+import subprocess
+import tempfile
+import time
+from typing import List
+
+from tunnel_manager import SnapshotExecutor, StateStore, TunnelFactory, TunnelManager, TunnelRecords, TunnelType
+
+TUNNELS = 500
+
+
+# Answers the reads validate issues from a fixed set of links and counts every call
+class CountingExecutor:
+    def __init__(self, tunnels: int) -> None:
+        self.calls = 0
+        self.links = [{"ifname": f"vxlan{vni}", "master": "br0", "linkinfo": {"info_kind": "vxlan", "info_data": {"id": vni, "local": "10.0.0.1", "remote": "10.0.0.2", "port": 4789}, "info_slave_kind": "bridge", "info_slave_data": {"learning": False, "flood": True, "mcast_flood": True}}} for vni in range(tunnels)]
+
+    def run(self, command: List[str], check: bool = True) -> subprocess.CompletedProcess:
+        self.calls += 1
+        if command[:2] == ["ip", "-d"] or command[:4] == ["ip", "-d", "-s", "-j"]:
+            links = [link for link in self.links if command[-1] in (link["ifname"], "show")]
+            return subprocess.CompletedProcess(command, 0 if links else 1, stdout=json.dumps(links))
+        if command[0] == "bridge":
+            link = next(link for link in self.links if link["ifname"] == command[-1])
+            return subprocess.CompletedProcess(command, 0, stdout=json.dumps([dict(link["linkinfo"]["info_slave_data"], ifname=command[-1])]))
+        if command[:3] == ["ip", "-j", "route"]:
+            return subprocess.CompletedProcess(command, 0, stdout=json.dumps([{"dst": "10.8.0.0/16", "metrics": [{"mtu": 1400, "lock": ["mtu"]}]}]))
+        return subprocess.CompletedProcess(command, 0, stdout="")
+
+
+def validate_all(wrap_in_snapshot: bool) -> None:
+    with tempfile.TemporaryDirectory() as tmpdir:
+        records = TunnelRecords(StateStore(os.path.join(tmpdir, "state.json")))
+        state = {"tunnels": {records.key("vxlan", vni): {"tunnel_type": "vxlan", "vni": vni, "bridge_name": "br0", "port_flags": {"learning": "off"}, "routes": ["10.8.0.0/16"], "route_mtu": 1400} for vni in range(TUNNELS)}}
+        records.store.save(state)
+        counting = CountingExecutor(TUNNELS)
+        executor = SnapshotExecutor(counting) if wrap_in_snapshot else counting
+        manager = TunnelManager(TunnelFactory.create_tunnel(TunnelType.VXLAN, executor=executor), records)
+        start = time.perf_counter()
+        for vni in range(TUNNELS):
+            manager.check_state(vni)
+        elapsed = time.perf_counter() - start
+        print(f"validate over {TUNNELS} tunnels {'with' if wrap_in_snapshot else 'without'} snapshot: {counting.calls} executor calls, {elapsed * 1000:.0f} ms")
+
+
+if __name__ == "__main__":
+    validate_all(wrap_in_snapshot=False)
+    validate_all(wrap_in_snapshot=True)
@@ -1,15 +1,42 @@
 import argparse
+import collections
+import concurrent.futures
+import contextlib
 import csv
+import dataclasses
+import datetime
+import fcntl
+import fnmatch
+import functools
+import glob
+import hashlib
+import hmac
+import http.server
+import inspect
 import io
+import ipaddress
+import itertools
 import json
 import logging
+import os
+import queue
 import re
+import select
+import shlex
 import shutil
+import signal
 import socket
+import struct
 import subprocess
 import sys
+import tempfile
+import threading
+import time
+import urllib.parse
+import urllib.request
+import uuid
 from enum import Enum
-from typing import Any, Dict, List, Optional, Protocol, Type
+from typing import Any, Callable, Dict, Iterator, List, NamedTuple, Optional, Protocol, Set, Tuple, Type, Union, cast
 from xml.etree import ElementTree
 
 import yaml
@@ -25,10 +52,773 @@ class TunnelManagerError(Exception):
     pass
 
 
+class OperationCancelled(TunnelManagerError):
+    """Raised when the caller cancelled the operation; the interrupted step may or may not have run."""
+
+    def __init__(self, message: str = "", completed: Optional[List[str]] = None, rolled_back: Optional[List[str]] = None) -> None:
+        super().__init__(message)
+        self.completed = completed or []
+        self.rolled_back = rolled_back or []
+
+    def report(self) -> Dict[str, Any]:
+        return {"error": str(self), "completed": self.completed, "rolled_back": self.rolled_back}
+
+
+class CancelToken:
+    def __init__(self) -> None:
+        self.event = threading.Event()
+        self.shields = 0
+        self.followers: List["CancelToken"] = []
+
+    def cancel(self) -> None:
+        self.event.set()
+        for follower in list(self.followers):
+            follower.cancel()
+
+    @contextlib.contextmanager
+    def follow(self, token: "CancelToken") -> Iterator[None]:
+        # The daemon's executors watch one token; each request brings its own and only cancels while it runs
+        self.event.clear()
+        token.followers.append(self)
+        if token.event.is_set():
+            self.event.set()
+        try:
+            yield
+        finally:
+            token.followers.remove(self)
+            self.event.clear()
+
+    @property
+    def cancelled(self) -> bool:
+        return self.event.is_set() and not self.shields
+
+    @contextlib.contextmanager
+    def shielded(self) -> Iterator[None]:
+        # Rollback after a cancellation must still be able to run its commands
+        self.shields += 1
+        try:
+            yield
+        finally:
+            self.shields -= 1
+
+
+class CommandExecutor(Protocol):
+    def run(self, command: List[str], check: bool = True) -> subprocess.CompletedProcess:
+        ...
+
+
+class SubprocessExecutor(CommandExecutor):
+    def __init__(self, cancel: Optional[CancelToken] = None, poll_interval: float = 0.1) -> None:
+        self.cancel = cancel
+        self.poll_interval = poll_interval
+
+    def run(self, command: List[str], check: bool = True) -> subprocess.CompletedProcess:
+        if not self.cancel:
+            return subprocess.run(command, check=check, stdout=subprocess.PIPE, text=True)
+        with subprocess.Popen(command, stdout=subprocess.PIPE, text=True) as process:
+            while True:
+                try:
+                    stdout, _ = process.communicate(timeout=self.poll_interval)
+                    break
+                except subprocess.TimeoutExpired:
+                    if self.cancel.cancelled:
+                        process.terminate()
+                        process.communicate()
+                        raise OperationCancelled(f"Cancelled while running {shlex.join(command)}")
+        if check and process.returncode:
+            raise subprocess.CalledProcessError(process.returncode, command, output=stdout)
+        return subprocess.CompletedProcess(command, process.returncode, stdout=stdout)
+
+
+class SshExecutor(CommandExecutor):
+    def __init__(self, target: str, options: Optional[List[str]] = None) -> None:
+        self.target = target
+        self.options = options or ["-o", "BatchMode=yes", "-o", "ConnectTimeout=10"]
+
+    def run(self, command: List[str], check: bool = True) -> subprocess.CompletedProcess:
+        return subprocess.run(["ssh", *self.options, self.target, shlex.join(command)], check=check, stdout=subprocess.PIPE, text=True)
+
+
+# Runs commands inside a named network namespace. Tunnel devices are created in the current namespace, where
+# their underlay lives, and then moved in; commands about the underlay itself stay outside.
+class NetnsExecutor(CommandExecutor):
+    UNDERLAY_PREFIXES = (["ping"], ["sysctl"], ["ip", "-j", "route", "get"])
+
+    def __init__(self, executor: CommandExecutor, netns: str) -> None:
+        self.executor = executor
+        self.netns = netns
+
+    def inside(self, command: List[str]) -> List[str]:
+        if command[0] in ("ip", "bridge"):
+            return [command[0], "-n", self.netns, *command[1:]]
+        return ["ip", "netns", "exec", self.netns, *command]
+
+    def run(self, command: List[str], check: bool = True) -> subprocess.CompletedProcess:
+        if any(command[:len(prefix)] == prefix for prefix in self.UNDERLAY_PREFIXES) or command[:2] == ["ip", "netns"]:
+            return self.executor.run(command, check)
+        if not (command[:3] == ["ip", "link", "add"] and command[4:5] == ["type"] and command[5:6] and command[5] in TUNNEL_KINDS):
+            return self.executor.run(self.inside(command), check)
+        result = self.executor.run(command, check)
+        if result.returncode != 0:
+            return result
+        moved = self.executor.run(["ip", "link", "set", command[3], "netns", self.netns], check=False)
+        if moved.returncode != 0:
+            # The name is taken inside the namespace; report it as the failed add, the way a clash outside would be
+            self.executor.run(["ip", "link", "del", command[3]], check=False)
+            if check:
+                raise subprocess.CalledProcessError(moved.returncode, command, output=moved.stdout)
+            return subprocess.CompletedProcess(command, moved.returncode, stdout=moved.stdout)
+        return result
+
+
+# Netlink attribute names for the `ip link add` options each tunnel kind takes; a trailing 6 selects the IPv6 variant
+NETLINK_LINK_OPTIONS: Dict[str, Dict[str, str]] = {
+    "vxlan": {"id": "vxlan_id", "local": "vxlan_local", "remote": "vxlan_group", "group": "vxlan_group", "dev": "vxlan_link", "dstport": "vxlan_port", "ttl": "vxlan_ttl"},
+    "geneve": {"id": "geneve_id", "remote": "geneve_remote", "dstport": "geneve_port", "ttl": "geneve_ttl"},
+    "gretap": {"key": "gre_key", "local": "gre_local", "remote": "gre_remote", "dev": "gre_link", "ttl": "gre_ttl"},
+    "gre": {"key": "gre_key", "local": "gre_local", "remote": "gre_remote", "dev": "gre_link", "ttl": "gre_ttl"},
+}
+
+# IFLA_*_INFO_DATA attributes and the keys `ip -d -j link show` reports them under
+NETLINK_INFO_DATA: Dict[str, str] = {
+    "IFLA_VXLAN_ID": "id", "IFLA_VXLAN_GROUP": "remote", "IFLA_VXLAN_GROUP6": "remote6", "IFLA_VXLAN_LOCAL": "local", "IFLA_VXLAN_LOCAL6": "local6", "IFLA_VXLAN_LINK": "link", "IFLA_VXLAN_PORT": "port", "IFLA_VXLAN_TTL": "ttl",
+    "IFLA_VXLAN_LEARNING": "learning", "IFLA_VXLAN_PROXY": "proxy", "IFLA_VXLAN_L2MISS": "l2miss", "IFLA_VXLAN_L3MISS": "l3miss", "IFLA_VXLAN_GBP": "gbp", "IFLA_VXLAN_COLLECT_METADATA": "external",
+    "IFLA_GENEVE_ID": "id", "IFLA_GENEVE_REMOTE": "remote", "IFLA_GENEVE_REMOTE6": "remote6", "IFLA_GENEVE_PORT": "port", "IFLA_GENEVE_TTL": "ttl", "IFLA_GENEVE_COLLECT_METADATA": "external",
+    "IFLA_GRE_IKEY": "ikey", "IFLA_GRE_OKEY": "okey", "IFLA_GRE_LOCAL": "local", "IFLA_GRE_REMOTE": "remote", "IFLA_GRE_LINK": "link", "IFLA_GRE_TTL": "ttl",
+}
+
+
+# Serves the `ip link` commands tunnels are built from over netlink (pyroute2), without exec'ing iproute2.
+# Anything it does not translate, or everything when pyroute2 is not installed, goes to the fallback executor.
+class NetlinkExecutor(CommandExecutor):
+    IFF_UP = 0x1
+    # GRE_KEY in the byte order pyroute2 expects for gre_iflags/gre_oflags
+    GRE_KEY_FLAG = 0x20
+    # iproute2 exits with 2 when the kernel rejects a request and 1 when a device does not exist
+    EXIT_NETLINK_ERROR = 2
+    EXIT_NO_DEVICE = 1
+
+    def __init__(self, fallback: Optional[CommandExecutor] = None, ipr: Any = None) -> None:
+        self.fallback = fallback or SubprocessExecutor()
+        self.ipr = ipr
+        # Netlink sockets are not safe to share, so each thread opens its own
+        self.local = threading.local()
+        self.errors: Tuple[Type[BaseException], ...] = (OSError,)
+
+    def route(self) -> Any:
+        if self.ipr is not None:
+            return self.ipr
+        if not hasattr(self.local, "ipr"):
+            try:
+                from pyroute2 import IPRoute, NetlinkError
+            except ImportError:
+                logger.warning("pyroute2 is not installed; falling back to the ip command.")
+                self.ipr = False
+                return self.ipr
+            self.local.ipr = IPRoute()
+            self.errors = (NetlinkError, OSError)
+        return self.local.ipr
+
+    def run(self, command: List[str], check: bool = True) -> subprocess.CompletedProcess:
+        handler = self.handler(command)
+        if handler is None or not self.route():
+            return self.fallback.run(command, check)
+        try:
+            return subprocess.CompletedProcess(command, 0, stdout=handler())
+        except LookupError as e:
+            return self.failed(command, self.EXIT_NO_DEVICE, f"Device \"{e.args[0]}\" does not exist.", check)
+        except self.errors as e:
+            code = getattr(e, "code", None) or getattr(e, "errno", None)
+            return self.failed(command, self.EXIT_NETLINK_ERROR, f"RTNETLINK answers: {os.strerror(code) if code else e}", check)
+
+    @staticmethod
+    def failed(command: List[str], returncode: int, stderr: str, check: bool) -> subprocess.CompletedProcess:
+        if check:
+            raise subprocess.CalledProcessError(returncode, command, output="", stderr=stderr)
+        return subprocess.CompletedProcess(command, returncode, stdout="", stderr=stderr)
+
+    def handler(self, command: List[str]) -> Optional[Callable[[], str]]:
+        if command[:3] == ["ip", "link", "add"] and command[4:5] == ["type"] and len(command) % 2 == 0 and all(option in NETLINK_LINK_OPTIONS.get(command[5], {}) for option in command[6::2]) and "inherit" not in command:
+            return lambda: self.add(command[3], command[5], dict(zip(command[6::2], command[7::2])))
+        if command[:4] == ["ip", "link", "set", "master"] and len(command) == 6:
+            return lambda: self.set(command[5], master=self.index(command[4]))
+        if command[:3] == ["ip", "link", "set"] and len(command) == 5 and command[4] in ("up", "down"):
+            return lambda: self.set(command[3], state=command[4])
+        if command[:3] == ["ip", "link", "set"] and len(command) == 5 and command[4] == "nomaster":
+            return lambda: self.set(command[3], master=0)
+        if command[:3] == ["ip", "link", "del"] and len(command) == 4:
+            return lambda: self.delete(command[3])
+        # -d, -j and -s in any order before `link show`, the way the status, stats and snapshot reads put them
+        flags, rest = (command[1:command.index("link")], command[command.index("link") + 1:]) if command[0] == "ip" and "link" in command else ([], [])
+        if "-j" in flags and set(flags) <= {"-d", "-j", "-s"} and len(set(flags)) == len(flags) and rest[:1] == ["show"] and (len(rest) == 1 or (len(rest) == 3 and rest[1] in ("dev", "type"))):
+            return lambda: self.show(rest[1:], stats="-s" in flags)
+        return None
+
+    def index(self, ifname: str) -> int:
+        indexes = self.route().link_lookup(ifname=ifname)
+        if not indexes:
+            raise LookupError(ifname)
+        return indexes[0]
+
+    def add(self, ifname: str, kind: str, options: Dict[str, str]) -> str:
+        attributes: Dict[str, Any] = {}
+        for option, value in options.items():
+            name = NETLINK_LINK_OPTIONS[kind][option]
+            if name == "gre_key":
+                attributes.update(gre_ikey=int(value), gre_okey=int(value), gre_iflags=self.GRE_KEY_FLAG, gre_oflags=self.GRE_KEY_FLAG)
+            elif name.endswith("_link"):
+                attributes[name] = self.index(value)
+            elif option in ("local", "remote", "group") and ipaddress.ip_address(value).version == 6:
+                attributes[name + "6"] = value
+            else:
+                attributes[name] = int(value) if value.isdigit() else value
+        self.route().link("add", ifname=ifname, kind=kind, **attributes)
+        return ""
+
+    def set(self, ifname: str, **attributes: Any) -> str:
+        self.route().link("set", index=self.index(ifname), **attributes)
+        return ""
+
+    def delete(self, ifname: str) -> str:
+        self.route().link("del", index=self.index(ifname))
+        return ""
+
+    def show(self, selector: List[str], stats: bool = False) -> str:
+        messages = self.route().get_links()
+        names = {message["index"]: message.get_attr("IFLA_IFNAME") for message in messages}
+        links = [dict(self.link_json(message, names), **({"stats64": self.link_stats(message)} if stats else {})) for message in messages]
+        if selector[:1] == ["dev"]:
+            links = [link for link in links if link["ifname"] == selector[1]]
+            if not links:
+                raise LookupError(selector[1])
+        elif selector[:1] == ["type"]:
+            links = [link for link in links if link.get("linkinfo", {}).get("info_kind") == selector[1]]
+        return json.dumps(links)
+
+    @staticmethod
+    def link_stats(message: Any) -> Dict[str, Dict[str, int]]:
+        counters = message.get_attr("IFLA_STATS64") or message.get_attr("IFLA_STATS") or {}
+        return {direction: {field: counters.get(f"{direction}_{field}") or 0 for field in ("bytes", "packets", "errors", "dropped")} for direction in ("rx", "tx")}
+
+    @staticmethod
+    def link_json(message: Any, names: Dict[int, str]) -> Dict[str, Any]:
+        # Shaped like `ip -d -j link show`, so every reader of that output works unchanged
+        link: Dict[str, Any] = {"ifindex": message["index"], "ifname": message.get_attr("IFLA_IFNAME"), "flags": ["UP"] if message["flags"] & NetlinkExecutor.IFF_UP else [], "mtu": message.get_attr("IFLA_MTU"), "operstate": message.get_attr("IFLA_OPERSTATE") or "UNKNOWN"}
+        if message.get_attr("IFLA_MASTER"):
+            link["master"] = names.get(message.get_attr("IFLA_MASTER"))
+        linkinfo = message.get_attr("IFLA_LINKINFO")
+        if not linkinfo:
+            return link
+        link["linkinfo"] = {"info_kind": linkinfo.get_attr("IFLA_INFO_KIND")}
+        data = linkinfo.get_attr("IFLA_INFO_DATA")
+        if data is None or isinstance(data, (str, bytes)):
+            return link
+        info_data = {key: data.get_attr(name) for name, key in NETLINK_INFO_DATA.items() if data.get_attr(name) is not None}
+        for key in ("ikey", "okey"):
+            if key in info_data:
+                info_data[key] = str(ipaddress.IPv4Address(info_data[key]))
+        if "link" in info_data:
+            info_data["link"] = names.get(info_data["link"], info_data["link"])
+        for key in ("remote", "remote6"):
+            if key in info_data and ipaddress.ip_address(info_data[key]).is_multicast:
+                info_data[key.replace("remote", "group")] = info_data.pop(key)
+        link["linkinfo"]["info_data"] = info_data
+        return link
+
+
+class RecordingExecutor(CommandExecutor):
+    def __init__(self) -> None:
+        self.commands: List[List[str]] = []
+
+    def run(self, command: List[str], check: bool = True) -> subprocess.CompletedProcess:
+        self.commands.append(command)
+        return subprocess.CompletedProcess(command, 0, stdout="")
+
+
+# Runs queries so decisions match a real run, but prints changing commands instead of running them
+class DryRunExecutor(CommandExecutor):
+    READ_PREFIXES = (["ip", "-V"], ["ip", "-j", "route", "get"], ["sysctl", "-n"], ["ping"], ["ovs-vsctl", "get"], ["ovs-vsctl", "--if-exists", "get"], ["ovs-vsctl", "--format=json"], ["ovs-vsctl", "br-exists"], ["ovs-vsctl", "list-br"], ["ovs-vsctl", "list-ports"], ["ovs-vsctl", "port-to-br"], ["ovs-ofctl", "dump-flows"])
+
+    def __init__(self, executor: CommandExecutor, output: Optional[Any] = None) -> None:
+        self.executor = executor
+        self.output = output
+        self.commands: List[List[str]] = []
+
+    @classmethod
+    def is_read(cls, command: List[str]) -> bool:
+        return SnapshotExecutor.is_read(command) or any(command[:len(prefix)] == prefix for prefix in cls.READ_PREFIXES) or command[:3] == ["sh", "-c", WireGuardKeys.PUBKEY] or (command[:3] == ["ip", "netns", "exec"] and command[4:7] == ["sh", "-c", TextLinkReader.SYSFS])
+
+    def run(self, command: List[str], check: bool = True) -> subprocess.CompletedProcess:
+        if self.is_read(command):
+            return self.executor.run(command, check)
+        self.commands.append(command)
+        print(shlex.join(command), file=self.output or sys.stdout, flush=True)
+        return subprocess.CompletedProcess(command, 0, stdout="")
+
+
+# Files kept outside the state file, such as sysctl.d snippets, the link group names, IPAM files and WireGuard keys.
+# Under --dry-run they are listed next to the printed commands and left alone.
+class FileWriter:
+    def __init__(self, dry_run: bool = False, output: Optional[Any] = None) -> None:
+        self.dry_run = dry_run
+        self.output = output
+
+    def announce(self, action: str) -> None:
+        print(f"# {action}", file=self.output or sys.stdout, flush=True)
+
+    def makedirs(self, path: str, mode: int = 0o755) -> None:
+        if not self.dry_run:
+            os.makedirs(path, mode=mode, exist_ok=True)
+            os.chmod(path, mode)
+
+    def write(self, path: str, content: str, mode: int = 0o644, exclusive: bool = False) -> None:
+        if self.dry_run:
+            self.announce(f"write {path}")
+            return
+        os.makedirs(os.path.dirname(path) or ".", exist_ok=True)
+        if exclusive:
+            # Never overwrites; a key file that appeared in the meantime is kept
+            with os.fdopen(os.open(path, os.O_WRONLY | os.O_CREAT | os.O_EXCL, mode), "w") as f:
+                f.write(content)
+            return
+        tmp_path = f"{path}.tmp"
+        with os.fdopen(os.open(tmp_path, os.O_WRONLY | os.O_CREAT | os.O_TRUNC, mode), "w") as f:
+            f.write(content)
+        os.replace(tmp_path, path)
+
+    def replace(self, source: str, target: str) -> None:
+        if self.dry_run:
+            self.announce(f"move {source} to {target}")
+            return
+        os.replace(source, target)
+
+
+# Middleware answering repeated reads of live state from one snapshot; any other command invalidates it.
+# Counters move between two reads, so statistics queries always reach the system, and the snapshot expires after max_age
+class SnapshotExecutor(CommandExecutor):
+    LINK_QUERY = ["ip", "-d", "-j", "link", "show"]
+    LINK_FLAGS = {"-d", "-j"}
+    READ_COMMANDS = ("dig", "nstat")
+    COUNTER_FLAGS = {"-s", "-stats", "-statistics"}
+
+    def __init__(self, executor: CommandExecutor, max_entries: int = 1024, max_age: float = 5.0) -> None:
+        self.executor = executor
+        self.max_entries = max_entries
+        self.max_age = max_age
+        self.lock = threading.RLock()
+        self.links: Optional[Dict[str, Dict[str, Any]]] = None
+        self.results: "collections.OrderedDict[Tuple[str, ...], subprocess.CompletedProcess]" = collections.OrderedDict()
+        self.taken: Optional[float] = None
+        # Bumped by every invalidate, so a read that overlapped a change is not cached afterwards
+        self.generation = 0
+
+    def invalidate(self) -> None:
+        with self.lock:
+            self.links = None
+            self.results.clear()
+            self.taken = None
+            self.generation += 1
+
+    def expire(self) -> None:
+        with self.lock:
+            if self.taken is None:
+                self.taken = time.monotonic()
+            elif time.monotonic() - self.taken > self.max_age:
+                self.invalidate()
+                self.taken = time.monotonic()
+
+    @classmethod
+    def is_read(cls, command: List[str]) -> bool:
+        return "show" in command or command[0] in cls.READ_COMMANDS
+
+    @classmethod
+    def is_counter(cls, command: List[str]) -> bool:
+        return command[0] == "nstat" or bool(cls.COUNTER_FLAGS & set(command))
+
+    def snapshot(self) -> Dict[str, Dict[str, Any]]:
+        with self.lock:
+            if self.links is None:
+                self.links = {link["ifname"]: link for link in json.loads(self.executor.run(self.LINK_QUERY).stdout or "[]")}
+            return self.links
+
+    def from_snapshot(self, command: List[str]) -> Optional[Tuple[int, Any]]:
+        if command[:1] == ["ip"] and "link" in command and command[command.index("link") + 1:command.index("link") + 2] == ["show"]:
+            flags, rest = command[1:command.index("link")], command[command.index("link") + 2:]
+            if "-j" not in flags or not set(flags) <= self.LINK_FLAGS:
+                return None
+            if not rest:
+                return 0, list(self.snapshot().values())
+            if rest[0] == "dev" and len(rest) == 2:
+                link = self.snapshot().get(rest[1])
+                return (0, [link]) if link else (1, [])
+            return None
+        if command[:5] == ["bridge", "-d", "-j", "link", "show"] and len(command) == 7:
+            link = self.snapshot().get(command[6])
+            linkinfo = (link or {}).get("linkinfo", {})
+            if linkinfo.get("info_slave_kind") != "bridge":
+                return 0, []
+            return 0, [dict(linkinfo.get("info_slave_data", {}), ifname=command[6], master=link.get("master"))]
+        return None
+
+    def run(self, command: List[str], check: bool = True) -> subprocess.CompletedProcess:
+        if not self.is_read(command):
+            self.invalidate()
+            try:
+                return self.executor.run(command, check=check)
+            finally:
+                # Another thread may have read the links while the change was running
+                self.invalidate()
+        if self.is_counter(command):
+            return self.executor.run(command, check=check)
+        self.expire()
+        if (served := self.from_snapshot(command)) is not None:
+            returncode, data = served
+            if returncode and check:
+                raise subprocess.CalledProcessError(returncode, command)
+            return subprocess.CompletedProcess(command, returncode, stdout=json.dumps(data) if data else "")
+        key = tuple(command)
+        with self.lock:
+            if key in self.results:
+                self.results.move_to_end(key)
+                return self.results[key]
+            generation = self.generation
+        result = self.executor.run(command, check=check)
+        with self.lock:
+            if generation != self.generation:
+                return result
+            self.results[key] = result
+            if len(self.results) > self.max_entries:
+                self.results.popitem(last=False)
+        return result
+
+
+# Middleware failing commands on purpose, used to exercise rollback and retry paths
+class FaultInjectingExecutor(CommandExecutor):
+    def __init__(self, executor: CommandExecutor, fail_after_step: Optional[int] = None, fail_on: Optional[Callable[[List[str]], bool]] = None) -> None:
+        self.executor = executor
+        self.fail_after_step = fail_after_step
+        self.fail_on = fail_on
+        self.steps = 0
+
+    def run(self, command: List[str], check: bool = True) -> subprocess.CompletedProcess:
+        if (self.fail_after_step is not None and self.steps >= self.fail_after_step) or (self.fail_on is not None and self.fail_on(command)):
+            logger.warning(f"Injecting failure into step {self.steps + 1}: {' '.join(command)}")
+            raise subprocess.CalledProcessError(1, command, stderr="injected failure")
+        self.steps += 1
+        return self.executor.run(command, check)
+
+
+# Middleware refusing further commands once the caller cancelled; a command already running is reported as cancelled when it returns
+class CancellableExecutor(CommandExecutor):
+    def __init__(self, executor: CommandExecutor, cancel: CancelToken) -> None:
+        self.executor = executor
+        self.cancel = cancel
+        # Changes that ran, so a cancelled caller can be told what already happened
+        self.changes: List[str] = []
+
+    def run(self, command: List[str], check: bool = True) -> subprocess.CompletedProcess:
+        if self.cancel.cancelled:
+            raise OperationCancelled(f"Cancelled before running {shlex.join(command)}")
+        result = self.executor.run(command, check=check)
+        if not DryRunExecutor.is_read(command):
+            self.changes.append(shlex.join(command))
+        if self.cancel.cancelled:
+            raise OperationCancelled(f"Cancelled while running {shlex.join(command)}")
+        return result
+
+
+# Counts the commands that reach the system, for the resource report after bulk operations
+class OperationCounter(CommandExecutor):
+    def __init__(self, executor: CommandExecutor) -> None:
+        self.executor = executor
+        self.reads = 0
+        self.changes = 0
+
+    def run(self, command: List[str], check: bool = True) -> subprocess.CompletedProcess:
+        if SnapshotExecutor.is_read(command):
+            self.reads += 1
+        else:
+            self.changes += 1
+        return self.executor.run(command, check=check)
+
+
+# First iproute2 release with each feature; older builds report a snapshot date (ssYYMMDD) instead of a release
+IPROUTE2_FEATURES: Dict[str, Tuple[Tuple[int, ...], str]] = {
+    "json": ((4, 14, 0), "171113"),
+}
+
+
+class Iproute2Version(NamedTuple):
+    release: Tuple[int, ...] = ()
+    snapshot: str = ""
+
+    @classmethod
+    def parse(cls, output: str) -> Optional["Iproute2Version"]:
+        if match := re.search(r"iproute2-ss(\d{6})", output):
+            return cls(snapshot=match[1])
+        if match := re.search(r"iproute2-(\d+(?:\.\d+)*)", output):
+            return cls(release=tuple(int(part) for part in match[1].split(".")))
+        return None
+
+    @classmethod
+    def detect(cls, executor: CommandExecutor) -> Optional["Iproute2Version"]:
+        try:
+            return cls.parse(executor.run(["ip", "-V"], check=False).stdout or "")
+        except FileNotFoundError:
+            return None
+
+    def supports(self, feature: str) -> bool:
+        release, snapshot = IPROUTE2_FEATURES[feature]
+        return self.release >= release if self.release else self.snapshot >= snapshot
+
+
+# Reads links from `ip -d link show` text and sysfs for iproute2 builds without JSON output
+class TextLinkReader:
+    HEADER = re.compile(r"^\d+: (?P<ifname>[^:@\s]+)(?:@\S+)?: <(?P<flags>[^>]*)>(?P<rest>.*)$")
+    TUNNEL_KINDS = ("vxlan", "geneve", "gretap", "gre", "ip6gretap", "ip6gre")
+    STATS_FIELDS = ("bytes", "packets", "errors", "dropped")
+    # Prints the sysfs fields of one link as name=value lines; run inside a namespace, whose sysfs `ip netns exec` mounts
+    SYSFS = 'cd "$1" || exit 1; for name in mtu operstate address; do [ -r "$name" ] && echo "$name=$(cat "$name")"; done; for master in master brport/bridge; do [ -L "$master" ] && echo "master=$(basename "$(readlink -f "$master")")" && break; done; exit 0'
+
+    def __init__(self, executor: Optional[CommandExecutor] = None, sysfs_root: str = "/sys/class/net", netns: Optional[str] = None) -> None:
+        self.executor = executor or SubprocessExecutor()
+        self.sysfs_root = sysfs_root
+        self.netns = netns
+
+    @staticmethod
+    def pairs(words: List[str]) -> Dict[str, str]:
+        return {key: value for key, value in zip(words, words[1:])}
+
+    @classmethod
+    def parse_info_data(cls, words: List[str]) -> Dict[str, Any]:
+        pairs = cls.pairs(words)
+        info_data: Dict[str, Any] = {}
+        if "id" in pairs:
+            info_data["id"] = int(pairs["id"])
+        if "key" in pairs:
+            info_data["ikey"] = info_data["okey"] = pairs["key"]
+        for key in ("remote", "local", "ttl"):
+            if key in pairs:
+                info_data[key] = pairs[key]
+        if "dev" in pairs:
+            info_data["link"] = pairs["dev"]
+        if pairs.get("dstport", "").isdigit():
+            info_data["port"] = int(pairs["dstport"])
+        # VXLAN flags are printed only when they differ from the default
+        if "nolearning" in words:
+            info_data["learning"] = False
+        for flag in ("proxy", "l2miss", "l3miss", "gbp", "external"):
+            if flag in words:
+                info_data[flag] = True
+        return info_data
+
+    @classmethod
+    def parse(cls, text: str) -> List[Dict[str, Any]]:
+        links: List[Dict[str, Any]] = []
+        counters: List[str] = []
+        direction = ""
+        for line in text.splitlines():
+            if header := cls.HEADER.match(line):
+                pairs = cls.pairs(header["rest"].split())
+                link: Dict[str, Any] = {"ifname": header["ifname"], "flags": header["flags"].split(",") if header["flags"] else [], "operstate": pairs.get("state", "UNKNOWN")}
+                if pairs.get("mtu", "").isdigit():
+                    link["mtu"] = int(pairs["mtu"])
+                if "master" in pairs:
+                    link["master"] = pairs["master"]
+                links.append(link)
+                continue
+            words = line.split()
+            if not links or not words:
+                continue
+            if words[0].startswith("link/") and len(words) > 1:
+                links[-1]["address"] = words[1]
+            elif words[0] in cls.TUNNEL_KINDS:
+                info_data = cls.parse_info_data(words[1:])
+                if words[0] == "vxlan":
+                    info_data.setdefault("learning", True)
+                links[-1]["linkinfo"] = dict(links[-1].get("linkinfo", {}), info_kind=words[0], info_data=info_data)
+            elif words[0] == "bridge_slave":
+                links[-1].setdefault("linkinfo", {})["info_slave_kind"] = "bridge"
+            elif words[0] in ("RX:", "TX:"):
+                counters = words[1:]
+                direction = words[0][:2].lower()
+            elif counters and all(word.isdigit() for word in words):
+                # `ip -s` prints a row of counters under each RX: and TX: header
+                links[-1].setdefault("stats64", {})[direction] = {field: int(value) for field, value in zip(counters, words) if field in cls.STATS_FIELDS}
+                counters = []
+        return links
+
+    def sysfs_values(self, ifname: str) -> Dict[str, str]:
+        path = os.path.join(self.sysfs_root, ifname)
+        if self.netns:
+            result = self.executor.run(["ip", "netns", "exec", self.netns, "sh", "-c", self.SYSFS, "sysfs", path], check=False)
+            return dict(line.split("=", 1) for line in (result.stdout or "").splitlines() if "=" in line) if result.returncode == 0 else {}
+        values: Dict[str, str] = {}
+        if not os.path.isdir(path):
+            return values
+        for name in ("mtu", "operstate", "address"):
+            try:
+                with open(os.path.join(path, name)) as f:
+                    values[name] = f.read().strip()
+            except OSError:
+                pass
+        for master in ("master", os.path.join("brport", "bridge")):
+            if os.path.islink(os.path.join(path, master)):
+                values["master"] = os.path.basename(os.path.realpath(os.path.join(path, master)))
+                break
+        return values
+
+    def sysfs(self, link: Dict[str, Any]) -> Dict[str, Any]:
+        # sysfs is authoritative where present; the text output of old iproute2 omits or abbreviates some of these
+        values = self.sysfs_values(link["ifname"])
+        for name, convert in (("mtu", int), ("operstate", str.upper), ("address", str), ("master", str)):
+            try:
+                if name in values:
+                    link[name] = convert(values[name])
+            except ValueError:
+                pass
+        return link
+
+    def links(self, kind: Optional[str] = None, stats: bool = False) -> List[Dict[str, Any]]:
+        result = self.executor.run(["ip"] + (["-s"] if stats else []) + ["-d", "link", "show"] + (["type", kind] if kind else []))
+        return [self.sysfs(link) for link in self.parse(result.stdout or "")]
+
+    def link(self, ifname: str, stats: bool = False) -> Optional[Dict[str, Any]]:
+        result = self.executor.run(["ip"] + (["-s"] if stats else []) + ["-d", "link", "show", "dev", ifname], check=False)
+        if result.returncode != 0:
+            return None
+        links = self.parse(result.stdout or "")
+        return self.sysfs(links[0]) if links else None
+
+    def attributes(self, ifname: str) -> Optional[Dict[str, Any]]:
+        link = self.link(ifname)
+        return TunnelInterface.parse_link_attributes(link) if link else None
+
+
+# Answers `ip -j link show` from the text reader on iproute2 builds without JSON output, so status, stats, the snapshot
+# and every other link read keep working. Other JSON queries have no text fallback and are refused with a clear error
+class TextLinkExecutor(CommandExecutor):
+    LINK_FLAGS = {"-d", "-j", "-s"}
+
+    def __init__(self, executor: CommandExecutor, reader: Optional[TextLinkReader] = None) -> None:
+        self.executor = executor
+        self.reader = reader or TextLinkReader(executor)
+
+    def run(self, command: List[str], check: bool = True) -> subprocess.CompletedProcess:
+        flags = list(itertools.takewhile(lambda word: word.startswith("-"), command[1:]))
+        if command[0] not in ("ip", "bridge") or "-j" not in flags:
+            return self.executor.run(command, check)
+        rest = command[1 + len(flags):]
+        if command[0] != "ip" or not set(flags) <= self.LINK_FLAGS or rest[:2] != ["link", "show"] or not (len(rest) == 2 or (len(rest) == 4 and rest[2] in ("dev", "type"))):
+            raise TunnelManagerError(f"This iproute2 has no JSON output, which `{shlex.join(command)}` needs; upgrade to iproute2 4.14 or later")
+        stats = "-s" in flags
+        if rest[2:3] != ["dev"]:
+            return subprocess.CompletedProcess(command, 0, stdout=json.dumps(self.reader.links(rest[3] if len(rest) == 4 else None, stats)))
+        link = self.reader.link(rest[3], stats)
+        if link:
+            return subprocess.CompletedProcess(command, 0, stdout=json.dumps([link]))
+        stderr = f"Device \"{rest[3]}\" does not exist."
+        if check:
+            raise subprocess.CalledProcessError(1, command, output="", stderr=stderr)
+        return subprocess.CompletedProcess(command, 1, stdout="", stderr=stderr)
+
+
 class TunnelInterface(Protocol):
-    ip_pattern = r"(?:\d{1,3}(?:\.\d{1,3}){3}|[a-fA-F0-9:]+(?::\d{1,3}(?:\.\d{1,3}){3})?)"
+    CHECKSUMS = ("udpcsum", "udp6zerocsumtx", "udp6zerocsumrx")
+    tunnel_type: str
+    executor: CommandExecutor
+    ifnames: Dict[int, str]
+    ttl: Optional[Union[int, str]]
+    tos: Optional[str]
+    df: Optional[str]
+
+    def interface_name(self, vni: int) -> str:
+        return self.ifnames.get(vni, f"{self.tunnel_type}{vni}")
+
+    def device_id(self, vni: int) -> int:
+        # The id the device reports; only a GRE key given at create differs from the VNI
+        return vni
+
+    def checksum_options(self, vni: int, ipv6: bool) -> List[str]:
+        # Options given for one tunnel win over --udp6-zero-csum; the kernel default depends on its version, so only requested ones are passed
+        checksums = dict({"udp6zerocsumtx": True, "udp6zerocsumrx": True} if ipv6 and getattr(self, "udp6_zero_csum", False) else {}, **getattr(self, "checksums", {}).get(vni, {}))
+        return [name if enabled else f"no{name}" for name, enabled in checksums.items()]
+
+    def header_options(self) -> List[str]:
+        # Outer header fields; those left unset keep the kernel defaults
+        return (["ttl", str(self.ttl)] if self.ttl else []) + (["tos", self.tos] if self.tos else []) + (["df", self.df] if self.df else [])
+
+    def link(self, vni: int) -> Optional[Dict[str, Any]]:
+        result = self.executor.run(["ip", "-d", "-j", "link", "show", "dev", self.interface_name(vni)], check=False)
+        if result.returncode != 0:
+            return None
+        links = json.loads(result.stdout or "[]")
+        return links[0] if links else None
+
+    def link_attributes(self, vni: int) -> Optional[Dict[str, Any]]:
+        link = self.link(vni)
+        if not link:
+            return None
+        attributes = self.parse_link_attributes(link)
+        if attributes["master"] == OvsBridgeBackend.DATAPATH:
+            attributes["master"] = OvsBridgeBackend(self.executor).bridge_of(link["ifname"])
+        return attributes
+
+    def bridges(self) -> "BridgeBackend":
+        return BRIDGE_BACKENDS[getattr(self, "bridge_tool", "ip")](self.executor)
+
+    @staticmethod
+    def ip_version(host: str) -> Optional[int]:
+        # Plans may still carry host names; those are resolved before anything runs
+        try:
+            return ipaddress.ip_address(host).version
+        except ValueError:
+            return None
+
+    @classmethod
+    def underlay_version(cls, src_host: str, dst_host: str) -> Optional[int]:
+        # The kernel rejects a tunnel whose local and remote endpoints are in different address families
+        src_version, dst_version = cls.ip_version(src_host), cls.ip_version(dst_host)
+        if src_version and dst_version and src_version != dst_version:
+            raise TunnelManagerError(f"Underlay endpoints must be in one address family; {src_host} is IPv{src_version} and {dst_host} is IPv{dst_version}")
+        return dst_version
+
+    @staticmethod
+    def is_multicast(host: str) -> bool:
+        try:
+            return ipaddress.ip_address(host).is_multicast
+        except ValueError:
+            return False
+
+    @staticmethod
+    def socket_family(address: str) -> socket.AddressFamily:
+        return socket.AF_INET6 if ipaddress.ip_address(address).version == 6 else socket.AF_INET
+
+    @staticmethod
+    def info_data(link: Dict[str, Any]) -> Dict[str, Any]:
+        info_data = dict(link.get("linkinfo", {}).get("info_data", {}))
+        # GRE carries the VNI as its key, which iproute2 prints in dotted-quad form
+        if "id" not in info_data and "ikey" in info_data:
+            key = str(info_data["ikey"])
+            info_data["id"] = int(key) if key.isdigit() else int(ipaddress.IPv4Address(key))
+        return info_data
+
+    @staticmethod
+    def parse_link_attributes(link: Dict[str, Any]) -> Dict[str, Any]:
+        info_data = TunnelInterface.info_data(link)
+        # iproute2 reports IPv6 endpoints under separate keys, and a multicast remote as the group
+        attributes = {key.rstrip("6").replace("group", "remote"): value for key, value in info_data.items() if key in ("id", "remote", "remote6", "group", "group6", "local", "local6", "link", "port")}
+        return dict(attributes, master=link.get("master"))
+
+    def attach_tunnel_interface(self, vni: int, bridge_name: str) -> None:
+        try:
+            self.executor.run(["ip", "link", "set", self.interface_name(vni), "up"])
+            self.bridges().add_port(bridge_name, self.interface_name(vni))
+        except subprocess.CalledProcessError as e:
+            logger.error(f"Error attaching {self.interface_name(vni)} to {bridge_name}: {e}")
+            raise TunnelManagerError(f"Error attaching {self.interface_name(vni)} to {bridge_name}") from e
 
-    def create_tunnel_interface(self, vni: int, src_host: str, dst_host: str, bridge_name: str, src_port: Optional[int] = None, dst_port: Optional[int] = None, dev: Optional[str] = "eth0") -> None:
+    def create_tunnel_interface(self, vni: int, src_host: str, dst_host: str, bridge_name: str, src_port: Optional[Union[int, str]] = None, dst_port: Optional[int] = None, dev: Optional[str] = "eth0") -> None:
         raise NotImplementedError
 
     def cleanup_tunnel_interface(self, vni: int, bridge_name: str) -> None:
@@ -37,38 +827,90 @@ class TunnelInterface(Protocol):
     def validate_connectivity(self, src_host: str, dst_host: str, vni: int, port: Optional[int] = None, timeout: int = 3, max_retries: int = 3) -> None:
         raise NotImplementedError
 
+    @staticmethod
+    def tunnel_row(link: Dict[str, Any]) -> Optional[Dict[str, Any]]:
+        info_data = TunnelInterface.info_data(link)
+        # External devices report VNI 0 and carry every VNI; they belong to the external command, not to one tunnel
+        if info_data.get("id") is None or info_data.get("external"):
+            return None
+        row = {"ifname": link["ifname"], "vni": str(info_data["id"]), "src_host": info_data.get("local", info_data.get("local6", "")), "dst_host": info_data.get("remote", info_data.get("remote6", info_data.get("group", info_data.get("group6", "")))), "dst_port": str(info_data.get("port", "")), "dev": info_data.get("link", ""), "master": link.get("master", ""), "state": "up" if "UP" in link.get("flags", []) else "down"}
+        # Kernel VXLAN devices report learning; OVS ports and other kinds have none of these flags
+        if any(flag in info_data for flag in VXLANTunnel.FLAGS):
+            row["flags"] = ",".join(VXLANTunnel.flag_words(VXLANTunnel.link_flags(info_data)))
+        return row
+
     def collect_tunnel_data(self) -> List[Dict[str, Any]]:
-        raise NotImplementedError
+        try:
+            links = json.loads(self.executor.run(["ip", "-d", "-j", "link", "show", "type", self.tunnel_type]).stdout or "[]")
+        except (subprocess.CalledProcessError, json.JSONDecodeError) as e:
+            logger.error(f"Error collecting {self.tunnel_type} tunnel data: {e}")
+            return []
+        return [row for link in links if (row := self.tunnel_row(link))]
 
 
 # VXLAN-specific tunnel
 class VXLANTunnel(TunnelInterface):
     DEFAULT_PORT = 4789
+    ATTRIBUTES = ("remote", "local", "port")
+    # Device flags and their kernel defaults; EVPN and SDN controllers turn off learning and answer ARP and misses themselves.
+    # gbp carries a Group-Based Policy tag (a security group) in the header, for controllers such as Cilium and ACI
+    FLAGS = {"learning": True, "proxy": False, "l2miss": False, "l3miss": False, "gbp": False}
 
-    def __init__(self, bridge_tool: str = "ip") -> None:
+    def __init__(self, bridge_tool: str = "ip", executor: Optional[CommandExecutor] = None, ifnames: Optional[Dict[int, str]] = None, ttl: Optional[Union[int, str]] = None, tos: Optional[str] = None, df: Optional[str] = None, udp6_zero_csum: bool = False) -> None:
         self.bridge_tool = bridge_tool
+        self.executor = executor or SubprocessExecutor()
+        self.ifnames = dict(ifnames or {})
+        self.ttl = ttl
+        self.tos = tos
+        self.df = df
+        # Zero UDP checksums over IPv6 interoperate with VTEPs that send them, such as many switch ASICs
+        self.udp6_zero_csum = udp6_zero_csum
+        self.checksums: Dict[int, Dict[str, bool]] = {}
         self.tunnel_type = "vxlan"
+        self.flags: Dict[int, Dict[str, bool]] = {}
 
-    def create_tunnel_interface(self, vni: int, src_host: str, dst_host: str, bridge_name: str, src_port: Optional[int] = None, dst_port: Optional[int] = None, dev: Optional[str] = "eth0") -> None:
-        src_port = src_port or self.DEFAULT_PORT
+    @classmethod
+    def link_flags(cls, info_data: Dict[str, Any]) -> Dict[str, bool]:
+        return {flag: bool(info_data.get(flag, default)) for flag, default in cls.FLAGS.items()}
+
+    @staticmethod
+    def port_range(value: Union[int, str]) -> Tuple[int, int]:
+        # The kernel excludes MAX and ignores an empty range, so a single port N becomes N N+1; it pins every flow to N
+        match = re.fullmatch(r"(\d+)(?:-(\d+))?", str(value).strip())
+        low, high = (int(match[1]), int(match[2]) if match[2] else int(match[1]) + 1) if match else (0, 0)
+        if not 1 <= low < high <= 65535:
+            raise TunnelManagerError(f"Invalid source port range: {value} (expected MIN-MAX with MIN below MAX, e.g. 49152-65535)")
+        return low, high
+
+    @classmethod
+    def flag_words(cls, flags: Dict[str, bool]) -> List[str]:
+        # Only flags that differ from the default, spelled the way ip link takes them
+        return [flag if flags[flag] else f"no{flag}" for flag in cls.FLAGS if flag in flags and flags[flag] != cls.FLAGS[flag]]
+
+    def create_tunnel_interface(self, vni: int, src_host: str, dst_host: str, bridge_name: str, src_port: Optional[Union[int, str]] = None, dst_port: Optional[int] = None, dev: Optional[str] = "eth0") -> None:
+        # The kernel hashes each inner flow onto a source port in this range, which underlay ECMP spreads on
+        srcport = ["srcport", *map(str, self.port_range(src_port))] if src_port else []
         dst_port = dst_port or self.DEFAULT_PORT
 
+        ipv6 = self.underlay_version(src_host, dst_host) == 6
+        # A multicast group floods BUM traffic to every VTEP that joined it, which the kernel does on a named device
+        multicast = self.is_multicast(dst_host)
+        if multicast and not dev:
+            raise TunnelManagerError(f"Multicast group {dst_host} needs --dev to join the group on")
+
         try:
-            subprocess.run(["ip", "link", "add", f"vxlan{vni}", "type", "vxlan", "id", str(vni), "local", src_host, "remote", dst_host, "dev", dev, "dstport", str(dst_port)], check=True)
-            subprocess.run(["ip", "link", "set", f"vxlan{vni}", "up"], check=True)
-            subprocess.run(["ip", "link", "set", "master", bridge_name, f"vxlan{vni}"], check=True)
+            self.executor.run(["ip", "link", "add", self.interface_name(vni), "type", "vxlan", "id", str(vni), "local", src_host, "group" if multicast else "remote", dst_host] + (["dev", dev] if dev else []) + srcport + ["dstport", str(dst_port)] + self.header_options() + self.checksum_options(vni, ipv6) + self.flag_words(self.flags.get(vni, {})))
+            self.executor.run(["ip", "link", "set", self.interface_name(vni), "up"])
+            self.bridges().add_port(bridge_name, self.interface_name(vni))
         except subprocess.CalledProcessError as e:
             logger.error(f"Error creating VXLAN interface for VNI {vni}: {e}")
             raise TunnelManagerError(f"Error creating VXLAN interface for VNI {vni}") from e
 
     def cleanup_tunnel_interface(self, vni: int, bridge_name: str) -> None:
         try:
-            if self.bridge_tool == "brctl":
-                subprocess.run(["brctl", "delif", bridge_name, f"vxlan{vni}"], check=True)
-            else:
-                subprocess.run(["ip", "link", "set", f"vxlan{vni}", "nomaster"], check=True)
+            self.bridges().remove_port(bridge_name, self.interface_name(vni))
 
-            subprocess.run(["ip", "link", "del", f"vxlan{vni}"], check=True)
+            self.executor.run(["ip", "link", "del", self.interface_name(vni)])
         except subprocess.CalledProcessError as e:
             logger.error(f"Error deleting VXLAN interface for VNI {vni}: {e}")
             raise TunnelManagerError(f"Error deleting VXLAN interface for VNI {vni}") from e
@@ -76,9 +918,13 @@ class VXLANTunnel(TunnelInterface):
     def validate_connectivity(self, src_host: str, dst_host: str, vni: int, port: Optional[int] = None, timeout: int = 3, max_retries: int = 3) -> None:
         src_port = port or self.DEFAULT_PORT
 
+        if self.is_multicast(dst_host):
+            logger.info(f"Skipping connectivity check for {self.tunnel_type.upper()} VNI {vni}: {dst_host} is a multicast group, not a single peer.")
+            return
+
         retries = 0
         while retries < max_retries:
-            with socket.socket(socket.AF_INET, socket.SOCK_STREAM) as s:
+            with socket.socket(self.socket_family(dst_host), socket.SOCK_STREAM) as s:
                 s.settimeout(timeout)
 
                 try:
@@ -92,50 +938,46 @@ class VXLANTunnel(TunnelInterface):
                         logger.error(f"Failed to establish connectivity to {self.tunnel_type.upper()} VNI {vni} at {dst_host}:{src_port} from {src_host} after {max_retries} attempts.")
                         raise TunnelManagerError(f"Failed to establish connectivity to {self.tunnel_type.upper()} VNI {vni} at {dst_host}:{src_port} from {src_host}") from e
 
-    def collect_tunnel_data(self) -> List[Dict[str, Any]]:
-        vxlan_data = []
-        try:
-            result = subprocess.run(["ip", "-d", "link", "show", "type", "vxlan"], stdout=subprocess.PIPE, text=True)
-            vxlan_regex = re.compile(rf"\b(?P<ifname>\S+): .+ \bvxlan\b id (?P<vni>\d+) .+ local (?P<src_host>{self.ip_pattern}) remote (?P<dst_host>{self.ip_pattern}) .+ dstport (?P<dst_port>\d+)")
-
-            for line in result.stdout.split("\n"):
-                if match := vxlan_regex.search(line):
-                    details = match.groupdict()
-                    vxlan_details = dict(details.items())
-                    vxlan_data.append(vxlan_details)
-        except subprocess.CalledProcessError as e:
-            logger.error(f"Error collecting VXLAN tunnel data: {e}")
-        return vxlan_data
-
 
 # Geneve-specific tunnel
 class GeneveTunnel(TunnelInterface):
     DEFAULT_PORT = 6081
+    ATTRIBUTES = ("remote", "port")
 
-    def __init__(self, bridge_tool: str = "ip") -> None:
+    def __init__(self, bridge_tool: str = "ip", executor: Optional[CommandExecutor] = None, ifnames: Optional[Dict[int, str]] = None, ttl: Optional[Union[int, str]] = None, tos: Optional[str] = None, df: Optional[str] = None, udp6_zero_csum: bool = False) -> None:
         self.bridge_tool = bridge_tool
+        self.executor = executor or SubprocessExecutor()
+        self.ifnames = dict(ifnames or {})
+        self.ttl = ttl
+        self.tos = tos
+        self.df = df
+        # Zero UDP checksums over IPv6 interoperate with VTEPs that send them, such as many switch ASICs
+        self.udp6_zero_csum = udp6_zero_csum
+        self.checksums: Dict[int, Dict[str, bool]] = {}
         self.tunnel_type = "geneve"
 
-    def create_tunnel_interface(self, vni: int, src_host: str, dst_host: str, bridge_name: str, src_port: Optional[int] = None, dst_port: Optional[int] = None, dev: Optional[str] = "eth0") -> None:
+    def create_tunnel_interface(self, vni: int, src_host: str, dst_host: str, bridge_name: str, src_port: Optional[Union[int, str]] = None, dst_port: Optional[int] = None, dev: Optional[str] = "eth0") -> None:
         src_port = src_port or self.DEFAULT_PORT
         dst_port = dst_port or self.DEFAULT_PORT
 
+        if self.is_multicast(dst_host):
+            raise TunnelManagerError(f"Geneve has no multicast group mode; {dst_host} must be a unicast remote")
+
         try:
-            subprocess.run(["ip", "link", "add", f"geneve{vni}", "type", "geneve", "id", str(vni), "remote", dst_host, "local", src_host, "dev", dev, "dstport", str(dst_port)], check=True)
-            subprocess.run(["ip", "link", "set", f"geneve{vni}", "up"], check=True)
-            subprocess.run(["ip", "link", "set", "master", bridge_name, f"geneve{vni}"], check=True)
+            # Geneve has no local or dev option; the kernel picks the source address and device by routing to the remote
+            ipv6 = self.ip_version(dst_host) == 6
+            self.executor.run(["ip", "link", "add", self.interface_name(vni), "type", "geneve", "id", str(vni), "remote", dst_host, "dstport", str(dst_port)] + self.header_options() + self.checksum_options(vni, ipv6))
+            self.executor.run(["ip", "link", "set", self.interface_name(vni), "up"])
+            self.bridges().add_port(bridge_name, self.interface_name(vni))
         except subprocess.CalledProcessError as e:
             logger.error(f"Error creating Geneve interface for VNI {vni}: {e}")
             raise TunnelManagerError(f"Error creating Geneve interface for VNI {vni}") from e
 
     def cleanup_tunnel_interface(self, vni: int, bridge_name: str) -> None:
         try:
-            if self.bridge_tool == "brctl":
-                subprocess.run(["brctl", "delif", bridge_name, f"geneve{vni}"], check=True)
-            else:
-                subprocess.run(["ip", "link", "set", f"geneve{vni}", "nomaster"], check=True)
+            self.bridges().remove_port(bridge_name, self.interface_name(vni))
 
-            subprocess.run(["ip", "link", "del", f"geneve{vni}"], check=True)
+            self.executor.run(["ip", "link", "del", self.interface_name(vni)])
         except subprocess.CalledProcessError as e:
             logger.error(f"Error deleting Geneve interface for VNI {vni}: {e}")
             raise TunnelManagerError(f"Error deleting Geneve interface for VNI {vni}") from e
@@ -145,7 +987,7 @@ class GeneveTunnel(TunnelInterface):
 
         retries = 0
         while retries < max_retries:
-            with socket.socket(socket.AF_INET, socket.SOCK_STREAM) as s:
+            with socket.socket(self.socket_family(dst_host), socket.SOCK_STREAM) as s:
                 s.settimeout(timeout)
 
                 try:
@@ -159,35 +1001,220 @@ class GeneveTunnel(TunnelInterface):
                         logger.error(f"Failed to establish connectivity to Geneve VNI {vni} at {dst_host}:{src_port} from {src_host} after {max_retries} attempts.")
                         raise TunnelManagerError(f"Failed to establish connectivity to Geneve VNI {vni} at {dst_host}:{src_port} from {src_host}") from e
 
+
+# GRE and GRETAP tunnels for underlays that block UDP; only gretap carries Ethernet frames and can join a bridge
+class GreTunnel(TunnelInterface):
+    DEFAULT_PORT = None
+    ATTRIBUTES = ("remote", "local")
+
+    def __init__(self, bridge_tool: str = "ip", executor: Optional[CommandExecutor] = None, ifnames: Optional[Dict[int, str]] = None, ttl: Optional[Union[int, str]] = None, tos: Optional[str] = None, df: Optional[str] = None, kind: str = "gretap") -> None:
+        self.bridge_tool = bridge_tool
+        self.executor = executor or SubprocessExecutor()
+        self.ifnames = dict(ifnames or {})
+        self.ttl = ttl
+        self.tos = tos
+        self.df = df
+        self.tunnel_type = kind
+        self.gre_options: Dict[int, Dict[str, Any]] = {}
+
+    @property
+    def bridgeable(self) -> bool:
+        return self.tunnel_type == "gretap"
+
+    def header_options(self) -> List[str]:
+        # GRE sets DF through path MTU discovery, which is on by default and has no inherit mode
+        if self.df == "inherit":
+            raise TunnelManagerError(f"{self.tunnel_type} cannot inherit DF from the inner packet; use --df set or --df unset")
+        return (["ttl", str(self.ttl)] if self.ttl else []) + (["tos", self.tos] if self.tos else []) + {"set": ["pmtudisc"], "unset": ["nopmtudisc"]}.get(self.df or "", [])
+
+    def device_id(self, vni: int) -> int:
+        return self.gre_options.get(vni, {}).get("ikey", vni)
+
+    def key_options(self, vni: int) -> List[str]:
+        # The VNI is the key unless one is given; separate input and output keys match routers configured that way
+        options = self.gre_options.get(vni, {})
+        ikey, okey = options.get("ikey", vni), options.get("okey", vni)
+        keys = ["key", str(ikey)] if ikey == okey else ["ikey", str(ikey), "okey", str(okey)]
+        return keys + [option for option in ("csum", "seq") if options.get(option)]
+
+    def attach_tunnel_interface(self, vni: int, bridge_name: str) -> None:
+        if not self.bridgeable:
+            raise TunnelManagerError(f"{self.interface_name(vni)} is a layer 3 GRE device and cannot join bridge {bridge_name}; use --tunnel-type gretap")
+        super().attach_tunnel_interface(vni, bridge_name)
+
+    def create_tunnel_interface(self, vni: int, src_host: str, dst_host: str, bridge_name: str, src_port: Optional[Union[int, str]] = None, dst_port: Optional[int] = None, dev: Optional[str] = "eth0") -> None:
+        if ipaddress.ip_address(dst_host).version == 6:
+            raise TunnelManagerError(f"{self.tunnel_type} needs an IPv4 underlay; {dst_host} is IPv6")
+        if self.is_multicast(dst_host):
+            raise TunnelManagerError(f"{self.tunnel_type} has no multicast group mode; {dst_host} must be a unicast remote")
+
+        try:
+            # The key keeps tunnels to the same remote apart; GRE has no ports
+            self.executor.run(["ip", "link", "add", self.interface_name(vni), "type", self.tunnel_type] + self.key_options(vni) + ["local", src_host, "remote", dst_host] + (["dev", dev] if dev else []) + self.header_options())
+            self.executor.run(["ip", "link", "set", self.interface_name(vni), "up"])
+            if self.bridgeable:
+                self.bridges().add_port(bridge_name, self.interface_name(vni))
+            else:
+                logger.warning(f"{self.interface_name(vni)} is a layer 3 GRE device; not attaching it to {bridge_name}.")
+        except subprocess.CalledProcessError as e:
+            logger.error(f"Error creating {self.tunnel_type.upper()} interface for VNI {vni}: {e}")
+            raise TunnelManagerError(f"Error creating {self.tunnel_type.upper()} interface for VNI {vni}") from e
+
+    def cleanup_tunnel_interface(self, vni: int, bridge_name: str) -> None:
+        try:
+            if self.bridgeable:
+                self.bridges().remove_port(bridge_name, self.interface_name(vni))
+
+            self.executor.run(["ip", "link", "del", self.interface_name(vni)])
+        except subprocess.CalledProcessError as e:
+            logger.error(f"Error deleting {self.tunnel_type.upper()} interface for VNI {vni}: {e}")
+            raise TunnelManagerError(f"Error deleting {self.tunnel_type.upper()} interface for VNI {vni}") from e
+
+    def validate_connectivity(self, src_host: str, dst_host: str, vni: int, port: Optional[int] = None, timeout: int = 3, max_retries: int = 3) -> None:
+        # GRE is its own IP protocol, so there is no port to connect to; the remote endpoint must answer ping instead
+        for attempt in range(1, max_retries + 1):
+            if ping(self.executor, dst_host, timeout=timeout):
+                logger.info(f"Connectivity to {self.tunnel_type.upper()} VNI {vni} at {dst_host} from {src_host} is successful.")
+                return
+            logger.warning(f"Retry {attempt}/{max_retries} - {dst_host} did not answer ping for {self.tunnel_type.upper()} VNI {vni}")
+        logger.error(f"Failed to establish connectivity to {self.tunnel_type.upper()} VNI {vni} at {dst_host} from {src_host} after {max_retries} attempts.")
+        raise TunnelManagerError(f"Failed to establish connectivity to {self.tunnel_type.upper()} VNI {vni} at {dst_host} from {src_host}")
+
+
+# Tunnel ports of an Open vSwitch bridge instead of kernel devices; OVS encapsulates in its datapath
+class OvsTunnel(TunnelInterface):
+    # tunnel_manager's tunnel types and the OVS interface types that carry them
+    OVS_TYPES = {"vxlan": "vxlan", "geneve": "geneve", "gretap": "gre"}
+    PREFIXES = {"vxlan": "vx", "geneve": "gnv", "gretap": "gre"}
+    DEFAULT_PORTS = {"vxlan": 4789, "geneve": 6081}
+    COLUMNS = "name,type,options,admin_state"
+    # Ports of an OVS bridge are not netdevs, so link groups and bridge port flags do not apply
+    KERNEL_DEVICE = False
+
+    def __init__(self, bridge_tool: str = "ovs-vsctl", executor: Optional[CommandExecutor] = None, ifnames: Optional[Dict[int, str]] = None, ttl: Optional[Union[int, str]] = None, tos: Optional[str] = None, df: Optional[str] = None, udp6_zero_csum: bool = False, kind: str = "vxlan") -> None:
+        if kind not in self.OVS_TYPES:
+            raise TunnelManagerError(f"OVS has no {kind} tunnel port; its GRE ports carry Ethernet, so use --tunnel-type gretap")
+        # Bridges of OVS tunnel ports are always OVS bridges, whatever --bridge-tool says
+        self.bridge_tool = OvsBridgeBackend.TOOL
+        self.executor = executor or SubprocessExecutor()
+        self.ifnames = dict(ifnames or {})
+        self.ttl = ttl
+        self.tos = tos
+        self.df = df
+        self.udp6_zero_csum = udp6_zero_csum
+        self.tunnel_type = kind
+        self.DEFAULT_PORT = self.DEFAULT_PORTS.get(kind)
+        self.ATTRIBUTES = ("remote", "local") + (("port",) if self.DEFAULT_PORT else ())
+
+    def interface_name(self, vni: int) -> str:
+        return self.ifnames.get(vni, f"{self.PREFIXES[self.tunnel_type]}{vni}")
+
+    def interfaces(self, condition: str) -> List[Dict[str, Any]]:
+        try:
+            table = json.loads(self.executor.run(["ovs-vsctl", "--format=json", f"--columns={self.COLUMNS}", "find", "interface", condition]).stdout or "{}")
+        except (subprocess.CalledProcessError, json.JSONDecodeError) as e:
+            raise TunnelManagerError(f"Error reading OVS interfaces ({condition})") from e
+        return [dict(zip(table["headings"], row)) for row in table.get("data", [])]
+
+    def link_json(self, interface: Dict[str, Any], master: Optional[str]) -> Dict[str, Any]:
+        # Shaped like `ip -d -j link show`, so parse_link_attributes and tunnel_row read OVS ports unchanged
+        options = dict(interface["options"][1])
+        info_data: Dict[str, Any] = {"remote": options.get("remote_ip"), "local": options.get("local_ip"), "port": int(options.get("dst_port", self.DEFAULT_PORT or 0)) or None, "ttl": int(options["ttl"]) if "ttl" in options else None}
+        # Flow-based ports (key=flow) belong to `flows`, not to one VNI
+        if options.get("key", "").isdigit():
+            info_data["id"] = int(options["key"])
+        return {"ifname": interface["name"], "flags": ["UP"] if interface["admin_state"] == "up" else [], "master": master, "linkinfo": {"info_kind": self.tunnel_type, "info_data": {key: value for key, value in info_data.items() if value is not None}}}
+
+    def link(self, vni: int) -> Optional[Dict[str, Any]]:
+        interfaces = self.interfaces(f"name={self.interface_name(vni)}")
+        if not interfaces:
+            return None
+        return self.link_json(interfaces[0], OvsBridgeBackend(self.executor).bridge_of(interfaces[0]["name"]))
+
     def collect_tunnel_data(self) -> List[Dict[str, Any]]:
-        geneve_data = []
         try:
-            result = subprocess.run(["ip", "-d", "link", "show", "type", "geneve"], stdout=subprocess.PIPE, text=True)
-            geneve_regex = re.compile(rf"\b(?P<ifname>\S+): .+ \bgeneve\b id (?P<vni>\d+) .+ remote (?P<dst_host>{self.ip_pattern}) local (?P<src_host>{self.ip_pattern}) .+ dstport (?P<dst_port>\d+)")
+            bridges = OvsBridgeBackend(self.executor)
+            masters = {port: bridge for bridge in self.executor.run(["ovs-vsctl", "list-br"]).stdout.split() for port in bridges.ports(bridge)}
+            interfaces = self.interfaces(f"type={self.OVS_TYPES[self.tunnel_type]}")
+        except (subprocess.CalledProcessError, TunnelManagerError) as e:
+            logger.error(f"Error collecting OVS {self.tunnel_type} tunnel ports: {e}")
+            return []
+        return [row for interface in interfaces if (row := self.tunnel_row(self.link_json(interface, masters.get(interface["name"]))))]
+
+    def port_command(self, vni: int, src_host: str, dst_host: str, bridge_name: str, dst_port: Optional[int]) -> List[str]:
+        ifname = self.interface_name(vni)
+        options = [f"options:remote_ip={dst_host}", f"options:local_ip={src_host}", f"options:key={vni}"]
+        if self.DEFAULT_PORT:
+            options.append(f"options:dst_port={dst_port or self.DEFAULT_PORT}")
+        if self.ttl:
+            options.append(f"options:ttl={self.ttl}")
+        if self.tos:
+            options.append(f"options:tos={self.tos}")
+        if self.df == "inherit":
+            raise TunnelManagerError("OVS tunnel ports cannot inherit DF from the inner packet; use --df set or --df unset")
+        if self.df:
+            options.append(f"options:df_default={'true' if self.df == 'set' else 'false'}")
+        # OVS checksums UDP over IPv6 unless told otherwise
+        if self.udp6_zero_csum and self.DEFAULT_PORT and self.ip_version(dst_host) == 6:
+            options.append("options:csum=false")
+        return ["ovs-vsctl", "add-port", bridge_name, ifname, "--", "set", "interface", ifname, f"type={self.OVS_TYPES[self.tunnel_type]}", *options]
+
+    def create_tunnel_interface(self, vni: int, src_host: str, dst_host: str, bridge_name: str, src_port: Optional[Union[int, str]] = None, dst_port: Optional[int] = None, dev: Optional[str] = "eth0") -> None:
+        self.underlay_version(src_host, dst_host)
+        if self.is_multicast(dst_host):
+            raise TunnelManagerError(f"OVS {self.tunnel_type} ports have no multicast group mode; {dst_host} must be a unicast remote")
+
+        try:
+            # OVS picks the underlay device by routing to the remote, so --dev does not apply
+            self.executor.run(self.port_command(vni, src_host, dst_host, bridge_name, dst_port))
+        except subprocess.CalledProcessError as e:
+            logger.error(f"Error creating OVS {self.tunnel_type} port for VNI {vni}: {e}")
+            raise TunnelManagerError(f"Error creating OVS {self.tunnel_type} port for VNI {vni}") from e
+
+    def attach_tunnel_interface(self, vni: int, bridge_name: str) -> None:
+        # A port belongs to exactly one OVS bridge, so moving it re-adds it with its options in one transaction
+        link = self.link(vni)
+        if link is None:
+            raise TunnelManagerError(f"{self.interface_name(vni)} does not exist")
+        info_data = link["linkinfo"]["info_data"]
+        try:
+            self.executor.run(["ovs-vsctl", "--if-exists", "del-port", self.interface_name(vni), "--"] + self.port_command(vni, info_data.get("local", ""), info_data["remote"], bridge_name, info_data.get("port"))[1:])
+        except subprocess.CalledProcessError as e:
+            logger.error(f"Error attaching {self.interface_name(vni)} to {bridge_name}: {e}")
+            raise TunnelManagerError(f"Error attaching {self.interface_name(vni)} to {bridge_name}") from e
 
-            for line in result.stdout.split("\n"):
-                if match := geneve_regex.search(line):
-                    details = match.groupdict()
-                    geneve_details = dict(details.items())
-                    geneve_data.append(geneve_details)
+    def cleanup_tunnel_interface(self, vni: int, bridge_name: str) -> None:
+        try:
+            self.executor.run(["ovs-vsctl", "del-port", self.interface_name(vni)])
         except subprocess.CalledProcessError as e:
-            logger.error(f"Error collecting Geneve tunnel data: {e}")
+            logger.error(f"Error deleting OVS {self.tunnel_type} port for VNI {vni}: {e}")
+            raise TunnelManagerError(f"Error deleting OVS {self.tunnel_type} port for VNI {vni}") from e
 
-        return geneve_data
+    def validate_connectivity(self, src_host: str, dst_host: str, vni: int, port: Optional[int] = None, timeout: int = 3, max_retries: int = 3) -> None:
+        # Reaching the remote VTEP does not depend on who encapsulates
+        TunnelFactory.create_tunnel(TunnelType(self.tunnel_type), executor=self.executor).validate_connectivity(src_host, dst_host, vni, port, timeout, max_retries)
 
 
 class TunnelType(Enum):
     VXLAN = "vxlan"
     GENEVE = "geneve"
+    GRE = "gre"
+    GRETAP = "gretap"
 
 
 class TunnelFactory:
     @staticmethod
     def create_tunnel(tunnel_type: TunnelType, **kwargs: Any) -> TunnelInterface:
+        if kwargs.pop("ovs", False):
+            return OvsTunnel(kind=tunnel_type.value, **kwargs)
         if tunnel_type == TunnelType.VXLAN:
             return VXLANTunnel(**kwargs)
         elif tunnel_type == TunnelType.GENEVE:
             return GeneveTunnel(**kwargs)
+        elif tunnel_type in (TunnelType.GRE, TunnelType.GRETAP):
+            # GRE has no UDP header to checksum
+            kwargs.pop("udp6_zero_csum", None)
+            return GreTunnel(kind=tunnel_type.value, **kwargs)
         else:
             raise ValueError(f"Unsupported tunnel type: {tunnel_type}")
 
@@ -246,10 +1273,10 @@ class TableFormatter(OutputFormatterStrategy):
     def format(self, data: Any) -> str:
         table = str()
         headers = data[0].keys() if data else []
-        table += " | ".join(str(item.get(header, "")) for header in headers) + "\n"
+        table += " | ".join(str(header) for header in headers) + "\n"
         table += "-+-".join(["-" * len(header) for header in headers]) + "\n"
         for item in data:
-            table += " | ".join(item.values()) + "\n"
+            table += " | ".join(str(item.get(header, "")) for header in headers) + "\n"
         return table
 
 
@@ -261,102 +1288,7148 @@ class OutputFormatterFactory:
         return OutputFormatterFactory.formatters[format_type]
 
 
-class TunnelManager:
-    def __init__(self, tunnel: TunnelInterface) -> None:
-        self.tunnel: TunnelInterface = tunnel
-
-    def create(self, vni: int, src_host: str, dst_host: str, bridge_name: str, src_port: Optional[int] = None, dst_port: Optional[int] = None, dev: Optional[str] = None) -> None:
-        self.tunnel.create_tunnel_interface(vni, src_host, dst_host, bridge_name, src_port, dst_port, dev)
+class PlanEntry(NamedTuple):
+    action: str
+    tunnel_type: str
+    vni: int
+    changes: Dict[str, Any]
+    commands: List[List[str]]
+    description: str = ""
+    site: str = ""
 
-    def cleanup(self, vni: int, bridge_name: str) -> None:
-        self.tunnel.cleanup_tunnel_interface(vni, bridge_name)
+    # Every entry gets its own changes and commands; a shared default would leak edits between entries
+    @classmethod
+    def build(cls, action: str, tunnel_type: str, vni: int, changes: Optional[Dict[str, Any]] = None, commands: Optional[List[List[str]]] = None, description: str = "", site: str = "") -> "PlanEntry":
+        return cls(action, tunnel_type, vni, dict(changes or {}), list(commands or []), description, site)
 
-    def validate(self, src_host: str, dst_host: str, vni: int, port: Optional[int] = None) -> None:
-        self.tunnel.validate_connectivity(src_host, dst_host, vni, port)
+    def to_dict(self) -> Dict[str, Any]:
+        return {"action": self.action, "tunnel_type": self.tunnel_type, "vni": self.vni, "changes": {field: {"old": old, "new": new} for field, (old, new) in self.changes.items()}, "commands": [shlex.join(command) for command in self.commands], "description": self.description, **({"site": self.site} if self.site else {})}
 
-    def list(self) -> List[Dict[str, Any]]:
-        return self.tunnel.collect_tunnel_data()
 
-    def execute_action(self, action: str, **kwargs: Any) -> Any:
-        if method := getattr(self, action):
-            return method(**kwargs)
-        raise ValueError(f"No method available for action: {action}")
+class PlanFormatType(Enum):
+    TEXT = "text"
+    JSON = "json"
+    MARKDOWN = "markdown"
 
 
-class CommandValidator(Protocol):
-    def check_command_existence(self, command: str) -> bool:
+class PlanFormatterStrategy(Protocol):
+    def format(self, plan: List[PlanEntry]) -> str:
         ...
 
-    def check_bridge_tool_existence(self, bridge_tool: str) -> None:
-        ...
 
+def plan_summary(plan: List[PlanEntry]) -> str:
+    counts = {action: sum(1 for entry in plan if entry.action == action) for action in ("create", "modify", "replace", "delete")}
+    counts["modify"] += counts["replace"]
+    return f"{counts['create']} to create, {counts['modify']} to modify, {counts['delete']} to delete"
 
-class SystemCommandValidator(CommandValidator):
-    def check_command_existence(self, command: str) -> bool:
-        return shutil.which(command) is not None
 
-    def check_bridge_tool_existence(self, bridge_tool: str) -> None:
-        if not self.check_command_existence(bridge_tool):
-            raise RuntimeError(f"Error: The bridge tool '{bridge_tool}' is not found. Please install it.")
+def describe_changes(changes: Dict[str, Any]) -> str:
+    return ", ".join(f"{field}: {old if old is not None else '-'} -> {new if new is not None else '-'}" for field, (old, new) in changes.items())
 
 
-def main() -> None:
-    parser = argparse.ArgumentParser(description="Manage VXLAN and GENEVE tunnels between bridges.")
-    parser.add_argument("--tunnel-type", type=TunnelType, choices=[tunnel_type.value for tunnel_type in TunnelType], default=TunnelType.VXLAN.value, help="Type of tunnel to create (default: %(default)s)")
-    parser.add_argument("--bridge-tool", choices=["ip", "brctl"], default="ip", help="Bridge tool to use (default: %(default)s)")
-    subparsers = parser.add_subparsers(dest="command", help="sub-command help")
+class TextPlanFormatter(PlanFormatterStrategy):
+    SYMBOLS = {"create": "+", "modify": "~", "replace": "~", "delete": "-", "noop": " ", "conflict": "!"}
 
-    # Create the parser for the "create" command
-    parser_create = subparsers.add_parser("create", help="create a tunnel interface")
-    parser_create.add_argument("--vni", type=int, required=True, help="VNI (Virtual Network Identifier)")
-    parser_create.add_argument("--src-host", required=True, help="Source host IP address")
-    parser_create.add_argument("--dst-host", required=True, help="Destination host IP address")
-    parser_create.add_argument("--bridge-name", required=True, help="Bridge name to associate with the tunnel interface")
-    parser_create.add_argument("--src-port", type=int, help="Source port (optional)")
-    parser_create.add_argument("--dst-port", type=int, help="Destination port (optional)")
-    parser_create.add_argument("--dev", help="Device (optional)")
+    def format(self, plan: List[PlanEntry]) -> str:
+        lines = []
+        # Plain tunnels first, then one header per site over its services
+        grouped = sorted(plan, key=lambda entry: entry.site)
+        for index, entry in enumerate(grouped):
+            if entry.site and (index == 0 or grouped[index - 1].site != entry.site):
+                lines.append(f"Site {entry.site}:")
+            lines.append(f"{self.SYMBOLS.get(entry.action, '?')} {entry.action} {entry.tunnel_type} VNI {entry.vni}" + (f" ({entry.description})" if entry.description else ""))
+            if entry.changes:
+                lines.append(f"    {describe_changes(entry.changes)}")
+            lines.extend(f"    $ {shlex.join(command)}" for command in entry.commands)
+        lines.append(f"Plan: {plan_summary(plan)}.")
+        return "\n".join(lines)
 
-    # Create the parser for the "cleanup" command
-    parser_cleanup = subparsers.add_parser("cleanup", help="cleanup a tunnel interface")
-    parser_cleanup.add_argument("--vni", type=int, required=True, help="VNI (Virtual Network Identifier)")
-    parser_cleanup.add_argument("--bridge-name", required=True, help="Bridge name associated with the tunnel interface")
 
-    # Create the parser for the "validate" command
-    parser_validate = subparsers.add_parser("validate", help="validate connectivity of a tunnel interface")
-    parser_validate.add_argument("--src-host", required=True, help="Source host IP address")
-    parser_validate.add_argument("--dst-host", required=True, help="Destination host IP address")
-    parser_validate.add_argument("--vni", type=int, required=True, help="VNI (Virtual Network Identifier)")
-    parser_validate.add_argument("--port", type=int, help="Port (optional)")
-    parser_validate.add_argument("--retries", type=int, default=3, help="Number of retries for connectivity validation (default: %(default)s)")
-    parser_validate.add_argument("--timeout", type=int, default=3, help="Timeout in seconds for connectivity validation (default: %(default)s)")
+class JsonPlanFormatter(PlanFormatterStrategy):
+    def format(self, plan: List[PlanEntry]) -> str:
+        return json.dumps({"summary": plan_summary(plan), "entries": [entry.to_dict() for entry in plan]}, indent=2)
 
-    # Create the parser for the "list" command
-    parser_list = subparsers.add_parser("list", help="list all tunnel interfaces")
-    parser_list.add_argument("-fo", "--format", type=OutputFormatType, choices=[format_type.value for format_type in OutputFormatType], default=OutputFormatType.TABLE.value, help="Output format for listing tunnels (default: %(default)s)")
-    parser_list.add_argument("-fi", "--fields", nargs="+", default="all", help="Fields to display for listing tunnel interfaces")
 
-    args = parser.parse_args()
-    command_validator = SystemCommandValidator()
-    command_validator.check_bridge_tool_existence(args.bridge_tool)
+class MarkdownPlanFormatter(PlanFormatterStrategy):
+    def __init__(self, max_length: int = 60000) -> None:
+        # GitHub rejects comments above 65536 characters
+        self.max_length = max_length
 
-    try:
-        tunnel = TunnelFactory.create_tunnel(args.tunnel_type)
-        manager = TunnelManager(tunnel)
-        if args.command == "create":
-            manager.create(args.vni, args.src_host, args.dst_host, args.bridge_name, args.src_port, args.dst_port, args.dev)
-        elif args.command == "cleanup":
-            manager.cleanup(args.vni, args.bridge_name)
-        elif args.command == "validate":
-            manager.validate(args.src_host, args.dst_host, args.vni, args.src_port or args.dst_port, args.timeout, args.retries)
-        elif args.command == "list":
-            data = manager.list()
-            formatter = OutputFormatterFactory.get_formatter(args.output_format)
-            print(formatter.format(data))
+    @staticmethod
+    def escape(text: str) -> str:
+        text = " ".join(str(text).split())
+        text = text.replace("&", "&amp;").replace("<", "&lt;").replace(">", "&gt;")
+        return re.sub(r"([\\`*_{}\[\]()#+!|~])", r"\\\1", text)
+
+    @staticmethod
+    def fence(commands: List[List[str]]) -> str:
+        return MarkdownPlanFormatter.fence_text("\n".join(shlex.join(command) for command in commands))
+
+    @staticmethod
+    def fence_text(body: str) -> str:
+        longest_backticks = max((len(run) for run in re.findall(r"`+", body)), default=0)
+        fence = "`" * max(3, longest_backticks + 1)
+        return f"{fence}sh\n{body}\n{fence}"
+
+    def format(self, plan: List[PlanEntry]) -> str:
+        header = [f"### Plan: {plan_summary(plan)}", "", "| Action | Type | VNI | Changes | Description |", "|---|---|---|---|---|"]
+        rows = [f"| {entry.action} | {entry.tunnel_type} | {entry.vni} | {self.escape(describe_changes(entry.changes))} | {self.escape(entry.description)} |" for entry in plan]
+        sections = [f"<details><summary>Commands for {entry.tunnel_type} VNI {entry.vni} ({entry.action})</summary>\n\n{self.fence(entry.commands)}\n\n</details>" for entry in plan if entry.commands]
+
+        output = "\n".join(header)
+        parts = [("\n" + row) for row in rows] + [("\n\n" + section) for section in sections]
+        for shown, part in enumerate(parts):
+            if len(output) + len(part) > self.max_length:
+                omitted_rows = max(len(rows) - shown, 0)
+                omitted_sections = len(sections) - max(shown - len(rows), 0)
+                return output + f"\n\n_Output truncated: {omitted_rows} more rows and {omitted_sections} command sections not shown._"
+            output += part
+        return output
+
+
+class PlanFormatterFactory:
+    formatters = {PlanFormatType.TEXT: TextPlanFormatter(), PlanFormatType.JSON: JsonPlanFormatter(), PlanFormatType.MARKDOWN: MarkdownPlanFormatter()}
+
+    @staticmethod
+    def get_formatter(format_type: PlanFormatType) -> PlanFormatterStrategy:
+        return PlanFormatterFactory.formatters[format_type]
+
+
+class StateStore:
+    DEFAULT_PATH = "/var/lib/tunnel_manager/state.json"
+
+    def __init__(self, path: str = DEFAULT_PATH) -> None:
+        self.path = path
+        # Serializes read-modify-write cycles of threads sharing the store, such as apply --parallel workers
+        self.lock = threading.RLock()
+
+    def load(self) -> Dict[str, Any]:
+        try:
+            with open(self.path) as f:
+                return json.load(f)
+        except FileNotFoundError:
+            return {}
+        except json.JSONDecodeError as e:
+            raise TunnelManagerError(f"State file {self.path} is corrupt") from e
+
+    def scratch_copy(self, directory: str) -> "StateStore":
+        # Dry runs change a copy, so records, the audit log and the journal behave as in a real run
+        for name in (os.path.basename(self.path), "audit.log", "intents.jsonl"):
+            source = os.path.join(os.path.dirname(self.path) or ".", name)
+            if os.path.exists(source):
+                shutil.copy2(source, os.path.join(directory, name))
+        return StateStore(os.path.join(directory, os.path.basename(self.path)))
+
+    def save(self, state: Dict[str, Any]) -> None:
+        os.makedirs(os.path.dirname(self.path) or ".", exist_ok=True)
+        tmp_path = f"{self.path}.tmp"
+        with self.lock:
+            with open(tmp_path, "w") as f:
+                json.dump(state, f, indent=2, sort_keys=True)
+            os.replace(tmp_path, self.path)
+
+
+class ResolvePolicy(Enum):
+    PREFER_IPV4 = "prefer-ipv4"
+    PREFER_IPV6 = "prefer-ipv6"
+    REQUIRE_IPV4 = "require-ipv4"
+    REQUIRE_IPV6 = "require-ipv6"
+
+
+class HostResolver:
+    def __init__(self, policy: Optional[ResolvePolicy] = None) -> None:
+        self.policy = policy
+
+    @staticmethod
+    def is_literal(host: str) -> bool:
+        try:
+            ipaddress.ip_address(host)
+            return True
+        except ValueError:
+            return False
+
+    def resolve(self, host: str) -> str:
+        # Literals are returned in canonical form, the way the kernel reports IPv6 endpoints
+        if self.is_literal(host):
+            return str(ipaddress.ip_address(host))
+
+        try:
+            addrinfo = socket.getaddrinfo(host, None, proto=socket.IPPROTO_UDP)
+        except socket.gaierror as e:
+            raise TunnelManagerError(f"Cannot resolve host {host}: {e.strerror}") from e
+
+        addresses = list(dict.fromkeys(str(info[4][0]) for info in addrinfo))
+        ipv4 = [address for address in addresses if ipaddress.ip_address(address).version == 4]
+        ipv6 = [address for address in addresses if ipaddress.ip_address(address).version == 6]
+
+        if self.policy is None:
+            if len(addresses) > 1:
+                raise TunnelManagerError(f"Host {host} resolves to multiple addresses ({', '.join(addresses)}); pass --resolve to choose one")
+            candidates = addresses
+        elif self.policy == ResolvePolicy.PREFER_IPV4:
+            candidates = ipv4 or ipv6
+        elif self.policy == ResolvePolicy.PREFER_IPV6:
+            candidates = ipv6 or ipv4
+        elif self.policy == ResolvePolicy.REQUIRE_IPV4:
+            candidates = ipv4
+        else:
+            candidates = ipv6
+
+        if not candidates:
+            raise TunnelManagerError(f"Host {host} has no address matching resolve policy {self.policy.value if self.policy else 'none'}")
+        logger.info(f"Resolved {host} to {candidates[0]}.")
+        return candidates[0]
+
+
+class TunnelRecords:
+    def __init__(self, store: StateStore) -> None:
+        self.store = store
+
+    @staticmethod
+    def key(tunnel_type: str, vni: int) -> str:
+        return f"{tunnel_type}:{vni}"
+
+    def get(self, tunnel_type: str, vni: int) -> Optional[Dict[str, Any]]:
+        return self.store.load().get("tunnels", {}).get(self.key(tunnel_type, vni))
+
+    def record(self, tunnel_type: str, vni: int, attributes: Dict[str, Any]) -> None:
+        with self.store.lock:
+            state = self.store.load()
+            now = datetime.datetime.now().isoformat(timespec="seconds")
+            # Updates pass the previous record back in, which keeps its creation time
+            state.setdefault("tunnels", {})[self.key(tunnel_type, vni)] = dict(attributes, tunnel_type=tunnel_type, vni=vni, created_at=attributes.get("created_at", now), updated_at=now)
+            self.store.save(state)
+
+    def remove(self, tunnel_type: str, vni: int) -> None:
+        with self.store.lock:
+            state = self.store.load()
+            if state.get("tunnels", {}).pop(self.key(tunnel_type, vni), None) is not None:
+                self.store.save(state)
+
+    def ifnames(self, tunnel_type: str) -> Dict[int, str]:
+        return {record["vni"]: record["ifname"] for record in self.store.load().get("tunnels", {}).values() if record["tunnel_type"] == tunnel_type and record.get("ifname")}
+
+    def site(self, name: str) -> List[Dict[str, Any]]:
+        return [record for record in self.store.load().get("tunnels", {}).values() if record.get("site") == name]
+
+    def tunnels(self) -> List[Dict[str, Any]]:
+        return list(self.store.load().get("tunnels", {}).values())
+
+    def is_managed(self, tunnel_type: str, vni: int, ifname: str) -> bool:
+        # A foreign interface may reuse a recorded VNI under another name
+        record = self.get(tunnel_type, vni)
+        return bool(record) and record.get("ifname", ifname) == ifname
+
+    def mark_managed(self, tunnel_type: str, data: List[Dict[str, Any]]) -> List[Dict[str, Any]]:
+        for item in data:
+            item["managed"] = "yes" if self.is_managed(tunnel_type, int(item["vni"]), item["ifname"]) else "no"
+        return data
+
+    def mark_labels(self, tunnel_type: str, data: List[Dict[str, Any]]) -> List[Dict[str, Any]]:
+        for item in data:
+            record = self.get(tunnel_type, int(item["vni"])) if item.get("managed", "yes") == "yes" else None
+            item["labels"] = ",".join(f"{key}={value}" for key, value in sorted(((record or {}).get("labels") or {}).items()))
+        return data
+
+    @staticmethod
+    def matches_labels(item: Dict[str, Any], selector: Dict[str, str]) -> bool:
+        labels = dict(label.split("=", 1) for label in item.get("labels", "").split(",") if label)
+        return all(labels.get(key) == value for key, value in selector.items())
+
+    def annotate(self, tunnel_type: str, data: List[Dict[str, Any]]) -> List[Dict[str, Any]]:
+        tunnels = self.store.load().get("tunnels", {})
+        if not any(record.get("status") for record in tunnels.values() if record["tunnel_type"] == tunnel_type):
+            return data
+        for item in data:
+            record = tunnels.get(self.key(tunnel_type, int(item["vni"])), {})
+            status = record.get("status", "up")
+            item["status"] = f"{status} ({', '.join(record['drift'])})" if record.get("drift") else status
+        return data
+
+    @staticmethod
+    def track(record: Dict[str, Any], kind: str, **spec: Any) -> None:
+        obj = dict(kind=kind, **spec)
+        if obj not in record.setdefault("ancillary", []):
+            record["ancillary"].append(obj)
+
+    def tracked(self, kind: str, **spec: Any) -> bool:
+        obj = dict(kind=kind, **spec)
+        return any(obj in record.get("ancillary", []) for record in self.store.load().get("tunnels", {}).values())
+
+    def trackers(self, kind: str, **spec: Any) -> int:
+        obj = dict(kind=kind, **spec)
+        return sum(obj in record.get("ancillary", []) for record in self.store.load().get("tunnels", {}).values())
+
+    @staticmethod
+    def untrack(record: Dict[str, Any], kind: str, **spec: Any) -> None:
+        obj = dict(kind=kind, **spec)
+        record["ancillary"] = [tracked for tracked in record.get("ancillary", []) if tracked != obj]
+
+
+class AuditLog:
+    def __init__(self, path: str) -> None:
+        self.path = path
+
+    @classmethod
+    def beside(cls, store: StateStore) -> "AuditLog":
+        return cls(os.path.join(os.path.dirname(store.path) or ".", "audit.log"))
+
+    def record(self, action: str, **details: Any) -> None:
+        os.makedirs(os.path.dirname(self.path) or ".", exist_ok=True)
+        entry = {"time": datetime.datetime.now().isoformat(timespec="seconds"), "user": os.environ.get("SUDO_USER") or os.environ.get("USER", ""), "action": action, **details}
+        with open(self.path, "a") as f:
+            f.write(json.dumps(entry, sort_keys=True) + "\n")
+
+    def entries(self) -> List[Dict[str, Any]]:
+        try:
+            with open(self.path) as f:
+                return [json.loads(line) for line in f if line.strip()]
+        except FileNotFoundError:
+            return []
+
+
+class StateLock:
+    def __init__(self, path: str) -> None:
+        self.path = path
+        self.fd: Optional[int] = None
+        self.stale_pid: Optional[int] = None
+
+    @classmethod
+    def beside(cls, store: StateStore) -> "StateLock":
+        return cls(f"{store.path}.lock")
+
+    @staticmethod
+    def pid_alive(pid: int) -> bool:
+        try:
+            os.kill(pid, 0)
+        except ProcessLookupError:
+            return False
+        except PermissionError:
+            return True
+        return True
+
+    def _recorded_pid(self) -> Optional[int]:
+        os.lseek(self.fd, 0, os.SEEK_SET)
+        content = os.read(self.fd, 64).decode().strip()
+        return int(content) if content.isdigit() else None
+
+    def acquire(self) -> None:
+        os.makedirs(os.path.dirname(self.path) or ".", exist_ok=True)
+        self.fd = os.open(self.path, os.O_RDWR | os.O_CREAT, 0o644)
+        try:
+            fcntl.flock(self.fd, fcntl.LOCK_EX | fcntl.LOCK_NB)
+        except BlockingIOError:
+            pid = self._recorded_pid()
+            os.close(self.fd)
+            self.fd = None
+            raise TunnelManagerError(f"{self.path} is held by another tunnel_manager process" + (f" (pid {pid})" if pid else ""))
+        # A clean release empties the file, so a recorded pid means its owner died holding the lock
+        previous = self._recorded_pid()
+        if previous and previous != os.getpid() and not self.pid_alive(previous):
+            self.stale_pid = previous
+            logger.warning(f"Recovered stale lock {self.path} left by pid {previous}.")
+        os.ftruncate(self.fd, 0)
+        os.lseek(self.fd, 0, os.SEEK_SET)
+        os.write(self.fd, f"{os.getpid()}\n".encode())
+
+    def release(self) -> None:
+        if self.fd is not None:
+            os.ftruncate(self.fd, 0)
+            fcntl.flock(self.fd, fcntl.LOCK_UN)
+            os.close(self.fd)
+            self.fd = None
+
+    def __enter__(self) -> "StateLock":
+        self.acquire()
+        return self
+
+    def __exit__(self, *exc_info: Any) -> None:
+        self.release()
+
+
+# Inverse of each mutating command, used to roll back the steps of an interrupted operation
+INVERSE_COMMANDS: List[Tuple[List[str], Callable[[List[str]], List[str]]]] = [
+    (["ip", "link", "add", "link"], lambda command: ["ip", "link", "del", command[6]]),
+    (["ip", "link", "add"], lambda command: ["ip", "link", "del", command[3]]),
+    (["ip", "link", "set", "master"], lambda command: ["ip", "link", "set", command[5], "nomaster"]),
+    (["brctl", "addif"], lambda command: ["brctl", "delif", *command[2:4]]),
+    (["ovs-vsctl", "--may-exist", "add-port"], lambda command: ["ovs-vsctl", "--if-exists", "del-port", *command[3:5]]),
+    (["ovs-vsctl", "add-port"], lambda command: ["ovs-vsctl", "--if-exists", "del-port", command[3]]),
+    (["bridge", "fdb", "append"], lambda command: ["bridge", "fdb", "del", *command[3:]]),
+    (["ip", "route", "add"], lambda command: ["ip", "route", "del", *command[3:6]]),
+    (["ip", "xfrm", "state", "add"], lambda command: ["ip", "xfrm", "state", "delete", *command[4:12]]),
+    (["ip", "xfrm", "policy", "add"], lambda command: ["ip", "xfrm", "policy", "delete", *command[4:14]]),
+]
+
+
+def inverse_command(command: List[str]) -> Optional[List[str]]:
+    for prefix, inverse in INVERSE_COMMANDS:
+        if command[:len(prefix)] == prefix:
+            return inverse(command)
+    return None
+
+
+class IntentJournal:
+    # Operations that are undone when interrupted; the others are finished instead
+    RECOVERY = {"create": "rollback", "cleanup": "replay"}
+
+    def __init__(self, path: str) -> None:
+        self.path = path
+        # Each thread runs its own operation, so the active intent and its steps are per thread
+        self.local = threading.local()
+        self.lock = threading.RLock()
+
+    @property
+    def active(self) -> Optional[str]:
+        return getattr(self.local, "active", None)
+
+    @active.setter
+    def active(self, intent_id: Optional[str]) -> None:
+        self.local.active = intent_id
+
+    @property
+    def steps(self) -> List[List[str]]:
+        # Steps of the active intent that reached the kernel, undone if the operation fails
+        if not hasattr(self.local, "steps"):
+            self.local.steps = []
+        return self.local.steps
+
+    @steps.setter
+    def steps(self, steps: List[List[str]]) -> None:
+        self.local.steps = steps
+
+    @classmethod
+    def beside(cls, store: StateStore) -> "IntentJournal":
+        return cls(os.path.join(os.path.dirname(store.path) or ".", "intents.jsonl"))
+
+    def _append(self, event: Dict[str, Any]) -> None:
+        os.makedirs(os.path.dirname(self.path) or ".", exist_ok=True)
+        with self.lock, open(self.path, "a") as f:
+            f.write(json.dumps(event, sort_keys=True) + "\n")
+            f.flush()
+            os.fsync(f.fileno())
+
+    def begin(self, operation: str, tunnel_type: str, params: Dict[str, Any]) -> str:
+        self.active = f"{os.getpid()}-{time.time_ns()}"
+        self.steps = []
+        self._append({"id": self.active, "event": "begin", "operation": operation, "tunnel_type": tunnel_type, "params": params, "time": datetime.datetime.now().isoformat(timespec="seconds")})
+        return self.active
+
+    def step(self, command: List[str]) -> None:
+        if self.active:
+            self._append({"id": self.active, "event": "step", "command": command})
+            self.steps.append(command)
+
+    def step_failed(self, command: List[str]) -> None:
+        if self.active:
+            self._append({"id": self.active, "event": "step_failed", "command": command})
+            if self.steps and self.steps[-1] == command:
+                self.steps.pop()
+
+    def undo_steps(self, executor: CommandExecutor) -> List[List[str]]:
+        # The inverses are not journaled; if they are interrupted, recovery rolls the same steps back again
+        steps, self.steps, self.active = self.steps, [], None
+        undone = []
+        for command in reversed(steps):
+            inverse = inverse_command(command)
+            if inverse and executor.run(inverse, check=False).returncode == 0:
+                undone.append(inverse)
+        return undone
+
+    def finish(self, intent_id: str, event: str = "complete") -> None:
+        self.active = None
+        # Truncating must not race with another thread beginning an intent
+        with self.lock:
+            self._append({"id": intent_id, "event": event})
+            if not self.incomplete():
+                open(self.path, "w").close()
+
+    def incomplete(self) -> List[Dict[str, Any]]:
+        intents: Dict[str, Dict[str, Any]] = {}
+        try:
+            with open(self.path) as f:
+                events = [json.loads(line) for line in f if line.strip()]
+        except FileNotFoundError:
+            return []
+        except json.JSONDecodeError:
+            # The write that was interrupted by the crash is the last line; earlier lines are intact
+            with open(self.path) as f:
+                events = [json.loads(line) for line in f.read().splitlines()[:-1] if line.strip()]
+        for event in events:
+            if event["event"] == "begin":
+                intents[event["id"]] = dict(event, steps=[])
+            elif event["id"] not in intents:
+                continue
+            elif event["event"] == "step":
+                intents[event["id"]]["steps"].append(event["command"])
+            elif event["event"] == "step_failed" and intents[event["id"]]["steps"]:
+                intents[event["id"]]["steps"].pop()
+            else:
+                del intents[event["id"]]
+        return [intent for intent_id, intent in intents.items() if intent_id != self.active]
+
+    def rollback(self, intent: Dict[str, Any], executor: CommandExecutor) -> str:
+        undone = 0
+        for command in reversed(intent["steps"]):
+            if inverse := inverse_command(command):
+                # The step may never have reached the kernel, so a failing inverse is expected
+                undone += executor.run(inverse, check=False).returncode == 0
+        return f"rolled back ({undone} of {len(intent['steps'])} steps undone)"
+
+    def replay(self, intent: Dict[str, Any], manager: "TunnelManager") -> str:
+        params = intent["params"]
+        if intent["operation"] == "cleanup" and manager.tunnel.link_attributes(params["vni"]) is None:
+            manager.remove_ancillaries(params["vni"], before_link=True)
+            manager.cleanup_records(params["vni"], params["bridge_name"])
+            return "replayed (device already gone, records removed)"
+        getattr(manager, intent["operation"])(**params)
+        return "replayed"
+
+    def recover(self, manager_factory: Callable[[str], "TunnelManager"], executor: CommandExecutor) -> List[Dict[str, Any]]:
+        report = []
+        for intent in self.incomplete():
+            self.active = intent["id"]
+            try:
+                manager = manager_factory(intent["tunnel_type"])
+                result = self.rollback(intent, executor) if self.RECOVERY[intent["operation"]] == "rollback" else self.replay(intent, manager)
+                self.finish(intent["id"], "recovered")
+            except (TunnelManagerError, subprocess.CalledProcessError) as e:
+                self.active = None
+                result = f"failed: {e}"
+            report.append({"started": intent["time"], "operation": intent["operation"], "tunnel_type": intent["tunnel_type"], "vni": intent["params"].get("vni"), "steps": len(intent["steps"]), "result": result})
+        return report
+
+
+class JournalingExecutor(CommandExecutor):
+    def __init__(self, executor: CommandExecutor, journal: IntentJournal) -> None:
+        self.executor = executor
+        self.journal = journal
+
+    # Commands carrying a key, and the word two places before it
+    SECRETS = [(["ip", "xfrm", "state", "add"], "aead"), (["ip", "macsec", "add"], "key")]
+
+    @classmethod
+    def redact(cls, command: List[str]) -> List[str]:
+        # Keys never reach the journal; rolling a step back needs only what comes before the key
+        for prefix, word in cls.SECRETS:
+            if command[:len(prefix)] == prefix and word in command:
+                index = command.index(word) + 2
+                return command[:index] + ["<key>"] + command[index + 1:]
+        return command
+
+    def run(self, command: List[str], check: bool = True) -> subprocess.CompletedProcess:
+        # Write-ahead: the step is on disk before the kernel sees it
+        step = self.redact(command)
+        self.journal.step(step)
+        try:
+            result = self.executor.run(command, check=check)
+        except subprocess.CalledProcessError:
+            self.journal.step_failed(step)
+            raise
+        if result.returncode not in (0, None):
+            self.journal.step_failed(step)
+        return result
+
+
+def journaled(operation: str) -> Callable[[Callable[..., Any]], Callable[..., Any]]:
+    def decorator(method: Callable[..., Any]) -> Callable[..., Any]:
+        @functools.wraps(method)
+        def wrapper(self: "TunnelManager", *args: Any, **kwargs: Any) -> Any:
+            if not self.journal:
+                return method(self, *args, **kwargs)
+            bound = inspect.signature(method).bind(self, *args, **kwargs)
+            bound.apply_defaults()
+            # A TunnelSpec is journaled as its fields, so recovery reads the VNI and bridge of any operation the same way
+            params = {}
+            for name, value in bound.arguments.items():
+                if dataclasses.is_dataclass(value):
+                    params.update(dataclasses.asdict(value))
+                elif name != "self":
+                    params[name] = value
+            intent = self.journal.begin(operation, self.tunnel.tunnel_type, params)
+            try:
+                result = method(self, *args, **kwargs)
+            except Exception as e:
+                if self.journal.RECOVERY[operation] != "rollback":
+                    # A failed cleanup is not a crash; the operator decides what to do with it
+                    self.journal.finish(intent, "aborted")
+                    raise
+                # A failed create leaves nothing half-configured behind
+                undone = self.journal.undo_steps(self.tunnel.executor)
+                self.journal.finish(intent, "rolled back")
+                for command in undone:
+                    logger.info(f"Rolled back: {' '.join(command)}")
+                raise TunnelManagerError(f"{e}; rolled back " + ("; ".join(" ".join(command) for command in undone) if undone else "nothing")) from e
+            self.journal.finish(intent)
+            return result
+        return wrapper
+    return decorator
+
+
+TUNNEL_KINDS = ("vxlan", "geneve", "gretap", "gre")
+
+
+class BridgePolicy:
+    def __init__(self, max_tunnels_per_bridge: Optional[int] = None, executor: Optional[CommandExecutor] = None, audit: Optional[AuditLog] = None) -> None:
+        self.max_tunnels_per_bridge = max_tunnels_per_bridge
+        self.executor = executor or SubprocessExecutor()
+        self.audit = audit
+
+    def tunnel_ports(self) -> Dict[str, List[str]]:
+        # Counts every tunnel port on a bridge, including ones this tool does not manage
+        try:
+            result = self.executor.run(["ip", "-d", "-j", "link", "show"])
+            links = json.loads(result.stdout or "[]")
+        except (subprocess.CalledProcessError, json.JSONDecodeError) as e:
+            logger.error(f"Error reading bridge ports: {e}")
+            raise TunnelManagerError("Error reading bridge ports") from e
+
+        ports: Dict[str, List[str]] = {link["ifname"]: [] for link in links if link.get("linkinfo", {}).get("info_kind") == "bridge"}
+        for link in links:
+            if link.get("master") and link.get("linkinfo", {}).get("info_kind") in TUNNEL_KINDS:
+                ports.setdefault(link["master"], []).append(link["ifname"])
+        return ports
+
+    def check(self, bridge_name: str, override: bool = False) -> None:
+        if self.max_tunnels_per_bridge is None:
+            return
+        count = len(self.tunnel_ports().get(bridge_name, []))
+        if count < self.max_tunnels_per_bridge:
+            return
+        message = f"Bridge {bridge_name} already has {count} tunnel ports (limit {self.max_tunnels_per_bridge})"
+        if not override:
+            raise TunnelManagerError(f"{message}; consolidate peers onto one tunnel with head-end replication or use a new bridge, or pass --policy-override")
+        logger.warning(f"{message}; overridden by --policy-override.")
+        if self.audit:
+            self.audit.record("policy-override", policy="max_tunnels_per_bridge", bridge=bridge_name, count=count, limit=self.max_tunnels_per_bridge)
+
+    def usage(self, records: Optional[TunnelRecords] = None) -> List[Dict[str, Any]]:
+        managed: Dict[str, int] = {}
+        for record in (records.store.load().get("tunnels", {}).values() if records else []):
+            managed[record["bridge_name"]] = managed.get(record["bridge_name"], 0) + 1
+
+        limit = self.max_tunnels_per_bridge
+        return [{"bridge": bridge_name, "tunnels": len(ports), "managed": managed.get(bridge_name, 0), "limit": limit if limit is not None else "none", "usage": f"{len(ports) * 100 // limit}%" if limit else ""} for bridge_name, ports in sorted(self.tunnel_ports().items())]
+
+
+# Blast radius of an apply or agent cycle, from recorded state and policy limits only: it must not add commands of its own
+class ResourceReport:
+    # Linux bridges accept at most this many ports (BR_MAX_PORTS)
+    KERNEL_MAX_BRIDGE_PORTS = 1024
+    WARN_AT = 0.8
+
+    def __init__(self, records: TunnelRecords, policy: Optional[BridgePolicy] = None, counter: Optional[OperationCounter] = None) -> None:
+        self.records = records
+        self.policy = policy
+        self.counter = counter
+        self.begin()
+
+    def begin(self) -> None:
+        self.before = self.totals()
+        self.operations = (self.counter.reads, self.counter.changes) if self.counter else (0, 0)
+
+    def bridges(self) -> Dict[str, int]:
+        bridges: Dict[str, int] = {}
+        for record in self.records.store.load().get("tunnels", {}).values():
+            bridges[record["bridge_name"]] = bridges.get(record["bridge_name"], 0) + 1
+        return bridges
+
+    def totals(self) -> Dict[str, int]:
+        tunnels = list(self.records.store.load().get("tunnels", {}).values())
+        return {
+            "interfaces": len(tunnels),
+            "bridges": len({record["bridge_name"] for record in tunnels}),
+            "routes": sum(len(record.get("routes") or []) for record in tunnels),
+            "fdb_entries": sum(len(record.get("peers") or []) for record in tunnels),
+            "ancillary": sum(len(record.get("ancillary", [])) for record in tunnels),
+        }
+
+    def warnings(self, bridges: Dict[str, int]) -> List[str]:
+        warnings = []
+        limit = self.policy.max_tunnels_per_bridge if self.policy else None
+        for bridge_name, count in sorted(bridges.items()):
+            for cap, what in ((limit, "max_tunnels_per_bridge"), (self.KERNEL_MAX_BRIDGE_PORTS, "the kernel's bridge port limit")):
+                if cap and count >= cap * self.WARN_AT:
+                    warnings.append(f"bridge {bridge_name} has {count} managed tunnel ports, {count * 100 // cap}% of {what} ({cap})")
+                    break
+        return warnings
+
+    def build(self) -> Dict[str, Any]:
+        totals = self.totals()
+        bridges = self.bridges()
+        reads, changes = (self.counter.reads - self.operations[0], self.counter.changes - self.operations[1]) if self.counter else (0, 0)
+        limit = self.policy.max_tunnels_per_bridge if self.policy else None
+        return {
+            "operations": {"reads": reads, "changes": changes},
+            "managed": {name: {"now": value, "delta": value - self.before.get(name, 0)} for name, value in totals.items()},
+            "bridges": [{"bridge": bridge_name, "tunnels": count, "limit": limit if limit is not None else "none", "usage": f"{count * 100 // limit}%" if limit else ""} for bridge_name, count in sorted(bridges.items())],
+            "warnings": self.warnings(bridges),
+        }
+
+    @staticmethod
+    def format_text(report: Dict[str, Any]) -> str:
+        operations = report["operations"]
+        lines = ["Resource report:", f"  commands run: {operations['reads'] + operations['changes']} ({operations['reads']} reads, {operations['changes']} changes)"]
+        lines += [f"  {name.replace('_', ' ')}: {value['now']} ({value['delta']:+d})" for name, value in report["managed"].items()]
+        lines += [f"  bridge {row['bridge']}: {row['tunnels']} tunnels" + (f", {row['usage']} of limit {row['limit']}" if row["usage"] else "") for row in report["bridges"]]
+        lines += [f"Warning: {warning}" for warning in report["warnings"]]
+        return "\n".join(lines)
+
+
+# How bridges are created and how ports join them; chosen with --bridge-tool
+class BridgeBackend:
+    TOOL = ""
+
+    def __init__(self, executor: Optional[CommandExecutor] = None) -> None:
+        self.executor = executor or SubprocessExecutor()
+
+    @staticmethod
+    def delete_command(name: str) -> List[str]:
+        raise NotImplementedError
+
+    @staticmethod
+    def ports_command(name: str) -> List[str]:
+        raise NotImplementedError
+
+    @staticmethod
+    def parse_ports(output: str) -> List[str]:
+        raise NotImplementedError
+
+    def exists(self, name: str) -> bool:
+        raise NotImplementedError
+
+    def create_bridge(self, name: str, mtu: Optional[int], stp: Optional[bool], forward_delay: Optional[int]) -> None:
+        raise NotImplementedError
+
+    def add_port(self, bridge_name: str, ifname: str) -> None:
+        raise NotImplementedError
+
+    def remove_port(self, bridge_name: str, ifname: str) -> None:
+        raise NotImplementedError
+
+    def list(self) -> List[Dict[str, Any]]:
+        raise NotImplementedError
+
+    def create(self, name: str, mtu: Optional[int] = None, stp: Optional[bool] = None, forward_delay: Optional[int] = None) -> bool:
+        if self.exists(name):
+            return False
+        try:
+            self.create_bridge(name, mtu, stp, forward_delay)
+            self.executor.run(["ip", "link", "set", name, "up"])
+        except subprocess.CalledProcessError as e:
+            raise TunnelManagerError(f"Error creating bridge {name}: {e}") from e
+        return True
+
+    def create_commands(self, name: str, mtu: Optional[int] = None, stp: Optional[bool] = None, forward_delay: Optional[int] = None) -> List[List[str]]:
+        recorder = RecordingExecutor()
+        type(self)(recorder).create_bridge(name, mtu, stp, forward_delay)
+        return recorder.commands + [["ip", "link", "set", name, "up"]]
+
+    def ports(self, name: str) -> List[str]:
+        try:
+            return self.parse_ports(self.executor.run(self.ports_command(name)).stdout or "")
+        except (subprocess.CalledProcessError, json.JSONDecodeError) as e:
+            raise TunnelManagerError(f"Error reading the ports of bridge {name}") from e
+
+    def delete(self, name: str) -> None:
+        ports = self.ports(name)
+        if ports:
+            raise TunnelManagerError(f"Bridge {name} still has ports: {', '.join(ports)}; clean up its tunnels first")
+        try:
+            self.executor.run(self.delete_command(name))
+        except subprocess.CalledProcessError as e:
+            raise TunnelManagerError(f"Error deleting bridge {name}: {e}") from e
+
+
+class IpBridgeBackend(BridgeBackend):
+    TOOL = "ip"
+
+    @staticmethod
+    def delete_command(name: str) -> List[str]:
+        return ["ip", "link", "del", name]
+
+    @staticmethod
+    def ports_command(name: str) -> List[str]:
+        return ["ip", "-j", "link", "show", "master", name]
+
+    @staticmethod
+    def parse_ports(output: str) -> List[str]:
+        return [link["ifname"] for link in json.loads(output or "[]")]
+
+    def exists(self, name: str) -> bool:
+        return self.executor.run(["ip", "-j", "link", "show", "dev", name], check=False).returncode == 0
+
+    def create_bridge(self, name: str, mtu: Optional[int], stp: Optional[bool], forward_delay: Optional[int]) -> None:
+        # iproute2 takes the forward delay in hundredths of a second
+        self.executor.run(["ip", "link", "add", name] + (["mtu", str(mtu)] if mtu else []) + ["type", "bridge"] + (["stp_state", "1" if stp else "0"] if stp is not None else []) + (["forward_delay", str(forward_delay * 100)] if forward_delay is not None else []))
+
+    def add_port(self, bridge_name: str, ifname: str) -> None:
+        self.executor.run(["ip", "link", "set", "master", bridge_name, ifname])
+
+    def remove_port(self, bridge_name: str, ifname: str) -> None:
+        self.executor.run(["ip", "link", "set", ifname, "nomaster"])
+
+    def list(self) -> List[Dict[str, Any]]:
+        try:
+            bridges = json.loads(self.executor.run(["ip", "-d", "-j", "link", "show", "type", "bridge"]).stdout or "[]")
+            links = json.loads(self.executor.run(["ip", "-j", "link", "show"]).stdout or "[]")
+        except (subprocess.CalledProcessError, json.JSONDecodeError) as e:
+            raise TunnelManagerError("Error listing bridges") from e
+        rows = []
+        for bridge in bridges:
+            info_data = bridge.get("linkinfo", {}).get("info_data", {})
+            ports = [link["ifname"] for link in links if link.get("master") == bridge["ifname"]]
+            rows.append({"bridge_name": bridge["ifname"], "mtu": str(bridge.get("mtu", "")), "state": "up" if "UP" in bridge.get("flags", []) else "down", "stp": "on" if info_data.get("stp_state") else "off", "forward_delay": str(info_data["forward_delay"] // 100) if "forward_delay" in info_data else "", "ports": ",".join(ports)})
+        return rows
+
+
+# For hosts with bridge-utils only; reading bridges and deleting them works the same as with ip
+class BrctlBridgeBackend(IpBridgeBackend):
+    TOOL = "brctl"
+
+    def create_bridge(self, name: str, mtu: Optional[int], stp: Optional[bool], forward_delay: Optional[int]) -> None:
+        self.executor.run(["brctl", "addbr", name])
+        if stp is not None:
+            self.executor.run(["brctl", "stp", name, "on" if stp else "off"])
+        if forward_delay is not None:
+            self.executor.run(["brctl", "setfd", name, str(forward_delay)])
+        if mtu:
+            self.executor.run(["ip", "link", "set", name, "mtu", str(mtu)])
+
+    def add_port(self, bridge_name: str, ifname: str) -> None:
+        self.executor.run(["brctl", "addif", bridge_name, ifname])
+
+    def remove_port(self, bridge_name: str, ifname: str) -> None:
+        self.executor.run(["brctl", "delif", bridge_name, ifname])
+
+
+class OvsBridgeBackend(BridgeBackend):
+    TOOL = "ovs-vsctl"
+    # Every port of an OVS bridge reports the datapath as its kernel master
+    DATAPATH = "ovs-system"
+
+    @staticmethod
+    def delete_command(name: str) -> List[str]:
+        return ["ovs-vsctl", "--if-exists", "del-br", name]
+
+    @staticmethod
+    def ports_command(name: str) -> List[str]:
+        return ["ovs-vsctl", "list-ports", name]
+
+    @staticmethod
+    def parse_ports(output: str) -> List[str]:
+        return output.split()
+
+    def exists(self, name: str) -> bool:
+        return self.executor.run(["ovs-vsctl", "br-exists", name], check=False).returncode == 0
+
+    def create_bridge(self, name: str, mtu: Optional[int], stp: Optional[bool], forward_delay: Optional[int]) -> None:
+        # One ovs-vsctl transaction, so a bridge never exists without its settings
+        settings = ([f"stp_enable={'true' if stp else 'false'}"] if stp is not None else []) + ([f"other_config:stp-forward-delay={forward_delay}"] if forward_delay is not None else [])
+        self.executor.run(["ovs-vsctl", "add-br", name] + (["--", "set", "bridge", name, *settings] if settings else []) + (["--", "set", "interface", name, f"mtu_request={mtu}"] if mtu else []))
+
+    def add_port(self, bridge_name: str, ifname: str) -> None:
+        self.executor.run(["ovs-vsctl", "--may-exist", "add-port", bridge_name, ifname])
+
+    def remove_port(self, bridge_name: str, ifname: str) -> None:
+        self.executor.run(["ovs-vsctl", "--if-exists", "del-port", bridge_name, ifname])
+
+    def bridge_of(self, ifname: str) -> Optional[str]:
+        result = self.executor.run(["ovs-vsctl", "port-to-br", ifname], check=False)
+        return result.stdout.strip() or None if result.returncode == 0 else None
+
+    def list(self) -> List[Dict[str, Any]]:
+        try:
+            names = self.executor.run(["ovs-vsctl", "list-br"]).stdout.split()
+            links = {link["ifname"]: link for link in json.loads(self.executor.run(["ip", "-j", "link", "show"]).stdout or "[]")}
+            rows = []
+            for name in names:
+                stp = self.executor.run(["ovs-vsctl", "get", "bridge", name, "stp_enable"]).stdout.strip()
+                forward_delay = self.executor.run(["ovs-vsctl", "--if-exists", "get", "bridge", name, "other_config:stp-forward-delay"]).stdout.strip().strip('"')
+                link = links.get(name, {})
+                rows.append({"bridge_name": name, "mtu": str(link.get("mtu", "")), "state": "up" if "UP" in link.get("flags", []) else "down", "stp": "on" if stp == "true" else "off", "forward_delay": forward_delay, "ports": ",".join(self.ports(name))})
+        except (subprocess.CalledProcessError, json.JSONDecodeError) as e:
+            raise TunnelManagerError("Error listing bridges") from e
+        return rows
+
+
+BRIDGE_BACKENDS: Dict[str, Type[BridgeBackend]] = {backend.TOOL: backend for backend in (IpBridgeBackend, BrctlBridgeBackend, OvsBridgeBackend)}
+
+
+class BridgePort:
+    # neigh_suppress answers ARP and ND requests from the bridge's neighbour entries instead of flooding them over the tunnel
+    FLAGS = ("learning", "flood", "mcast_flood", "neigh_suppress")
+    DEFAULTS = {"learning": "on", "flood": "on", "mcast_flood": "on", "neigh_suppress": "off"}
+
+    def __init__(self, executor: Optional[CommandExecutor] = None) -> None:
+        self.executor = executor or SubprocessExecutor()
+
+    def set_flags(self, ifname: str, flags: Dict[str, str]) -> None:
+        if not flags:
+            return
+        command = ["bridge", "link", "set", "dev", ifname]
+        for flag, value in flags.items():
+            command += [flag, value]
+        try:
+            self.executor.run(command)
+        except subprocess.CalledProcessError as e:
+            logger.error(f"Error setting bridge port flags on {ifname}: {e}")
+            raise TunnelManagerError(f"Error setting bridge port flags on {ifname}") from e
+
+    def flags(self, ifname: str) -> Dict[str, str]:
+        try:
+            result = self.executor.run(["bridge", "-d", "-j", "link", "show", "dev", ifname])
+            ports = json.loads(result.stdout or "[]")
+        except (subprocess.CalledProcessError, json.JSONDecodeError) as e:
+            logger.error(f"Error reading bridge port flags of {ifname}: {e}")
+            raise TunnelManagerError(f"Error reading bridge port flags of {ifname}") from e
+        port = ports[0] if ports else {}
+        return {flag: "on" if port[flag] else "off" for flag in self.FLAGS if flag in port}
+
+
+class FloodList:
+    ALL_ZEROS_MAC = "00:00:00:00:00:00"
+
+    def __init__(self, executor: Optional[CommandExecutor] = None) -> None:
+        self.executor = executor or SubprocessExecutor()
+
+    def add(self, ifname: str, peers: List[str]) -> None:
+        for peer in peers:
+            try:
+                self.executor.run(["bridge", "fdb", "append", self.ALL_ZEROS_MAC, "dev", ifname, "dst", peer])
+            except subprocess.CalledProcessError as e:
+                logger.error(f"Error adding flood entry for {peer} on {ifname}: {e}")
+                raise TunnelManagerError(f"Error adding flood entry for {peer} on {ifname}") from e
+
+    def remove(self, ifname: str, peers: List[str]) -> None:
+        for peer in peers:
+            try:
+                self.executor.run(["bridge", "fdb", "del", self.ALL_ZEROS_MAC, "dev", ifname, "dst", peer])
+            except subprocess.CalledProcessError as e:
+                logger.error(f"Error removing flood entry for {peer} on {ifname}: {e}")
+                raise TunnelManagerError(f"Error removing flood entry for {peer} on {ifname}") from e
+
+    def peers(self, ifname: str, remote: Optional[str] = None) -> List[str]:
+        try:
+            entries = json.loads(self.executor.run(["bridge", "-j", "fdb", "show", "dev", ifname]).stdout or "[]")
+        except (subprocess.CalledProcessError, json.JSONDecodeError) as e:
+            raise TunnelManagerError(f"Error reading flood entries of {ifname}") from e
+        # The kernel keeps the device's own remote as an all-zeros entry too; that is the primary VTEP, not a flood peer
+        return [entry["dst"] for entry in entries if entry.get("mac") == self.ALL_ZEROS_MAC and "dst" in entry and entry["dst"] != remote]
+
+    @staticmethod
+    def delta(current: List[str], desired: List[str]) -> Tuple[List[str], List[str]]:
+        return [peer for peer in desired if peer not in current], [peer for peer in current if peer not in desired]
+
+
+class ForwardingTable:
+    def __init__(self, executor: Optional[CommandExecutor] = None) -> None:
+        self.executor = executor or SubprocessExecutor()
+
+    def add(self, ifname: str, mac: str, remote: str) -> None:
+        # replace rather than add, so repeating a command or moving a MAC to another VTEP succeeds
+        try:
+            self.executor.run(["bridge", "fdb", "replace", mac, "dev", ifname, "dst", remote])
+        except subprocess.CalledProcessError as e:
+            logger.error(f"Error adding fdb entry {mac} dst {remote} on {ifname}: {e}")
+            raise TunnelManagerError(f"Error adding fdb entry {mac} dst {remote} on {ifname}") from e
+
+    def remove(self, ifname: str, mac: str, remote: str) -> None:
+        try:
+            self.executor.run(["bridge", "fdb", "del", mac, "dev", ifname, "dst", remote])
+        except subprocess.CalledProcessError as e:
+            logger.error(f"Error removing fdb entry {mac} dst {remote} from {ifname}: {e}")
+            raise TunnelManagerError(f"Error removing fdb entry {mac} dst {remote} from {ifname}") from e
+
+    def entries(self, ifname: str) -> List[Dict[str, Any]]:
+        try:
+            entries = json.loads(self.executor.run(["bridge", "-j", "fdb", "show", "dev", ifname]).stdout or "[]")
+        except (subprocess.CalledProcessError, json.JSONDecodeError) as e:
+            raise TunnelManagerError(f"Error reading fdb entries of {ifname}") from e
+        return [{"mac": entry.get("mac", ""), "remote": entry.get("dst", ""), "type": "flood" if entry.get("mac") == FloodList.ALL_ZEROS_MAC else "unicast", "flags": ",".join(entry.get("flags", [])), "state": entry.get("state", "")} for entry in entries]
+
+
+# Static ARP and ND entries for overlays whose controller knows every host's address, so they are never learned or flooded
+class NeighborTable:
+    def __init__(self, executor: Optional[CommandExecutor] = None) -> None:
+        self.executor = executor or SubprocessExecutor()
+
+    def add(self, dev: str, address: str, mac: str) -> None:
+        # replace rather than add, so repeating a command or moving an address to another MAC succeeds
+        try:
+            self.executor.run(["ip", "neigh", "replace", address, "lladdr", mac, "dev", dev, "nud", "permanent"])
+        except subprocess.CalledProcessError as e:
+            logger.error(f"Error adding neighbour entry {address} lladdr {mac} on {dev}: {e}")
+            raise TunnelManagerError(f"Error adding neighbour entry {address} lladdr {mac} on {dev}") from e
+
+    def remove(self, dev: str, address: str) -> None:
+        try:
+            self.executor.run(["ip", "neigh", "del", address, "dev", dev])
+        except subprocess.CalledProcessError as e:
+            logger.error(f"Error removing neighbour entry {address} from {dev}: {e}")
+            raise TunnelManagerError(f"Error removing neighbour entry {address} from {dev}") from e
+
+    def entries(self, dev: str) -> List[Dict[str, Any]]:
+        try:
+            entries = json.loads(self.executor.run(["ip", "-j", "neigh", "show", "dev", dev]).stdout or "[]")
+        except (subprocess.CalledProcessError, json.JSONDecodeError) as e:
+            raise TunnelManagerError(f"Error reading neighbour entries of {dev}") from e
+        return [{"address": entry.get("dst", ""), "mac": entry.get("lladdr", ""), "state": ",".join(entry.get("state", []))} for entry in entries]
+
+
+class LinkGroup:
+    DEFAULT_GROUP = 42
+    NAME = "tunnelmgr"
+    GROUP_FILE = "/etc/iproute2/group"
+
+    def __init__(self, executor: Optional[CommandExecutor] = None, group_file: str = GROUP_FILE, files: Optional[FileWriter] = None) -> None:
+        self.executor = executor or SubprocessExecutor()
+        self.group_file = group_file
+        self.files = files or FileWriter()
+
+    def names(self) -> Dict[int, str]:
+        try:
+            with open(self.group_file) as f:
+                entries = [line.split() for line in f if line.strip() and not line.lstrip().startswith("#")]
+        except OSError:
+            return {}
+        names = {}
+        for entry in entries:
+            try:
+                names[int(entry[0], 16 if entry[0].lower().startswith("0x") else 10)] = entry[1]
+            except (ValueError, IndexError):
+                # iproute2 skips lines it cannot parse, and so do we
+                continue
+        return names
+
+    def register(self, group: int) -> None:
+        # Only a new id gets a line; one already named, by this tool or anyone else, is left as it is
+        if group in self.names():
+            return
+        try:
+            with open(self.group_file) as f:
+                content = f.read()
+        except FileNotFoundError:
+            content = ""
+        except OSError as e:
+            logger.warning(f"Could not register link group {group} in {self.group_file}: {e}")
+            return
+        try:
+            self.files.write(self.group_file, content + ("\n" if content and not content.endswith("\n") else "") + f"{group}\t{self.NAME}\n")
+        except OSError as e:
+            logger.warning(f"Could not register link group {group} in {self.group_file}: {e}")
+
+    def assign(self, ifname: str, group: int) -> None:
+        try:
+            self.executor.run(["ip", "link", "set", "dev", ifname, "group", str(group)])
+        except subprocess.CalledProcessError as e:
+            logger.error(f"Error moving {ifname} into link group {group}: {e}")
+            raise TunnelManagerError(f"Error moving {ifname} into link group {group}") from e
+
+    def members(self, group: int) -> List[str]:
+        try:
+            return [link["ifname"] for link in json.loads(self.executor.run(["ip", "-j", "link", "show", "group", str(group)]).stdout or "[]")]
+        except (subprocess.CalledProcessError, json.JSONDecodeError) as e:
+            raise TunnelManagerError(f"Error listing members of link group {group}: {e}") from e
+
+    def conflicts(self, group: int, managed: List[str]) -> List[str]:
+        problems = []
+        name = self.names().get(group)
+        if name not in (None, self.NAME):
+            problems.append(f"group {group} is registered as '{name}' in {self.group_file}")
+        foreign = [ifname for ifname in self.members(group) if ifname not in managed]
+        if foreign:
+            problems.append(f"group {group} also contains unmanaged interfaces: {', '.join(foreign)}")
+        return problems
+
+
+# Strict reverse path filtering drops tunnel traffic arriving on a device the route back to its sender does not use
+class RpFilter:
+    MODES = {0: "off", 1: "strict", 2: "loose"}
+    STRICT = 1
+    LOOSE = 2
+    SYSCTL_DIR = "/etc/sysctl.d"
+
+    def __init__(self, executor: Optional[CommandExecutor] = None, sysctl_dir: str = SYSCTL_DIR, files: Optional[FileWriter] = None) -> None:
+        self.executor = executor or SubprocessExecutor()
+        self.sysctl_dir = sysctl_dir
+        self.files = files or FileWriter()
+
+    @staticmethod
+    def key(dev: str) -> str:
+        # VLAN devices such as eth0.100 need the slash form, dots would split the name
+        return f"net/ipv4/conf/{dev}/rp_filter" if "." in dev else f"net.ipv4.conf.{dev}.rp_filter"
+
+    def read(self, dev: str) -> Optional[int]:
+        result = self.executor.run(["sysctl", "-n", self.key(dev)], check=False)
+        try:
+            return int(result.stdout.strip()) if result.returncode == 0 else None
+        except ValueError:
+            return None
+
+    def egress_dev(self, remote: str) -> Optional[str]:
+        try:
+            routes = json.loads(self.executor.run(["ip", "-j", "route", "get", remote]).stdout or "[]")
+        except (subprocess.CalledProcessError, json.JSONDecodeError) as e:
+            logger.warning(f"Error looking up the route to {remote}: {e}")
+            return None
+        return routes[0].get("dev") if routes else None
+
+    def check(self, dev: str, remote: str) -> Dict[str, Any]:
+        values = {"all": self.read("all"), "dev": self.read(dev)}
+        # The kernel applies the higher of conf/all and conf/<dev>
+        effective = max(value or 0 for value in values.values())
+        egress = self.egress_dev(remote)
+        result = {"dev": dev, "all": values["all"], "dev_value": values["dev"], "effective": self.MODES.get(effective, str(effective)), "egress_dev": egress, "status": "ok"}
+        if effective == self.STRICT and egress and egress != dev:
+            result["status"] = "at risk"
+            result["message"] = f"strict rp_filter on {dev} drops traffic from {remote}, whose route leaves via {egress}"
+        return result
+
+    def fix(self, dev: str, persist: bool = False) -> Optional[str]:
+        try:
+            self.executor.run(["sysctl", "-w", f"{self.key(dev)}={self.LOOSE}"])
+        except subprocess.CalledProcessError as e:
+            raise TunnelManagerError(f"Error setting loose rp_filter on {dev}: {e}") from e
+        if not persist:
+            return None
+        path = os.path.join(self.sysctl_dir, f"90-tunnel-manager-rp-filter-{dev}.conf")
+        self.files.write(path, f"# Loose reverse path filtering for tunnel underlay {dev}, written by tunnel_manager\n{self.key(dev)} = {self.LOOSE}\n")
+        return path
+
+
+class DnsPeerSource:
+    def __init__(self, name: str, executor: Optional[CommandExecutor] = None, resolver: Optional[HostResolver] = None) -> None:
+        self.name = name
+        self.executor = executor or SubprocessExecutor()
+        self.resolver = resolver or HostResolver()
+
+    def _answers(self, record_type: str) -> List[List[str]]:
+        try:
+            result = self.executor.run(["dig", "+noall", "+answer", record_type, self.name])
+        except (subprocess.CalledProcessError, FileNotFoundError) as e:
+            raise TunnelManagerError(f"Error querying {record_type} records of {self.name}: {e}") from e
+        # Answer lines look like "<name> <ttl> IN <type> <rdata...>"
+        return [line.split() for line in result.stdout.splitlines() if len(line.split()) > 4 and line.split()[3] == record_type]
+
+    def resolve(self) -> Tuple[List[str], int]:
+        answers = self._answers("SRV")
+        if answers:
+            peers = [self.resolver.resolve(answer[7].rstrip(".")) for answer in answers if len(answer) > 7]
+        else:
+            answers = self._answers("TXT")
+            peers = [peer.strip() for answer in answers for peer in " ".join(answer[4:]).replace('"', "").split(",") if peer.strip()]
+        if not peers:
+            raise TunnelManagerError(f"No SRV or TXT peers published at {self.name}")
+        return sorted(set(peers)), min(int(answer[1]) for answer in answers)
+
+
+class TunnelEncryption:
+    # AES-GCM with a 128-bit key, a 32-bit salt and a 16-byte ICV, as RFC 4106 defines it for ESP
+    AEAD = "rfc4106(gcm(aes))"
+    ICV_BITS = 128
+    # ESP header, IV and ICV taken from each packet in transport mode
+    OVERHEAD = 40
+
+    def __init__(self, executor: Optional[CommandExecutor] = None) -> None:
+        self.executor = executor or SubprocessExecutor()
+
+    @staticmethod
+    def load_secret(path: str) -> bytes:
+        try:
+            with open(path, "rb") as f:
+                secret = f.read().strip()
+        except OSError as e:
+            raise TunnelManagerError(f"Error reading the encryption key file {path}: {e}") from e
+        if len(secret) < 16:
+            raise TunnelManagerError(f"The encryption key file {path} holds {len(secret)} bytes; it needs at least 16")
+        return secret
+
+    @staticmethod
+    def association(secret: bytes, src: str, dst: str, port: int) -> Tuple[str, int, str]:
+        # Both hosts derive the same SPI and key for each direction from the shared secret, so no key exchange runs
+        digest = hmac.new(secret, f"{src}>{dst}:{port}".encode(), hashlib.sha256).digest()
+        spi = 0x100 + int.from_bytes(digest[:4], "big") % (0x100000000 - 0x100)
+        return f"0x{spi:08x}", spi & 0x7FFFFFFF or 1, "0x" + digest[4:24].hex()
+
+    @staticmethod
+    def host(address: str) -> str:
+        return f"{address}/{ipaddress.ip_address(address).max_prefixlen}"
+
+    def plan(self, src: str, dst: str, port: int, key_file: str) -> List[Tuple[Dict[str, Any], List[str]]]:
+        secret = self.load_secret(key_file)
+        steps: List[Tuple[Dict[str, Any], List[str]]] = []
+        for direction, local, remote in (("out", src, dst), ("in", dst, src)):
+            spi, reqid, key = self.association(secret, local, remote, port)
+            steps.append(({"kind": "xfrm_state", "src": local, "dst": remote, "spi": spi}, ["ip", "xfrm", "state", "add", "src", local, "dst", remote, "proto", "esp", "spi", spi, "reqid", str(reqid), "mode", "transport", "aead", self.AEAD, key, str(self.ICV_BITS)]))
+            steps.append(({"kind": "xfrm_policy", "src": self.host(local), "dst": self.host(remote), "port": port, "dir": direction}, ["ip", "xfrm", "policy", "add", "src", self.host(local), "dst", self.host(remote), "proto", "udp", "dport", str(port), "dir", direction, "tmpl", "src", local, "dst", remote, "proto", "esp", "reqid", str(reqid), "mode", "transport"]))
+        return steps
+
+    def installed(self, steps: List[Tuple[Dict[str, Any], List[str]]]) -> bool:
+        state = steps[0][0]
+        result = self.executor.run(["ip", "xfrm", "state", "show", "src", state["src"], "dst", state["dst"], "proto", "esp", "spi", state["spi"]], check=False)
+        return result.returncode == 0 and bool((result.stdout or "").strip())
+
+    def enable(self, steps: List[Tuple[Dict[str, Any], List[str]]]) -> None:
+        done: List[Dict[str, Any]] = []
+        for obj, command in steps:
+            try:
+                self.executor.run(command)
+            except subprocess.CalledProcessError as e:
+                for added in reversed(done):
+                    self.executor.run(ANCILLARY_KINDS[added["kind"]].delete(added), check=False)
+                # The command holds the key, so it is left out of the error
+                raise TunnelManagerError(f"Error adding {ANCILLARY_KINDS[obj['kind']].describe(obj)}; is another policy or SA already using it?") from None
+            done.append(obj)
+
+
+# A MACsec device on top of a layer 2 tunnel encrypts the overlay's Ethernet frames; it, not the tunnel, is the bridge port
+class TunnelMacsec:
+    # Cipher suites and their key lengths in bytes
+    CIPHERS = {"gcm-aes-128": 16, "gcm-aes-256": 32}
+    DEFAULT_CIPHER = "gcm-aes-128"
+    # SecTAG and ICV added to every frame
+    OVERHEAD = 32
+
+    def __init__(self, executor: Optional[CommandExecutor] = None) -> None:
+        self.executor = executor or SubprocessExecutor()
+
+    @staticmethod
+    def interface_name(ifname: str) -> str:
+        return f"ms{ifname}"[:15]
+
+    @classmethod
+    def channel(cls, secret: bytes, src: str, dst: str, vni: int, cipher: str) -> Tuple[str, str, str]:
+        # Each direction's SCI, key ID and key come from the shared secret, so both hosts build matching channels
+        digest = hmac.new(secret, f"{src}>{dst}:{vni}".encode(), hashlib.sha512).digest()
+        return "0x" + digest[:8].hex(), digest[8:24].hex(), digest[24:24 + cls.CIPHERS[cipher]].hex()
+
+    def plan(self, ifname: str, src: str, dst: str, vni: int, key_file: str, cipher: Optional[str] = None) -> List[List[str]]:
+        cipher = cipher or self.DEFAULT_CIPHER
+        if cipher not in self.CIPHERS:
+            raise TunnelManagerError(f"Unknown MACsec cipher suite {cipher} (expected one of {', '.join(self.CIPHERS)})")
+        secret = TunnelEncryption.load_secret(key_file)
+        name = self.interface_name(ifname)
+        tx_sci, tx_id, tx_key = self.channel(secret, src, dst, vni, cipher)
+        rx_sci, rx_id, rx_key = self.channel(secret, dst, src, vni, cipher)
+        return [
+            ["ip", "link", "add", name, "link", ifname, "type", "macsec", "sci", tx_sci, "cipher", cipher, "encrypt", "on"],
+            ["ip", "macsec", "add", name, "tx", "sa", "0", "pn", "1", "on", "key", tx_id, tx_key],
+            ["ip", "macsec", "add", name, "rx", "sci", rx_sci, "on"],
+            ["ip", "macsec", "add", name, "rx", "sci", rx_sci, "sa", "0", "pn", "1", "on", "key", rx_id, rx_key],
+            ["ip", "link", "set", name, "up"],
+        ]
+
+    def enable(self, commands: List[List[str]]) -> None:
+        name = commands[0][3]
+        for command in commands:
+            try:
+                self.executor.run(command)
+            except subprocess.CalledProcessError:
+                self.executor.run(["ip", "link", "del", name], check=False)
+                # The command holds the key, so it is left out of the error
+                raise TunnelManagerError(f"Error setting up MACsec device {name}; is the macsec module loaded?") from None
+
+    def link(self, name: str) -> Optional[Dict[str, Any]]:
+        result = self.executor.run(["ip", "-j", "link", "show", "dev", name], check=False)
+        try:
+            return json.loads(result.stdout or "[]")[0] if result.returncode == 0 else None
+        except (json.JSONDecodeError, IndexError):
+            return None
+
+
+# Puts a tunnel's bridge, or a layer 3 tunnel itself, into a VRF so each tenant routes in its own table
+class VrfBinding:
+    def __init__(self, executor: Optional[CommandExecutor] = None) -> None:
+        self.executor = executor or SubprocessExecutor()
+
+    def link(self, name: str) -> Optional[Dict[str, Any]]:
+        result = self.executor.run(["ip", "-d", "-j", "link", "show", "dev", name], check=False)
+        try:
+            return json.loads(result.stdout or "[]")[0] if result.returncode == 0 else None
+        except (json.JSONDecodeError, IndexError):
+            return None
+
+    def check(self, name: str, table: Optional[int] = None) -> bool:
+        # Returns whether the VRF has to be created
+        if table is not None and (not 1 <= table <= 4294967295 or table in (253, 254, 255)):
+            raise TunnelManagerError(f"Invalid VRF table {table} (expected 1-4294967295 other than the default, main and local tables 253-255)")
+        link = self.link(name)
+        if link is None and table is None:
+            raise TunnelManagerError(f"VRF {name} does not exist; pass --vrf-table to create it")
+        if link is None:
+            return True
+        linkinfo = link.get("linkinfo", {})
+        if linkinfo.get("info_kind") != "vrf":
+            raise TunnelManagerError(f"{name} is a {linkinfo.get('info_kind') or 'device'}, not a VRF")
+        current = linkinfo.get("info_data", {}).get("table")
+        if table is not None and current != table:
+            raise TunnelManagerError(f"VRF {name} already uses table {current} (requested {table})")
+        return False
+
+    def check_port(self, ifname: str, name: str) -> None:
+        master = (self.link(ifname) or {}).get("master")
+        if master and master != name:
+            raise TunnelManagerError(f"{ifname} is already enslaved to {master}; it cannot join VRF {name}")
+
+    def create(self, name: str, table: int) -> None:
+        try:
+            self.executor.run(["ip", "link", "add", name, "type", "vrf", "table", str(table)])
+            self.executor.run(["ip", "link", "set", name, "up"])
+        except subprocess.CalledProcessError as e:
+            logger.error(f"Error creating VRF {name}: {e}")
+            raise TunnelManagerError(f"Error creating VRF {name} with table {table}; is the vrf module loaded?") from e
+
+    def enslave(self, ifname: str, name: str) -> None:
+        try:
+            self.executor.run(["ip", "link", "set", "master", name, ifname])
+        except subprocess.CalledProcessError as e:
+            logger.error(f"Error adding {ifname} to VRF {name}: {e}")
+            raise TunnelManagerError(f"Error adding {ifname} to VRF {name}") from e
+
+
+# VLAN-aware bridges carry many segments on one bridge: each VLAN maps to a VNI, either through one tunnel device per VNI
+# that takes the VLAN untagged, or through the VLAN's tunnel_info on a single external device
+class BridgeVlans:
+    def __init__(self, executor: Optional[CommandExecutor] = None) -> None:
+        self.executor = executor or SubprocessExecutor()
+
+    def run(self, command: List[str], message: str) -> None:
+        try:
+            self.executor.run(command)
+        except subprocess.CalledProcessError as e:
+            logger.error(f"{message}: {e}")
+            raise TunnelManagerError(message) from e
+
+    @staticmethod
+    def check_vlan(vlan: int) -> None:
+        if not 1 <= vlan <= 4094:
+            raise TunnelManagerError(f"Invalid VLAN {vlan} (expected 1-4094)")
+
+    def filtering(self, bridge_name: str) -> bool:
+        result = self.executor.run(["ip", "-d", "-j", "link", "show", "dev", bridge_name], check=False)
+        try:
+            links = json.loads(result.stdout or "[]") if result.returncode == 0 else []
+        except json.JSONDecodeError:
+            links = []
+        return bool(links and TunnelInterface.info_data(links[0]).get("vlan_filtering"))
+
+    def enable_filtering(self, bridge_name: str) -> None:
+        if self.filtering(bridge_name):
+            return
+        # Existing ports stay untagged members of VLAN 1, the default PVID, so their traffic is unaffected
+        logger.info(f"Turning on VLAN filtering on bridge {bridge_name}.")
+        self.run(["ip", "link", "set", "dev", bridge_name, "type", "bridge", "vlan_filtering", "1"], f"Error turning on VLAN filtering on bridge {bridge_name}")
+
+    def map_port(self, ifname: str, vlan: int) -> None:
+        # Frames of the VLAN leave the bridge untagged into the tunnel, and frames from the tunnel join the VLAN
+        self.run(["bridge", "vlan", "add", "dev", ifname, "vid", str(vlan), "pvid", "untagged"], f"Error mapping VLAN {vlan} to {ifname}")
+        if vlan != 1:
+            self.run(["bridge", "vlan", "del", "dev", ifname, "vid", "1"], f"Error removing {ifname} from VLAN 1")
+
+    def map_tunnel(self, ifname: str, vlan: int, vni: int) -> None:
+        self.run(["bridge", "link", "set", "dev", ifname, "vlan_tunnel", "on"], f"Error turning on VLAN tunnelling on {ifname}")
+        self.run(["bridge", "vlan", "add", "dev", ifname, "vid", str(vlan)], f"Error adding VLAN {vlan} to {ifname}")
+        self.run(["bridge", "vlan", "add", "dev", ifname, "vid", str(vlan), "tunnel_info", "id", str(vni)], f"Error mapping VLAN {vlan} to VNI {vni} on {ifname}")
+
+    def unmap_tunnel(self, ifname: str, vlan: int, vni: int) -> None:
+        self.run(["bridge", "vlan", "del", "dev", ifname, "vid", str(vlan), "tunnel_info", "id", str(vni)], f"Error removing the VNI of VLAN {vlan} on {ifname}")
+        self.run(["bridge", "vlan", "del", "dev", ifname, "vid", str(vlan)], f"Error removing VLAN {vlan} from {ifname}")
+
+    @staticmethod
+    def vlan_range(entry: Dict[str, Any]) -> range:
+        # A range of VLANs is printed as its first VLAN and a vlanEnd key
+        return range(int(entry["vlan"]), int(entry.get("vlanEnd", entry["vlan"])) + 1)
+
+    def port_vlans(self, ifname: str) -> List[int]:
+        try:
+            ports = json.loads(self.executor.run(["bridge", "-j", "vlan", "show", "dev", ifname]).stdout or "[]")
+        except (subprocess.CalledProcessError, json.JSONDecodeError) as e:
+            raise TunnelManagerError(f"Error reading the VLANs of {ifname}") from e
+        return [vlan for port in ports for entry in port.get("vlans", []) for vlan in self.vlan_range(entry)]
+
+    def tunnels(self, ifname: str) -> Dict[int, int]:
+        try:
+            ports = json.loads(self.executor.run(["bridge", "-j", "vlan", "tunnelshow", "dev", ifname]).stdout or "[]")
+        except (subprocess.CalledProcessError, json.JSONDecodeError) as e:
+            raise TunnelManagerError(f"Error reading the VLAN tunnel mappings of {ifname}") from e
+        return {vlan: int(entry["tunid"]) + vlan - int(entry["vlan"]) for port in ports for entry in port.get("tunnels", []) for vlan in self.vlan_range(entry)}
+
+
+# Providers that hand over transport on a VLAN, or on stacked 802.1ad (S-tag) and 802.1Q (C-tag) VLANs, get a
+# sub-interface of the underlay device per tag; the tunnel then runs over the innermost one
+class UnderlayVlan:
+    PROTOCOLS = ("802.1Q", "802.1ad")
+
+    def __init__(self, executor: Optional[CommandExecutor] = None) -> None:
+        self.executor = executor or SubprocessExecutor()
+
+    @staticmethod
+    def parse(value: str) -> List[int]:
+        try:
+            vlans = [int(tag) for tag in value.split(".")]
+        except ValueError:
+            raise TunnelManagerError(f"Invalid underlay VLAN {value} (expected VID or SVID.CVID)") from None
+        if len(vlans) > 2 or any(not 1 <= vlan <= 4094 for vlan in vlans):
+            raise TunnelManagerError(f"Invalid underlay VLAN {value} (expected VID or SVID.CVID, each 1-4094)")
+        return vlans
+
+    @staticmethod
+    def default_protocol(vlans: List[int]) -> str:
+        # A single tag is an ordinary 802.1Q VLAN; the outer of two tags is an 802.1ad service tag
+        return "802.1ad" if len(vlans) > 1 else "802.1Q"
+
+    @staticmethod
+    def interface_name(parent: str, vlans: List[int]) -> str:
+        suffix = "".join(f".{vlan}" for vlan in vlans)
+        return parent[:15 - len(suffix)] + suffix
+
+    def plan(self, spec: Dict[str, Any]) -> List[Dict[str, Any]]:
+        # Outermost first: each sub-interface sits on the one before it
+        vlans, lower = spec["vlans"], spec["parent"]
+        steps = []
+        for depth, vlan in enumerate(vlans):
+            name = self.interface_name(spec["parent"], vlans[:depth + 1])
+            steps.append({"name": name, "link": lower, "id": vlan, "protocol": (spec.get("protocol") or self.default_protocol(vlans)) if depth == 0 else "802.1Q"})
+            lower = name
+        return steps
+
+    def link(self, name: str) -> Optional[Dict[str, Any]]:
+        result = self.executor.run(["ip", "-d", "-j", "link", "show", "dev", name], check=False)
+        try:
+            return json.loads(result.stdout or "[]")[0] if result.returncode == 0 else None
+        except (json.JSONDecodeError, IndexError):
+            return None
+
+    def check(self, steps: List[Dict[str, Any]]) -> List[Dict[str, Any]]:
+        # Returns the sub-interfaces that have to be created; existing ones must carry the requested tag
+        if self.link(steps[0]["link"]) is None:
+            raise TunnelManagerError(f"Underlay device {steps[0]['link']} does not exist")
+        missing = []
+        for step in steps:
+            link = self.link(step["name"])
+            if link is None:
+                missing.append(step)
+                continue
+            linkinfo = link.get("linkinfo", {})
+            info_data = linkinfo.get("info_data", {})
+            if linkinfo.get("info_kind") != "vlan" or link.get("link") != step["link"] or info_data.get("id") != step["id"] or info_data.get("protocol", "802.1Q").lower() != step["protocol"].lower():
+                current = f"{info_data.get('protocol')} VLAN {info_data.get('id')} on {link.get('link')}" if linkinfo.get("info_kind") == "vlan" else f"a {linkinfo.get('info_kind') or 'device'}"
+                raise TunnelManagerError(f"{step['name']} already exists as {current} (requested {step['protocol']} VLAN {step['id']} on {step['link']})")
+        return missing
+
+    def create(self, steps: List[Dict[str, Any]]) -> None:
+        created: List[str] = []
+        try:
+            for step in steps:
+                self.executor.run(["ip", "link", "add", "link", step["link"], "name", step["name"], "type", "vlan", "protocol", step["protocol"], "id", str(step["id"])])
+                created.append(step["name"])
+                self.executor.run(["ip", "link", "set", step["name"], "up"])
+        except subprocess.CalledProcessError as e:
+            logger.error(f"Error creating underlay VLAN device: {e}")
+            for name in reversed(created):
+                self.executor.run(["ip", "link", "del", name], check=False)
+            raise TunnelManagerError(f"Error creating underlay VLAN devices {', '.join(step['name'] for step in steps)}; is the 8021q module loaded?") from e
+
+
+class TunnelRoutes:
+    def __init__(self, executor: Optional[CommandExecutor] = None) -> None:
+        self.executor = executor or SubprocessExecutor()
+
+    def link_mtu(self, ifname: str) -> int:
+        try:
+            result = self.executor.run(["ip", "-j", "link", "show", "dev", ifname])
+            return int(json.loads(result.stdout or "[{}]")[0].get("mtu", 0))
+        except (subprocess.CalledProcessError, json.JSONDecodeError, IndexError) as e:
+            raise TunnelManagerError(f"Error reading the MTU of {ifname}") from e
+
+    def add(self, prefixes: List[str], dev: str, mtu: Optional[int] = None) -> None:
+        for prefix in prefixes:
+            try:
+                self.executor.run(["ip", "route", "add", prefix, "dev", dev] + (["mtu", "lock", str(mtu)] if mtu else []))
+            except subprocess.CalledProcessError as e:
+                logger.error(f"Error adding route {prefix} via {dev}: {e}")
+                raise TunnelManagerError(f"Error adding route {prefix} via {dev}") from e
+
+    def lock(self, prefixes: List[str], dev: str, mtu: int) -> None:
+        for prefix in prefixes:
+            try:
+                self.executor.run(["ip", "route", "replace", prefix, "dev", dev, "mtu", "lock", str(mtu)])
+            except subprocess.CalledProcessError as e:
+                raise TunnelManagerError(f"Error locking route {prefix} via {dev} to mtu {mtu}") from e
+
+    def routes(self, dev: str) -> List[Dict[str, Any]]:
+        try:
+            result = self.executor.run(["ip", "-j", "route", "show", "dev", dev])
+            entries = json.loads(result.stdout or "[]")
+        except (subprocess.CalledProcessError, json.JSONDecodeError) as e:
+            raise TunnelManagerError(f"Error reading routes of {dev}") from e
+        routes = []
+        for entry in entries:
+            metrics = {key: value for metric in entry.get("metrics", []) for key, value in metric.items()}
+            mtu = metrics.get("mtu")
+            # Locked metrics are reported as {"value": n, "lock": true} by some iproute2 versions
+            locked = isinstance(mtu, dict) and bool(mtu.get("lock")) or "mtu" in metrics.get("lock", [])
+            routes.append({"dst": entry.get("dst"), "dev": dev, "mtu": mtu.get("value") if isinstance(mtu, dict) else mtu, "mtu_locked": locked})
+        return routes
+
+    def check(self, prefixes: List[str], dev: str, mtu: Optional[int]) -> None:
+        installed = {route["dst"]: route for route in self.routes(dev)}
+        problems = []
+        for prefix in prefixes:
+            route = installed.get(prefix)
+            if route is None:
+                problems.append(f"{prefix} is missing")
+            elif mtu and (route["mtu"] != mtu or not route["mtu_locked"]):
+                problems.append(f"{prefix} has mtu {route['mtu']}{' locked' if route['mtu_locked'] else ''} (expected mtu lock {mtu})")
+        if problems:
+            raise TunnelManagerError(f"Routes via {dev} drifted: {'; '.join(problems)}")
+
+
+class TunnelMtu:
+    MIN_MTU = 68
+
+    def __init__(self, executor: Optional[CommandExecutor] = None) -> None:
+        self.executor = executor or SubprocessExecutor()
+
+    def underlay(self, remote: str, dev: Optional[str] = None) -> str:
+        # Without --dev the encapsulated packets leave along the route to the remote
+        if dev:
+            return dev
+        try:
+            routes = json.loads(self.executor.run(["ip", "-j", "route", "get", remote]).stdout or "[]")
+        except (subprocess.CalledProcessError, json.JSONDecodeError) as e:
+            raise TunnelManagerError(f"Error finding the underlay device towards {remote}: {e}; pass --dev or --mtu") from e
+        if not routes or not routes[0].get("dev"):
+            raise TunnelManagerError(f"No route to {remote}; pass --dev or --mtu")
+        return routes[0]["dev"]
+
+    def auto(self, tunnel_type: str, remote: str, dev: Optional[str] = None) -> int:
+        underlay = self.underlay(remote, dev)
+        mtu = LinkHealth.expected_mtu(tunnel_type, TunnelRoutes(self.executor).link_mtu(underlay), remote)
+        if mtu < self.MIN_MTU:
+            raise TunnelManagerError(f"{underlay} leaves no room for a {tunnel_type} tunnel (mtu {mtu})")
+        logger.info(f"Tunnel MTU {mtu}: {underlay} MTU minus the {tunnel_type} over IPv{TunnelInterface.ip_version(remote) or 4} overhead.")
+        return mtu
+
+    def set(self, ifname: str, mtu: int) -> None:
+        try:
+            self.executor.run(["ip", "link", "set", ifname, "mtu", str(mtu)])
+        except subprocess.CalledProcessError as e:
+            raise TunnelManagerError(f"Error setting the MTU of {ifname} to {mtu}") from e
+
+
+def ping(executor: CommandExecutor, address: str, count: int = 1, timeout: int = 2, dev: Optional[str] = None) -> bool:
+    return executor.run(["ping", "-c", str(count), "-W", str(timeout)] + (["-I", dev] if dev else []) + [address], check=False).returncode == 0
+
+
+class FlowSampler:
+    DEFAULT_PORTS = {"sflow": 6343, "ipfix": 4739}
+    # hsflowd reads psample group 1 unless configured otherwise
+    DEFAULT_GROUP = 1
+
+    def __init__(self, executor: Optional[CommandExecutor] = None) -> None:
+        self.executor = executor or SubprocessExecutor()
+
+    def is_ovs_bridge(self, bridge_name: str) -> bool:
+        try:
+            return self.executor.run(["ovs-vsctl", "br-exists", bridge_name], check=False).returncode == 0
+        except FileNotFoundError:
+            return False
+
+    def check_collector(self, host: str) -> None:
+        if not ping(self.executor, host):
+            raise TunnelManagerError(f"Flow collector {host} is not reachable")
+
+    @staticmethod
+    def target(host: str, port: int) -> str:
+        return f"[{host}]:{port}" if ":" in host else f"{host}:{port}"
+
+    def enable(self, ifname: str, bridge_name: str, settings: Dict[str, Any], agent: Optional[str] = None) -> List[Dict[str, Any]]:
+        try:
+            if settings["method"] == "ovs":
+                target = self.target(settings["collector"], settings["port"])
+                self.executor.run(["ovs-vsctl", "--", "--id=@sample", "create", settings["protocol"]] + ([f"agent={agent or bridge_name}"] if settings["protocol"] == "sflow" else []) + [f'targets="{target}"', f"sampling={settings['rate']}", "--", "set", "bridge", bridge_name, f"{settings['protocol']}=@sample"])
+                return [{"kind": "ovs_sampling", "bridge": bridge_name, "protocol": settings["protocol"]}]
+            self.executor.run(["tc", "qdisc", "replace", "dev", ifname, "clsact"])
+            for direction in ("ingress", "egress"):
+                self.executor.run(["tc", "filter", "add", "dev", ifname, direction, "matchall", "action", "sample", "rate", str(settings["rate"]), "group", str(settings["group"])])
+            return [{"kind": "qdisc", "dev": ifname, "parent": "clsact"}]
+        except subprocess.CalledProcessError as e:
+            logger.error(f"Error enabling flow sampling on {ifname}: {e}")
+            raise TunnelManagerError(f"Error enabling flow sampling on {ifname}") from e
+
+    def active(self, ifname: str, bridge_name: str, settings: Dict[str, Any]) -> bool:
+        if settings["method"] == "ovs":
+            result = self.executor.run(["ovs-vsctl", "get", "bridge", bridge_name, settings["protocol"]], check=False)
+            return result.returncode == 0 and result.stdout.strip() not in ("", "[]")
+        result = self.executor.run(["tc", "filter", "show", "dev", ifname, "ingress"], check=False)
+        return result.returncode == 0 and "sample" in result.stdout
+
+
+class AncillaryKind(NamedTuple):
+    # Objects with an order below LINK_ORDER are removed before the tunnel device, the rest after it
+    order: int
+    delete: Callable[[Dict[str, Any]], List[str]]
+    describe: Callable[[Dict[str, Any]], str]
+    # Shared objects are kept while this query still lists something depending on them
+    users: Optional[Callable[[Dict[str, Any]], List[str]]] = None
+    # Objects several tunnel records track, such as the IPsec SAs of a host pair, stay until the last of them goes
+    shared: bool = False
+
+
+LINK_ORDER = 50
+
+ANCILLARY_KINDS = {
+    "nft_rule": AncillaryKind(10, lambda obj: ["nft", "delete", "rule", obj["family"], obj["table"], obj["chain"], "handle", str(obj["handle"])], lambda obj: f"nft rule {obj['family']} {obj['table']} {obj['chain']} handle {obj['handle']}"),
+    "xfrm_policy": AncillaryKind(12, lambda obj: ["ip", "xfrm", "policy", "delete", "src", obj["src"], "dst", obj["dst"], "proto", "udp", "dport", str(obj["port"]), "dir", obj["dir"]], lambda obj: f"xfrm policy {obj['src']} -> {obj['dst']} udp dport {obj['port']} dir {obj['dir']}", shared=True),
+    "xfrm_state": AncillaryKind(14, lambda obj: ["ip", "xfrm", "state", "delete", "src", obj["src"], "dst", obj["dst"], "proto", "esp", "spi", obj["spi"]], lambda obj: f"xfrm state {obj['src']} -> {obj['dst']} esp spi {obj['spi']}", shared=True),
+    "neigh": AncillaryKind(18, lambda obj: ["ip", "neigh", "del", obj["address"], "dev", obj["dev"]], lambda obj: f"neighbour {obj['address']} lladdr {obj['mac']} dev {obj['dev']}"),
+    "route": AncillaryKind(20, lambda obj: ["ip", "route", "del", obj["prefix"], "dev", obj["dev"]], lambda obj: f"route {obj['prefix']} dev {obj['dev']}"),
+    "ovs_sampling": AncillaryKind(25, lambda obj: ["ovs-vsctl", "clear", "bridge", obj["bridge"], obj["protocol"]], lambda obj: f"{obj['protocol']} sampling on OVS bridge {obj['bridge']}", shared=True),
+    "qdisc": AncillaryKind(30, lambda obj: ["tc", "qdisc", "del", "dev", obj["dev"], obj.get("parent", "root")], lambda obj: f"qdisc {obj.get('parent', 'root')} dev {obj['dev']}"),
+    "fdb": AncillaryKind(40, lambda obj: ["bridge", "fdb", "del", obj["mac"], "dev", obj["dev"], "dst", obj["dst"]], lambda obj: f"fdb {obj['mac']} dev {obj['dev']} dst {obj['dst']}"),
+    "macsec": AncillaryKind(35, lambda obj: ["ip", "link", "del", obj["ifname"]], lambda obj: f"MACsec device {obj['ifname']}"),
+    "dhcp_client": AncillaryKind(45, lambda obj: ["dhclient", "-x", "-pf", obj["pidfile"], obj["ifname"]], lambda obj: f"DHCP client on {obj['ifname']} ({obj['pidfile']})"),
+    "vlan_subif": AncillaryKind(55, lambda obj: ["ip", "link", "del", obj["name"]], lambda obj: f"underlay VLAN device {obj['name']}", shared=True),
+    "fou": AncillaryKind(60, lambda obj: ["ip", "fou", "del", "port", str(obj["port"])], lambda obj: f"fou listener on port {obj['port']}"),
+    "bridge": AncillaryKind(70, lambda obj: BRIDGE_BACKENDS[obj.get("tool", "ip")].delete_command(obj["name"]), lambda obj: f"bridge {obj['name']}", lambda obj: BRIDGE_BACKENDS[obj.get("tool", "ip")].ports_command(obj["name"])),
+    "vrf": AncillaryKind(75, lambda obj: ["ip", "link", "del", obj["name"]], lambda obj: f"VRF {obj['name']} (table {obj['table']})", lambda obj: ["ip", "-j", "link", "show", "master", obj["name"]]),
+}
+
+
+# The options of one tunnel as create takes them. Records keep the same names, so a recorded tunnel is created again
+# from TunnelSpec.from_record and a new option needs no copy line in the places that recreate tunnels
+@dataclasses.dataclass
+class TunnelSpec:
+    vni: int
+    src_host: str
+    dst_host: str
+    bridge_name: str
+    src_port: Optional[Union[int, str]] = None
+    dst_port: Optional[int] = None
+    dev: Optional[str] = None
+    port_flags: Optional[Dict[str, str]] = None
+    peers_from_dns: Optional[str] = None
+    routes: Optional[List[str]] = None
+    route_mtu: Optional[str] = None
+    link_group: Optional[int] = None
+    ifname: Optional[str] = None
+    site: Optional[str] = None
+    peers: Optional[List[str]] = None
+    bridge_options: Optional[Dict[str, Any]] = None
+    labels: Optional[Dict[str, str]] = None
+    mtu: Optional[str] = None
+    vxlan_flags: Optional[Dict[str, bool]] = None
+    udp_checksums: Optional[Dict[str, bool]] = None
+    gre_options: Optional[Dict[str, Any]] = None
+    encrypt_key_file: Optional[str] = None
+    macsec: Optional[Dict[str, Any]] = None
+    vrf: Optional[str] = None
+    vrf_table: Optional[int] = None
+    vlan: Optional[int] = None
+    dev_vlan: Optional[Dict[str, Any]] = None
+
+    @classmethod
+    def from_record(cls, vni: int, record: Dict[str, Any]) -> "TunnelSpec":
+        options = {field.name: record.get(field.name) for field in dataclasses.fields(cls)}
+        # Records keep the resolved addresses next to the names given, and the MTUs as measured; those are asked for again.
+        # Peers found in DNS are looked up again rather than pinned
+        route_mtu = record.get("route_mtu")
+        return cls(**dict(options, vni=vni, src_host=record.get("src_name") or record["src_host"], dst_host=record.get("dst_name") or record["dst_host"], route_mtu=str(route_mtu) if route_mtu else None, peers=None if record.get("peers_from_dns") else record.get("peers"), mtu="auto" if record.get("mtu_auto") else str(record["mtu"]) if record.get("mtu") else None))
+
+    @classmethod
+    def from_entry(cls, entry: Dict[str, Any]) -> "TunnelSpec":
+        # The options a manifest entry can carry
+        return cls(entry["vni"], entry["src_host"], entry["dst_host"], entry["bridge_name"], entry.get("src_port"), entry.get("dst_port"), entry.get("dev"), ifname=entry.get("ifname"), site=entry.get("site"), peers=entry.get("peers"), peers_from_dns=entry.get("peers_from_dns"), vxlan_flags=entry.get("vxlan_flags"))
+
+
+class TunnelManager:
+    # What ip, bridge, tc, nft and ovs-vsctl print when the object to delete does not exist
+    GONE_MARKERS = ("ENOENT", "Cannot find", "No such", "no row")
+    # Columns of `list`; status and maintenance only show up once a record has drifted or a window is open
+    LIST_FIELDS = ("ifname", "vni", "src_host", "dst_host", "dst_port", "dev", "master", "state", "flags", "managed", "labels", "status", "maintenance")
+
+    def __init__(self, tunnel: TunnelInterface, records: Optional[TunnelRecords] = None, resolver: Optional[HostResolver] = None, policy: Optional[BridgePolicy] = None, audit: Optional[AuditLog] = None, journal: Optional[IntentJournal] = None, frr: Optional["FrrEvpnSync"] = None) -> None:
+        self.tunnel: TunnelInterface = tunnel
+        self.records = records
+        # Site services are named after the site and service rather than the VNI
+        if records:
+            self.tunnel.ifnames.update(records.ifnames(tunnel.tunnel_type))
+        self.resolver = resolver or HostResolver()
+        self.policy = policy
+        self.audit = audit
+        self.journal = journal
+        self.frr = frr
+
+    @journaled("create")
+    def create(self, spec: TunnelSpec, policy_override: bool = False, attach_only: bool = False, replace: bool = False) -> None:
+        vni = spec.vni
+        if spec.ifname:
+            self.tunnel.ifnames[vni] = spec.ifname
+        if self.policy:
+            self.policy.check(spec.bridge_name, policy_override)
+        src_ip = self.resolver.resolve(spec.src_host)
+        dst_ip = self.resolver.resolve(spec.dst_host)
+        kernel_device = getattr(self.tunnel, "KERNEL_DEVICE", True)
+        if spec.dev_vlan and not kernel_device:
+            raise TunnelManagerError("OVS tunnel ports follow the host's routes; put the VLAN on the underlay yourself")
+        # The tunnel runs over the innermost sub-interface, which is what the record keeps as its dev
+        dev_vlan_steps = UnderlayVlan(self.tunnel.executor).plan(spec.dev_vlan) if spec.dev_vlan else []
+        dev = dev_vlan_steps[-1]["name"] if dev_vlan_steps else spec.dev
+        missing_dev_vlans = UnderlayVlan(self.tunnel.executor).check(dev_vlan_steps) if dev_vlan_steps else []
+        if spec.peers and (self.tunnel.tunnel_type != "vxlan" or not kernel_device):
+            raise TunnelManagerError(f"Head-end replication to several remotes needs VXLAN devices; {self.tunnel.tunnel_type if kernel_device else 'an OVS tunnel port'} has no flood entries")
+        if spec.vxlan_flags and (self.tunnel.tunnel_type != "vxlan" or not kernel_device):
+            raise TunnelManagerError(f"learning, proxy, l2miss, l3miss and gbp are VXLAN device flags; {self.tunnel.tunnel_type if kernel_device else 'an OVS tunnel port'} has none")
+        if spec.vxlan_flags:
+            # The kernel fixes proxy and the miss notifications when the device is created
+            cast(VXLANTunnel, self.tunnel).flags[vni] = spec.vxlan_flags
+        if spec.udp_checksums and not hasattr(self.tunnel, "checksums"):
+            raise TunnelManagerError(f"UDP checksum options apply to VXLAN and Geneve devices; {self.tunnel.tunnel_type if kernel_device else 'an OVS tunnel port'} has none" + ("" if kernel_device else ", use --udp6-zero-csum"))
+        if spec.udp_checksums:
+            cast(Union[VXLANTunnel, GeneveTunnel], self.tunnel).checksums[vni] = spec.udp_checksums
+        if spec.gre_options and not hasattr(self.tunnel, "gre_options"):
+            raise TunnelManagerError(f"key, ikey, okey, csum and seq are GRE options; {self.tunnel.tunnel_type if kernel_device else 'an OVS tunnel port'} has none")
+        if spec.gre_options:
+            cast(GreTunnel, self.tunnel).gre_options[vni] = spec.gre_options
+        self.check_port_flag_support(spec.port_flags or {})
+        if spec.encrypt_key_file and not getattr(self.tunnel, "DEFAULT_PORT", None):
+            raise TunnelManagerError(f"IPsec encryption protects the UDP port of VXLAN and Geneve tunnels; {self.tunnel.tunnel_type} has none")
+        if spec.encrypt_key_file and (spec.peers or ipaddress.ip_address(dst_ip).is_multicast):
+            raise TunnelManagerError("IPsec encryption protects the traffic between two hosts; it cannot be combined with a multicast group or head-end peers")
+        # The key file is read before anything is created, so a bad key fails the create cleanly
+        encryption = TunnelEncryption(self.tunnel.executor).plan(src_ip, dst_ip, spec.dst_port or getattr(self.tunnel, "DEFAULT_PORT"), spec.encrypt_key_file) if spec.encrypt_key_file else []
+        if spec.macsec and (not kernel_device or not getattr(self.tunnel, "bridgeable", True)):
+            raise TunnelManagerError(f"MACsec needs a layer 2 tunnel device to sit on; {self.tunnel.tunnel_type if kernel_device else 'an OVS tunnel port'} is not one")
+        if spec.macsec and self.tunnel.bridges().TOOL == BrctlBridgeBackend.TOOL:
+            raise TunnelManagerError("MACsec devices are attached with ip link or ovs-vsctl; use --bridge-tool ip or ovs-vsctl")
+        if spec.macsec and (spec.peers or ipaddress.ip_address(dst_ip).is_multicast):
+            raise TunnelManagerError("MACsec keys one channel to a single remote; it cannot be combined with a multicast group or head-end peers")
+        macsec_commands = TunnelMacsec(self.tunnel.executor).plan(self.tunnel.interface_name(vni), src_ip, dst_ip, vni, spec.macsec["key_file"], spec.macsec.get("cipher")) if spec.macsec else []
+        if spec.vrf and self.tunnel.bridges().TOOL == OvsBridgeBackend.TOOL:
+            raise TunnelManagerError("OVS bridges cannot join a VRF; use --bridge-tool ip or brctl")
+        # A layer 3 GRE device is not bridged, so it joins the VRF itself
+        vrf_port = spec.bridge_name if getattr(self.tunnel, "bridgeable", True) else self.tunnel.interface_name(vni)
+        create_vrf = VrfBinding(self.tunnel.executor).check(spec.vrf, spec.vrf_table) if spec.vrf else False
+        if spec.vrf:
+            VrfBinding(self.tunnel.executor).check_port(vrf_port, spec.vrf)
+        if spec.vlan is not None:
+            BridgeVlans.check_vlan(spec.vlan)
+        if spec.vlan is not None and (not kernel_device or not getattr(self.tunnel, "bridgeable", True) or self.tunnel.bridges().TOOL != IpBridgeBackend.TOOL):
+            raise TunnelManagerError("VLAN-to-VNI mapping needs a layer 2 tunnel device on a Linux bridge managed with --bridge-tool ip")
+        for other in (self.records.tunnels() if self.records and spec.vlan is not None else []):
+            if other.get("bridge_name") == spec.bridge_name and other.get("vlan") == spec.vlan and (other["tunnel_type"], other["vni"]) != (self.tunnel.tunnel_type, vni):
+                raise TunnelManagerError(f"VLAN {spec.vlan} on {spec.bridge_name} already carries {other['tunnel_type']} VNI {other['vni']}; one VLAN maps to one segment")
+        if spec.mtu and not kernel_device:
+            raise TunnelManagerError("OVS tunnel ports have no MTU of their own; set the MTU of the OVS bridge instead")
+        # The underlay is read before anything is created, so a missing route fails the create cleanly
+        tunnel_mtu = TunnelMtu(self.tunnel.executor).auto(self.tunnel.tunnel_type, dst_ip, dev) if spec.mtu == "auto" else int(spec.mtu) if spec.mtu else None
+        # The device's own remote already floods; listing it again would duplicate every flooded frame to it
+        peers = [peer for peer in dict.fromkeys(self.resolver.resolve(peer) for peer in spec.peers or []) if peer != dst_ip]
+        # A bridge this tool created, or already shares with another tunnel, is removed with the last tunnel on it
+        bridge = {"name": spec.bridge_name, "tool": self.tunnel.bridges().TOOL}
+        owns_bridge = spec.bridge_options is not None and (self.ensure_bridge(spec.bridge_name, **spec.bridge_options) or bool(self.records and self.records.tracked("bridge", **bridge)))
+        UnderlayVlan(self.tunnel.executor).create(missing_dev_vlans)
+        existing = self.tunnel.link_attributes(vni) if attach_only or replace else None
+        mismatches = self.attribute_mismatches(existing, {"id": self.tunnel.device_id(vni), "remote": dst_ip, "local": src_ip, "link": dev, "port": spec.dst_port or getattr(self.tunnel, "DEFAULT_PORT", None)}) if existing else {}
+        ifname = self.tunnel.interface_name(vni)
+        if existing and mismatches and not replace:
+            details = ", ".join(f"{key} is {current} (requested {requested})" for key, (current, requested) in mismatches.items())
+            raise TunnelManagerError(f"{ifname} already exists with different attributes: {details}; pass --replace (or --force) to recreate it")
+        if existing and mismatches:
+            logger.info(f"Replacing {ifname}: attributes differ from the request.")
+            self.tunnel.cleanup_tunnel_interface(vni, existing.get("master") or spec.bridge_name)
+            existing = None
+        # --replace keeps an identical device; `ip link add` would fail on it with EEXIST
+        if existing and (attach_only or replace):
+            self.tunnel.attach_tunnel_interface(vni, spec.bridge_name)
+            logger.info(f"Attached existing {ifname} to {spec.bridge_name}.")
+        else:
+            try:
+                self.tunnel.create_tunnel_interface(vni, src_ip, dst_ip, spec.bridge_name, spec.src_port, spec.dst_port, dev)
+            except TunnelManagerError as e:
+                # Only a failed `ip link add` can mean the device was there before; later steps fail on our own device
+                failed = getattr(e.__cause__, "cmd", None) or []
+                existing = self.tunnel.link_attributes(vni) if failed[:3] == ["ip", "link", "add"] or failed[:2] == ["ovs-vsctl", "add-port"] else None
+                if existing is None:
+                    raise
+                difference = self.existing_difference(vni, existing, src_ip, dst_ip, spec.bridge_name, spec.dst_port, dev)
+                if difference:
+                    raise TunnelManagerError(difference) from e.__cause__
+                # Running the same create twice is a no-op
+                logger.info(f"{ifname} already exists with the requested attributes; nothing to do.")
+                return
+        # Tunnels between the same two hosts on the same port share one pair of SAs
+        if encryption and not TunnelEncryption(self.tunnel.executor).installed(encryption):
+            TunnelEncryption(self.tunnel.executor).enable(encryption)
+        if tunnel_mtu:
+            TunnelMtu(self.tunnel.executor).set(ifname, tunnel_mtu)
+        bridge_port = TunnelMacsec.interface_name(ifname) if spec.macsec else ifname
+        if spec.macsec and TunnelMacsec(self.tunnel.executor).link(bridge_port) is None:
+            # The MACsec device takes the tunnel's place on the bridge
+            self.tunnel.bridges().remove_port(spec.bridge_name, ifname)
+            TunnelMacsec(self.tunnel.executor).enable(macsec_commands)
+            self.tunnel.bridges().add_port(spec.bridge_name, bridge_port)
+        if create_vrf:
+            VrfBinding(self.tunnel.executor).create(cast(str, spec.vrf), cast(int, spec.vrf_table))
+        if spec.vrf:
+            VrfBinding(self.tunnel.executor).enslave(vrf_port, spec.vrf)
+        if spec.vlan is not None:
+            BridgeVlans(self.tunnel.executor).enable_filtering(spec.bridge_name)
+            BridgeVlans(self.tunnel.executor).map_port(bridge_port, spec.vlan)
+        if spec.link_group is not None and kernel_device:
+            LinkGroup(self.tunnel.executor).assign(ifname, spec.link_group)
+        BridgePort(self.tunnel.executor).set_flags(bridge_port, spec.port_flags or {})
+        peers, peers_ttl = DnsPeerSource(spec.peers_from_dns, self.tunnel.executor, self.resolver).resolve() if spec.peers_from_dns else (peers or [], None)
+        FloodList(self.tunnel.executor).add(ifname, peers)
+        locked_mtu = TunnelRoutes(self.tunnel.executor).link_mtu(ifname) if spec.route_mtu == "auto" else int(spec.route_mtu) if spec.route_mtu else None
+        TunnelRoutes(self.tunnel.executor).add(spec.routes or [], spec.bridge_name, locked_mtu)
+        attributes = {"src_host": src_ip, "dst_host": dst_ip, "src_name": spec.src_host, "dst_name": spec.dst_host, "bridge_name": spec.bridge_name, "src_port": spec.src_port, "dst_port": spec.dst_port, "dev": dev, "port_flags": spec.port_flags or {}, "peers": peers, "peers_from_dns": spec.peers_from_dns, "peers_ttl": peers_ttl, "routes": spec.routes or [], "route_mtu": locked_mtu, "link_group": spec.link_group}
+        if tunnel_mtu:
+            attributes["mtu"] = tunnel_mtu
+        if spec.vxlan_flags:
+            attributes["vxlan_flags"] = spec.vxlan_flags
+        if spec.udp_checksums:
+            attributes["udp_checksums"] = spec.udp_checksums
+        if spec.gre_options:
+            attributes["gre_options"] = spec.gre_options
+        if spec.encrypt_key_file:
+            # Only the path is recorded; the secret stays in the key file
+            attributes["encrypt_key_file"] = spec.encrypt_key_file
+        if spec.vrf:
+            attributes["vrf"] = spec.vrf
+        if spec.vrf_table is not None:
+            attributes["vrf_table"] = spec.vrf_table
+        if create_vrf or (spec.vrf and self.records and self.records.tracked("vrf", name=spec.vrf, table=spec.vrf_table)):
+            # A VRF this tool created goes with the last tunnel in it
+            TunnelRecords.track(attributes, "vrf", name=spec.vrf, table=spec.vrf_table)
+        if spec.vlan is not None:
+            attributes["vlan"] = spec.vlan
+        if spec.dev_vlan:
+            attributes["dev_vlan"] = {"parent": spec.dev_vlan["parent"], "vlans": spec.dev_vlan["vlans"], "protocol": dev_vlan_steps[0]["protocol"]}
+        # Inner sub-interfaces are tracked first so they go before the ones they sit on
+        for step in reversed(dev_vlan_steps):
+            if step in missing_dev_vlans or (self.records and self.records.tracked("vlan_subif", name=step["name"])):
+                TunnelRecords.track(attributes, "vlan_subif", name=step["name"])
+        if spec.macsec:
+            attributes["macsec"] = {"key_file": spec.macsec["key_file"], "cipher": spec.macsec.get("cipher") or TunnelMacsec.DEFAULT_CIPHER, "ifname": bridge_port}
+            TunnelRecords.track(attributes, "macsec", ifname=bridge_port)
+        if spec.mtu == "auto":
+            # Recreating the tunnel measures the underlay again
+            attributes["mtu_auto"] = True
+        if ifname:
+            attributes["ifname"] = ifname
+        if spec.site:
+            attributes["site"] = spec.site
+        if spec.labels:
+            attributes["labels"] = spec.labels
+        for obj, _ in encryption:
+            TunnelRecords.track(attributes, **obj)
+        for prefix in spec.routes or []:
+            TunnelRecords.track(attributes, "route", prefix=prefix, dev=spec.bridge_name)
+        for peer in peers:
+            TunnelRecords.track(attributes, "fdb", mac=FloodList.ALL_ZEROS_MAC, dev=ifname, dst=peer)
+        if owns_bridge:
+            TunnelRecords.track(attributes, "bridge", **bridge)
+            attributes["bridge_options"] = spec.bridge_options
+        if self.frr and self.tunnel.tunnel_type == TunnelType.VXLAN.value and kernel_device:
+            # BGP advertises the VNI only once its device exists; a failed push rolls the device back
+            self.frr.add(vni, src_ip)
+            attributes["frr_asn"] = self.frr.asn
+        if self.records:
+            self.records.record(self.tunnel.tunnel_type, vni, attributes)
+        if self.audit:
+            self.audit.record("create", tunnel_type=self.tunnel.tunnel_type, vni=vni, record=attributes)
+
+    def sync_dns_peers(self, vni: int, metrics: Optional["MetricRegistry"] = None) -> Optional[int]:
+        record = self.records.get(self.tunnel.tunnel_type, vni) if self.records else None
+        if not record or not record.get("peers_from_dns"):
+            return None
+        try:
+            peers, ttl = DnsPeerSource(record["peers_from_dns"], self.tunnel.executor, self.resolver).resolve()
+        except TunnelManagerError as e:
+            # Keep the last known-good flood list rather than flushing it
+            logger.error(f"Keeping last known peers of VNI {vni}: {e}")
+            (metrics or METRICS).inc(DNS_PEER_FAILURES, type=self.tunnel.tunnel_type, vni=vni)
+            return record.get("peers_ttl")
+        ifname = self.tunnel.interface_name(vni)
+        known = record.get("peers", [])
+        FloodList(self.tunnel.executor).add(ifname, [peer for peer in peers if peer not in known])
+        FloodList(self.tunnel.executor).remove(ifname, [peer for peer in known if peer not in peers])
+        for peer in known:
+            TunnelRecords.untrack(record, "fdb", mac=FloodList.ALL_ZEROS_MAC, dev=ifname, dst=peer)
+        for peer in peers:
+            TunnelRecords.track(record, "fdb", mac=FloodList.ALL_ZEROS_MAC, dev=ifname, dst=peer)
+        record.update(peers=peers, peers_ttl=ttl)
+        self.records.record(self.tunnel.tunnel_type, vni, record)
+        return ttl
+
+    def flood_peers(self, vni: int, remote: Optional[str] = None) -> List[str]:
+        record = self.records.get(self.tunnel.tunnel_type, vni) if self.records else None
+        return FloodList(self.tunnel.executor).peers(self.tunnel.interface_name(vni), remote or (record.get("dst_host") if record else None))
+
+    def sync_peers(self, vni: int, peers: List[str], remote: Optional[str] = None) -> Tuple[List[str], List[str]]:
+        # Only the difference is applied, so untouched peers never drop out of the flood list
+        ifname = self.tunnel.interface_name(vni)
+        flood_list = FloodList(self.tunnel.executor)
+        added, removed = FloodList.delta(self.flood_peers(vni, remote), peers)
+        flood_list.add(ifname, added)
+        flood_list.remove(ifname, removed)
+        record = self.records.get(self.tunnel.tunnel_type, vni) if self.records else None
+        if record and (added or removed or record.get("peers") != peers):
+            for peer in removed:
+                TunnelRecords.untrack(record, "fdb", mac=FloodList.ALL_ZEROS_MAC, dev=ifname, dst=peer)
+            for peer in added:
+                TunnelRecords.track(record, "fdb", mac=FloodList.ALL_ZEROS_MAC, dev=ifname, dst=peer)
+            record["peers"] = peers
+            self.records.record(self.tunnel.tunnel_type, vni, record)
+        return added, removed
+
+    def existing_difference(self, vni: int, existing: Dict[str, Any], src_ip: str, dst_ip: str, bridge_name: str, dst_port: Optional[int], dev: Optional[str]) -> Optional[str]:
+        ifname = self.tunnel.interface_name(vni)
+        mismatches = self.attribute_mismatches(existing, {"id": self.tunnel.device_id(vni), "remote": dst_ip, "local": src_ip, "link": dev, "port": dst_port or getattr(self.tunnel, "DEFAULT_PORT", None)})
+        if mismatches:
+            details = ", ".join(f"{key} is {current} (requested {requested})" for key, (current, requested) in mismatches.items())
+            return f"{ifname} already exists with different attributes: {details}; pass --replace (or --force) to recreate it"
+        if getattr(self.tunnel, "bridgeable", True) and existing.get("master") != bridge_name:
+            return f"{ifname} already exists on {existing.get('master') or 'no bridge'}; pass --attach-only to move it to {bridge_name}"
+        return None
+
+    @staticmethod
+    def attribute_mismatches(existing: Dict[str, Any], expected: Dict[str, Any]) -> Dict[str, Any]:
+        return {key: (existing[key], value) for key, value in expected.items() if value is not None and key in existing and str(existing[key]) != str(value)}
+
+    def bridge_port(self, vni: int, record: Optional[Dict[str, Any]] = None) -> str:
+        record = record if record is not None else self.records.get(self.tunnel.tunnel_type, vni) if self.records else None
+        return record["macsec"]["ifname"] if record and record.get("macsec") else self.tunnel.interface_name(vni)
+
+    def check_port_flag_support(self, port_flags: Dict[str, str]) -> None:
+        # Only EVPN fills the bridge's neighbour entries for remote hosts, and EVPN carries VXLAN only
+        if port_flags.get("neigh_suppress") == "on" and (self.tunnel.tunnel_type != "vxlan" or not getattr(self.tunnel, "KERNEL_DEVICE", True)):
+            raise TunnelManagerError(f"ARP/ND suppression is for VXLAN devices in an EVPN fabric; {self.tunnel.tunnel_type if getattr(self.tunnel, 'KERNEL_DEVICE', True) else 'an OVS tunnel port'} is not one")
+
+    def set_port_flags(self, vni: int, port_flags: Dict[str, str]) -> None:
+        self.check_port_flag_support(port_flags)
+        record = self.records.get(self.tunnel.tunnel_type, vni) if self.records else None
+        BridgePort(self.tunnel.executor).set_flags(self.bridge_port(vni, record), port_flags)
+        if record:
+            record["port_flags"] = dict(record.get("port_flags", {}), **port_flags)
+            self.records.record(self.tunnel.tunnel_type, vni, record)
+
+    def set_mtu(self, vni: int, mtu: int, relock_routes: bool = False) -> None:
+        if not getattr(self.tunnel, "KERNEL_DEVICE", True):
+            raise TunnelManagerError("OVS tunnel ports have no MTU of their own; set the MTU of the OVS bridge instead")
+        TunnelMtu(self.tunnel.executor).set(self.tunnel.interface_name(vni), mtu)
+        record = self.records.get(self.tunnel.tunnel_type, vni) if self.records else None
+        if not record:
+            return
+        record["mtu"] = mtu
+        record.pop("mtu_auto", None)
+        locked = record.get("route_mtu")
+        # Routes locked to the old MTU keep clamping traffic to it until they are locked again
+        if record.get("routes") and locked and locked != mtu:
+            if relock_routes:
+                TunnelRoutes(self.tunnel.executor).lock(record["routes"], record["bridge_name"], mtu)
+                record["route_mtu"] = mtu
+                logger.info(f"Locked the routes via {record['bridge_name']} to mtu {mtu}.")
+            else:
+                logger.warning(f"Routes {', '.join(record['routes'])} via {record['bridge_name']} are still locked to mtu {locked}; pass --relock-routes to lock them to {mtu}.")
+        self.records.record(self.tunnel.tunnel_type, vni, record)
+
+    def add_fdb_entry(self, vni: int, mac: str, remote: str) -> None:
+        remote = self.resolver.resolve(remote)
+        if mac == FloodList.ALL_ZEROS_MAC:
+            peers = self.flood_peers(vni)
+            self.sync_peers(vni, peers + [remote] if remote not in peers else peers)
+            return
+        ifname = self.tunnel.interface_name(vni)
+        ForwardingTable(self.tunnel.executor).add(ifname, mac, remote)
+        record = self.records.get(self.tunnel.tunnel_type, vni) if self.records else None
+        if record:
+            # A MAC lives behind one VTEP, so an entry that moved replaces the tracked one
+            record["ancillary"] = [obj for obj in record.get("ancillary", []) if not (obj["kind"] == "fdb" and obj["mac"] == mac and obj["dev"] == ifname)]
+            TunnelRecords.track(record, "fdb", mac=mac, dev=ifname, dst=remote)
+            self.records.record(self.tunnel.tunnel_type, vni, record)
+
+    def remove_fdb_entry(self, vni: int, mac: str, remote: str) -> None:
+        remote = self.resolver.resolve(remote)
+        if mac == FloodList.ALL_ZEROS_MAC:
+            self.sync_peers(vni, [peer for peer in self.flood_peers(vni) if peer != remote])
+            return
+        ifname = self.tunnel.interface_name(vni)
+        ForwardingTable(self.tunnel.executor).remove(ifname, mac, remote)
+        record = self.records.get(self.tunnel.tunnel_type, vni) if self.records else None
+        if record:
+            TunnelRecords.untrack(record, "fdb", mac=mac, dev=ifname, dst=remote)
+            self.records.record(self.tunnel.tunnel_type, vni, record)
+
+    def fdb_entries(self, vni: int) -> List[Dict[str, Any]]:
+        return ForwardingTable(self.tunnel.executor).entries(self.tunnel.interface_name(vni))
+
+    def neigh_dev(self, vni: int, record: Optional[Dict[str, Any]]) -> str:
+        # Hosts behind the tunnel are neighbours of the bridge, which is also where ARP/ND suppression looks them up
+        if not getattr(self.tunnel, "bridgeable", True):
+            raise TunnelManagerError(f"{self.tunnel.interface_name(vni)} is a layer 3 tunnel and has no neighbours")
+        bridge_name = record["bridge_name"] if record else (self.tunnel.link_attributes(vni) or {}).get("master")
+        if not bridge_name:
+            raise TunnelManagerError(f"{self.tunnel.interface_name(vni)} is not on a bridge")
+        return bridge_name
+
+    def add_neigh_entry(self, vni: int, address: str, mac: str) -> None:
+        record = self.records.get(self.tunnel.tunnel_type, vni) if self.records else None
+        dev = self.neigh_dev(vni, record)
+        NeighborTable(self.tunnel.executor).add(dev, address, mac)
+        if record:
+            # An address has one MAC, so an entry that moved replaces the tracked one
+            record["ancillary"] = [obj for obj in record.get("ancillary", []) if not (obj["kind"] == "neigh" and obj["address"] == address and obj["dev"] == dev)]
+            TunnelRecords.track(record, "neigh", address=address, mac=mac, dev=dev)
+            self.records.record(self.tunnel.tunnel_type, vni, record)
+
+    def remove_neigh_entry(self, vni: int, address: str) -> None:
+        record = self.records.get(self.tunnel.tunnel_type, vni) if self.records else None
+        dev = self.neigh_dev(vni, record)
+        NeighborTable(self.tunnel.executor).remove(dev, address)
+        if record:
+            record["ancillary"] = [obj for obj in record.get("ancillary", []) if not (obj["kind"] == "neigh" and obj["address"] == address and obj["dev"] == dev)]
+            self.records.record(self.tunnel.tunnel_type, vni, record)
+
+    def neigh_entries(self, vni: int) -> List[Dict[str, Any]]:
+        record = self.records.get(self.tunnel.tunnel_type, vni) if self.records else None
+        dev = self.neigh_dev(vni, record)
+        tracked = {obj["address"] for obj in (record or {}).get("ancillary", []) if obj["kind"] == "neigh" and obj["dev"] == dev}
+        return [dict(entry, managed="yes" if entry["address"] in tracked else "no") for entry in NeighborTable(self.tunnel.executor).entries(dev)]
+
+    def port_flags(self, vni: int) -> Dict[str, str]:
+        return BridgePort(self.tunnel.executor).flags(self.bridge_port(vni))
+
+    def check_port_flags(self, vni: int) -> None:
+        record = self.records.get(self.tunnel.tunnel_type, vni) if self.records else None
+        recorded = record.get("port_flags", {}) if record else {}
+        if not recorded:
+            return
+        actual = self.port_flags(vni)
+        drifted = {flag: (value, actual.get(flag)) for flag, value in recorded.items() if actual.get(flag) != value}
+        if drifted:
+            details = ", ".join(f"{flag} is {current} (expected {expected})" for flag, (expected, current) in drifted.items())
+            raise TunnelManagerError(f"Bridge port {self.bridge_port(vni, record)} drifted from its recorded settings: {details}")
+
+    def enable_flow_sampling(self, vni: int, collector: str, port: Optional[int] = None, rate: int = 1024, protocol: str = "sflow", group: int = FlowSampler.DEFAULT_GROUP, check_collector: bool = False) -> Dict[str, Any]:
+        record = self.records.get(self.tunnel.tunnel_type, vni) if self.records else None
+        if not record:
+            raise TunnelManagerError(f"No recorded {self.tunnel.tunnel_type} tunnel with VNI {vni}")
+        if record.get("flowsample"):
+            raise TunnelManagerError(f"Flow sampling is already enabled on VNI {vni}; disable it first")
+        sampler = FlowSampler(self.tunnel.executor)
+        ifname = self.tunnel.interface_name(vni)
+        method = "ovs" if sampler.is_ovs_bridge(record["bridge_name"]) else "tc"
+        if method == "tc" and protocol != "sflow":
+            raise TunnelManagerError(f"{protocol} export needs an OVS bridge; on kernel bridge {record['bridge_name']} only sFlow through psample is supported")
+        collector_ip = self.resolver.resolve(collector)
+        if check_collector:
+            sampler.check_collector(collector_ip)
+        settings = {"method": method, "protocol": protocol, "collector": collector_ip, "port": port or FlowSampler.DEFAULT_PORTS[protocol], "rate": rate}
+        if method == "tc":
+            settings["group"] = group
+        # OVS samples the whole bridge, so tunnels on it share one sampler and must agree on its settings
+        sharing = self.bridge_sampling(record["bridge_name"], protocol) if method == "ovs" else None
+        if sharing:
+            other, existing = sharing
+            if any(existing[key] != settings[key] for key in ("collector", "port", "rate")):
+                raise TunnelManagerError(f"{protocol} sampling on OVS bridge {record['bridge_name']} is already set up for VNI {other} with collector {FlowSampler.target(existing['collector'], existing['port'])} and rate {existing['rate']}; use the same settings or disable it there first")
+            objects = existing["objects"]
+        else:
+            objects = sampler.enable(ifname, record["bridge_name"], settings, record.get("dev"))
+        if method == "tc":
+            # tc only hands samples to psample; an sFlow agent such as hsflowd exports them
+            logger.info(f"Sampling {ifname} into psample group {group}; point hsflowd at collector {FlowSampler.target(collector_ip, settings['port'])}.")
+        for obj in objects:
+            TunnelRecords.track(record, **obj)
+        record["flowsample"] = dict(settings, objects=objects)
+        self.records.record(self.tunnel.tunnel_type, vni, record)
+        return record["flowsample"]
+
+    def disable_flow_sampling(self, vni: int) -> List[Dict[str, str]]:
+        record = self.records.get(self.tunnel.tunnel_type, vni) if self.records else None
+        if not record or not record.get("flowsample"):
+            raise TunnelManagerError(f"Flow sampling is not enabled on {self.tunnel.tunnel_type} VNI {vni}")
+        report = []
+        for obj in record["flowsample"]["objects"]:
+            report.append(self.remove_ancillary(obj))
+            TunnelRecords.untrack(record, **obj)
+        del record["flowsample"]
+        self.records.record(self.tunnel.tunnel_type, vni, record)
+        return report
+
+    def bridge_sampling(self, bridge_name: str, protocol: str) -> Optional[Tuple[int, Dict[str, Any]]]:
+        for record in self.records.store.load().get("tunnels", {}).values():
+            settings = record.get("flowsample")
+            if settings and settings["method"] == "ovs" and settings["protocol"] == protocol and record["bridge_name"] == bridge_name:
+                return record["vni"], settings
+        return None
+
+    def flow_sampling(self) -> List[Dict[str, Any]]:
+        tunnels = self.records.store.load().get("tunnels", {}).values() if self.records else []
+        sampler = FlowSampler(self.tunnel.executor)
+        rows = []
+        for record in tunnels:
+            if settings := record.get("flowsample"):
+                ifname = record.get("ifname") or TunnelFactory.create_tunnel(TunnelType(record["tunnel_type"])).interface_name(record["vni"])
+                rows.append({"tunnel_type": record["tunnel_type"], "vni": record["vni"], "ifname": ifname, "method": settings["method"], "protocol": settings["protocol"], "collector": FlowSampler.target(settings["collector"], settings["port"]), "rate": settings["rate"], "status": "active" if sampler.active(ifname, record["bridge_name"], settings) else "missing"})
+        return rows
+
+    def remove_ancillary(self, obj: Dict[str, Any]) -> Dict[str, str]:
+        kind = ANCILLARY_KINDS[obj["kind"]]
+        if kind.shared and self.records and self.records.trackers(**obj) > 1:
+            return {"object": kind.describe(obj), "result": "kept (shared with another tunnel)"}
+        if kind.users:
+            users = self.tunnel.executor.run(kind.users(obj), check=False)
+            if users.returncode == 0 and users.stdout.strip() not in ("", "[]"):
+                return {"object": kind.describe(obj), "result": "kept (in use)"}
+        # Cleanup carries on past a failed delete, but only a missing object counts as done
+        result = self.tunnel.executor.run(kind.delete(obj), check=False)
+        if result.returncode == 0:
+            return {"object": kind.describe(obj), "result": "removed"}
+        error = (result.stderr or "").strip()
+        if any(marker in error for marker in self.GONE_MARKERS):
+            return {"object": kind.describe(obj), "result": "already gone"}
+        logger.warning(f"Error removing {kind.describe(obj)}: {error or f'exit status {result.returncode}'}")
+        return {"object": kind.describe(obj), "result": f"failed: {error.splitlines()[-1] if error else f'exit status {result.returncode}'}"}
+
+    def remove_ancillaries(self, vni: int, before_link: bool) -> List[Dict[str, str]]:
+        record = self.records.get(self.tunnel.tunnel_type, vni) if self.records else None
+        ancillary = sorted(record.get("ancillary", []) if record else [], key=lambda obj: ANCILLARY_KINDS[obj["kind"]].order)
+        return [self.remove_ancillary(obj) for obj in ancillary if (ANCILLARY_KINDS[obj["kind"]].order < LINK_ORDER) == before_link]
+
+    def cleanup_records(self, vni: int, bridge_name: str) -> List[Dict[str, str]]:
+        report = self.remove_ancillaries(vni, before_link=False)
+        record = self.records.get(self.tunnel.tunnel_type, vni) if self.records else None
+        if self.records:
+            self.records.remove(self.tunnel.tunnel_type, vni)
+        if self.audit:
+            self.audit.record("cleanup", tunnel_type=self.tunnel.tunnel_type, vni=vni, record=record or {"bridge_name": bridge_name})
+        return report
+
+    @journaled("cleanup")
+    def cleanup(self, vni: int, bridge_name: str) -> List[Dict[str, str]]:
+        record = self.records.get(self.tunnel.tunnel_type, vni) if self.records else None
+        report = []
+        if record and record.get("frr_asn"):
+            # The VNI is withdrawn from BGP before its device goes
+            try:
+                FrrEvpnSync(record["frr_asn"], self.tunnel.executor).remove(vni)
+                report.append({"object": f"FRR EVPN vni {vni} (router bgp {record['frr_asn']})", "result": "removed"})
+            except TunnelManagerError as e:
+                logger.warning(f"{e}; run frr sync once FRR is back")
+                report.append({"object": f"FRR EVPN vni {vni} (router bgp {record['frr_asn']})", "result": "failed"})
+        report += self.remove_ancillaries(vni, before_link=True)
+        self.tunnel.cleanup_tunnel_interface(vni, bridge_name)
+        return report + self.cleanup_records(vni, bridge_name)
+
+    def bridge_exists(self, bridge_name: str) -> bool:
+        return self.tunnel.bridges().exists(bridge_name)
+
+    def ensure_bridge(self, bridge_name: str, mtu: Optional[int] = None, stp: Optional[bool] = None, forward_delay: Optional[int] = None) -> bool:
+        return self.tunnel.bridges().create(bridge_name, mtu, stp, forward_delay)
+
+    def repair_attachment(self, vni: int, bridge_name: Optional[str] = None, create_bridge: bool = False) -> str:
+        record = self.records.get(self.tunnel.tunnel_type, vni) if self.records else None
+        bridge_name = bridge_name or (record or {}).get("bridge_name")
+        if not bridge_name:
+            raise TunnelManagerError(f"No bridge recorded for VNI {vni}; pass --bridge-name")
+        ifname = self.bridge_port(vni, record)
+        attributes = self.tunnel.link_attributes(vni)
+        if attributes is not None and record and record.get("macsec"):
+            # Re-attaching the tunnel itself would bypass MACsec, so the MACsec device is what gets attached
+            attributes = TunnelMacsec(self.tunnel.executor).link(ifname)
+        if attributes is None:
+            return "missing"
+        if attributes.get("master") == bridge_name:
+            return "attached"
+        outcome = "reattached"
+        if not self.bridge_exists(bridge_name):
+            if not create_bridge:
+                logger.warning(f"{ifname} is degraded: bridge {bridge_name} does not exist.")
+                if record:
+                    self.records.record(self.tunnel.tunnel_type, vni, dict(record, status="degraded"))
+                return "degraded"
+            self.ensure_bridge(bridge_name)
+            outcome = "bridge created"
+        if ifname != self.tunnel.interface_name(vni):
+            self.tunnel.bridges().add_port(bridge_name, ifname)
+        else:
+            self.tunnel.attach_tunnel_interface(vni, bridge_name)
+        BridgePort(self.tunnel.executor).set_flags(ifname, (record or {}).get("port_flags", {}))
+        if record and record.get("vlan") is not None:
+            # A port joins the bridge in VLAN 1 only, so the mapping is restored with it
+            BridgeVlans(self.tunnel.executor).enable_filtering(bridge_name)
+            BridgeVlans(self.tunnel.executor).map_port(ifname, record["vlan"])
+        if record:
+            record.pop("status", None)
+            self.records.record(self.tunnel.tunnel_type, vni, record)
+        logger.info(f"Re-attached {ifname} to {bridge_name}" + (" after creating the bridge." if outcome == "bridge created" else "."))
+        return outcome
+
+    def check_dns_drift(self, vni: int) -> List[str]:
+        record = self.records.get(self.tunnel.tunnel_type, vni) if self.records else None
+        if not record:
+            return []
+        drifted = []
+        for role in ("src", "dst"):
+            name, recorded_ip = record.get(f"{role}_name"), record.get(f"{role}_host")
+            if name and not self.resolver.is_literal(name) and (current_ip := self.resolver.resolve(name)) != recorded_ip:
+                logger.warning(f"DNS for {name} moved from {recorded_ip} to {current_ip} since VNI {vni} was created; recreate the tunnel to follow it.")
+                drifted.append(name)
+        return drifted
+
+    def check_routes(self, vni: int) -> None:
+        record = self.records.get(self.tunnel.tunnel_type, vni) if self.records else None
+        if record and record.get("routes"):
+            TunnelRoutes(self.tunnel.executor).check(record["routes"], record["bridge_name"], record.get("route_mtu"))
+
+    def check_link(self, vni: int) -> None:
+        record = self.records.get(self.tunnel.tunnel_type, vni) if self.records else None
+        if not record:
+            return
+        attributes = self.tunnel.link_attributes(vni)
+        if attributes is None:
+            raise TunnelManagerError(f"{self.tunnel.interface_name(vni)} is recorded but does not exist")
+        if record.get("macsec"):
+            attributes = TunnelMacsec(self.tunnel.executor).link(record["macsec"]["ifname"])
+            if attributes is None:
+                raise TunnelManagerError(f"MACsec device {record['macsec']['ifname']} of {self.tunnel.interface_name(vni)} does not exist; recreate the tunnel")
+        for step in UnderlayVlan(self.tunnel.executor).plan(record["dev_vlan"]) if record.get("dev_vlan") else []:
+            if UnderlayVlan(self.tunnel.executor).link(step["name"]) is None:
+                raise TunnelManagerError(f"Underlay VLAN device {step['name']} of {self.tunnel.interface_name(vni)} does not exist; recreate the tunnel")
+        if record.get("vrf"):
+            port = record["bridge_name"] if getattr(self.tunnel, "bridgeable", True) else self.tunnel.interface_name(vni)
+            master = (VrfBinding(self.tunnel.executor).link(port) or {}).get("master")
+            if master != record["vrf"]:
+                raise TunnelManagerError(f"{port} is in {'VRF ' + master if master else 'no VRF'} (expected VRF {record['vrf']}); run ip link set master {record['vrf']} {port}")
+        if attributes.get("master") != record["bridge_name"]:
+            raise TunnelManagerError(f"{self.bridge_port(vni, record)} is attached to {attributes.get('master') or 'no bridge'} (expected {record['bridge_name']}); run repair --vni {vni}")
+        if record.get("vlan") is not None and record["vlan"] not in BridgeVlans(self.tunnel.executor).port_vlans(self.bridge_port(vni, record)):
+            raise TunnelManagerError(f"{self.bridge_port(vni, record)} is not a member of VLAN {record['vlan']}; run repair --vni {vni}")
+
+    def check_state(self, vni: int) -> None:
+        self.check_link(vni)
+        self.check_dns_drift(vni)
+        self.check_port_flags(vni)
+        self.check_routes(vni)
+
+    def validate(self, src_host: str, dst_host: str, vni: int, port: Optional[int] = None, timeout: int = 3, max_retries: int = 3) -> None:
+        self.check_state(vni)
+        self.tunnel.validate_connectivity(self.resolver.resolve(src_host), self.resolver.resolve(dst_host), vni, port, timeout, max_retries)
+
+    def inspect(self, vni: int, bridge_name: Optional[str] = None, src_host: Optional[str] = None, dst_host: Optional[str] = None, dst_port: Optional[int] = None, vxlan_flags: Optional[Dict[str, bool]] = None) -> List[Dict[str, Any]]:
+        # One row per check; expectations not given on the command line come from the recorded tunnel
+        record = (self.records.get(self.tunnel.tunnel_type, vni) if self.records else None) or {}
+        ifname = self.tunnel.interface_name(vni)
+        configured = getattr(self.tunnel, "ATTRIBUTES", ())
+        expected = [
+            ("bridge", "master", bridge_name or record.get("bridge_name")),
+            ("remote", "remote", self.resolver.resolve(dst_host) if dst_host else record.get("dst_host")),
+            ("local", "local", (self.resolver.resolve(src_host) if src_host else record.get("src_host")) if "local" in configured else None),
+            ("dstport", "port", (dst_port or record.get("dst_port") or getattr(self.tunnel, "DEFAULT_PORT", None)) if "port" in configured else None),
+        ]
+        wanted_flags = vxlan_flags or record.get("vxlan_flags")
+        link = self.tunnel.link(vni)
+        checks = [{"check": "exists", "status": "ok" if link else "drift", "expected": ifname, "actual": ifname if link else "missing"}]
+        if link is None:
+            return checks + [{"check": name, "status": "skipped", "expected": "", "actual": ""} for name in ["up"] + [name for name, _, _ in expected] + (["flags"] if wanted_flags else [])]
+        attributes = self.tunnel.parse_link_attributes(link)
+        up = "UP" in link.get("flags", [])
+        checks.append({"check": "up", "status": "ok" if up else "drift", "expected": "UP", "actual": "UP" if up else "DOWN"})
+        for name, key, wanted in expected:
+            actual = attributes.get(key)
+            if wanted is None:
+                checks.append({"check": name, "status": "skipped", "expected": "", "actual": "" if actual is None else str(actual)})
+            else:
+                checks.append({"check": name, "status": "ok" if str(actual) == str(wanted) else "drift", "expected": str(wanted), "actual": "none" if actual is None else str(actual)})
+        info_data = TunnelInterface.info_data(link)
+        # Unrequested flags are shown only when they differ from the kernel defaults
+        if any(flag in info_data for flag in VXLANTunnel.FLAGS) and (wanted_flags or VXLANTunnel.flag_words(VXLANTunnel.link_flags(info_data))):
+            actual_flags = VXLANTunnel.link_flags(info_data)
+            status = "skipped" if not wanted_flags else "ok" if all(actual_flags[flag] == value for flag, value in wanted_flags.items()) else "drift"
+            checks.append({"check": "flags", "status": status, "expected": ",".join(VXLANTunnel.flag_words(wanted_flags or {})) or ("default" if wanted_flags else ""), "actual": ",".join(VXLANTunnel.flag_words(actual_flags)) or "default"})
+        return checks
+
+    def describe(self, vni: int) -> Dict[str, Any]:
+        ifname = self.tunnel.interface_name(vni)
+        record = (self.records.get(self.tunnel.tunnel_type, vni) if self.records else None) or {}
+        link = self.tunnel.link(vni)
+        checks = self.inspect(vni)
+        detail: Dict[str, Any] = {"ifname": ifname, "type": self.tunnel.tunnel_type, "vni": vni, "managed": bool(self.records and self.records.is_managed(self.tunnel.tunnel_type, vni, ifname)), "status": "missing" if link is None else "drift" if any(check["status"] == "drift" for check in checks) else "ok"}
+        detail["kernel"] = dict(TunnelInterface.info_data(link), mtu=link.get("mtu"), state=link.get("operstate"), address=link.get("address")) if link else {}
+        detail["bridge"] = {"name": link.get("master"), "port_flags": {}} if link else {}
+        detail["fdb"], detail["statistics"] = [], {}
+        # OVS ports have no bridge port flags, forwarding entries or kernel counters of their own
+        if link and getattr(self.tunnel, "KERNEL_DEVICE", True):
+            if link.get("master"):
+                detail["bridge"]["port_flags"] = BridgePort(self.tunnel.executor).flags(ifname)
+            detail["fdb"] = ForwardingTable(self.tunnel.executor).entries(ifname)
+            try:
+                stats = json.loads(self.tunnel.executor.run(["ip", "-s", "-j", "link", "show", "dev", ifname]).stdout or "[{}]")[0]
+                stats = stats.get("stats64", stats.get("stats", {}))
+            except (subprocess.CalledProcessError, json.JSONDecodeError, IndexError) as e:
+                raise TunnelManagerError(f"Error reading statistics of {ifname}") from e
+            detail["statistics"] = {f"{direction}_{counter}": stats.get(direction, {}).get(counter, 0) for direction in ("rx", "tx") for counter in ("bytes", "packets", "errors", "dropped")}
+        # Recorded routes as the kernel has them, with the MTU they are locked to
+        detail["routes"] = [route for route in TunnelRoutes(self.tunnel.executor).routes(record["bridge_name"]) if route["dst"] in record["routes"]] if record.get("routes") else []
+        detail["record"] = {key: value for key, value in record.items() if key != "ancillary"}
+        detail["ancillary"] = [{"kind": obj["kind"], "object": ANCILLARY_KINDS[obj["kind"]].describe(obj)} for obj in record.get("ancillary", [])]
+        detail["checks"] = checks
+        return detail
+
+    @staticmethod
+    def format_description(detail: Dict[str, Any]) -> str:
+        table = OutputFormatterFactory.get_formatter(OutputFormatType.TABLE)
+        header = f"{detail['ifname']}: {detail['type']} VNI {detail['vni']}, {'managed' if detail['managed'] else 'not managed'}, {detail['status']}"
+        sections = [
+            ("Kernel parameters", [{"parameter": key, "value": str(value)} for key, value in detail["kernel"].items() if value is not None]),
+            ("Bridge", [{"bridge": detail["bridge"]["name"] or "none", **detail["bridge"]["port_flags"]}] if detail["bridge"] else []),
+            ("Forwarding entries", detail["fdb"]),
+            ("Statistics", [{"counter": key, "value": str(value)} for key, value in detail["statistics"].items()]),
+            ("Routes", [{"route": route["dst"], "dev": route["dev"], "mtu": str(route["mtu"] or ""), "locked": "yes" if route["mtu_locked"] else "no"} for route in detail["routes"]]),
+            ("Record", [{"field": key, "value": json.dumps(value) if isinstance(value, (dict, list)) else str(value)} for key, value in detail["record"].items()]),
+            ("Ancillary objects", detail["ancillary"]),
+            ("Checks", detail["checks"]),
+        ]
+        return header + "\n" + "".join(f"\n{title}:\n" + (table.format(rows).rstrip("\n") if rows else "  none") + "\n" for title, rows in sections)
+
+    def check_rp_filter(self, dev: str, remote: str, fix: bool = False, persist: bool = False, files: Optional[FileWriter] = None) -> Dict[str, Any]:
+        rp_filter = RpFilter(self.tunnel.executor, files=files)
+        result = rp_filter.check(dev, remote)
+        if result["status"] != "at risk":
+            return result
+        if not fix:
+            logger.warning(f"{result['message']}; pass --fix-rpfilter to set it to loose.")
+            return result
+        path = rp_filter.fix(dev, persist)
+        logger.info(f"Set rp_filter on {dev} to loose" + (f" and persisted it in {path}." if path else " (not persisted; pass --persist to keep it across reboots)."))
+        return dict(result, status="fixed", effective="loose", **({"persisted": path} if path else {}))
+
+    def list(self, kernel_group: Optional[int] = None) -> List[Dict[str, Any]]:
+        data = self.tunnel.collect_tunnel_data()
+        # A GRE tunnel created with its own key reports that key as its id; its record maps it back to the VNI
+        keyed = {record.get("ifname") or self.tunnel.interface_name(record["vni"]): record["vni"] for record in (self.records.tunnels() if self.records else []) if record["tunnel_type"] == self.tunnel.tunnel_type and "ikey" in (record.get("gre_options") or {})}
+        for item in data:
+            if item["ifname"] in keyed:
+                item["vni"] = str(keyed[item["ifname"]])
+        if kernel_group is None:
+            return data
+        members = LinkGroup(self.tunnel.executor).members(kernel_group)
+        return [item for item in data if item.get("ifname") in members]
+
+    def list_text(self, kernel_group: Optional[int] = None) -> str:
+        return self.tunnel.executor.run(["ip", "-d", "link", "show"] + (["group", str(kernel_group)] if kernel_group is not None else []) + ["type", self.tunnel.tunnel_type]).stdout or ""
+
+    def managed_interfaces(self) -> List[str]:
+        tunnels = self.records.store.load().get("tunnels", {}).values() if self.records else []
+        return [record.get("ifname") or TunnelFactory.create_tunnel(TunnelType(record["tunnel_type"])).interface_name(record["vni"]) for record in tunnels]
+
+    def adopt(self, vnis: Optional[List[int]] = None, record: bool = True) -> List[Dict[str, Any]]:
+        # Existing links are recorded as they are, so they come under management without being recreated
+        kernel_device = getattr(self.tunnel, "KERNEL_DEVICE", True)
+        adopted = []
+        for item in self.list():
+            vni, ifname = int(item["vni"]), item["ifname"]
+            if vnis and vni not in vnis:
+                continue
+            row = {"ifname": ifname, "vni": vni, "bridge_name": item["master"]}
+            if self.records and self.records.get(self.tunnel.tunnel_type, vni):
+                adopted.append(dict(row, result="already managed"))
+                continue
+            if not item["master"]:
+                adopted.append(dict(row, result="skipped (not on a bridge)"))
+                continue
+            peers = FloodList(self.tunnel.executor).peers(ifname, item["dst_host"]) if kernel_device and self.tunnel.tunnel_type == "vxlan" else []
+            # Only flags turned off differ from what a new bridge port gets
+            port_flags = {flag: value for flag, value in BridgePort(self.tunnel.executor).flags(ifname).items() if value != BridgePort.DEFAULTS[flag]} if kernel_device else {}
+            attributes = {"src_host": item["src_host"], "dst_host": item["dst_host"], "src_name": item["src_host"], "dst_name": item["dst_host"], "bridge_name": item["master"], "src_port": None, "dst_port": int(item["dst_port"]) if item.get("dst_port") else None, "dev": item.get("dev") or None, "port_flags": port_flags, "peers": peers, "peers_from_dns": None, "peers_ttl": None, "routes": [], "route_mtu": None, "link_group": None, "ifname": ifname, "imported": True}
+            for peer in attributes["peers"]:
+                TunnelRecords.track(attributes, "fdb", mac=FloodList.ALL_ZEROS_MAC, dev=ifname, dst=peer)
+            if record and self.records:
+                self.records.record(self.tunnel.tunnel_type, vni, attributes)
+                if self.audit:
+                    self.audit.record("import", tunnel_type=self.tunnel.tunnel_type, vni=vni, record=attributes)
+            adopted.append(dict(row, result="imported", attributes=attributes))
+        return adopted
+
+    def on_bridge(self, bridge_name: str) -> List[Dict[str, Any]]:
+        return [item for item in self.list() if item["master"] == bridge_name]
+
+    def orphans(self) -> List[Dict[str, Any]]:
+        return [item for item in self.list() if not (self.records and self.records.is_managed(self.tunnel.tunnel_type, int(item["vni"]), item["ifname"]))]
+
+    def remove_orphan(self, item: Dict[str, Any]) -> Dict[str, Any]:
+        # Deleted by name: an orphan may reuse the VNI of a recorded tunnel, whose record must stay
+        self.tunnel.executor.run(["ip", "link", "del", item["ifname"]])
+        if self.audit:
+            self.audit.record("prune", tunnel_type=self.tunnel.tunnel_type, vni=int(item["vni"]), record={"ifname": item["ifname"], "bridge_name": item["master"], "src_host": item["src_host"], "dst_host": item["dst_host"]})
+        return {"ifname": item["ifname"], "tunnel_type": self.tunnel.tunnel_type, "vni": item["vni"], "result": "removed"}
+
+    def move_to_group(self, group: int) -> List[Dict[str, Any]]:
+        link_group = LinkGroup(self.tunnel.executor)
+        state = self.records.store.load() if self.records else {}
+        moved = []
+        for record in state.get("tunnels", {}).values():
+            ifname = record.get("ifname") or TunnelFactory.create_tunnel(TunnelType(record["tunnel_type"])).interface_name(record["vni"])
+            link_group.assign(ifname, group)
+            moved.append({"ifname": ifname, "previous": record.get("link_group"), "group": group})
+            record["link_group"] = group
+        if self.records:
+            self.records.store.save(state)
+        return moved
+
+    def execute_action(self, action: str, **kwargs: Any) -> Any:
+        if method := getattr(self, action):
+            return method(**kwargs)
+        raise ValueError(f"No method available for action: {action}")
+
+
+class OperationHistory:
+    MUTATIONS = ("create", "cleanup", "apply")
+    INVERSE = {"create": "cleanup", "cleanup": "create", "apply": "apply"}
+    # Record fields a peer update changes; a change elsewhere needs the tunnel recreated
+    PEER_FIELDS = ("peers", "ancillary", "updated_at")
+
+    def __init__(self, audit: AuditLog, manager_factory: Callable[[str], TunnelManager]) -> None:
+        self.audit = audit
+        # Builds a manager for a tunnel type without its own audit log, undo records a single entry itself
+        self.manager_factory = manager_factory
+
+    def mutations(self) -> List[Dict[str, Any]]:
+        return [dict(entry, id=index) for index, entry in enumerate(self.audit.entries(), start=1) if entry.get("action") in self.MUTATIONS]
+
+    def target(self, entry_id: Optional[int] = None) -> Dict[str, Any]:
+        mutations = self.mutations()
+        candidates = [entry for entry in mutations if entry_id is None or entry["id"] == entry_id]
+        if not candidates:
+            raise TunnelManagerError("No operation to undo" if entry_id is None else f"No create, cleanup or apply operation with id {entry_id}")
+        return candidates[-1]
+
+    @staticmethod
+    def record_apply(audit: AuditLog, manifest: str, before: Dict[str, Any], after: Dict[str, Any]) -> None:
+        # One entry for the whole transaction, holding the records of every tunnel it changed as they were before and after
+        changes = [{"tunnel_type": (before.get(key) or after[key])["tunnel_type"], "vni": (before.get(key) or after[key])["vni"], "before": before.get(key), "after": after.get(key)} for key in sorted(set(before) | set(after)) if before.get(key) != after.get(key)]
+        if changes:
+            audit.record("apply", manifest=manifest, changes=changes)
+
+    @staticmethod
+    def touched(entry: Dict[str, Any]) -> Set[Tuple[str, int]]:
+        if entry["action"] == "apply":
+            return {(change["tunnel_type"], change["vni"]) for change in entry["changes"]}
+        return {(entry["tunnel_type"], entry["vni"])}
+
+    def conflicts(self, target: Dict[str, Any]) -> List[Dict[str, Any]]:
+        return [entry for entry in self.mutations() if entry["id"] > target["id"] and self.touched(entry) & self.touched(target)]
+
+    @staticmethod
+    def describe(entry: Dict[str, Any]) -> str:
+        subject = f"{len(entry['changes'])} tunnel(s) from {entry['manifest']}" if entry["action"] == "apply" else f"{entry['tunnel_type']} VNI {entry['vni']}"
+        return f"#{entry['id']} {entry['action']} of {subject} at {entry['time']}" + (f" (undo of #{entry['undo_of']})" if entry.get("undo_of") else "")
+
+    def undo(self, target: Dict[str, Any]) -> str:
+        if conflicts := self.conflicts(target):
+            raise TunnelManagerError(f"Cannot undo {self.describe(target)}; later operations touched the same tunnel: " + "; ".join(self.describe(entry) for entry in conflicts))
+
+        if target["action"] == "apply":
+            # The inverse diff: every change is reverted, last first, and recorded as an apply going the other way
+            for change in reversed(target["changes"]):
+                self.revert(change)
+            self.audit.record("apply", manifest=target["manifest"], changes=[dict(change, before=change["after"], after=change["before"]) for change in target["changes"]], undo_of=target["id"])
+            return f"Undid {self.describe(target)} by applying its inverse."
+
+        manager = self.manager_factory(target["tunnel_type"])
+        record, vni = target["record"], target["vni"]
+        inverse = self.INVERSE[target["action"]]
+        if inverse == "cleanup":
+            manager.cleanup(vni, record["bridge_name"])
+        else:
+            self.recreate(manager, target["tunnel_type"], vni, record)
+        self.audit.record(inverse, tunnel_type=target["tunnel_type"], vni=vni, record=record, undo_of=target["id"])
+        return f"Undid {self.describe(target)} by running {inverse}."
+
+    def revert(self, change: Dict[str, Any]) -> None:
+        manager = self.manager_factory(change["tunnel_type"])
+        before, after, vni = change["before"], change["after"], change["vni"]
+        if before is None:
+            manager.cleanup(vni, after["bridge_name"])
+            return
+        if after is not None:
+            if {key: value for key, value in before.items() if key not in self.PEER_FIELDS} == {key: value for key, value in after.items() if key not in self.PEER_FIELDS}:
+                manager.sync_peers(vni, before.get("peers") or [], before["dst_host"])
+                manager.records.record(change["tunnel_type"], vni, before)
+                return
+            manager.cleanup(vni, after["bridge_name"])
+        self.recreate(manager, change["tunnel_type"], vni, before)
+        # Puts back the record as it was, creation time and ancillary objects included
+        manager.records.record(change["tunnel_type"], vni, before)
+
+    @staticmethod
+    def recreate(manager: TunnelManager, tunnel_type: str, vni: int, record: Dict[str, Any]) -> None:
+        if "dst_host" not in record:
+            raise TunnelManagerError(f"Cannot recreate {tunnel_type} VNI {vni}: its attributes were not recorded when it was cleaned up")
+        manager.create(TunnelSpec.from_record(vni, record))
+
+
+class CommandValidator(Protocol):
+    def check_command_existence(self, command: str) -> bool:
+        ...
+
+    def check_bridge_tool_existence(self, bridge_tool: str) -> None:
+        ...
+
+
+class SystemCommandValidator(CommandValidator):
+    def check_command_existence(self, command: str) -> bool:
+        return shutil.which(command) is not None
+
+    def check_bridge_tool_existence(self, bridge_tool: str) -> None:
+        if not self.check_command_existence(bridge_tool):
+            raise RuntimeError(f"Error: The bridge tool '{bridge_tool}' is not found. Please install it.")
+
+
+# Encapsulation overhead in bytes on an IPv4 underlay
+ENCAP_OVERHEAD = {"vxlan": 50, "geneve": 50, "gretap": 42, "gre": 28}
+
+COUNTER_FIELDS = ["rx_bytes", "rx_packets", "rx_errors", "rx_dropped", "tx_bytes", "tx_packets", "tx_errors", "tx_dropped"]
+
+# nstat counters of ICMPv6 "packet too big", which is sent for nothing but path MTU feedback
+ICMP_FRAG_NEEDED_COUNTERS = ["Icmp6InPktTooBigs"]
+# IPv4 counts "fragmentation needed" only as one code of Destination Unreachable, together with unreachable hosts and ports
+ICMP_UNREACHABLE_COUNTERS = ["IcmpMsgInType3"]
+
+
+class CounterSnapshotCollector:
+    def __init__(self, tunnel_type: str, executor: Optional[CommandExecutor] = None) -> None:
+        self.tunnel_type = tunnel_type
+        self.executor = executor or SubprocessExecutor()
+        self.kernel_warned = False
+
+    def collect(self) -> Dict[str, Any]:
+        return {"interfaces": self.collect_interfaces(), "kernel": self.collect_kernel_counters()}
+
+    def collect_interfaces(self) -> Dict[str, Any]:
+        try:
+            result = self.executor.run(["ip", "-s", "-d", "-j", "link", "show"])
+            links = json.loads(result.stdout or "[]")
+        except (subprocess.CalledProcessError, json.JSONDecodeError, TypeError) as e:
+            raise TunnelManagerError(f"Error collecting link counters: {e}") from e
+
+        interfaces = {}
+        for link in links:
+            linkinfo = link.get("linkinfo", {})
+            info_data = TunnelInterface.info_data(link)
+            stats = link.get("stats64", link.get("stats", {}))
+            counters = {field: int(stats.get(field.split("_")[0], {}).get(field.split("_")[1], 0)) for field in COUNTER_FIELDS}
+            interfaces[link["ifname"]] = {"kind": linkinfo.get("info_kind", ""), "vni": info_data.get("id"), "link": info_data.get("link"), "remote": info_data.get("remote", ""), "mtu": link.get("mtu", 0), "counters": counters}
+        return interfaces
+
+    def collect_kernel_counters(self) -> Dict[str, int]:
+        try:
+            result = self.executor.run(["nstat", "-asz", "--json"])
+            kernel = json.loads(result.stdout or "{}").get("kernel", {})
+        except (subprocess.CalledProcessError, json.JSONDecodeError, FileNotFoundError, TypeError, AttributeError) as e:
+            # The agent collects every cycle, so a missing nstat is reported once
+            if not self.kernel_warned:
+                logger.warning(f"Kernel counters are unavailable, ICMP based heuristics are disabled: {e}")
+                self.kernel_warned = True
+            return {}
+        return {name: int(kernel.get(name, 0)) for name in ICMP_FRAG_NEEDED_COUNTERS + ICMP_UNREACHABLE_COUNTERS}
+
+    def tunnel_counters(self, snapshot: Dict[str, Any]) -> List[Dict[str, Any]]:
+        return [dict(ifname=ifname, **details["counters"]) for ifname, details in snapshot["interfaces"].items() if details["kind"] == self.tunnel_type]
+
+
+class TrafficStats:
+    RATE_FIELDS = ("rx_bytes", "rx_packets", "tx_bytes", "tx_packets")
+
+    def __init__(self, collector: CounterSnapshotCollector, vnis: Optional[List[int]] = None) -> None:
+        self.collector = collector
+        self.vnis = vnis
+
+    def sample(self) -> Dict[str, Dict[str, Any]]:
+        return {ifname: details for ifname, details in self.collector.collect_interfaces().items() if details["kind"] == self.collector.tunnel_type and (not self.vnis or details["vni"] in self.vnis)}
+
+    @staticmethod
+    def totals(sample: Dict[str, Dict[str, Any]]) -> List[Dict[str, Any]]:
+        return [dict(ifname=ifname, vni=details["vni"], **details["counters"]) for ifname, details in sorted(sample.items())]
+
+    @classmethod
+    def rates(cls, before: Dict[str, Dict[str, Any]], after: Dict[str, Dict[str, Any]], elapsed: float) -> List[Dict[str, Any]]:
+        # Bytes and packets become per-second rates; drops and errors are counted over the interval
+        rows = []
+        for ifname, details in sorted(after.items()):
+            if ifname not in before:
+                continue
+            delta = DropAnalyzer.counter_delta(before[ifname]["counters"], details["counters"])
+            rates = {f"{field}_per_s": round(delta[field] / elapsed) if elapsed > 0 else 0 for field in cls.RATE_FIELDS}
+            rows.append(dict(ifname=ifname, vni=details["vni"], **rates, **{field: delta[field] for field in COUNTER_FIELDS if field not in cls.RATE_FIELDS}))
+        return rows
+
+
+class DropHeuristic(NamedTuple):
+    name: str
+    cause: str
+    weight: int
+    matches: Callable[[Dict[str, Any]], bool]
+    remediation: str
+
+
+# Ordered by weight when reported; each heuristic sees the counter deltas of one tunnel
+DROP_HEURISTICS = [
+    DropHeuristic("mtu-blackhole", "MTU blackhole: encapsulated packets exceed the path MTU", 3, lambda c: c["tunnel"]["tx_dropped"] > 0 and c["icmp_frag_needed"] > 0, "ip link set dev {ifname} mtu {suggested_mtu}"),
+    DropHeuristic("udp-checksum-offload", "UDP checksum offload bug on the underlay device", 2, lambda c: c["underlay"]["rx_errors"] > 0 and (c["tunnel"]["rx_errors"] + c["tunnel"]["rx_dropped"] > 0 or c["tunnel"]["rx_packets"] == 0), "ethtool -K {dev} rx off tx off"),
+    DropHeuristic("mtu-blackhole-guess", "Possible MTU blackhole (a guess): ICMP destination unreachable seen, which on IPv4 includes fragmentation needed", 1, lambda c: c["tunnel"]["tx_dropped"] > 0 and c["icmp_frag_needed"] == 0 and c["icmp_unreachable"] > 0, "ip link set dev {ifname} mtu {suggested_mtu}"),
+    DropHeuristic("remote-down", "Remote VTEP down or unreachable: traffic is sent but nothing comes back", 1, lambda c: c["tunnel"]["tx_packets"] > 0 and c["tunnel"]["rx_packets"] == 0, "ping -c 3 {remote}"),
+    DropHeuristic("mtu-mismatch", "Tunnel MTU larger than the underlay can carry (no packet too big feedback seen)", 1, lambda c: c["tunnel"]["tx_dropped"] > 0 and c["icmp_frag_needed"] == 0, "ip link set dev {ifname} mtu {suggested_mtu}"),
+]
+
+
+class DropAnalyzer:
+    def __init__(self, tunnel_type: str, heuristics: Optional[List[DropHeuristic]] = None) -> None:
+        self.tunnel_type = tunnel_type
+        self.heuristics = DROP_HEURISTICS if heuristics is None else heuristics
+
+    @staticmethod
+    def counter_delta(before: Dict[str, int], after: Dict[str, int]) -> Dict[str, int]:
+        return {field: max(after.get(field, 0) - before.get(field, 0), 0) for field in COUNTER_FIELDS}
+
+    def analyze(self, before: Dict[str, Any], after: Dict[str, Any]) -> List[Dict[str, Any]]:
+        empty = {field: 0 for field in COUNTER_FIELDS}
+        icmp_frag_needed = sum(max(after["kernel"].get(name, 0) - before["kernel"].get(name, 0), 0) for name in ICMP_FRAG_NEEDED_COUNTERS)
+        icmp_unreachable = sum(max(after["kernel"].get(name, 0) - before["kernel"].get(name, 0), 0) for name in ICMP_UNREACHABLE_COUNTERS)
+
+        findings = []
+        for ifname, details in after["interfaces"].items():
+            if details["kind"] != self.tunnel_type or ifname not in before["interfaces"]:
+                continue
+            dev = details.get("link") or ""
+            underlay_before = before["interfaces"].get(dev, {}).get("counters", empty)
+            underlay_after = after["interfaces"].get(dev, {}).get("counters", empty)
+            underlay_mtu = after["interfaces"].get(dev, {}).get("mtu") or 1500
+            context = {
+                "tunnel": self.counter_delta(before["interfaces"][ifname]["counters"], details["counters"]),
+                "underlay": self.counter_delta(underlay_before, underlay_after),
+                "icmp_frag_needed": icmp_frag_needed,
+                "icmp_unreachable": icmp_unreachable,
+            }
+            values = {"ifname": ifname, "dev": dev or "<underlay>", "remote": details.get("remote") or "<remote>", "suggested_mtu": underlay_mtu - ENCAP_OVERHEAD.get(self.tunnel_type, 50)}
+
+            for heuristic in self.heuristics:
+                if heuristic.matches(context):
+                    findings.append({"ifname": ifname, "finding": heuristic.name, "cause": heuristic.cause, "weight": heuristic.weight, "remediation": heuristic.remediation.format(**values)})
+
+        findings.sort(key=lambda finding: finding["weight"], reverse=True)
+        return [dict(rank=rank, **finding) for rank, finding in enumerate(findings, start=1)]
+
+
+def parse_duration(value: str) -> int:
+    units = {"s": 1, "m": 60, "h": 3600, "d": 86400}
+    if value.isdigit():
+        return int(value)
+    parts = re.findall(r"(\d+)([smhd])", value)
+    if not parts or "".join(number + unit for number, unit in parts) != value:
+        raise argparse.ArgumentTypeError(f"Invalid duration: {value} (expected e.g. 90s, 30m, 2h, 1h30m)")
+    return sum(int(number) * units[unit] for number, unit in parts)
+
+
+def parse_port_range(value: str) -> str:
+    try:
+        VXLANTunnel.port_range(value)
+    except TunnelManagerError as e:
+        raise argparse.ArgumentTypeError(str(e)) from e
+    return value
+
+
+def parse_ttl(value: str) -> Union[int, str]:
+    if value == "inherit":
+        return value
+    if not value.isdigit() or not 1 <= int(value) <= 255:
+        raise argparse.ArgumentTypeError(f"Invalid TTL: {value} (expected 1-255 or 'inherit')")
+    return int(value)
+
+
+def parse_tos(value: str) -> str:
+    if value == "inherit":
+        return value
+    try:
+        tos = int(value, 0)
+    except ValueError as e:
+        raise argparse.ArgumentTypeError(f"Invalid TOS: {value} (expected 0-255, e.g. 0xb8, or 'inherit')") from e
+    if not 0 <= tos <= 255:
+        raise argparse.ArgumentTypeError(f"Invalid TOS: {value} (expected 0-255, e.g. 0xb8, or 'inherit')")
+    # iproute2 reads the TOS as hex whether or not it has the 0x prefix
+    return f"{tos:#04x}"
+
+
+def parse_gre_key(value: str) -> int:
+    # Routers write keys as numbers or, like iproute2 prints them, in dotted-quad form
+    try:
+        key = int(ipaddress.IPv4Address(value)) if "." in value else int(value)
+    except ValueError as e:
+        raise argparse.ArgumentTypeError(f"Invalid GRE key: {value} (expected 0-4294967295 or a dotted quad)") from e
+    if not 0 <= key <= 0xFFFFFFFF:
+        raise argparse.ArgumentTypeError(f"Invalid GRE key: {value} (expected 0-4294967295 or a dotted quad)")
+    return key
+
+
+def parse_route_mtu(value: str) -> str:
+    if value != "auto" and not value.isdigit():
+        raise argparse.ArgumentTypeError(f"Invalid route MTU: {value} (expected a number or 'auto')")
+    return value
+
+
+def parse_collector(value: str) -> Tuple[str, Optional[int]]:
+    match = re.fullmatch(r"\[(?P<bracketed>[0-9a-fA-F:]+)\](?::(?P<bracketed_port>\d+))?|(?P<host>[^:\s]+)(?::(?P<port>\d+))?", value)
+    if not match:
+        raise argparse.ArgumentTypeError(f"Invalid collector: {value} (expected host[:port] or [ipv6][:port])")
+    port = match["bracketed_port"] or match["port"]
+    return match["bracketed"] or match["host"], int(port) if port else None
+
+
+def parse_mesh_nodes(value: str) -> Dict[str, str]:
+    nodes: Dict[str, str] = {}
+    for entry in value.split(","):
+        name, _, address = entry.partition("=")
+        if not name or not address:
+            raise argparse.ArgumentTypeError(f"Invalid node: {entry} (expected name=address)")
+        if name in nodes:
+            raise argparse.ArgumentTypeError(f"Node {name} is listed more than once")
+        nodes[name] = address
+    return nodes
+
+
+def parse_allowed_ips(value: str) -> List[str]:
+    try:
+        return [str(ipaddress.ip_network(prefix.strip(), strict=False)) for prefix in value.split(",")]
+    except ValueError as e:
+        raise argparse.ArgumentTypeError(f"Invalid allowed IPs: {value} (expected comma-separated prefixes, e.g. 10.200.0.2/32)") from e
+
+
+def parse_host_list(value: str) -> List[str]:
+    hosts = [host.strip() for host in value.split(",") if host.strip()]
+    if not hosts:
+        raise argparse.ArgumentTypeError(f"Invalid host list: {value!r}")
+    return hosts
+
+
+def parse_link_prefix(value: str) -> int:
+    if not value.lstrip("/").isdigit():
+        raise argparse.ArgumentTypeError(f"Invalid link prefix: {value} (expected e.g. /31)")
+    return int(value.lstrip("/"))
+
+
+def parse_mac(value: str) -> str:
+    if not re.fullmatch(r"[0-9a-fA-F]{2}(:[0-9a-fA-F]{2}){5}", value):
+        raise argparse.ArgumentTypeError(f"Invalid MAC address: {value}")
+    return value.lower()
+
+
+def parse_label(value: str) -> Tuple[str, str]:
+    key, _, label = value.partition("=")
+    # list shows labels as key=value,key=value, so a value cannot hold a comma
+    if not re.fullmatch(r"[A-Za-z0-9][A-Za-z0-9_.\-/]*", key) or not _ or "," in label:
+        raise argparse.ArgumentTypeError(f"Invalid label: {value} (expected key=value without commas, e.g. env=prod)")
+    return key, label
+
+
+def parse_multicast_group(value: str) -> str:
+    try:
+        address = ipaddress.ip_address(value)
+    except ValueError as e:
+        raise argparse.ArgumentTypeError(f"Invalid multicast group: {value} (expected an address such as 239.1.1.1)") from e
+    if not address.is_multicast:
+        raise argparse.ArgumentTypeError(f"{value} is not a multicast address (expected 224.0.0.0/4 or ff00::/8)")
+    return str(address)
+
+
+def parse_ip_address(value: str) -> str:
+    try:
+        return str(ipaddress.ip_address(value))
+    except ValueError as e:
+        raise argparse.ArgumentTypeError(f"Invalid IP address: {value}") from e
+
+
+def parse_vni_list(value: str) -> List[int]:
+    try:
+        return [int(vni) for vni in value.split(",") if vni]
+    except ValueError as e:
+        raise argparse.ArgumentTypeError(f"Invalid VNI list: {value}") from e
+
+
+def parse_mtu(value: str) -> int:
+    if not value.isdigit() or not TunnelMtu.MIN_MTU <= int(value) <= 65535:
+        raise argparse.ArgumentTypeError(f"Invalid MTU: {value} (expected {TunnelMtu.MIN_MTU}-65535)")
+    return int(value)
+
+
+def parse_vni_range(value: str) -> List[int]:
+    match = re.fullmatch(r"(\d+)-(\d+)", value)
+    if not match or not 0 < int(match[1]) <= int(match[2]) <= MeshGenerator.MAX_VNI:
+        raise argparse.ArgumentTypeError(f"Invalid VNI range: {value} (expected e.g. 100-150)")
+    return list(range(int(match[1]), int(match[2]) + 1))
+
+
+VNI_MAP_FIELDS = ("src_host", "dst_host", "bridge_name", "dev", "src_port", "dst_port", "ifname")
+
+
+def load_vni_map(path: str) -> Dict[int, Dict[str, Any]]:
+    try:
+        with open(path) as f:
+            document = yaml.safe_load(f) or {}
+    except (OSError, yaml.YAMLError) as e:
+        raise TunnelManagerError(f"Error reading VNI map {path}: {e}") from e
+    if not isinstance(document, dict):
+        raise TunnelManagerError(f"VNI map {path} must map VNIs to tunnel settings")
+    mapping = {}
+    for vni, entry in document.items():
+        if not str(vni).isdigit() or not isinstance(entry, dict):
+            raise TunnelManagerError(f"VNI map {path}: expected a VNI with its settings, got {vni}: {entry}")
+        if unknown := sorted(set(entry) - set(VNI_MAP_FIELDS)):
+            raise TunnelManagerError(f"VNI map {path}: unknown field(s) {', '.join(unknown)} for VNI {vni} (expected {', '.join(VNI_MAP_FIELDS)})")
+        # A remote list replicates like repeated --dst-host
+        if "dst_host" in entry:
+            remotes = entry.pop("dst_host")
+            entry["dst_hosts"] = parse_host_list(",".join(map(str, remotes if isinstance(remotes, list) else [remotes])))
+        mapping[int(vni)] = entry
+    return mapping
+
+
+def expand_vni_range(vnis: List[int], defaults: Dict[str, Any], mapping: Dict[int, Dict[str, Any]]) -> List[Dict[str, Any]]:
+    # Command line values are templates: {vni} is the tunnel's VNI and {index} its position in the range, from 0
+    def fill(value: Any, vni: int, index: int) -> Any:
+        if isinstance(value, list):
+            return [fill(item, vni, index) for item in value]
+        return value.format(vni=vni, index=index) if isinstance(value, str) else value
+
+    entries = []
+    for index, vni in enumerate(vnis):
+        entry = dict(defaults, **mapping.get(vni, {}))
+        try:
+            entry = {key: fill(value, vni, index) for key, value in entry.items()}
+        except (KeyError, IndexError, ValueError) as e:
+            raise TunnelManagerError(f"Invalid template for VNI {vni}: {e} (only {{vni}} and {{index}} can be used)") from e
+        if missing := [field for field in ("src_host", "dst_hosts", "bridge_name") if not entry.get(field)]:
+            raise TunnelManagerError(f"VNI {vni} has no {', '.join(missing)}; pass it on the command line or in the VNI map")
+        entries.append(dict(entry, vni=vni))
+    return entries
+
+
+IFNAME_MAX = 15
+
+
+def render_ifname(template: str, vni: int, bridge_name: str, tunnel_type: str, index: int = 0) -> str:
+    # {{.VNI}}, {{.Bridge}}, {{.Type}} and {{.Index}} are accepted as spellings of {vni}, {bridge}, {type} and {index}
+    template = re.sub(r"\{\{\s*\.(\w+)\s*\}\}", lambda match: "{" + match[1].lower() + "}", template)
+    try:
+        ifname = template.format(vni=vni, bridge=bridge_name, type=tunnel_type, index=index)
+    except (KeyError, IndexError, ValueError) as e:
+        raise TunnelManagerError(f"Invalid interface name template {template}: {e} (only {{vni}}, {{bridge}}, {{type}} and {{index}} can be used)") from e
+    # The kernel limits names to IFNAMSIZ - 1 bytes and rejects slashes, colons and whitespace
+    if not ifname or len(ifname.encode()) > IFNAME_MAX or re.search(r"[/:\s]", ifname) or ifname in (".", ".."):
+        raise TunnelManagerError(f"Interface name template {template} gives {ifname!r} for VNI {vni}, which is not a valid interface name (at most {IFNAME_MAX} characters, no '/', ':' or whitespace)")
+    return ifname
+
+
+def select_tunnels(data: List[Dict[str, Any]], vnis: Optional[List[int]] = None, bridge: Optional[str] = None, remote: Optional[str] = None, ifname: Optional[str] = None, labels: Optional[Dict[str, str]] = None) -> List[Dict[str, Any]]:
+    # Interface and bridge names are shell-style globs, so vx-* or br-tenant? match a family of names
+    return [item for item in data if (not vnis or int(item["vni"]) in vnis) and (bridge is None or fnmatch.fnmatchcase(item.get("master") or "", bridge)) and (remote is None or item.get("dst_host") == remote) and (ifname is None or fnmatch.fnmatchcase(item["ifname"], ifname)) and (not labels or TunnelRecords.matches_labels(item, labels))]
+
+
+def expand_fields(names: List[str]) -> List[str]:
+    # all stands for every field, so it can be mixed with the others and is never taken for a field name
+    fields = list(dict.fromkeys(field for name in names for field in (TunnelManager.LIST_FIELDS if name == "all" else [name])))
+    unknown = [field for field in fields if field not in TunnelManager.LIST_FIELDS]
+    if unknown:
+        raise TunnelManagerError(f"Unknown fields: {', '.join(unknown)}; choose from {', '.join(TunnelManager.LIST_FIELDS)} or all")
+    return fields
+
+
+class MaintenanceManager:
+    ALL = "all"
+
+    def __init__(self, store: StateStore, clock: Callable[[], float] = time.time) -> None:
+        self.store = store
+        self.clock = clock
+
+    def _load_windows(self) -> Dict[str, Any]:
+        # Reads only leave out expired windows; they run without the state lock, so pruning is left to start and end
+        now = self.clock()
+        return {scope: window for scope, window in self.store.load().get("maintenance", {}).items() if window["end"] > now}
+
+    def _update_windows(self, change: Callable[[Dict[str, Any]], None]) -> None:
+        with self.store.lock:
+            state = self.store.load()
+            windows = state.get("maintenance", {})
+            now = self.clock()
+            for scope in [scope for scope, window in windows.items() if window["end"] <= now]:
+                logger.info(f"Maintenance window for {self._describe(scope)} expired at {self._timestamp(windows[scope]['end'])}, resuming normal operation.")
+                del windows[scope]
+            change(windows)
+            state["maintenance"] = windows
+            self.store.save(state)
+
+    @staticmethod
+    def _describe(scope: str) -> str:
+        return "all tunnels" if scope == MaintenanceManager.ALL else f"VNI {scope}"
+
+    @staticmethod
+    def _timestamp(epoch: float) -> str:
+        return datetime.datetime.fromtimestamp(epoch).isoformat(timespec="seconds")
+
+    def start(self, duration: int, vnis: Optional[List[int]] = None, reason: str = "") -> List[Dict[str, Any]]:
+        def change(windows: Dict[str, Any]) -> None:
+            now = self.clock()
+            for scope in [str(vni) for vni in vnis] if vnis else [self.ALL]:
+                # Overlapping windows for the same scope merge into one spanning both
+                window = windows.get(scope, {"start": now, "end": now, "reason": reason})
+                window["end"] = max(window["end"], now + duration)
+                window["reason"] = reason or window.get("reason", "")
+                windows[scope] = window
+                logger.info(f"Maintenance window for {self._describe(scope)} active until {self._timestamp(window['end'])}.")
+
+        self._update_windows(change)
+        return self.status()
+
+    def end(self, vnis: Optional[List[int]] = None) -> None:
+        def change(windows: Dict[str, Any]) -> None:
+            for scope in [str(vni) for vni in vnis] if vnis else list(windows):
+                if windows.pop(scope, None) is not None:
+                    logger.info(f"Maintenance window for {self._describe(scope)} ended.")
+
+        self._update_windows(change)
+
+    def status(self) -> List[Dict[str, Any]]:
+        now = self.clock()
+        return [{"scope": self._describe(scope), "start": self._timestamp(window["start"]), "end": self._timestamp(window["end"]), "remaining": f"{int(window['end'] - now)}s", "reason": window.get("reason", "")} for scope, window in sorted(self._load_windows().items())]
+
+    def covers(self, vni: int) -> bool:
+        windows = self._load_windows()
+        return self.ALL in windows or str(vni) in windows
+
+    def annotate(self, data: List[Dict[str, Any]]) -> List[Dict[str, Any]]:
+        windows = self._load_windows()
+        if not windows:
+            return data
+        for item in data:
+            item["maintenance"] = "MAINTENANCE" if self.ALL in windows or str(item.get("vni")) in windows else ""
+        return data
+
+
+class AddressInspector:
+    # Lifetime reported by iproute2 for addresses that never expire
+    INFINITE_LIFETIME = 4294967295
+    DHCP_CLIENTS = ("dhclient", "dhcpcd", "udhcpc", "dhcpcd5")
+
+    def __init__(self, ifname: str, executor: Optional[CommandExecutor] = None) -> None:
+        self.ifname = ifname
+        self.executor = executor or SubprocessExecutor()
+
+    def _addresses(self, ifname: str) -> List[Dict[str, Any]]:
+        try:
+            result = self.executor.run(["ip", "-j", "addr", "show", "dev", ifname])
+            return json.loads(result.stdout or "[]")
+        except (subprocess.CalledProcessError, json.JSONDecodeError, TypeError) as e:
+            logger.error(f"Error reading addresses of {ifname}: {e}")
+            raise TunnelManagerError(f"Error reading addresses of {ifname}") from e
+
+    @classmethod
+    def _lifetime(cls, seconds: int) -> str:
+        return "forever" if seconds >= cls.INFINITE_LIFETIME else f"{seconds}s"
+
+    def collect(self) -> List[Dict[str, Any]]:
+        links = self._addresses(self.ifname)
+        # Overlay addresses usually live on the bridge the tunnel is enslaved to
+        if links and links[0].get("master"):
+            links += self._addresses(links[0]["master"])
+
+        addresses = []
+        for link in links:
+            for info in link.get("addr_info", []):
+                valid_lft = info.get("valid_life_time", self.INFINITE_LIFETIME)
+                addresses.append({
+                    "ifname": link["ifname"],
+                    "family": info.get("family", ""),
+                    "address": f"{info.get('local')}/{info.get('prefixlen')}",
+                    "scope": info.get("scope", ""),
+                    "valid_lft": self._lifetime(valid_lft),
+                    "preferred_lft": self._lifetime(info.get("preferred_life_time", self.INFINITE_LIFETIME)),
+                    "origin": "dhcp" if info.get("dynamic") else "static",
+                    "expires_in": None if valid_lft >= self.INFINITE_LIFETIME else valid_lft,
+                })
+        return addresses
+
+    @classmethod
+    def dhcp_client_running(cls, ifname: str) -> bool:
+        for cmdline_path in glob.glob("/proc/[0-9]*/cmdline"):
+            try:
+                with open(cmdline_path, "rb") as f:
+                    argv = [arg.decode(errors="replace") for arg in f.read().split(b"\0") if arg]
+            except OSError:
+                continue
+            if argv and os.path.basename(argv[0]) in cls.DHCP_CLIENTS and ifname in argv[1:]:
+                return True
+        return False
+
+    @staticmethod
+    def expiring(addresses: List[Dict[str, Any]], warn_within: float) -> List[Dict[str, Any]]:
+        return [address for address in addresses if address["origin"] == "dhcp" and address["expires_in"] is not None and address["expires_in"] <= warn_within]
+
+    def check_expiry(self, addresses: List[Dict[str, Any]], warn_within: float) -> List[Dict[str, Any]]:
+        expiring = self.expiring(addresses, warn_within)
+        for address in expiring:
+            if not self.dhcp_client_running(address["ifname"]):
+                logger.warning(f"Address {address['address']} on {address['ifname']} expires in {address['expires_in']}s and no DHCP client is running to renew it.")
+        return expiring
+
+    def assign(self, address: str) -> bool:
+        if any(info["address"] == address for info in self.collect() if info["ifname"] == self.ifname):
+            return False
+        try:
+            self.executor.run(["ip", "addr", "add", address, "dev", self.ifname])
+            return True
+        except subprocess.CalledProcessError as e:
+            raise TunnelManagerError(f"Error assigning {address} to {self.ifname}: {e}") from e
+
+    def unassign(self, address: str) -> None:
+        self.executor.run(["ip", "addr", "del", address, "dev", self.ifname], check=False)
+
+    def stop_client(self, pidfile: str) -> Optional[int]:
+        try:
+            with open(pidfile) as f:
+                pid = int(f.read().strip())
+        except (OSError, ValueError):
+            # The client is gone along with its pidfile; there is nothing to stop
+            return None
+        self.executor.run(["kill", str(pid)], check=False)
+        return pid
+
+    def renew(self, ifname: str, pidfile: Optional[str] = None) -> str:
+        # A client recorded for the interface is restarted on its own pidfile instead of a second one being started beside it
+        pid = self.stop_client(pidfile) if pidfile else None
+        pidfile = pidfile or f"/run/dhclient-{ifname}.pid"
+        try:
+            self.executor.run(["dhclient", "-nw", "-pf", pidfile, ifname])
+            logger.info(f"Restarted the DHCP client on {ifname} (was pid {pid})." if pid else f"Started a DHCP client on {ifname}.")
+            return pidfile
+        except (subprocess.CalledProcessError, FileNotFoundError) as e:
+            logger.error(f"Error starting a DHCP client on {ifname}: {e}")
+            raise TunnelManagerError(f"Error starting a DHCP client on {ifname}") from e
+
+
+def load_inventory(path: str) -> List[Dict[str, Any]]:
+    try:
+        with open(path) as f:
+            document = yaml.safe_load(f) or {}
+    except (OSError, yaml.YAMLError) as e:
+        raise TunnelManagerError(f"Error reading inventory {path}: {e}") from e
+
+    hosts = []
+    for entry in document.get("hosts", []) if isinstance(document, dict) else document:
+        if isinstance(entry, str):
+            entry = {"name": entry}
+        if "name" not in entry:
+            raise TunnelManagerError(f"Inventory {path} has a host without a name: {entry}")
+        hosts.append({"name": entry["name"], "ssh": entry.get("ssh", entry["name"]), "address": entry.get("address"), "labels": entry.get("labels", {})})
+    return hosts
+
+
+def select_hosts(hosts: List[Dict[str, Any]], limit: Optional[str]) -> List[Dict[str, Any]]:
+    if not limit:
+        return hosts
+    selected = [host for host in hosts if limit == host["name"] or limit in map(str, host["labels"].values())]
+    if not selected:
+        raise TunnelManagerError(f"No inventory host matches --limit {limit}")
+    return selected
+
+
+class FleetCollector:
+    FIELDS = ("host", "type", "ifname", "vni", "src_host", "dst_host", "dst_port", "status")
+
+    def __init__(self, hosts: List[Dict[str, Any]], executor_factory: Callable[[Dict[str, Any]], CommandExecutor] = lambda host: SshExecutor(host["ssh"]), max_workers: int = 8) -> None:
+        self.hosts = hosts
+        self.executor_factory = executor_factory
+        self.max_workers = max_workers
+
+    def collect_host(self, host: Dict[str, Any]) -> List[Dict[str, Any]]:
+        rows = []
+        for link in json.loads(self.executor_factory(host).run(["ip", "-d", "-j", "link", "show"]).stdout or "[]"):
+            linkinfo = link.get("linkinfo", {})
+            info_data = linkinfo.get("info_data", {})
+            if linkinfo.get("info_kind") in TUNNEL_KINDS:
+                rows.append({"host": host["name"], "type": linkinfo["info_kind"], "ifname": link["ifname"], "vni": info_data.get("id"), "src_host": info_data.get("local", info_data.get("local6", "")), "dst_host": info_data.get("remote", info_data.get("remote6", "")), "dst_port": info_data.get("port", ""), "status": "ok"})
+        return rows
+
+    def collect(self) -> List[Dict[str, Any]]:
+        rows = []
+        with concurrent.futures.ThreadPoolExecutor(max_workers=self.max_workers) as pool:
+            futures = {host["name"]: pool.submit(self.collect_host, host) for host in self.hosts}
+            for name, future in futures.items():
+                try:
+                    rows += future.result()
+                except Exception as e:
+                    # One unreachable host must not hide the rest of the fleet
+                    logger.error(f"Error collecting tunnels from {name}: {e}")
+                    rows.append(dict({field: "" for field in self.FIELDS}, host=name, status=f"error: {e}"))
+        return self.check_symmetry(rows)
+
+    def check_symmetry(self, rows: List[Dict[str, Any]]) -> List[Dict[str, Any]]:
+        addresses: Dict[str, str] = {host["address"]: host["name"] for host in self.hosts if host.get("address")}
+        for row in rows:
+            if row["status"] == "ok":
+                addresses.setdefault(row["src_host"], row["host"])
+        tunnels = {(row["host"], row["type"], str(row["vni"]), row["dst_host"]) for row in rows if row["status"] == "ok"}
+        for row in rows:
+            if row["status"] != "ok":
+                continue
+            peer = addresses.get(row["dst_host"])
+            if peer is None:
+                row["status"] = "peer outside inventory"
+            elif (peer, row["type"], str(row["vni"]), row["src_host"]) not in tunnels:
+                row["status"] = f"asymmetric: no reverse tunnel on {peer}"
+        return rows
+
+
+def side_by_side(columns: Dict[str, str], gap: int = 4) -> str:
+    blocks = [[title, "=" * len(title)] + text.splitlines() for title, text in columns.items()]
+    widths = [max(len(line) for line in block) for block in blocks]
+    rows = []
+    for index in range(max(len(block) for block in blocks)):
+        cells = [(block[index] if index < len(block) else "").ljust(width) for block, width in zip(blocks, widths)]
+        rows.append((" " * gap).join(cells).rstrip())
+    return "\n".join(rows)
+
+
+def plan_tunnel(tunnel_type: TunnelType, vni: int, existing: Optional[Dict[str, Any]], src_host: str, dst_host: str, bridge_name: str, src_port: Optional[Union[int, str]] = None, dst_port: Optional[int] = None, dev: Optional[str] = None, ifname: Optional[str] = None) -> PlanEntry:
+    recorder = RecordingExecutor()
+    tunnel = TunnelFactory.create_tunnel(tunnel_type, executor=recorder, ifnames={vni: ifname} if ifname else None)
+    ifname = tunnel.interface_name(vni)
+    if existing is None:
+        tunnel.create_tunnel_interface(vni, src_host, dst_host, bridge_name, src_port, dst_port, dev)
+        return PlanEntry.build("create", tunnel.tunnel_type, vni, commands=recorder.commands)
+    mismatches = TunnelManager.attribute_mismatches(existing, {"id": tunnel.device_id(vni), "remote": dst_host, "local": src_host, "link": dev, "port": dst_port or getattr(tunnel, "DEFAULT_PORT", None)})
+    if getattr(tunnel, "bridgeable", True) and existing.get("master") != bridge_name:
+        mismatches["master"] = (existing.get("master"), bridge_name)
+    if mismatches:
+        return PlanEntry.build("conflict", tunnel.tunnel_type, vni, changes=mismatches, description=f"{ifname} exists with different parameters")
+    return PlanEntry.build("noop", tunnel.tunnel_type, vni, description=f"{ifname} already exists")
+
+
+class PairPlanner:
+    EXIT_NO_CHANGES = 0
+    EXIT_CHANGES = 2
+    EXIT_CONFLICTS = 3
+
+    def __init__(self, tunnel_type: TunnelType, vni: int, bridge_name: str, dst_port: Optional[int] = None, dev: Optional[str] = None) -> None:
+        self.tunnel_type = tunnel_type
+        self.vni = vni
+        self.bridge_name = bridge_name
+        self.dst_port = dst_port
+        self.dev = dev
+
+    def plan_host(self, executor: CommandExecutor, local: str, remote: str) -> PlanEntry:
+        ifname = TunnelFactory.create_tunnel(self.tunnel_type, executor=executor).interface_name(self.vni)
+        try:
+            links = json.loads(executor.run(["ip", "-d", "-j", "link", "show"]).stdout or "[]")
+        except (subprocess.CalledProcessError, json.JSONDecodeError) as e:
+            raise TunnelManagerError(f"Error reading link state: {e}") from e
+        existing = next((TunnelInterface.parse_link_attributes(link) for link in links if link.get("ifname") == ifname), None)
+        return plan_tunnel(self.tunnel_type, self.vni, existing, local, remote, self.bridge_name, dst_port=self.dst_port, dev=self.dev)
+
+    @classmethod
+    def exit_code(cls, plans: List[PlanEntry]) -> int:
+        if any(plan.action == "conflict" for plan in plans):
+            return cls.EXIT_CONFLICTS
+        return cls.EXIT_CHANGES if any(plan.action == "create" for plan in plans) else cls.EXIT_NO_CHANGES
+
+    def apply_host(self, manager: TunnelManager, plan: PlanEntry, local: str, remote: str) -> bool:
+        if plan.action != "create":
+            return False
+        manager.create(TunnelSpec(self.vni, local, remote, self.bridge_name, dst_port=self.dst_port, dev=self.dev))
+        return True
+
+
+def link_addresses(network: Any) -> Tuple[str, str]:
+    hosts = list(itertools.islice(network.hosts(), 2))
+    if len(hosts) < 2:
+        raise TunnelManagerError(f"Prefix {network} does not hold two host addresses")
+    return f"{hosts[0]}/{network.prefixlen}", f"{hosts[1]}/{network.prefixlen}"
+
+
+class OverlayIpam(Protocol):
+    # Maps each link name to its overlay subnet; the same links in the same order always get the same subnets
+    def assign(self, links: List[str]) -> Dict[str, str]: ...
+
+
+class SequentialIpam:
+    def __init__(self, supernet: str, link_prefix: int = 31, reserved: Optional[Dict[str, str]] = None) -> None:
+        try:
+            self.supernet = ipaddress.ip_network(supernet, strict=True)
+        except ValueError as e:
+            raise TunnelManagerError(f"Invalid overlay supernet {supernet}: {e}") from e
+        if not self.supernet.prefixlen <= link_prefix < self.supernet.max_prefixlen:
+            raise TunnelManagerError(f"Link prefix /{link_prefix} does not fit overlay supernet {self.supernet}")
+        self.link_prefix = link_prefix
+        self.reserved = dict(reserved or {})
+
+    def assign(self, links: List[str]) -> Dict[str, str]:
+        duplicates = sorted({link for link in links if links.count(link) > 1})
+        if duplicates:
+            raise TunnelManagerError(f"Links listed more than once: {', '.join(duplicates)}")
+        assigned = {link: self.reserved[link] for link in links if link in self.reserved}
+        pending = [link for link in links if link not in assigned]
+        try:
+            taken = [ipaddress.ip_network(subnet, strict=False) for subnet in self.reserved.values()]
+        except ValueError as e:
+            raise TunnelManagerError(f"Invalid reserved subnet: {e}") from e
+        # Lowest free subnets first, skipping any that overlap a reservation, whatever its prefix length
+        free = (str(subnet) for subnet in self.supernet.subnets(new_prefix=self.link_prefix) if not any(subnet.version == other.version and subnet.overlaps(other) for other in taken))
+        for position, link in enumerate(pending):
+            subnet = next(free, None)
+            if subnet is None:
+                missing = len(pending) - position
+                raise TunnelManagerError(f"Overlay supernet {self.supernet} is exhausted: {len(pending)} links need a /{self.link_prefix} but only {position} are free; {missing} more /{self.link_prefix}s needed")
+            assigned[link] = subnet
+        return {link: assigned[link] for link in links}
+
+
+# Keeps every assignment in a file so a link keeps its subnet when other links come and go
+class ReservationIpam:
+    def __init__(self, path: str, supernet: str, link_prefix: int = 31, files: Optional[FileWriter] = None) -> None:
+        self.store = StateStore(path)
+        self.supernet = supernet
+        self.link_prefix = link_prefix
+        self.files = files or FileWriter()
+
+    def save(self, reservations: Dict[str, str]) -> None:
+        self.files.write(self.store.path, json.dumps({"links": reservations}, indent=2, sort_keys=True))
+
+    def assign(self, links: List[str]) -> Dict[str, str]:
+        reservations = self.store.load().get("links", {})
+        assigned = SequentialIpam(self.supernet, self.link_prefix, reservations).assign(links)
+        if any(reservations.get(link) != subnet for link, subnet in assigned.items()):
+            self.save(dict(reservations, **assigned))
+        return assigned
+
+    def release(self, link: str) -> None:
+        reservations = self.store.load().get("links", {})
+        if reservations.pop(link, None) is not None:
+            self.save(reservations)
+
+
+# Expands a node list into the point-to-point tunnels of a full mesh: one VNI and bridge per pair, one manifest per node
+class MeshGenerator:
+    MAX_VNI = 2 ** 24 - 1
+
+    def __init__(self, nodes: Dict[str, str], vni_base: int, tunnel_type: TunnelType = TunnelType.VXLAN, ipam: Optional[OverlayIpam] = None, dst_port: Optional[int] = None, dev: Optional[str] = None) -> None:
+        if len(nodes) < 2:
+            raise TunnelManagerError("A mesh needs at least two nodes")
+        addresses = list(nodes.values())
+        duplicates = sorted({address for address in addresses if addresses.count(address) > 1})
+        if duplicates:
+            raise TunnelManagerError(f"Nodes share underlay addresses: {', '.join(duplicates)}")
+        self.nodes = nodes
+        self.vni_base = vni_base
+        self.tunnel_type = tunnel_type
+        self.ipam = ipam
+        self.dst_port = dst_port
+        self.dev = dev
+
+    def links(self) -> List[Tuple[str, str, int]]:
+        # N*(N-1)/2 pairs in node order, so the same node list always yields the same VNIs
+        pairs = list(itertools.combinations(self.nodes, 2))
+        if self.vni_base + len(pairs) - 1 > self.MAX_VNI:
+            raise TunnelManagerError(f"{len(pairs)} links starting at VNI {self.vni_base} exceed the largest VNI {self.MAX_VNI}")
+        return [(a, b, self.vni_base + index) for index, (a, b) in enumerate(pairs)]
+
+    def manifests(self) -> Dict[str, Dict[str, Any]]:
+        links = self.links()
+        subnets = self.ipam.assign([f"{a}-{b}" for a, b, _ in links]) if self.ipam else {}
+        manifests: Dict[str, Dict[str, Any]] = {node: {"tunnels": []} for node in self.nodes}
+        for a, b, vni in links:
+            subnet = subnets.get(f"{a}-{b}")
+            addresses = link_addresses(ipaddress.ip_network(subnet)) if subnet else (None, None)
+            for local, remote, address in ((a, b, addresses[0]), (b, a, addresses[1])):
+                entry: Dict[str, Any] = {"vni": vni, "type": self.tunnel_type.value, "src_host": self.nodes[local], "dst_host": self.nodes[remote], "bridge_name": f"br{vni}", "create_bridge": True}
+                if self.dst_port:
+                    entry["dst_port"] = self.dst_port
+                if self.dev:
+                    entry["dev"] = self.dev
+                if address:
+                    entry["address"] = address
+                manifests[local]["tunnels"].append(entry)
+        return manifests
+
+    def commands(self, manifest: Dict[str, Any]) -> List[List[str]]:
+        recorder = RecordingExecutor()
+        for entry in manifest["tunnels"]:
+            recorder.run(["ip", "link", "add", entry["bridge_name"], "type", "bridge"])
+            recorder.run(["ip", "link", "set", entry["bridge_name"], "up"])
+            TunnelFactory.create_tunnel(TunnelType(entry["type"]), executor=recorder).create_tunnel_interface(entry["vni"], entry["src_host"], entry["dst_host"], entry["bridge_name"], None, entry.get("dst_port"), entry.get("dev"))
+            if entry.get("address"):
+                recorder.run(["ip", "addr", "add", entry["address"], "dev", entry["bridge_name"]])
+        return recorder.commands
+
+
+# WireGuard keys come from wg itself, through the executor, so --dry-run and tests see every key being made
+class WireGuardKeys:
+    # wg pubkey reads the private key on stdin; the redirect keeps the key off the command line
+    PUBKEY = 'wg pubkey < "$1"'
+
+    def __init__(self, executor: Optional[CommandExecutor] = None, files: Optional[FileWriter] = None) -> None:
+        self.executor = executor or SubprocessExecutor()
+        self.files = files or FileWriter()
+
+    def wg(self, command: List[str], what: str) -> str:
+        try:
+            key = (self.executor.run(command).stdout or "").strip()
+        except (subprocess.CalledProcessError, FileNotFoundError) as e:
+            logger.error(f"Error {what}: {e}")
+            raise TunnelManagerError(f"Error {what}; is wireguard-tools installed?") from e
+        if not key:
+            raise TunnelManagerError(f"Error {what}: wg printed no key")
+        return key
+
+    def generate(self) -> str:
+        return self.wg(["wg", "genkey"], "generating a WireGuard private key")
+
+    def public(self, path: str) -> str:
+        return self.wg(["sh", "-c", self.PUBKEY, "wg-pubkey", path], f"deriving the public key of {path}")
+
+    def preshared(self) -> str:
+        # A preshared key is 32 random bytes mixed into the handshake of one pair of peers
+        return self.wg(["wg", "genpsk"], "generating a WireGuard preshared key")
+
+    def load_or_create(self, path: str, generate: Optional[Callable[[], str]] = None) -> str:
+        # A key kept in a file survives regenerating the mesh, so peers' configs stay valid
+        if os.path.exists(path):
+            with open(path) as f:
+                return f.read().strip()
+        if self.files.dry_run:
+            # A key that is not kept would give peers a public key that never exists
+            raise TunnelManagerError(f"--dry-run does not create the key {path}; run without --dry-run to create it")
+        key = (generate or self.generate)()
+        self.files.write(path, key + "\n", 0o600, exclusive=True)
+        return key
+
+
+# Private and preshared WireGuard keys as files only their owner can read, next to the state file by default
+class WireGuardKeyStore:
+    NAME = re.compile(r"[A-Za-z0-9_][A-Za-z0-9_.\-]*")
+
+    def __init__(self, directory: str, executor: Optional[CommandExecutor] = None, files: Optional[FileWriter] = None) -> None:
+        self.directory = directory
+        self.keys = WireGuardKeys(executor, files)
+
+    @classmethod
+    def beside(cls, state_file: str, executor: Optional[CommandExecutor] = None, files: Optional[FileWriter] = None) -> "WireGuardKeyStore":
+        return cls(os.path.join(os.path.dirname(os.path.abspath(state_file)), "wireguard"), executor, files)
+
+    def checked(self, name: str) -> str:
+        # Names become file names, so they cannot climb out of the key directory
+        if not self.NAME.fullmatch(name):
+            raise TunnelManagerError(f"Invalid key name: {name} (expected letters, digits, '_', '.' and '-')")
+        return name
+
+    def ensure_directory(self, path: str) -> None:
+        self.keys.files.makedirs(path, 0o700)
+
+    def path(self, name: str) -> str:
+        return os.path.join(self.directory, f"{self.checked(name)}.key")
+
+    def psk_path(self, a: str, b: str) -> str:
+        # One key per pair, whichever end asks for it
+        return os.path.join(self.directory, "psk", "-".join(sorted((self.checked(a), self.checked(b)))) + ".psk")
+
+    def private(self, name: str) -> str:
+        self.ensure_directory(self.directory)
+        return self.keys.load_or_create(self.path(name))
+
+    def public(self, name: str) -> str:
+        self.private(name)
+        return self.keys.public(self.path(name))
+
+    def preshared(self, a: str, b: str) -> str:
+        if a == b:
+            raise TunnelManagerError(f"A preshared key belongs to two peers; {a} was given twice")
+        self.ensure_directory(os.path.join(self.directory, "psk"))
+        return self.keys.load_or_create(self.psk_path(a, b), self.keys.preshared)
+
+    def rotate(self, name: str) -> Tuple[Optional[str], str]:
+        # The old key stays as <name>.key.previous until the next rotation, so a rotation can be undone by hand
+        if self.keys.files.dry_run:
+            raise TunnelManagerError(f"--dry-run cannot rotate {name}: the new key would not be kept, so peers could not be given it")
+        path = self.path(name)
+        old = self.public(name) if os.path.exists(path) else None
+        if old:
+            self.keys.files.replace(path, path + ".previous")
+        return old, self.public(name)
+
+    def list(self) -> List[Dict[str, Any]]:
+        names = sorted(entry[:-4] for entry in os.listdir(self.directory) if entry.endswith(".key")) if os.path.isdir(self.directory) else []
+        return [{"name": name, "public_key": self.public(name), "created": datetime.datetime.fromtimestamp(os.stat(self.path(name)).st_mtime).isoformat(timespec="seconds"), "previous": "yes" if os.path.exists(self.path(name) + ".previous") else "no"} for name in names]
+
+
+# WireGuard devices: layer 3 interfaces whose keys and peers are set with `wg` rather than by VNI
+class WireGuardInterface:
+    DEFAULT_PORT = 51820
+
+    def __init__(self, store: StateStore, executor: Optional[CommandExecutor] = None, files: Optional[FileWriter] = None) -> None:
+        self.store = store
+        self.executor = executor or SubprocessExecutor()
+        self.files = files
+
+    def records(self) -> Dict[str, Any]:
+        return self.store.load().get("wireguard", {})
+
+    def save(self, ifname: str, record: Optional[Dict[str, Any]]) -> None:
+        with self.store.lock:
+            state = self.store.load()
+            interfaces = state.setdefault("wireguard", {})
+            if record is None:
+                interfaces.pop(ifname, None)
+            else:
+                interfaces[ifname] = record
+            self.store.save(state)
+
+    def create(self, ifname: str, private_key_file: str, listen_port: Optional[int] = None, address: Optional[str] = None) -> str:
+        keys = WireGuardKeys(self.executor, self.files)
+        keys.load_or_create(private_key_file)
+        listen_port = listen_port or self.DEFAULT_PORT
+        try:
+            self.executor.run(["ip", "link", "add", ifname, "type", "wireguard"])
+        except subprocess.CalledProcessError as e:
+            logger.error(f"Error creating WireGuard interface {ifname}: {e}")
+            raise TunnelManagerError(f"Error creating WireGuard interface {ifname}") from e
+        try:
+            self.executor.run(["wg", "set", ifname, "listen-port", str(listen_port), "private-key", private_key_file])
+            if address:
+                self.executor.run(["ip", "addr", "add", address, "dev", ifname])
+            self.executor.run(["ip", "link", "set", ifname, "up"])
+        except (subprocess.CalledProcessError, FileNotFoundError) as e:
+            logger.error(f"Error configuring WireGuard interface {ifname}: {e}")
+            self.executor.run(["ip", "link", "del", ifname], check=False)
+            raise TunnelManagerError(f"Error configuring WireGuard interface {ifname}") from e
+        self.save(ifname, {"ifname": ifname, "listen_port": listen_port, "address": address, "private_key_file": private_key_file, "peers": {}, "created_at": datetime.datetime.now().isoformat(timespec="seconds")})
+        public_key = keys.public(private_key_file)
+        logger.info(f"WireGuard interface {ifname} listening on port {listen_port} with public key {public_key}.")
+        return public_key
+
+    def set_peer(self, ifname: str, public_key: str, endpoint: Optional[str] = None, allowed_ips: Optional[List[str]] = None, keepalive: Optional[int] = None, preshared_key_file: Optional[str] = None) -> None:
+        options = (["endpoint", endpoint] if endpoint else []) + (["allowed-ips", ",".join(allowed_ips)] if allowed_ips else []) + (["persistent-keepalive", str(keepalive)] if keepalive else []) + (["preshared-key", preshared_key_file] if preshared_key_file else [])
+        try:
+            self.executor.run(["wg", "set", ifname, "peer", public_key] + options)
+        except (subprocess.CalledProcessError, FileNotFoundError) as e:
+            logger.error(f"Error setting peer {public_key} on {ifname}: {e}")
+            raise TunnelManagerError(f"Error setting peer {public_key} on {ifname}") from e
+        record = self.records().get(ifname)
+        if record:
+            record["peers"][public_key] = {"endpoint": endpoint, "allowed_ips": allowed_ips or [], "keepalive": keepalive, "preshared_key_file": preshared_key_file}
+            self.save(ifname, record)
+
+    def remove_peer(self, ifname: str, public_key: str) -> None:
+        try:
+            self.executor.run(["wg", "set", ifname, "peer", public_key, "remove"])
+        except (subprocess.CalledProcessError, FileNotFoundError) as e:
+            logger.error(f"Error removing peer {public_key} from {ifname}: {e}")
+            raise TunnelManagerError(f"Error removing peer {public_key} from {ifname}") from e
+        record = self.records().get(ifname)
+        if record and record["peers"].pop(public_key, None) is not None:
+            self.save(ifname, record)
+
+    def reload_key(self, private_key_file: str) -> List[str]:
+        # Interfaces created from a rotated key file pick up the new key; wg reads the file again
+        reloaded = []
+        for ifname, record in self.records().items():
+            if os.path.abspath(record["private_key_file"]) == os.path.abspath(private_key_file):
+                try:
+                    self.executor.run(["wg", "set", ifname, "private-key", private_key_file])
+                except (subprocess.CalledProcessError, FileNotFoundError) as e:
+                    raise TunnelManagerError(f"Error loading the rotated key into {ifname}") from e
+                reloaded.append(ifname)
+        return reloaded
+
+    def replace_peer_key(self, old: str, new: str) -> List[str]:
+        # A peer whose key was rotated is swapped for one with the new key and the same settings
+        replaced = []
+        for ifname, record in self.records().items():
+            peer = record["peers"].get(old)
+            if peer is not None:
+                self.set_peer(ifname, new, peer["endpoint"], peer["allowed_ips"], peer["keepalive"], peer.get("preshared_key_file"))
+                self.remove_peer(ifname, old)
+                replaced.append(ifname)
+        return replaced
+
+    def delete(self, ifname: str) -> None:
+        try:
+            self.executor.run(["ip", "link", "del", ifname])
+        except subprocess.CalledProcessError as e:
+            logger.error(f"Error deleting WireGuard interface {ifname}: {e}")
+            raise TunnelManagerError(f"Error deleting WireGuard interface {ifname}") from e
+        self.save(ifname, None)
+
+    def show(self, ifname: str) -> List[Dict[str, Any]]:
+        try:
+            dump = self.executor.run(["wg", "show", ifname, "dump"]).stdout or ""
+        except (subprocess.CalledProcessError, FileNotFoundError) as e:
+            raise TunnelManagerError(f"Error reading WireGuard interface {ifname}") from e
+        # The first line is the interface itself; each further line is one peer
+        rows = []
+        for line in dump.splitlines()[1:]:
+            public_key, _, endpoint, allowed_ips, handshake, rx, tx, keepalive = line.split("\t")[:8]
+            rows.append({"public_key": public_key, "endpoint": "" if endpoint == "(none)" else endpoint, "allowed_ips": "" if allowed_ips == "(none)" else allowed_ips, "latest_handshake": datetime.datetime.fromtimestamp(int(handshake)).isoformat(timespec="seconds") if handshake != "0" else "never", "rx_bytes": rx, "tx_bytes": tx, "keepalive": "" if keepalive == "off" else keepalive})
+        return rows
+
+    def apply(self, ifname: str, config: Dict[str, Any], private_key_file: str) -> None:
+        self.create(ifname, private_key_file, config["listen_port"], config["address"])
+        for peer in config["peers"]:
+            self.set_peer(ifname, peer["public_key"], peer["endpoint"], peer["allowed_ips"], peer.get("keepalive"), peer.get("preshared_key_file"))
+
+
+# A WireGuard full mesh: one interface per node with every other node as a peer, instead of a tunnel per pair
+class WireGuardMesh:
+    def __init__(self, nodes: Dict[str, str], supernet: str, keys: WireGuardKeyStore, listen_port: Optional[int] = None, keepalive: Optional[int] = None, preshared_keys: bool = False) -> None:
+        if len(nodes) < 2:
+            raise TunnelManagerError("A mesh needs at least two nodes")
+        try:
+            self.supernet = ipaddress.ip_network(supernet, strict=True)
+        except ValueError as e:
+            raise TunnelManagerError(f"Invalid overlay supernet {supernet}: {e}") from e
+        not_ipv4 = [address for address in [str(self.supernet), *nodes.values()] if TunnelInterface.ip_version(address.split("/")[0]) != 4]
+        if not_ipv4:
+            raise TunnelManagerError(f"A WireGuard mesh runs over IPv4; {', '.join(not_ipv4)} is not an IPv4 address")
+        if self.supernet.num_addresses - 2 < len(nodes):
+            raise TunnelManagerError(f"Overlay supernet {self.supernet} has no room for {len(nodes)} nodes")
+        self.nodes = nodes
+        self.keys = keys
+        self.listen_port = listen_port or WireGuardInterface.DEFAULT_PORT
+        self.keepalive = keepalive
+        self.preshared_keys = preshared_keys
+
+    def addresses(self) -> Dict[str, str]:
+        # Hosts of the supernet in node order; new nodes go at the end of the list to keep the others' addresses
+        return {node: str(host) for node, host in zip(self.nodes, self.supernet.hosts())}
+
+    def key_file(self, node: str) -> str:
+        return self.keys.path(node)
+
+    def peer(self, node: str, peer: str, address: str, public_key: str) -> Dict[str, Any]:
+        entry = {"node": peer, "public_key": public_key, "endpoint": f"{self.nodes[peer]}:{self.listen_port}", "allowed_ips": [f"{address}/32"], "keepalive": self.keepalive}
+        if self.preshared_keys:
+            entry.update(preshared_key=self.keys.preshared(node, peer), preshared_key_file=self.keys.psk_path(node, peer))
+        return entry
+
+    def configs(self) -> Dict[str, Dict[str, Any]]:
+        addresses = self.addresses()
+        public_keys = {node: self.keys.public(node) for node in self.nodes}
+        return {node: {"address": f"{addresses[node]}/{self.supernet.prefixlen}", "listen_port": self.listen_port, "private_key": self.keys.private(node), "peers": [self.peer(node, peer, addresses[peer], public_keys[peer]) for peer in self.nodes if peer != node]} for node in self.nodes}
+
+    @staticmethod
+    def wg_quick(config: Dict[str, Any]) -> str:
+        lines = ["[Interface]", f"Address = {config['address']}", f"ListenPort = {config['listen_port']}", f"PrivateKey = {config['private_key']}"]
+        for peer in config["peers"]:
+            lines += ["", f"# peer {peer['node']}", "[Peer]", f"PublicKey = {peer['public_key']}", f"Endpoint = {peer['endpoint']}", f"AllowedIPs = {', '.join(peer['allowed_ips'])}"] + ([f"PresharedKey = {peer['preshared_key']}"] if peer.get("preshared_key") else []) + ([f"PersistentKeepalive = {peer['keepalive']}"] if peer.get("keepalive") else [])
+        return "\n".join(lines) + "\n"
+
+
+# Brings up a point-to-point lab tunnel between this host and an SSH peer, addressing both bridges from one small prefix
+class LabPair:
+    # Set on a bridge `lab up` created, so `lab down` on either host removes it and leaves a bridge that was already there
+    BRIDGE_ALIAS = "tunnel_manager lab"
+
+    def __init__(self, network: str, vni: int, bridge_name: str, peer: str, tunnel_type: TunnelType = TunnelType.VXLAN, local_manager: Optional[TunnelManager] = None, peer_executor: Optional[CommandExecutor] = None, local_address: Optional[str] = None, dst_port: Optional[int] = None, bridge_tool: str = "ip") -> None:
+        try:
+            self.network = ipaddress.ip_network(network, strict=True)
+        except ValueError as e:
+            raise TunnelManagerError(f"Invalid lab prefix {network}: {e}") from e
+        self.vni = vni
+        self.bridge_name = bridge_name
+        self.peer = peer
+        self.tunnel_type = tunnel_type
+        self.local_manager = local_manager or TunnelManager(TunnelFactory.create_tunnel(tunnel_type, bridge_tool=bridge_tool))
+        self.peer_manager = TunnelManager(TunnelFactory.create_tunnel(tunnel_type, bridge_tool=bridge_tool, executor=peer_executor or SshExecutor(peer)))
+        self.local_address = local_address
+        self.planner = PairPlanner(tunnel_type, vni, bridge_name, dst_port)
+
+    def overlay_addresses(self) -> Tuple[str, str]:
+        return link_addresses(self.network)
+
+    def underlay_addresses(self) -> Tuple[str, str]:
+        remote = HostResolver().resolve(self.peer.rsplit("@", 1)[-1])
+        if self.local_address:
+            return self.local_address, remote
+        try:
+            routes = json.loads(self.local_manager.tunnel.executor.run(["ip", "-j", "route", "get", remote]).stdout or "[]")
+        except (subprocess.CalledProcessError, json.JSONDecodeError) as e:
+            raise TunnelManagerError(f"Error finding the local address towards {remote}: {e}") from e
+        if not routes or not routes[0].get("prefsrc"):
+            raise TunnelManagerError(f"No local address routes to {remote}; pass --local-address")
+        return routes[0]["prefsrc"], remote
+
+    def sides(self) -> List[Tuple[str, TunnelManager, str, str, str]]:
+        local, remote = self.underlay_addresses()
+        local_overlay, peer_overlay = self.overlay_addresses()
+        return [("local", self.local_manager, local, remote, local_overlay), (self.peer, self.peer_manager, remote, local, peer_overlay)]
+
+    def up(self) -> List[Dict[str, Any]]:
+        sides = self.sides()
+        plans = {host: self.planner.plan_host(manager.tunnel.executor, local, remote) for host, manager, local, remote, _ in sides}
+        if PairPlanner.exit_code(list(plans.values())) == PairPlanner.EXIT_CONFLICTS:
+            raise TunnelManagerError("Refusing to bring up the lab: " + "; ".join(f"{host}: {plan.description}" for host, plan in plans.items() if plan.action == "conflict"))
+        rows = []
+        for host, manager, local, remote, overlay in sides:
+            if manager.ensure_bridge(self.bridge_name):
+                manager.tunnel.executor.run(["ip", "link", "set", "dev", self.bridge_name, "alias", self.BRIDGE_ALIAS])
+            created = self.planner.apply_host(manager, plans[host], local, remote)
+            AddressInspector(self.bridge_name, manager.tunnel.executor).assign(overlay)
+            rows.append({"host": host, "ifname": manager.tunnel.interface_name(self.vni), "local": local, "remote": remote, "bridge": self.bridge_name, "address": overlay, "tunnel": "created" if created else "existing"})
+        # Each end pings the other's overlay address across the tunnel
+        for row, other in ((rows[0], rows[1]), (rows[1], rows[0])):
+            row["ping"] = "ok" if ping(self.local_manager.tunnel.executor if row["host"] == "local" else self.peer_manager.tunnel.executor, other["address"].split("/")[0], count=3, dev=self.bridge_name) else "failed"
+        return rows
+
+    def down(self) -> List[Dict[str, Any]]:
+        rows = []
+        for host, manager, _, _, overlay in self.sides():
+            AddressInspector(self.bridge_name, manager.tunnel.executor).unassign(overlay)
+            removed = manager.tunnel.link_attributes(self.vni) is not None
+            if removed:
+                manager.cleanup(self.vni, self.bridge_name)
+            rows.append({"host": host, "ifname": manager.tunnel.interface_name(self.vni), "address": overlay, "tunnel": "removed" if removed else "absent", "bridge": self.remove_bridge(host, manager)})
+        return rows
+
+    def remove_bridge(self, host: str, manager: TunnelManager) -> str:
+        result = manager.tunnel.executor.run(["ip", "-j", "link", "show", "dev", self.bridge_name], check=False)
+        if result.returncode != 0:
+            return "absent"
+        if not any(link.get("ifalias") == self.BRIDGE_ALIAS for link in json.loads(result.stdout or "[]")):
+            return "kept"
+        bridges = manager.tunnel.bridges()
+        ports = bridges.ports(self.bridge_name)
+        if ports:
+            logger.warning(f"Leaving bridge {self.bridge_name} on {host}: it still has ports {', '.join(ports)}.")
+            return "kept"
+        bridges.delete(self.bridge_name)
+        return "removed"
+
+    def summary(self, rows: List[Dict[str, Any]]) -> str:
+        lines = [f"Lab VNI {self.vni} on {self.network}:"]
+        for row in rows:
+            lines.append(f"  {row['host']:<20} {row['ifname']} {row['local']} -> {row['remote']}  {row['bridge']} {row['address']}  ping {row['ping']}")
+        lines.append("Tear down with:")
+        lines.append(f"  tunnel_manager.py lab down --cidr {self.network} --vni {self.vni} --bridge {self.bridge_name} --peer {self.peer}" + (f" --local-address {self.local_address}" if self.local_address else ""))
+        return "\n".join(lines)
+
+
+class EndpointMigration:
+    def __init__(self, old: str, new: str, executor: Optional[CommandExecutor] = None, host: str = "local") -> None:
+        self.old = old
+        self.new = new
+        self.executor = executor or SubprocessExecutor()
+        self.host = host
+
+    def _json(self, command: List[str]) -> List[Dict[str, Any]]:
+        try:
+            return json.loads(self.executor.run(command).stdout or "[]")
+        except (subprocess.CalledProcessError, json.JSONDecodeError) as e:
+            raise TunnelManagerError(f"Error running {shlex.join(command)} on {self.host}: {e}") from e
+
+    def affected(self) -> List[Dict[str, Any]]:
+        affected = []
+        for link in self._json(["ip", "-d", "-j", "link", "show"]):
+            linkinfo = link.get("linkinfo", {})
+            info_data = linkinfo.get("info_data", {})
+            if linkinfo.get("info_kind") in TUNNEL_KINDS and self.old in (info_data.get("remote"), info_data.get("remote6")):
+                affected.append({"host": self.host, "object": "link", "ifname": link["ifname"], "kind": linkinfo["info_kind"], "vni": info_data.get("id"), "link": link})
+        # The kernel's all-zeros entry for a device's own remote moves with the remote; rewriting it would cut the device off
+        moved = {item["ifname"] for item in affected}
+        for entry in self._json(["bridge", "-j", "fdb", "show"]):
+            if entry.get("mac") == FloodList.ALL_ZEROS_MAC and entry.get("ifname") in moved:
+                continue
+            if entry.get("dst") == self.old and entry.get("ifname"):
+                affected.append({"host": self.host, "object": "fdb", "ifname": entry["ifname"], "kind": "fdb", "vni": entry.get("vni"), "mac": entry.get("mac")})
+        return affected
+
+    def _recreate(self, link: Dict[str, Any]) -> None:
+        info_data = link["linkinfo"]["info_data"]
+        command = ["ip", "link", "add", link["ifname"], "type", link["linkinfo"]["info_kind"], "id", str(info_data["id"]), "remote", self.new]
+        for option, key in (("local", "local"), ("local", "local6"), ("dev", "link"), ("dstport", "port")):
+            if info_data.get(key):
+                command += [option, str(info_data[key])]
+        self.executor.run(["ip", "link", "del", link["ifname"]])
+        self.executor.run(command)
+        self.executor.run(["ip", "link", "set", link["ifname"], "up"])
+        if link.get("master"):
+            self.executor.run(["ip", "link", "set", "master", link["master"], link["ifname"]])
+
+    def apply(self, affected: List[Dict[str, Any]]) -> List[Dict[str, Any]]:
+        results = []
+        for item in affected:
+            try:
+                if item["object"] == "link":
+                    try:
+                        self.executor.run(["ip", "link", "set", "dev", item["ifname"], "type", item["kind"], "id", str(item["vni"]), "remote", self.new])
+                        action = "updated in place"
+                    except subprocess.CalledProcessError:
+                        self._recreate(item["link"])
+                        action = "recreated"
+                else:
+                    self.executor.run(["bridge", "fdb", "append", item["mac"], "dev", item["ifname"], "dst", self.new])
+                    self.executor.run(["bridge", "fdb", "del", item["mac"], "dev", item["ifname"], "dst", self.old])
+                    action = "updated"
+                results.append({"host": self.host, "object": item["object"], "ifname": item["ifname"], "result": action})
+            except subprocess.CalledProcessError as e:
+                logger.error(f"Error migrating {item['ifname']} on {self.host}: {e}")
+                results.append({"host": self.host, "object": item["object"], "ifname": item["ifname"], "result": f"failed: {e}"})
+        return results
+
+
+class MonitorSettings(NamedTuple):
+    probe_interval: int = 10
+    failure_threshold: int = 3
+    repair: bool = True
+    alert: bool = True
+
+    @classmethod
+    def merge(cls, base: "MonitorSettings", overrides: Dict[str, Any], where: str) -> "MonitorSettings":
+        if not isinstance(overrides, dict):
+            raise TunnelManagerError(f"{where}: monitor settings must be a mapping, got {overrides!r}")
+        unknown = sorted(set(overrides) - set(cls._fields))
+        if unknown:
+            raise TunnelManagerError(f"{where}: unknown monitor settings {', '.join(unknown)} (expected {', '.join(cls._fields)})")
+        for key, value in overrides.items():
+            if isinstance(cls._field_defaults[key], bool):
+                if not isinstance(value, bool):
+                    raise TunnelManagerError(f"{where}: {key} must be true or false, got {value!r}")
+            elif not isinstance(value, int) or isinstance(value, bool) or value < 1:
+                raise TunnelManagerError(f"{where}: {key} must be a positive integer, got {value!r}")
+        return base._replace(**overrides)
+
+
+class Manifest:
+    TUNNEL_FIELDS = ("vni", "type", "src_host", "dst_host", "bridge_name", "src_port", "dst_port", "dev", "peers", "peers_from_dns", "create_bridge", "monitor", "site", "service", "ifname", "address", "vxlan_flags")
+    REQUIRED_FIELDS = ("vni", "src_host", "dst_host", "bridge_name")
+    # A site is one remote with several services; the shared fields are copied into every service
+    SITE_FIELDS = ("name", "type", "src_host", "dst_host", "src_port", "dst_port", "dev", "peers", "peers_from_dns", "create_bridge", "monitor", "services")
+    SITE_REQUIRED_FIELDS = ("name", "src_host", "dst_host", "services")
+    SERVICE_FIELDS = ("name", "vni", "bridge_name", "ifname", "create_bridge", "monitor")
+    SERVICE_REQUIRED_FIELDS = ("name", "vni", "bridge_name")
+    MAX_IFNAME_LENGTH = 15
+
+    def __init__(self, defaults: MonitorSettings, tunnels: List[Dict[str, Any]], sources: Optional[Dict[int, str]] = None) -> None:
+        self.defaults = defaults
+        self.tunnels = tunnels
+        self.sources = sources or {}
+
+    @staticmethod
+    def read(path: str) -> Dict[str, Any]:
+        try:
+            with open(path) as f:
+                document = yaml.safe_load(f) or {}
+        except (OSError, yaml.YAMLError) as e:
+            raise TunnelManagerError(f"Error reading manifest {path}: {e}") from e
+        if not isinstance(document, dict):
+            raise TunnelManagerError(f"Manifest {path} must be a mapping")
+        return document
+
+    @classmethod
+    def load(cls, path: str) -> "Manifest":
+        document = cls.read(path)
+        return cls.build(document, path, cls.collect(path, document, []))
+
+    @classmethod
+    def parse(cls, document: Dict[str, Any], source: str = "manifest") -> "Manifest":
+        return cls.build(document, source, cls.entries(document, source))
+
+    @staticmethod
+    def check_fields(entry: Dict[str, Any], required: Tuple[str, ...], allowed: Tuple[str, ...], where: str) -> None:
+        missing = [field for field in required if field not in entry]
+        if missing:
+            raise TunnelManagerError(f"{where}: missing {', '.join(missing)}")
+        unknown = sorted(set(entry) - set(allowed))
+        if unknown:
+            raise TunnelManagerError(f"{where}: unknown fields {', '.join(unknown)}")
+
+    @classmethod
+    def expand_site(cls, site: Dict[str, Any], where: str) -> List[Tuple[Dict[str, Any], str]]:
+        cls.check_fields(site, cls.SITE_REQUIRED_FIELDS, cls.SITE_FIELDS, where)
+        if not site["services"]:
+            raise TunnelManagerError(f"{where}: a site needs at least one service")
+        shared = {field: site[field] for field in cls.SITE_FIELDS if field in site and field not in ("name", "services")}
+        expanded = []
+        for index, service in enumerate(site["services"]):
+            service_where = f"{where}.services[{index}]"
+            cls.check_fields(service, cls.SERVICE_REQUIRED_FIELDS, cls.SERVICE_FIELDS, service_where)
+            ifname = service.get("ifname") or f"{site['name']}-{service['name']}"
+            if len(ifname) > cls.MAX_IFNAME_LENGTH:
+                raise TunnelManagerError(f"{service_where}: interface name {ifname} is longer than {cls.MAX_IFNAME_LENGTH} characters; shorten the site or service name or set ifname")
+            entry = dict(shared, type=site.get("type", TunnelType.GENEVE.value), site=site["name"], service=service["name"], ifname=ifname, **{field: value for field, value in service.items() if field not in ("name", "ifname")})
+            if "monitor" in site and "monitor" in service:
+                entry["monitor"] = dict(site["monitor"], **service["monitor"])
+            expanded.append((entry, service_where))
+        return expanded
+
+    @classmethod
+    def entries(cls, document: Dict[str, Any], path: str) -> List[Tuple[Dict[str, Any], str, str]]:
+        entries = [(entry, path, f"{path}: tunnels[{index}]") for index, entry in enumerate(document.get("tunnels", []))]
+        for index, site in enumerate(document.get("sites", [])):
+            entries += [(entry, path, where) for entry, where in cls.expand_site(site, f"{path}: sites[{index}]")]
+        return entries
+
+    @classmethod
+    def collect(cls, path: str, document: Dict[str, Any], stack: List[str]) -> List[Tuple[Dict[str, Any], str, str]]:
+        real_path = os.path.realpath(path)
+        if real_path in stack:
+            raise TunnelManagerError(f"Manifest include cycle: {' -> '.join(stack + [real_path])}")
+        entries = cls.entries(document, path)
+        for pattern in document.get("include", []):
+            # Patterns are relative to the including file, not the working directory
+            matches = sorted(glob.glob(os.path.join(os.path.dirname(path), pattern)))
+            if not matches and not glob.has_magic(pattern):
+                raise TunnelManagerError(f"{path}: included manifest {pattern} does not exist")
+            for included in matches:
+                included_document = cls.read(included)
+                if "agent" in included_document:
+                    raise TunnelManagerError(f"{included}: agent settings are only allowed in the top-level manifest")
+                entries += cls.collect(included, included_document, stack + [real_path])
+        return entries
+
+    @classmethod
+    def build(cls, document: Dict[str, Any], source: str, entries: List[Tuple[Dict[str, Any], str, str]]) -> "Manifest":
+        defaults = MonitorSettings.merge(MonitorSettings(), document.get("agent", {}), f"{source}: agent")
+        tunnels, sources, vnis, bridges, ifnames = [], {}, {}, {}, {}
+        for entry, path, where in entries:
+            cls.check_fields(entry, cls.REQUIRED_FIELDS, cls.TUNNEL_FIELDS, where)
+            entry = dict(entry, type=entry.get("type", TunnelType.VXLAN.value))
+            if entry["type"] not in [tunnel_type.value for tunnel_type in TunnelType]:
+                raise TunnelManagerError(f"{where}: unsupported tunnel type {entry['type']}")
+            if entry["vni"] in vnis:
+                raise TunnelManagerError(f"{where}: VNI {entry['vni']} is already declared in {vnis[entry['vni']]}")
+            # A bridge shared between files would join tunnels of different tenants
+            if bridges.setdefault(entry["bridge_name"], (path, where))[0] != path:
+                raise TunnelManagerError(f"{where}: bridge {entry['bridge_name']} is already used by {bridges[entry['bridge_name']][1]}")
+            if entry.get("ifname") and ifnames.setdefault(entry["ifname"], where) != where:
+                raise TunnelManagerError(f"{where}: interface name {entry['ifname']} is already used by {ifnames[entry['ifname']]}")
+            if entry.get("src_port") is not None and entry["type"] == TunnelType.VXLAN.value:
+                try:
+                    VXLANTunnel.port_range(entry["src_port"])
+                except TunnelManagerError as e:
+                    raise TunnelManagerError(f"{where}: {e}") from e
+            if "vxlan_flags" in entry:
+                flags = entry["vxlan_flags"]
+                if entry["type"] != TunnelType.VXLAN.value:
+                    raise TunnelManagerError(f"{where}: vxlan_flags only apply to vxlan tunnels")
+                if not isinstance(flags, dict) or set(flags) - set(VXLANTunnel.FLAGS) or not all(isinstance(value, bool) for value in flags.values()):
+                    raise TunnelManagerError(f"{where}: vxlan_flags must map {', '.join(VXLANTunnel.FLAGS)} to true or false")
+            if "peers_from_dns" in entry:
+                if entry["type"] != TunnelType.VXLAN.value:
+                    raise TunnelManagerError(f"{where}: peers_from_dns only applies to vxlan tunnels")
+                if not isinstance(entry["peers_from_dns"], str) or not entry["peers_from_dns"]:
+                    raise TunnelManagerError(f"{where}: peers_from_dns must be a DNS name, got {entry['peers_from_dns']!r}")
+                if "peers" in entry:
+                    raise TunnelManagerError(f"{where}: peers and peers_from_dns cannot be combined")
+            if "address" in entry:
+                try:
+                    ipaddress.ip_interface(entry["address"])
+                except ValueError as e:
+                    raise TunnelManagerError(f"{where}: invalid overlay address {entry['address']}") from e
+            vnis[entry["vni"]] = where
+            sources[entry["vni"]] = path
+            # Validate overrides up front so a typo fails the load, not the first probe
+            MonitorSettings.merge(defaults, entry.get("monitor", {}), f"{where}: monitor")
+            tunnels.append(entry)
+        return cls(defaults, tunnels, sources)
+
+    def render(self) -> str:
+        lines = [yaml.dump({"agent": self.defaults._asdict()}, default_flow_style=False, sort_keys=False).rstrip(), "tunnels:"]
+        for entry in self.tunnels:
+            lines.append(f"# source: {self.sources.get(entry['vni'], '')}")
+            lines.append(yaml.dump([{field: entry[field] for field in self.TUNNEL_FIELDS if field in entry}], default_flow_style=False, sort_keys=False).rstrip())
+        return "\n".join(lines) + "\n"
+
+    def tunnel(self, vni: int) -> Dict[str, Any]:
+        for entry in self.tunnels:
+            if entry["vni"] == vni:
+                return entry
+        raise TunnelManagerError(f"VNI {vni} is not declared in the manifest")
+
+    def settings(self, vni: int) -> MonitorSettings:
+        return MonitorSettings.merge(self.defaults, self.tunnel(vni).get("monitor", {}), f"VNI {vni}")
+
+
+class Metric(NamedTuple):
+    name: str
+    kind: str
+    help: str
+    labels: Tuple[str, ...]
+    panel: str
+    unit: str
+
+
+class MetricRegistry:
+    def __init__(self, const_labels: Optional[Dict[str, str]] = None) -> None:
+        self.const_labels = const_labels or {}
+        self.metrics: Dict[str, Metric] = {}
+        self.values: Dict[str, Dict[Tuple[str, ...], float]] = {}
+
+    def register(self, name: str, kind: str, help: str, labels: Tuple[str, ...] = (), panel: str = "", unit: str = "short") -> str:
+        self.metrics[name] = Metric(name, kind, help, labels, panel or help, unit)
+        self.values[name] = {}
+        return name
+
+    def _key(self, name: str, labels: Dict[str, Any]) -> Tuple[str, ...]:
+        return tuple(str(labels[label]) for label in self.metrics[name].labels)
+
+    def set(self, name: str, value: float, **labels: Any) -> None:
+        self.values[name][self._key(name, labels)] = value
+
+    def reset(self, name: str) -> None:
+        self.values[name] = {}
+
+    def inc(self, name: str, amount: float = 1, **labels: Any) -> None:
+        key = self._key(name, labels)
+        self.values[name][key] = self.values[name].get(key, 0) + amount
+
+    def render(self) -> str:
+        lines = []
+        for metric in self.metrics.values():
+            lines += [f"# HELP {metric.name} {metric.help}", f"# TYPE {metric.name} {metric.kind}"]
+            for key, value in sorted(self.values[metric.name].items()):
+                labels = dict(self.const_labels, **dict(zip(metric.labels, key)))
+                rendered = ",".join(f'{label}="{value}"' for label, value in labels.items())
+                lines.append(f"{metric.name}{{{rendered}}} {value:g}" if rendered else f"{metric.name} {value:g}")
+        return "\n".join(lines) + "\n"
+
+    def write(self, path: str) -> None:
+        # Rename into place so the node_exporter textfile collector never reads a partial file
+        tmp_path = f"{path}.tmp"
+        with open(tmp_path, "w") as f:
+            f.write(self.render())
+        os.replace(tmp_path, path)
+
+
+METRICS = MetricRegistry({"host": socket.gethostname()})
+TUNNEL_UP = METRICS.register("tunnelmgr_tunnel_up", "gauge", "Whether the tunnel device exists (1) or not (0)", ("type", "vni"), "Tunnel up/down")
+TUNNEL_RX_BYTES = METRICS.register("tunnelmgr_tunnel_rx_bytes_total", "counter", "Bytes received on the tunnel device", ("type", "vni"), "Throughput", "Bps")
+TUNNEL_TX_BYTES = METRICS.register("tunnelmgr_tunnel_tx_bytes_total", "counter", "Bytes sent on the tunnel device", ("type", "vni"), "Throughput", "Bps")
+TUNNEL_RX_PACKETS = METRICS.register("tunnelmgr_tunnel_rx_packets_total", "counter", "Packets received on the tunnel device", ("type", "vni"), "Packet rate", "pps")
+TUNNEL_TX_PACKETS = METRICS.register("tunnelmgr_tunnel_tx_packets_total", "counter", "Packets sent on the tunnel device", ("type", "vni"), "Packet rate", "pps")
+MANAGED_TUNNELS = METRICS.register("tunnelmgr_managed_tunnels", "gauge", "Tunnels recorded in the state file", ("type",), "Managed tunnels")
+OPERATIONS = METRICS.register("tunnelmgr_operations_total", "counter", "Requests handled by the daemon", ("method",), "Daemon operations", "ops")
+OPERATION_FAILURES = METRICS.register("tunnelmgr_operation_failures_total", "counter", "Requests the daemon failed", ("method",), "Daemon operations", "ops")
+RECONCILE_SECONDS = METRICS.register("tunnelmgr_reconcile_duration_seconds", "gauge", "Duration of the last reconcile cycle", (), "Reconcile latency", "s")
+RECONCILE_ACTIONS = METRICS.register("tunnelmgr_reconcile_actions_total", "counter", "Actions taken by the agent", ("action",), "Reconcile actions", "ops")
+REATTACHMENTS = METRICS.register("tunnelmgr_reattachments_total", "counter", "Tunnels re-attached to a recreated bridge", ("type", "vni"), "Reconcile actions", "ops")
+RECONCILE_ERRORS = METRICS.register("tunnelmgr_reconcile_errors_total", "counter", "Failed repairs by the agent", ("type", "vni"), "Reconcile errors", "ops")
+RECREATIONS = METRICS.register("tunnelmgr_recreations_total", "counter", "Deleted tunnels re-created by the daemon", ("type", "vni"), "Reconcile actions", "ops")
+BRIDGE_TUNNELS = METRICS.register("tunnelmgr_bridge_tunnels", "gauge", "Tunnel ports on the bridge, managed or not", ("bridge",), "Bridge tunnel ports")
+BRIDGE_TUNNEL_LIMIT = METRICS.register("tunnelmgr_bridge_tunnel_limit", "gauge", "Tunnel ports allowed on the bridge by --max-tunnels-per-bridge", ("bridge",), "Bridge tunnel ports")
+DNS_PEER_FAILURES = METRICS.register("tunnelmgr_dns_peer_failures_total", "counter", "Failed DNS lookups of flood peers; the last known peers are kept", ("type", "vni"), "DNS peer failures", "ops")
+DRIFT_EVENTS = METRICS.register("tunnelmgr_drift_events_total", "counter", "Drift detected on the underlay devices and bridges of tunnels", ("event", "type", "vni"), "Drift events", "ops")
+
+
+# Renders recorded tunnels and their bridges as systemd-networkd units, so they are rebuilt at boot
+class NetworkdExporter:
+    PREFIX = "60-tunnelmgr-"
+    NETDEV_KINDS = {"vxlan": "VXLAN", "geneve": "GENEVE", "gretap": "Tunnel", "gre": "Tunnel"}
+    PORT_FLAGS = {"learning": "Learning", "flood": "UnicastFlood", "mcast_flood": "MulticastFlood", "neigh_suppress": "NeighborSuppression"}
+
+    def __init__(self, records: List[Dict[str, Any]]) -> None:
+        self.records = sorted(records, key=lambda record: (record["tunnel_type"], record["vni"]))
+
+    @staticmethod
+    def render(sections: List[Tuple[str, List[Tuple[str, Any]]]]) -> str:
+        # A section may repeat, such as one [BridgeFDB] per peer; settings without a value are left out
+        blocks = [f"[{name}]\n" + "".join(f"{key}={value}\n" for key, value in settings if value not in (None, "")) for name, settings in sections]
+        return "# Generated by tunnel_manager export systemd-networkd\n" + "\n".join(blocks)
+
+    def tunnel_netdev(self, record: Dict[str, Any], ifname: str) -> str:
+        kind, vni, remote = record["tunnel_type"], record["vni"], record["dst_host"]
+        group = TunnelInterface.is_multicast(remote)
+        if kind == "vxlan":
+            # Independent= keeps the device from waiting for a VXLAN= line in the underlay's own .network file
+            settings = [("VNI", vni), ("Local", record.get("src_host")), ("Group" if group else "Remote", remote), ("DestinationPort", record.get("dst_port") or VXLANTunnel.DEFAULT_PORT), ("Independent", "yes")]
+        elif kind == "geneve":
+            settings = [("Id", vni), ("Remote", remote), ("DestinationPort", record.get("dst_port") or GeneveTunnel.DEFAULT_PORT)]
+        else:
+            settings = [("Local", record.get("src_host")), ("Remote", remote), ("Key", vni), ("Independent", "yes")]
+        return self.render([("NetDev", [("Name", ifname), ("Kind", kind)]), (self.NETDEV_KINDS[kind], settings)])
+
+    def tunnel_network(self, record: Dict[str, Any], ifname: str) -> str:
+        sections = [("Match", [("Name", ifname)]), ("Link", [("Group", record.get("link_group"))]), ("Network", [("Bridge", record["bridge_name"] if record["tunnel_type"] != "gre" else None), ("LinkLocalAddressing", "no")])]
+        flags = [(self.PORT_FLAGS[flag], "yes" if value == "on" else "no") for flag, value in (record.get("port_flags") or {}).items() if flag in self.PORT_FLAGS]
+        if flags:
+            sections.append(("Bridge", flags))
+        sections += [("BridgeFDB", [("MACAddress", FloodList.ALL_ZEROS_MAC), ("Destination", peer)]) for peer in record.get("peers") or []]
+        return self.render([section for section in sections if any(value not in (None, "") for _, value in section[1])])
+
+    def bridge_netdev(self, name: str, options: Dict[str, Any]) -> str:
+        bridge = [("STP", None if options.get("stp") is None else "yes" if options["stp"] else "no"), ("ForwardDelaySec", options.get("forward_delay"))]
+        return self.render([("NetDev", [("Name", name), ("Kind", "bridge"), ("MTUBytes", options.get("mtu"))])] + ([("Bridge", bridge)] if any(value is not None for _, value in bridge) else []))
+
+    def bridge_network(self, name: str, records: List[Dict[str, Any]]) -> str:
+        routes = [("Route", [("Destination", prefix), ("MTUBytes", record.get("route_mtu"))]) for record in records for prefix in record.get("routes") or []]
+        return self.render([("Match", [("Name", name)]), ("Network", [("ConfigureWithoutCarrier", "yes"), ("LinkLocalAddressing", "no")])] + routes)
+
+    def units(self) -> Dict[str, str]:
+        units: Dict[str, str] = {}
+        bridges: Dict[str, List[Dict[str, Any]]] = {}
+        for record in self.records:
+            ifname = record.get("ifname") or f"{record['tunnel_type']}{record['vni']}"
+            units[f"{self.PREFIX}{ifname}.netdev"] = self.tunnel_netdev(record, ifname)
+            units[f"{self.PREFIX}{ifname}.network"] = self.tunnel_network(record, ifname)
+            if record["tunnel_type"] != "gre":
+                bridges.setdefault(record["bridge_name"], []).append(record)
+        for name, records in sorted(bridges.items()):
+            options = next((record["bridge_options"] for record in records if record.get("bridge_options")), {})
+            units[f"{self.PREFIX}{name}.netdev"] = self.bridge_netdev(name, options)
+            units[f"{self.PREFIX}{name}.network"] = self.bridge_network(name, records)
+        return units
+
+
+# Renders tunnels as a netplan document; netplan has no GENEVE devices, flood entries or port flags
+class NetplanExporter:
+    def __init__(self, records: List[Dict[str, Any]]) -> None:
+        self.records = sorted(records, key=lambda record: (record["tunnel_type"], record["vni"]))
+        self.skipped: List[str] = []
+
+    @staticmethod
+    def from_manifest(manifest: Manifest, resolver: HostResolver) -> List[Dict[str, Any]]:
+        # netplan only takes addresses, so declared host names are resolved now
+        return [dict({field: entry[field] for field in ("vni", "bridge_name", "dst_port", "dev", "ifname", "peers") if field in entry}, tunnel_type=entry["type"], src_host=resolver.resolve(entry["src_host"]), dst_host=resolver.resolve(entry["dst_host"])) for entry in manifest.tunnels]
+
+    @staticmethod
+    def tunnel(record: Dict[str, Any]) -> Dict[str, Any]:
+        kind, remote = record["tunnel_type"], record["dst_host"]
+        mode = f"ip6{kind}" if kind != "vxlan" and ipaddress.ip_address(remote).version == 6 else kind
+        tunnel: Dict[str, Any] = {"mode": mode, "local": record.get("src_host"), "remote": remote}
+        if kind == "vxlan":
+            tunnel.update({"id": record["vni"], "port": record.get("dst_port") or VXLANTunnel.DEFAULT_PORT, "link": record.get("dev")})
+        else:
+            tunnel["key"] = record["vni"]
+        return {key: value for key, value in tunnel.items() if value is not None}
+
+    @staticmethod
+    def bridge(interfaces: List[str], records: List[Dict[str, Any]]) -> Dict[str, Any]:
+        bridge: Dict[str, Any] = {"interfaces": interfaces}
+        options = next((record["bridge_options"] for record in records if record.get("bridge_options")), {})
+        if options.get("mtu"):
+            bridge["mtu"] = options["mtu"]
+        parameters = {key: value for key, value in (("stp", options.get("stp")), ("forward-delay", options.get("forward_delay"))) if value is not None}
+        if parameters:
+            bridge["parameters"] = parameters
+        routes = [dict({"to": prefix}, **({"mtu": record["route_mtu"]} if record.get("route_mtu") else {})) for record in records for prefix in record.get("routes") or []]
+        if routes:
+            bridge["routes"] = routes
+        return bridge
+
+    def document(self) -> Dict[str, Any]:
+        tunnels: Dict[str, Any] = {}
+        bridges: Dict[str, Tuple[List[str], List[Dict[str, Any]]]] = {}
+        self.skipped = []
+        for record in self.records:
+            ifname = record.get("ifname") or f"{record['tunnel_type']}{record['vni']}"
+            if record["tunnel_type"] == TunnelType.GENEVE.value:
+                self.skipped.append(f"{ifname}: netplan has no GENEVE tunnels")
+                continue
+            if record.get("peers"):
+                self.skipped.append(f"{ifname}: flood entries for {', '.join(record['peers'])} have no netplan equivalent")
+            tunnels[ifname] = self.tunnel(record)
+            if record["tunnel_type"] != TunnelType.GRE.value:
+                interfaces, members = bridges.setdefault(record["bridge_name"], ([], []))
+                interfaces.append(ifname)
+                members.append(record)
+        network: Dict[str, Any] = {"version": 2}
+        if tunnels:
+            network["tunnels"] = tunnels
+        if bridges:
+            network["bridges"] = {name: self.bridge(interfaces, members) for name, (interfaces, members) in sorted(bridges.items())}
+        return {"network": network}
+
+    def render(self) -> str:
+        return "# Generated by tunnel_manager export netplan\n" + yaml.dump(self.document(), default_flow_style=False, sort_keys=False)
+
+
+# Renders VXLAN and GENEVE tunnels and their bridges as NetworkManager keyfile connection profiles
+class NetworkManagerExporter:
+    KINDS = ("vxlan", "geneve")
+    SUFFIX = ".nmconnection"
+
+    def __init__(self, records: List[Dict[str, Any]]) -> None:
+        self.records = sorted(records, key=lambda record: (record["tunnel_type"], record["vni"]))
+        self.skipped: List[str] = []
+
+    @staticmethod
+    def render(name: str, sections: List[Tuple[str, List[Tuple[str, Any]]]]) -> str:
+        # The UUID derives from the name, so exporting again updates the profile instead of adding one
+        connection = [("id", name), ("uuid", uuid.uuid5(uuid.NAMESPACE_DNS, f"{name}.tunnelmgr")), ("interface-name", name)]
+        blocks = [f"[{section}]\n" + "".join(f"{key}={str(value).lower() if isinstance(value, bool) else value}\n" for key, value in settings if value not in (None, "")) for section, settings in [("connection", connection + sections[0][1])] + sections[1:]]
+        return "# Generated by tunnel_manager export networkmanager\n" + "\n".join(blocks)
+
+    def tunnel_profile(self, record: Dict[str, Any], ifname: str) -> str:
+        kind = record["tunnel_type"]
+        settings = [("id", record["vni"]), ("remote", record["dst_host"])]
+        if kind == "vxlan":
+            learning = (record.get("port_flags") or {}).get("learning")
+            settings = settings[:1] + [("local", record.get("src_host"))] + settings[1:] + [("destination-port", record.get("dst_port") or VXLANTunnel.DEFAULT_PORT), ("parent", record.get("dev")), ("learning", None if learning is None else learning == "on")]
+        else:
+            settings.append(("destination-port", record.get("dst_port") or GeneveTunnel.DEFAULT_PORT))
+        return self.render(ifname, [("connection", [("type", kind), ("master", record["bridge_name"]), ("slave-type", "bridge"), ("autoconnect", True)]), (kind, settings)])
+
+    def bridge_profile(self, name: str, options: Dict[str, Any]) -> str:
+        # NetworkManager turns STP on by default, unlike a bridge added with ip link
+        sections = [("connection", [("type", "bridge"), ("autoconnect", True)]), ("bridge", [("stp", bool(options.get("stp"))), ("forward-delay", options.get("forward_delay"))])]
+        if options.get("mtu"):
+            sections.append(("ethernet", [("mtu", options["mtu"])]))
+        # The bridge only switches tunnel traffic; it gets no addresses of its own
+        return self.render(name, sections + [("ipv4", [("method", "disabled")]), ("ipv6", [("method", "disabled")])])
+
+    def profiles(self) -> Dict[str, str]:
+        profiles: Dict[str, str] = {}
+        bridges: Dict[str, List[Dict[str, Any]]] = {}
+        self.skipped = []
+        for record in self.records:
+            ifname = record.get("ifname") or f"{record['tunnel_type']}{record['vni']}"
+            if record["tunnel_type"] not in self.KINDS:
+                self.skipped.append(f"{ifname}: only VXLAN and GENEVE tunnels are exported")
+                continue
+            if record.get("peers"):
+                self.skipped.append(f"{ifname}: flood entries for {', '.join(record['peers'])} have no NetworkManager equivalent")
+            if record.get("routes"):
+                self.skipped.append(f"{ifname}: routes over {record['bridge_name']} need an address on the bridge, which NetworkManager profiles here do not set")
+            profiles[f"{ifname}{self.SUFFIX}"] = self.tunnel_profile(record, ifname)
+            bridges.setdefault(record["bridge_name"], []).append(record)
+        for name, records in sorted(bridges.items()):
+            options = next((record["bridge_options"] for record in records if record.get("bridge_options")), {})
+            profiles[f"{name}{self.SUFFIX}"] = self.bridge_profile(name, options)
+        return profiles
+
+
+# Renders tunnels and their bridges as interfaces(5) stanzas that run the same commands as create at ifup
+class IfupdownExporter:
+    def __init__(self, records: List[Dict[str, Any]], bridge_tool: str = "ip") -> None:
+        self.records = sorted(records, key=lambda record: (record["tunnel_type"], record["vni"]))
+        self.bridge_tool = bridge_tool
+
+    @staticmethod
+    def stanza(name: str, commands: List[List[str]], teardown: List[List[str]]) -> str:
+        # The device is added before ifup brings it up; everything that needs it up follows
+        lines = [f"auto {name}", f"iface {name} inet manual", f"    pre-up {shlex.join(commands[0])}"]
+        lines += [f"    up {shlex.join(command)}" for command in commands[1:]] + [f"    post-down {shlex.join(command)}" for command in teardown]
+        return "\n".join(lines) + "\n"
+
+    def tunnel_commands(self, record: Dict[str, Any], ifname: str) -> List[List[str]]:
+        recorder = RecordingExecutor()
+        tunnel = TunnelFactory.create_tunnel(TunnelType(record["tunnel_type"]), bridge_tool=self.bridge_tool, executor=recorder, ifnames={record["vni"]: ifname})
+        tunnel.create_tunnel_interface(record["vni"], record["src_host"], record["dst_host"], record["bridge_name"], record.get("src_port"), record.get("dst_port"), record.get("dev"))
+        if record.get("link_group") is not None:
+            LinkGroup(recorder).assign(ifname, record["link_group"])
+        BridgePort(recorder).set_flags(ifname, record.get("port_flags") or {})
+        FloodList(recorder).add(ifname, record.get("peers") or [])
+        TunnelRoutes(recorder).add(record.get("routes") or [], record["bridge_name"], record.get("route_mtu"))
+        return recorder.commands
+
+    def render(self) -> str:
+        bridges: Dict[str, Dict[str, Any]] = {}
+        tunnels = []
+        for record in self.records:
+            ifname = record.get("ifname") or f"{record['tunnel_type']}{record['vni']}"
+            commands = self.tunnel_commands(record, ifname)
+            # Flood entries and ports go with the device; only routes on the bridge outlive it
+            teardown = [inverse_command(command) for command in reversed(commands) if command[:3] in (["ip", "route", "add"], ["ip", "link", "add"])]
+            tunnels.append(self.stanza(ifname, commands, teardown))
+            if record["tunnel_type"] != TunnelType.GRE.value and not bridges.get(record["bridge_name"]):
+                bridges[record["bridge_name"]] = record.get("bridge_options") or {}
+        backend = BRIDGE_BACKENDS[self.bridge_tool]
+        stanzas = [self.stanza(name, backend(RecordingExecutor()).create_commands(name, **options), [backend.delete_command(name)]) for name, options in sorted(bridges.items())]
+        # Bridges come first, since ifup brings interfaces up in file order
+        return "# Generated by tunnel_manager export ifupdown\n\n" + "\n".join(stanzas + tunnels)
+
+
+class BgpExporter:
+    def __init__(self, records: List[Dict[str, Any]], asn: int, router_id: Optional[str] = None, neighbors: Optional[List[str]] = None, remote_as: str = "internal") -> None:
+        if not 1 <= asn <= 4294967295:
+            raise TunnelManagerError(f"Invalid AS number {asn} (expected 1-4294967295)")
+        if remote_as not in ("internal", "external") and not (remote_as.isdigit() and 1 <= int(remote_as) <= 4294967295):
+            raise TunnelManagerError(f"Invalid remote AS {remote_as} (expected internal, external or an AS number)")
+        self.records = sorted(records, key=lambda record: (record["tunnel_type"], record["vni"]))
+        self.asn = asn
+        self.router_id = router_id
+        self.neighbors = neighbors
+        self.remote_as = remote_as
+        self.skipped: List[str] = []
+        self.warnings: List[str] = []
+
+    def local_router_id(self, records: List[Dict[str, Any]]) -> str:
+        if self.router_id:
+            return self.router_id
+        # The VTEP address is the usual router ID; several of them leave the choice to the caller
+        sources = sorted({record["src_host"] for record in records if ipaddress.ip_address(record["src_host"]).version == 4})
+        if len(sources) != 1:
+            raise TunnelManagerError(f"Cannot pick a router ID from {', '.join(sources) or 'no IPv4 VTEP address'}; pass --router-id")
+        return sources[0]
+
+
+# Renders FRR configuration that advertises the recorded VXLAN VNIs over BGP EVPN; zebra learns the VNIs from the devices themselves
+class FrrEvpnExporter(BgpExporter):
+    def vxlan_records(self) -> List[Dict[str, Any]]:
+        records = []
+        for record in self.records:
+            ifname = record.get("ifname") or f"{record['tunnel_type']}{record['vni']}"
+            if record["tunnel_type"] != TunnelType.VXLAN.value:
+                self.skipped.append(f"{ifname}: EVPN advertises VXLAN VNIs only")
+                continue
+            if (record.get("vxlan_flags") or {}).get("learning", True):
+                self.warnings.append(f"{ifname}: MAC learning is on; EVPN installs remote MACs itself, so recreate it with --learning off")
+            records.append(record)
+        return records
+
+    @staticmethod
+    def vni_block(asn: int, router_id: Optional[str], vni: int) -> List[str]:
+        # An IP-based RD has a 16-bit number, and a 4-byte AS leaves 16 bits for the VNI in the RT; beyond that FRR derives them itself
+        rd = f"{router_id}:{vni}" if router_id and vni <= 65535 else None
+        rt = f"{asn}:{vni}" if asn <= 65535 or vni <= 65535 else None
+        return [f"vni {vni}"] + ([f" rd {rd}"] if rd else []) + ([f" route-target import {rt}", f" route-target export {rt}"] if rt else []) + ["exit-vni"]
+
+    def render(self) -> str:
+        self.skipped, self.warnings = [], []
+        records = self.vxlan_records()
+        router_id = self.local_router_id(records)
+        # The remotes of the tunnels are the other VTEPs, so they are the BGP peers unless others are given
+        remotes = [peer for record in records for peer in [record["dst_host"]] + list(record.get("peers") or []) if not ipaddress.ip_address(peer).is_multicast]
+        neighbors = self.neighbors if self.neighbors is not None else sorted(set(remotes), key=ipaddress.ip_address)
+        lines = ["! Generated by tunnel_manager export frr", "frr defaults datacenter", "!", f"router bgp {self.asn}", f" bgp router-id {router_id}", " no bgp default ipv4-unicast"]
+        lines += [f" neighbor {neighbor} remote-as {self.remote_as}" for neighbor in neighbors]
+        lines += [" !", " address-family l2vpn evpn"] + [f"  neighbor {neighbor} activate" for neighbor in neighbors] + ["  advertise-all-vni"]
+        for vni in sorted({record["vni"] for record in records}):
+            lines += [f"  {line}" for line in self.vni_block(self.asn, router_id, vni)]
+        lines += [" exit-address-family", "exit", "!"]
+        return "\n".join(lines) + "\n"
+
+
+# Pushes the EVPN configuration of each VXLAN VNI into a running FRR through vtysh as tunnels come and go
+class FrrEvpnSync:
+    def __init__(self, asn: int, executor: Optional[CommandExecutor] = None) -> None:
+        if not 1 <= asn <= 4294967295:
+            raise TunnelManagerError(f"Invalid AS number {asn} (expected 1-4294967295)")
+        self.asn = asn
+        self.executor = executor or SubprocessExecutor()
+
+    def vtysh(self, lines: List[str]) -> None:
+        command = ["vtysh", "-c", "configure terminal", "-c", f"router bgp {self.asn}", "-c", "address-family l2vpn evpn"]
+        for line in lines:
+            command += ["-c", line.strip()]
+        try:
+            self.executor.run(command)
+        except (subprocess.CalledProcessError, FileNotFoundError) as e:
+            logger.error(f"Error configuring BGP EVPN in FRR: {e}")
+            raise TunnelManagerError(f"Error configuring BGP EVPN in FRR (router bgp {self.asn}); is FRR running with bgpd?") from e
+
+    def add(self, vni: int, vtep: str) -> None:
+        router_id = vtep if ipaddress.ip_address(vtep).version == 4 else None
+        self.vtysh(["advertise-all-vni"] + FrrEvpnExporter.vni_block(self.asn, router_id, vni))
+
+    def remove(self, vni: int) -> None:
+        self.vtysh([f"no vni {vni}"])
+
+    def configured(self) -> List[int]:
+        try:
+            config = self.executor.run(["vtysh", "-c", "show running-config"]).stdout or ""
+        except (subprocess.CalledProcessError, FileNotFoundError) as e:
+            raise TunnelManagerError("Error reading the FRR running configuration") from e
+        vnis, router, evpn = [], False, False
+        for line in config.splitlines():
+            if not line.startswith(" "):
+                router, evpn = line.strip() == f"router bgp {self.asn}", False
+            elif router and line.strip().startswith("address-family"):
+                evpn = line.strip() == "address-family l2vpn evpn"
+            elif router and evpn and (match := re.fullmatch(r"\s+vni (\d+)", line)):
+                vnis.append(int(match[1]))
+        return vnis
+
+    def sync(self, records: List[Dict[str, Any]]) -> List[Dict[str, Any]]:
+        wanted = {record["vni"]: record["src_host"] for record in records if record["tunnel_type"] == TunnelType.VXLAN.value}
+        configured = self.configured()
+        rows = []
+        for vni, vtep in sorted(wanted.items()):
+            if vni not in configured:
+                self.add(vni, vtep)
+                rows.append({"vni": vni, "action": "added"})
+        for vni in configured:
+            if vni not in wanted:
+                self.remove(vni)
+                rows.append({"vni": vni, "action": "removed"})
+        return rows
+
+
+# Renders a BIRD 2 configuration that announces the VTEP addresses and the overlay prefixes routed over the bridges to the underlay
+class BirdExporter(BgpExporter):
+    STATIC = {4: "tunnelmgr4", 6: "tunnelmgr6"}
+
+    @staticmethod
+    def protocol_name(neighbor: str) -> str:
+        return "tunnelmgr_" + re.sub(r"[^0-9A-Za-z]", "_", neighbor)
+
+    def routes(self) -> Dict[int, List[str]]:
+        routes: Dict[int, List[str]] = {4: [], 6: []}
+        for record in self.records:
+            vtep = ipaddress.ip_address(record["src_host"])
+            # The VTEP address is local; blackhole keeps the route inside BIRD, where BGP announces it with itself as next hop
+            route = f"route {vtep}/{vtep.max_prefixlen} blackhole;"
+            if route not in routes[vtep.version]:
+                routes[vtep.version].append(route)
+            for prefix in record.get("routes") or []:
+                network = ipaddress.ip_network(prefix, strict=False)
+                route = f'route {network} via "{record["bridge_name"]}";'
+                if route not in routes[network.version]:
+                    routes[network.version].append(route)
+        return {version: entries for version, entries in routes.items() if entries}
+
+    def render(self) -> str:
+        self.skipped, self.warnings = [], []
+        if not self.neighbors:
+            raise TunnelManagerError("BIRD announces the VTEPs to underlay routers, which cannot be guessed from the tunnels; pass --neighbor")
+        router_id = self.local_router_id(self.records)
+        routes = self.routes()
+        remote_as = self.remote_as if self.remote_as in ("internal", "external") else f"as {self.remote_as}"
+        blocks = [f"# Generated by tunnel_manager export bird\nrouter id {router_id};\n", "# Interface routes need the interfaces BIRD learns here\nprotocol device {\n}\n"]
+        for version, entries in routes.items():
+            blocks.append(f"protocol static {self.STATIC[version]} {{\n\tipv{version};\n" + "".join(f"\t{entry}\n" for entry in entries) + "}\n")
+        for neighbor in self.neighbors:
+            channels = "".join(f'\tipv{version} {{\n\t\timport none;\n\t\texport where proto = "{self.STATIC[version]}";\n\t}};\n' for version in routes)
+            blocks.append(f"protocol bgp {self.protocol_name(neighbor)} {{\n\tlocal as {self.asn};\n\tneighbor {neighbor} {remote_as};\n{channels}}}\n")
+        return "\n".join(blocks)
+
+
+class GrafanaDashboard:
+    def __init__(self, registry: MetricRegistry = METRICS, title: str = "Tunnel Manager") -> None:
+        self.registry = registry
+        self.title = title
+
+    @staticmethod
+    def target(metric: Metric, ref_id: str, shared: bool) -> Dict[str, Any]:
+        selector = f'{metric.name}{{host=~"$host"}}'
+        expr = selector if metric.kind == "gauge" else f"rate({selector}[$__rate_interval])"
+        legend = " ".join(f"{{{{{label}}}}}" for label in ("host",) + metric.labels)
+        # Panels plotting several metrics need the metric in the legend to tell the series apart
+        if shared:
+            legend += f" {metric.name.removeprefix('tunnelmgr_')}"
+        return {"expr": expr, "legendFormat": legend, "refId": ref_id}
+
+    def build(self) -> Dict[str, Any]:
+        panels: Dict[str, Dict[str, Any]] = {}
+        for metric in self.registry.metrics.values():
+            panel = panels.setdefault(metric.panel, {"title": metric.panel, "type": "timeseries", "datasource": {"type": "prometheus", "uid": "${datasource}"}, "fieldConfig": {"defaults": {"unit": metric.unit}, "overrides": []}, "targets": []})
+            shared = sum(1 for other in self.registry.metrics.values() if other.panel == metric.panel) > 1
+            panel["targets"].append(self.target(metric, chr(ord("A") + len(panel["targets"])), shared))
+        for index, panel in enumerate(panels.values()):
+            panel.update(id=index + 1, gridPos={"h": 8, "w": 12, "x": 12 * (index % 2), "y": 8 * (index // 2)})
+        first = next(iter(self.registry.metrics))
+        templating = [
+            {"name": "datasource", "type": "datasource", "query": "prometheus", "label": "Data source"},
+            {"name": "host", "type": "query", "label": "Host", "datasource": {"type": "prometheus", "uid": "${datasource}"}, "query": f"label_values({first}, host)", "refresh": 2, "multi": True, "includeAll": True},
+        ]
+        return {"title": self.title, "uid": "tunnelmgr", "schemaVersion": 39, "time": {"from": "now-6h", "to": "now"}, "refresh": "30s", "tags": ["tunnel_manager"], "templating": {"list": templating}, "panels": list(panels.values())}
+
+
+class DriftCheck(NamedTuple):
+    event: str
+    # Manifest field naming the device the check looks at
+    field: str
+    # Given the device's current link (None if missing) and the link first seen, returns what drifted or None
+    detect: Callable[[Optional[Dict[str, Any]], Dict[str, Any]], Optional[str]]
+
+
+# Drift outside the tunnel devices themselves; bridges that are gone are left to repair_attachment
+DRIFT_CHECKS: List[DriftCheck] = [
+    DriftCheck("dev_missing", "dev", lambda link, first: "device not found" if link is None else None),
+    DriftCheck("underlay_down", "dev", lambda link, first: f"operstate {link.get('operstate', 'unknown')}" if link is not None and not ReadinessGate.is_up(link) else None),
+    DriftCheck("bridge_mtu_changed", "bridge_name", lambda link, first: f"mtu {first.get('mtu')} -> {link.get('mtu')}" if link is not None and link.get("mtu") != first.get("mtu") else None),
+]
+
+
+class WebhookNotifier:
+    def __init__(self, url: str, timeout: float = 5) -> None:
+        self.url = url
+        self.timeout = timeout
+
+    def __call__(self, payload: Dict[str, Any]) -> None:
+        request = urllib.request.Request(self.url, data=json.dumps(payload).encode(), headers={"Content-Type": "application/json"}, method="POST")
+        try:
+            with urllib.request.urlopen(request, timeout=self.timeout):
+                pass
+        except OSError as e:
+            logger.warning(f"Error posting {payload['event']} to {self.url}: {e}")
+
+
+class TunnelAgent:
+    def __init__(self, manifest: Manifest, manager_factory: Callable[[str], TunnelManager], maintenance: Optional[MaintenanceManager] = None, clock: Callable[[], float] = time.time, metrics: MetricRegistry = METRICS, snapshot: Optional[SnapshotExecutor] = None, notify: Optional[Callable[[Dict[str, Any]], None]] = None, checks: Optional[List[DriftCheck]] = None, backoff: float = 0, max_backoff: float = 300, policy: Optional[BridgePolicy] = None, address_warn_within: float = 300) -> None:
+        self.manifest = manifest
+        self.snapshot = snapshot
+        self.manager_factory = manager_factory
+        self.maintenance = maintenance
+        self.clock = clock
+        self.metrics = metrics
+        self.notify = notify
+        self.checks = DRIFT_CHECKS if checks is None else checks
+        self.backoff = backoff
+        self.max_backoff = max_backoff
+        self.policy = policy
+        self.address_warn_within = address_warn_within
+        self.failures: Dict[int, int] = {}
+        self.next_probe: Dict[int, float] = {}
+        self.repair_failures: Dict[Any, int] = {}
+        self.next_repair: Dict[Any, float] = {}
+        # Links as first seen by the agent, the reference for checks such as MTU changes
+        self.first_seen: Dict[str, Dict[str, Any]] = {}
+        self.drift: Dict[int, Dict[str, str]] = {}
+        self.next_dns_sync: Dict[int, float] = {}
+        # Counters of the previous cycle per tunnel type; drop patterns between two cycles degrade the tunnel like drift
+        self.collectors: Dict[str, CounterSnapshotCollector] = {}
+        self.counters: Dict[str, Dict[str, Any]] = {}
+        # DHCP addresses per tunnel that are running out, so each one is warned about once rather than every cycle
+        self.expiring: Dict[int, Set[str]] = {}
+
+    def read_links(self, manager: TunnelManager) -> Optional[Dict[str, Dict[str, Any]]]:
+        try:
+            return {link["ifname"]: link for link in json.loads(manager.tunnel.executor.run(["ip", "-j", "link", "show"]).stdout or "[]")}
+        except (subprocess.CalledProcessError, json.JSONDecodeError, TypeError, KeyError) as e:
+            logger.warning(f"Error reading underlay devices and bridges: {e}")
+            return None
+
+    def analyze_drops(self, manager: TunnelManager) -> Dict[str, List[Dict[str, Any]]]:
+        tunnel_type = manager.tunnel.tunnel_type
+        collector = self.collectors.setdefault(tunnel_type, CounterSnapshotCollector(tunnel_type, manager.tunnel.executor))
+        try:
+            snapshot = collector.collect()
+        except TunnelManagerError as e:
+            logger.warning(f"Skipping drop analysis: {e}")
+            self.counters.pop(tunnel_type, None)
+            return {}
+        previous, self.counters[tunnel_type] = self.counters.get(tunnel_type), snapshot
+        findings: Dict[str, List[Dict[str, Any]]] = {}
+        for finding in DropAnalyzer(tunnel_type).analyze(previous, snapshot) if previous else []:
+            findings.setdefault(finding["ifname"], []).append(finding)
+        return findings
+
+    def check_drift(self, manager: TunnelManager, entry: Dict[str, Any], links: Dict[str, Dict[str, Any]], drops: Optional[List[Dict[str, Any]]] = None) -> List[Dict[str, Any]]:
+        vni = entry["vni"]
+        found = {}
+        for check in self.checks:
+            device = entry.get(check.field)
+            if not device:
+                continue
+            link = links.get(device)
+            first = self.first_seen.setdefault(device, link) if link is not None else self.first_seen.get(device, {})
+            detail = check.detect(link, first)
+            if detail:
+                found[check.event] = f"{device}: {detail}"
+        for finding in drops or []:
+            found[finding["finding"]] = f"{finding['ifname']}: {finding['cause']}; try {finding['remediation']}"
+        previous = self.drift.get(vni, {})
+        if found == previous:
+            return []
+        self.drift[vni] = found
+        events = []
+        # Only changes are reported, so a device that stays down raises one event rather than one per cycle
+        for event, detail in found.items():
+            if event not in previous:
+                self.metrics.inc(DRIFT_EVENTS, event=event, type=entry["type"], vni=vni)
+                events.append({"vni": vni, "action": event, "detail": detail})
+        for event in previous:
+            if event not in found:
+                events.append({"vni": vni, "action": f"{event} cleared", "detail": previous[event]})
+        record = manager.records.get(manager.tunnel.tunnel_type, vni) if manager.records else None
+        if record:
+            if found:
+                record.update(status="degraded", drift=sorted(found))
+            elif record.pop("drift", None) is not None:
+                record.pop("status", None)
+            manager.records.record(manager.tunnel.tunnel_type, vni, record)
+        for event in events:
+            logger.warning(f"VNI {vni}: {event['action']} ({event['detail']})")
+            if self.notify:
+                self.notify({"event": event["action"], "type": entry["type"], "vni": vni, "ifname": manager.tunnel.interface_name(vni), "detail": event["detail"], "host": socket.gethostname(), "time": self.clock()})
+        return events
+
+    def probe(self, manager: TunnelManager, vni: int) -> bool:
+        return manager.tunnel.link_attributes(vni) is not None
+
+    def repair(self, manager: TunnelManager, entry: Dict[str, Any]) -> None:
+        manager.create(TunnelSpec.from_entry(entry))
+
+    def attempt_repair(self, key: Any, now: float, repair: Callable[[], None]) -> Optional[Dict[str, Any]]:
+        # Returns None while the tunnel is backing off; each failure doubles the wait, so a tunnel that cannot come back does not hammer the host
+        if now < self.next_repair.get(key, 0):
+            return None
+        try:
+            repair()
+        except (TunnelManagerError, subprocess.CalledProcessError) as e:
+            self.repair_failures[key] = self.repair_failures.get(key, 0) + 1
+            delay = min(self.backoff * 2 ** (self.repair_failures[key] - 1), self.max_backoff)
+            self.next_repair[key] = now + delay
+            return {"action": "repair failed", "error": e, "retry_in": delay}
+        self.forget_repairs(key)
+        return {"action": "repaired"}
+
+    def forget_repairs(self, key: Any) -> None:
+        self.repair_failures.pop(key, None)
+        self.next_repair.pop(key, None)
+
+    def record_counters(self, manager: TunnelManager, vni: int) -> None:
+        try:
+            link = json.loads(manager.tunnel.executor.run(["ip", "-s", "-j", "link", "show", "dev", manager.tunnel.interface_name(vni)]).stdout)[0]
+        except (subprocess.CalledProcessError, json.JSONDecodeError, TypeError, IndexError) as e:
+            logger.warning(f"Error reading counters of VNI {vni}: {e}")
+            return
+        stats = link.get("stats64", link.get("stats", {}))
+        self.metrics.set(TUNNEL_RX_BYTES, stats.get("rx", {}).get("bytes", 0), type=manager.tunnel.tunnel_type, vni=vni)
+        self.metrics.set(TUNNEL_TX_BYTES, stats.get("tx", {}).get("bytes", 0), type=manager.tunnel.tunnel_type, vni=vni)
+        self.metrics.set(TUNNEL_RX_PACKETS, stats.get("rx", {}).get("packets", 0), type=manager.tunnel.tunnel_type, vni=vni)
+        self.metrics.set(TUNNEL_TX_PACKETS, stats.get("tx", {}).get("packets", 0), type=manager.tunnel.tunnel_type, vni=vni)
+
+    def refresh_dns_peers(self, manager: TunnelManager, vni: int, now: float) -> None:
+        # Peers published in DNS are looked up again once the lowest TTL of the last answer has run out
+        if now < self.next_dns_sync.get(vni, 0):
+            return
+        ttl = manager.sync_dns_peers(vni, self.metrics)
+        if ttl is None:
+            self.next_dns_sync.pop(vni, None)
+        else:
+            self.next_dns_sync[vni] = now + ttl
+
+    def check_addresses(self, manager: TunnelManager, vni: int) -> List[Dict[str, Any]]:
+        inspector = AddressInspector(manager.tunnel.interface_name(vni), manager.tunnel.executor)
+        try:
+            expiring = inspector.expiring(inspector.collect(), self.address_warn_within)
+        except TunnelManagerError as e:
+            logger.warning(f"Skipping address lifetimes of VNI {vni}: {e}")
+            return []
+        known = self.expiring.get(vni, set())
+        self.expiring[vni] = {address["address"] for address in expiring}
+        events = []
+        for address in expiring:
+            # An address with a client running gets renewed in time; only the others are worth a warning
+            if address["address"] in known or inspector.dhcp_client_running(address["ifname"]):
+                continue
+            detail = f"{address['address']} on {address['ifname']} expires in {address['expires_in']}s and no DHCP client is running to renew it"
+            logger.warning(f"VNI {vni}: address expiring ({detail})")
+            events.append({"vni": vni, "action": "address expiring", "detail": detail})
+        return events
+
+    def record_bridge_usage(self) -> None:
+        # Counted like create counts against the limit: every tunnel port on the bridge, managed or not
+        if not self.policy:
+            return
+        try:
+            ports = self.policy.tunnel_ports()
+        except TunnelManagerError:
+            return
+        self.metrics.reset(BRIDGE_TUNNELS)
+        self.metrics.reset(BRIDGE_TUNNEL_LIMIT)
+        for bridge_name, names in ports.items():
+            self.metrics.set(BRIDGE_TUNNELS, len(names), bridge=bridge_name)
+            if self.policy.max_tunnels_per_bridge is not None:
+                self.metrics.set(BRIDGE_TUNNEL_LIMIT, self.policy.max_tunnels_per_bridge, bridge=bridge_name)
+
+    def tick(self) -> List[Dict[str, Any]]:
+        started = time.monotonic()
+        events = self.reconcile()
+        self.record_bridge_usage()
+        self.metrics.set(RECONCILE_SECONDS, time.monotonic() - started)
+        return events
+
+    def reconcile(self) -> List[Dict[str, Any]]:
+        now = self.clock()
+        events = []
+        # Each cycle starts from fresh live state; mutations during the cycle invalidate it as well
+        if self.snapshot:
+            self.snapshot.invalidate()
+        links = None
+        drops: Dict[str, Dict[str, List[Dict[str, Any]]]] = {}
+        drift = []
+        for entry in self.manifest.tunnels:
+            vni = entry["vni"]
+            settings = self.manifest.settings(vni)
+            if now < self.next_probe.get(vni, 0):
+                continue
+            self.next_probe[vni] = now + settings.probe_interval
+            manager = self.manager_factory(entry["type"])
+            if entry.get("ifname"):
+                manager.tunnel.ifnames[vni] = entry["ifname"]
+            # One read of all links per cycle serves the drift checks of every tunnel
+            if links is None:
+                links = self.read_links(manager) or {}
+            if entry["type"] not in drops:
+                drops[entry["type"]] = self.analyze_drops(manager)
+            drift += self.check_drift(manager, entry, links, drops[entry["type"]].get(manager.tunnel.interface_name(vni)))
+            healthy = self.probe(manager, vni)
+            self.metrics.set(TUNNEL_UP, int(healthy), type=entry["type"], vni=vni)
+            if healthy:
+                self.failures[vni] = 0
+                self.record_counters(manager, vni)
+                self.refresh_dns_peers(manager, vni, now)
+                events += self.check_addresses(manager, vni)
+                if settings.repair and not (self.maintenance and self.maintenance.covers(vni)):
+                    outcome = manager.repair_attachment(vni, entry["bridge_name"], entry.get("create_bridge", False))
+                    if outcome in ("reattached", "bridge created"):
+                        self.metrics.inc(REATTACHMENTS, type=entry["type"], vni=vni)
+                    if outcome != "attached":
+                        events.append({"vni": vni, "action": outcome})
+                continue
+            self.failures[vni] = self.failures.get(vni, 0) + 1
+            if self.failures[vni] < settings.failure_threshold:
+                continue
+            # Probes fail as expected during a maintenance window, so they neither alert nor repair
+            if self.maintenance and self.maintenance.covers(vni):
+                events.append({"vni": vni, "action": "skipped (maintenance)"})
+                continue
+            if settings.alert:
+                logger.error(f"ALERT: {manager.tunnel.interface_name(vni)} failed {self.failures[vni]} consecutive probes.")
+            if settings.repair:
+                outcome = self.attempt_repair(vni, now, lambda: self.repair(manager, entry))
+                if outcome and outcome["action"] == "repaired":
+                    self.failures[vni] = 0
+                elif outcome:
+                    logger.error(f"Error repairing VNI {vni}: {outcome['error']}")
+                    self.metrics.inc(RECONCILE_ERRORS, type=entry["type"], vni=vni)
+                if outcome:
+                    events.append({"vni": vni, "action": outcome["action"]})
+            else:
+                events.append({"vni": vni, "action": "alerted" if settings.alert else "ignored"})
+        for event in events:
+            self.metrics.inc(RECONCILE_ACTIONS, action=event["action"])
+        return drift + events
+
+    def run(self, poll_interval: float = 1, metrics_file: Optional[str] = None, report: Optional[Callable[[], None]] = None) -> None:
+        while True:
+            for event in self.tick():
+                if "detail" not in event:
+                    logger.info(f"VNI {event['vni']}: {event['action']}")
+            if metrics_file:
+                self.metrics.write(metrics_file)
+            if report:
+                report()
+            time.sleep(poll_interval)
+
+
+class ReadinessGate:
+    def __init__(self, manager: TunnelManager, vnis: List[int], probe: bool = False, snapshot: Optional[SnapshotExecutor] = None, clock: Callable[[], float] = time.monotonic) -> None:
+        self.manager = manager
+        self.vnis = vnis
+        self.probe = probe
+        self.snapshot = snapshot
+        self.clock = clock
+        self.probed: set = set()
+
+    @staticmethod
+    def is_up(link: Dict[str, Any]) -> bool:
+        # Tunnel devices usually report operstate UNKNOWN, so carrier comes from the flags
+        flags = link.get("flags", [])
+        return "UP" in flags and "LOWER_UP" in flags and link.get("operstate") != "DOWN"
+
+    def run_probe(self, vni: int) -> str:
+        record = self.manager.records.get(self.manager.tunnel.tunnel_type, vni) if self.manager.records else None
+        if not record:
+            return "probe failed: tunnel is not recorded"
+        try:
+            self.manager.tunnel.validate_connectivity(record["src_host"], record["dst_host"], vni, record.get("dst_port"), timeout=1, max_retries=1)
+        except TunnelManagerError as e:
+            return f"probe failed: {e}"
+        self.probed.add(vni)
+        return "ready"
+
+    def poll(self) -> List[Dict[str, Any]]:
+        if self.snapshot:
+            self.snapshot.invalidate()
+        try:
+            # One query per interval covers every tunnel, however many are awaited
+            links = {link["ifname"]: link for link in json.loads(self.manager.tunnel.executor.run(["ip", "-j", "link", "show"]).stdout or "[]")}
+        except (subprocess.CalledProcessError, json.JSONDecodeError) as e:
+            raise TunnelManagerError(f"Error listing links: {e}") from e
+        rows = []
+        for vni in self.vnis:
+            ifname = self.manager.tunnel.interface_name(vni)
+            link = links.get(ifname)
+            if link is None:
+                status = "missing"
+            elif not self.is_up(link):
+                status = f"down ({link.get('operstate', 'unknown').lower()})"
+            elif self.probe and vni not in self.probed:
+                status = self.run_probe(vni)
+            else:
+                status = "ready"
+            rows.append({"vni": vni, "ifname": ifname, "status": status})
+        return rows
+
+    def wait(self, timeout: float, interval: float = 1, stop: Optional[threading.Event] = None) -> Tuple[bool, List[Dict[str, Any]]]:
+        stop = stop or threading.Event()
+        deadline = self.clock() + timeout
+        while True:
+            rows = self.poll()
+            if all(row["status"] == "ready" for row in rows):
+                return True, rows
+            remaining = deadline - self.clock()
+            # Waiting on the event rather than sleeping lets SIGTERM end the wait at once
+            if remaining <= 0 or stop.wait(min(interval, remaining)):
+                return False, rows
+
+
+class LinkHealth:
+    def __init__(self, manager: TunnelManager, store: Optional[StateStore] = None, ping_remote: bool = True, clock: Callable[[], datetime.datetime] = datetime.datetime.now) -> None:
+        self.manager = manager
+        self.store = store
+        self.ping_remote = ping_remote
+        self.clock = clock
+
+    @staticmethod
+    def expected_mtu(tunnel_type: str, underlay_mtu: int, remote: str) -> int:
+        # An IPv6 outer header is 20 bytes longer than the IPv4 one ENCAP_OVERHEAD assumes
+        return underlay_mtu - ENCAP_OVERHEAD.get(tunnel_type, 50) - (20 if TunnelInterface.ip_version(remote) == 6 else 0)
+
+    def mtu_problems(self, link: Dict[str, Any], links: Dict[str, Dict[str, Any]], remote: str) -> List[str]:
+        problems = []
+        mtu, underlay, bridge = link.get("mtu"), links.get(TunnelInterface.info_data(link).get("link") or ""), links.get(link.get("master") or "")
+        if mtu and underlay and underlay.get("mtu") and mtu > self.expected_mtu(self.manager.tunnel.tunnel_type, underlay["mtu"], remote):
+            problems.append(f"mtu {mtu} > {self.expected_mtu(self.manager.tunnel.tunnel_type, underlay['mtu'], remote)} for {underlay['ifname']} mtu {underlay['mtu']}")
+        if mtu and bridge and bridge.get("mtu", 0) > mtu:
+            problems.append(f"bridge {bridge['ifname']} mtu {bridge['mtu']} > {mtu}")
+        return problems
+
+    def changed_at(self, seen: Dict[str, Any], ifname: str, state: str) -> str:
+        # The kernel keeps no time of the last carrier change, so it is when status first saw the current state
+        previous = seen.get(ifname)
+        if not previous or previous["state"] != state:
+            seen[ifname] = {"state": state, "since": self.clock().isoformat(timespec="seconds")}
+        return seen[ifname]["since"]
+
+    def status(self) -> List[Dict[str, Any]]:
+        tunnel = self.manager.tunnel
+        try:
+            links = {link["ifname"]: link for link in json.loads(tunnel.executor.run(["ip", "-d", "-j", "link", "show"]).stdout or "[]")}
+        except (subprocess.CalledProcessError, json.JSONDecodeError) as e:
+            raise TunnelManagerError(f"Error listing links: {e}") from e
+        recorded = [record for record in (self.store.load().get("tunnels", {}).values() if self.store else []) if record["tunnel_type"] == tunnel.tunnel_type]
+        vnis = sorted({int(row["vni"]) for row in self.manager.list()} | {record["vni"] for record in recorded})
+        # Kept apart from the state file, which status must not rewrite without holding the lock
+        seen_store = StateStore(os.path.join(os.path.dirname(self.store.path) or ".", "link_status.json")) if self.store else None
+        seen = seen_store.load() if seen_store else {}
+        rows = []
+        for vni in vnis:
+            ifname = tunnel.interface_name(vni)
+            link = links.get(ifname)
+            record = next((record for record in recorded if record["vni"] == vni), {})
+            if link is None:
+                rows.append({"ifname": ifname, "vni": vni, "operstate": "missing", "carrier": "no", "changed": self.changed_at(seen, ifname, "missing"), "mtu": "", "mtu_check": "", "remote": "", "health": "down"})
+                continue
+            remote = TunnelInterface.parse_link_attributes(link).get("remote") or record.get("dst_host") or ""
+            carrier = ReadinessGate.is_up(link)
+            problems = self.mtu_problems(link, links, remote)
+            if not carrier or not remote or TunnelInterface.is_multicast(remote) or not self.ping_remote:
+                reachable = "skipped"
+            else:
+                reachable = "reachable" if ping(tunnel.executor, remote) else "unreachable"
+            health = "down" if not carrier else "degraded" if problems or reachable == "unreachable" else "ok"
+            rows.append({"ifname": ifname, "vni": vni, "operstate": link.get("operstate", "UNKNOWN"), "carrier": "yes" if carrier else "no", "changed": self.changed_at(seen, ifname, "up" if carrier else "down"), "mtu": str(link.get("mtu", "")), "mtu_check": "; ".join(problems) or "ok", "remote": f"{remote} {reachable}" if remote else reachable, "health": health})
+        if seen_store:
+            seen_store.save(seen)
+        return rows
+
+
+# Follows RTM_NEWLINK/RTM_DELLINK on a netlink socket and reports state changes of tunnel interfaces
+class LinkEventWatcher:
+    RTMGRP_LINK = 1
+    RTM_NEWLINK, RTM_DELLINK = 16, 17
+    IFLA_IFNAME, IFLA_OPERSTATE, IFLA_LINKINFO, IFLA_INFO_KIND = 3, 16, 18, 1
+    IFF_UP, IFF_LOWER_UP = 0x1, 0x10000
+    OPERSTATES = ("UNKNOWN", "NOTPRESENT", "DOWN", "LOWERLAYERDOWN", "TESTING", "DORMANT", "UP")
+
+    def __init__(self, names: Callable[[], List[str]], all_tunnels: bool = False, clock: Callable[[], datetime.datetime] = datetime.datetime.now) -> None:
+        # Managed names are read again for every event, so tunnels created while watching are followed too
+        self.names = names
+        self.all_tunnels = all_tunnels
+        self.clock = clock
+        self.states: Dict[str, str] = {}
+
+    @staticmethod
+    def open_socket() -> socket.socket:
+        sock = socket.socket(socket.AF_NETLINK, socket.SOCK_RAW, socket.NETLINK_ROUTE)
+        sock.bind((0, LinkEventWatcher.RTMGRP_LINK))
+        return sock
+
+    @staticmethod
+    def attributes(data: bytes) -> Dict[int, bytes]:
+        attributes, offset = {}, 0
+        while offset + 4 <= len(data):
+            length, kind = struct.unpack_from("=HH", data, offset)
+            if length < 4:
+                break
+            attributes[kind & 0x3FFF] = data[offset + 4:offset + length]
+            offset += (length + 3) & ~3
+        return attributes
+
+    @classmethod
+    def parse(cls, data: bytes) -> List[Dict[str, Any]]:
+        links, offset = [], 0
+        while offset + 16 <= len(data):
+            length, kind = struct.unpack_from("=LH", data, offset)
+            if length < 16:
+                break
+            if kind in (cls.RTM_NEWLINK, cls.RTM_DELLINK):
+                _, _, index, flags, _ = struct.unpack_from("=BxHiII", data, offset + 16)
+                attributes = cls.attributes(data[offset + 32:offset + length])
+                operstate = attributes.get(cls.IFLA_OPERSTATE, b"\0")[0]
+                link_kind = cls.attributes(attributes.get(cls.IFLA_LINKINFO, b"")).get(cls.IFLA_INFO_KIND, b"").rstrip(b"\0").decode()
+                links.append({"message": "dellink" if kind == cls.RTM_DELLINK else "newlink", "ifname": attributes.get(cls.IFLA_IFNAME, b"").rstrip(b"\0").decode(), "index": index, "kind": link_kind, "flags": ["UP"] * bool(flags & cls.IFF_UP) + ["LOWER_UP"] * bool(flags & cls.IFF_LOWER_UP), "operstate": cls.OPERSTATES[operstate] if operstate < len(cls.OPERSTATES) else "UNKNOWN"})
+            offset += (length + 3) & ~3
+        return links
+
+    def watched(self, link: Dict[str, Any]) -> bool:
+        return link["ifname"] in self.names() or (self.all_tunnels and link.get("kind") in TUNNEL_KINDS)
+
+    def seed(self, links: List[Dict[str, Any]]) -> None:
+        for link in links:
+            if self.watched(dict(link, kind=link.get("linkinfo", {}).get("info_kind", ""))):
+                self.states[link["ifname"]] = "up" if ReadinessGate.is_up(link) else "down"
+
+    def handle(self, link: Dict[str, Any]) -> Optional[Dict[str, Any]]:
+        # Deleted links carry no kind any more, so a link seen before is followed to its removal
+        if link["ifname"] not in self.states and not self.watched(link):
+            return None
+        if link["message"] == "dellink":
+            state = "deleted"
+        else:
+            state = "up" if ReadinessGate.is_up(link) else "down"
+        previous = self.states.pop(link["ifname"], None) if state == "deleted" else self.states.get(link["ifname"])
+        if state != "deleted":
+            self.states[link["ifname"]] = state
+        if state == previous:
+            return None
+        event = "created" if previous is None and state != "deleted" else state
+        return {"time": self.clock().isoformat(timespec="seconds"), "ifname": link["ifname"], "event": event, "state": state, "operstate": link["operstate"], "previous": previous or ""}
+
+    @staticmethod
+    def format(event: Dict[str, Any]) -> str:
+        return f"{event['time']} {event['ifname']} {event['event']}" + (f" (operstate {event['operstate']}, was {event['previous']})" if event["previous"] else f" (operstate {event['operstate']})")
+
+
+# Explanations of the commands the create path emits, matched by prefix; "{n}" is the n-th word of the command
+COMMAND_NOTES: List[Tuple[List[str], str]] = [
+    (["ip", "link", "add"], "Create {3} ({5} VNI {7})"),
+    (["ip", "link", "set", "master"], "Attach {5} to bridge {4}"),
+    (["ip", "link", "set", "dev"], "Place {4} in link group {6}"),
+    (["ip", "link", "set"], "Bring {3} up"),
+    (["brctl", "addif"], "Attach {3} to bridge {2}"),
+    (["ovs-vsctl", "--may-exist", "add-port"], "Attach {4} to OVS bridge {3}"),
+    (["ovs-vsctl", "add-port"], "Create OVS tunnel port {3} on bridge {2} ({8})"),
+    (["bridge", "link", "set"], "Set bridge port flags of {4}"),
+    (["bridge", "fdb", "append"], "Flood broadcast and unknown traffic to peer {7}"),
+    (["ip", "route", "add"], "Route {3} over bridge {5}"),
+]
+
+DISTRO_HINTS: Dict[str, List[Tuple[str, str]]] = {
+    "rhel8": [("Load the kernel module", "modprobe {module}"), ("Open the tunnel port in firewalld", "firewall-cmd --permanent --add-port={port}/udp && firewall-cmd --reload")],
+    "debian12": [("Load the kernel module", "modprobe {module}"), ("Open the tunnel port in nftables", "nft add rule inet filter input udp dport {port} accept")],
+}
+
+
+class CreateExplainer:
+    def __init__(self, tunnel_type: TunnelType, bridge_tool: str = "ip", resolver: Optional[HostResolver] = None) -> None:
+        self.tunnel_type = tunnel_type
+        self.bridge_tool = bridge_tool
+        self.resolver = resolver or HostResolver()
+
+    @staticmethod
+    def annotate(command: List[str]) -> str:
+        for prefix, note in COMMAND_NOTES:
+            if command[:len(prefix)] == prefix:
+                try:
+                    return note.format(*command)
+                except IndexError:
+                    break
+        return ""
+
+    def explain(self, spec: TunnelSpec, distro: Optional[str] = None) -> List[Tuple[str, str]]:
+        # Runs the real create path against a recorder, so the explanation cannot drift from what create does
+        recorder = RecordingExecutor()
+        tunnel = TunnelFactory.create_tunnel(self.tunnel_type, bridge_tool=self.bridge_tool, executor=recorder)
+        TunnelManager(tunnel, resolver=self.resolver).create(spec)
+        hints = {"module": tunnel.tunnel_type, "port": spec.dst_port or getattr(tunnel, "DEFAULT_PORT", "")}
+        steps = [(note, command.format(**hints)) for note, command in DISTRO_HINTS.get(distro, [])]
+        return steps + [(self.annotate(command), shlex.join(command)) for command in recorder.commands]
+
+    @staticmethod
+    def format(steps: List[Tuple[str, str]], markdown: bool = False) -> str:
+        lines = []
+        for note, command in steps:
+            if note:
+                lines.append(f"# {note}")
+            lines.append(command)
+        script = "\n".join(lines)
+        return MarkdownPlanFormatter.fence_text(script) if markdown else script
+
+
+class HookRunner(Protocol):
+    def run_hook(self, command: List[str], timeout: Optional[float] = None) -> subprocess.CompletedProcess:
+        ...
+
+
+class SubprocessHookRunner(HookRunner):
+    def run_hook(self, command: List[str], timeout: Optional[float] = None) -> subprocess.CompletedProcess:
+        try:
+            return subprocess.run(command, check=False, stdout=subprocess.PIPE, stderr=subprocess.STDOUT, text=True, timeout=timeout)
+        except subprocess.TimeoutExpired:
+            return subprocess.CompletedProcess(command, 124, stdout=f"timed out after {timeout}s")
+        except OSError as e:
+            return subprocess.CompletedProcess(command, 127, stdout=str(e))
+
+
+def render_hook_template(template: str, fields: Dict[str, Any]) -> List[str]:
+    # Split before substituting so a field value can never add or merge arguments
+    def substitute(match: "re.Match[str]") -> str:
+        if match[1] not in fields:
+            raise TunnelManagerError(f"Unknown hook template field {match[0]} (available: {', '.join('{{.' + name + '}}' for name in fields)})")
+        return str(fields[match[1]])
+    template = re.sub(r"\{\{\s*\.(\w+)\s*\}\}", r"{{.\1}}", template)
+    return [re.sub(r"\{\{\.(\w+)\}\}", substitute, token) for token in shlex.split(template)]
+
+
+class CanaryVerifier:
+    def __init__(self, manager_factory: Callable[[str], "TunnelManager"], template: Optional[str] = None, hooks: Optional[HookRunner] = None, timeout: float = 60) -> None:
+        self.manager_factory = manager_factory
+        self.template = template
+        self.hooks = hooks or SubprocessHookRunner()
+        self.timeout = timeout
+
+    def verify(self, entry: Dict[str, Any]) -> Tuple[bool, str]:
+        manager = self.manager_factory(entry["type"])
+        if not self.template:
+            try:
+                manager.validate(entry["src_host"], entry["dst_host"], entry["vni"], entry.get("dst_port"), max_retries=1)
+            except TunnelManagerError as e:
+                return False, str(e)
+            return True, "validate and probe passed"
+        fields = {"IfName": manager.tunnel.interface_name(entry["vni"]), "VNI": entry["vni"], "Type": entry["type"], "Bridge": entry["bridge_name"], "Local": entry["src_host"], "Remote": entry["dst_host"], "Site": entry.get("site", "")}
+        result = self.hooks.run_hook(render_hook_template(self.template, fields), self.timeout)
+        output = (result.stdout or "").strip()
+        return result.returncode == 0, output or f"exit status {result.returncode}"
+
+
+class ManifestApplier:
+    def __init__(self, manifest: Manifest, manager_factory: Callable[[str], TunnelManager], policy: Optional[BridgePolicy] = None, cancel: Optional[CancelToken] = None) -> None:
+        self.manifest = manifest
+        self.manager_factory = manager_factory
+        self.policy = policy
+        self.cancel = cancel or CancelToken()
+
+    def plan(self, replace: bool = False, prune: bool = False) -> List[PlanEntry]:
+        plan = []
+        for entry in self.manifest.tunnels:
+            manager = self.manager_factory(entry["type"])
+            src_ip, dst_ip = manager.resolver.resolve(entry["src_host"]), manager.resolver.resolve(entry["dst_host"])
+            if entry.get("ifname"):
+                manager.tunnel.ifnames[entry["vni"]] = entry["ifname"]
+            existing = manager.tunnel.link_attributes(entry["vni"])
+            planned = plan_tunnel(TunnelType(entry["type"]), entry["vni"], existing, src_ip, dst_ip, entry["bridge_name"], entry.get("src_port"), entry.get("dst_port"), entry.get("dev"), entry.get("ifname"))
+            if planned.action == "conflict" and replace:
+                planned = self.plan_replace(manager, entry, planned, existing or {}, src_ip, dst_ip)
+            if "peers" in entry and planned.action in ("create", "noop"):
+                planned = self.plan_peers(manager, entry, planned)
+            if entry.get("create_bridge") and planned.action in ("create", "replace") and not manager.bridge_exists(entry["bridge_name"]):
+                planned = planned._replace(commands=manager.tunnel.bridges().create_commands(entry["bridge_name"]) + planned.commands)
+            if entry.get("address") and planned.action == "create":
+                planned = planned._replace(commands=planned.commands + [["ip", "addr", "add", entry["address"], "dev", entry["bridge_name"]]])
+            plan.append(planned._replace(site=entry.get("site", "")))
+        return plan + (self.plan_prune() if prune else [])
+
+    @staticmethod
+    def plan_replace(manager: TunnelManager, entry: Dict[str, Any], planned: PlanEntry, existing: Dict[str, Any], src_ip: str, dst_ip: str) -> PlanEntry:
+        recorder = RecordingExecutor()
+        tunnel = TunnelFactory.create_tunnel(TunnelType(entry["type"]), bridge_tool=getattr(manager.tunnel, "bridge_tool", "ip"), executor=recorder, ifnames=manager.tunnel.ifnames)
+        ifname = tunnel.interface_name(entry["vni"])
+        # Only the bridge is wrong: moving the port keeps the device and its counters
+        if set(planned.changes) == {"master"}:
+            tunnel.attach_tunnel_interface(entry["vni"], entry["bridge_name"])
+            return planned._replace(action="replace", commands=recorder.commands, description=f"move {ifname} to {entry['bridge_name']}")
+        tunnel.cleanup_tunnel_interface(entry["vni"], existing.get("master") or entry["bridge_name"])
+        tunnel.create_tunnel_interface(entry["vni"], src_ip, dst_ip, entry["bridge_name"], entry.get("src_port"), entry.get("dst_port"), entry.get("dev"))
+        return planned._replace(action="replace", commands=recorder.commands, description=f"recreate {ifname}")
+
+    def recorded(self) -> List[Dict[str, Any]]:
+        records = self.manager_factory(TunnelType.VXLAN.value).records
+        tunnels = records.store.load().get("tunnels", {}).values() if records else []
+        return sorted(tunnels, key=lambda record: (record["tunnel_type"], record["vni"]))
+
+    def plan_prune(self) -> List[PlanEntry]:
+        # Only tunnels this tool recorded are pruned; interfaces created by hand or by other tools are left alone
+        declared = {(entry["type"], entry["vni"]) for entry in self.manifest.tunnels}
+        plan = []
+        for record in self.recorded():
+            if (record["tunnel_type"], record["vni"]) in declared:
+                continue
+            recorder = RecordingExecutor()
+            tunnel = TunnelFactory.create_tunnel(TunnelType(record["tunnel_type"]), executor=recorder, ifnames={record["vni"]: record["ifname"]} if record.get("ifname") else None)
+            tunnel.cleanup_tunnel_interface(record["vni"], record.get("bridge_name", ""))
+            plan.append(PlanEntry.build("delete", record["tunnel_type"], record["vni"], commands=recorder.commands, description=f"{tunnel.interface_name(record['vni'])} is not in the manifest", site=record.get("site") or ""))
+        return plan
+
+    @staticmethod
+    def plan_peers(manager: TunnelManager, entry: Dict[str, Any], planned: PlanEntry) -> PlanEntry:
+        ifname = manager.tunnel.interface_name(entry["vni"])
+        added, removed = FloodList.delta(FloodList(manager.tunnel.executor).peers(ifname, manager.resolver.resolve(entry["dst_host"])) if planned.action == "noop" else [], entry["peers"])
+        if not added and not removed:
+            return planned
+        recorder = RecordingExecutor()
+        FloodList(recorder).add(ifname, added)
+        FloodList(recorder).remove(ifname, removed)
+        if planned.action == "create":
+            return planned._replace(commands=planned.commands + recorder.commands)
+        description = "; ".join(part for part in (f"add peers {', '.join(added)}" if added else "", f"remove peers {', '.join(removed)}" if removed else "") if part)
+        return PlanEntry.build("modify", planned.tunnel_type, planned.vni, commands=recorder.commands, description=f"flood list of {ifname}: {description}")
+
+    def validate(self, plan: List[PlanEntry], check_connectivity: bool = False) -> List[str]:
+        problems = [f"{entry.tunnel_type} VNI {entry.vni}: {entry.description} ({describe_changes(entry.changes)})" for entry in plan if entry.action == "conflict"]
+        creates = [self.manifest.tunnel(entry.vni) for entry in plan if entry.action == "create"]
+        if self.policy and self.policy.max_tunnels_per_bridge is not None and creates:
+            ports = self.policy.tunnel_ports()
+            for bridge_name in sorted({entry["bridge_name"] for entry in creates}):
+                planned = len(ports.get(bridge_name, [])) + sum(1 for entry in creates if entry["bridge_name"] == bridge_name)
+                if planned > self.policy.max_tunnels_per_bridge:
+                    problems.append(f"bridge {bridge_name} would have {planned} tunnel ports (limit {self.policy.max_tunnels_per_bridge})")
+        checked = set()
+        for entry in creates if check_connectivity else []:
+            # Services of a site share one underlay path, which only needs checking once
+            underlay = (entry["type"], entry["src_host"], entry["dst_host"], entry.get("dst_port"))
+            if underlay in checked:
+                continue
+            checked.add(underlay)
+            manager = self.manager_factory(entry["type"])
+            try:
+                manager.tunnel.validate_connectivity(manager.resolver.resolve(entry["src_host"]), manager.resolver.resolve(entry["dst_host"]), entry["vni"], entry.get("dst_port"), max_retries=1)
+            except TunnelManagerError as e:
+                problems.append(f"{entry['type']} VNI {entry['vni']}: underlay unreachable: {e}")
+        return problems
+
+    def apply_one(self, planned: PlanEntry) -> Dict[str, Any]:
+        row = {"tunnel_type": planned.tunnel_type, "vni": planned.vni, "action": planned.action}
+        if planned.action in ("replace", "delete"):
+            return dict(row, result=self.reconcile(planned))
+        if planned.action == "modify":
+            entry = self.manifest.tunnel(planned.vni)
+            try:
+                manager = self.manager_factory(entry["type"])
+                added, removed = manager.sync_peers(entry["vni"], entry["peers"], manager.resolver.resolve(entry["dst_host"]))
+                return dict(row, result=f"peers updated (+{len(added)} -{len(removed)})")
+            except TunnelManagerError as e:
+                return dict(row, result=f"failed: {e}")
+        if planned.action != "create":
+            return dict(row, result="failed: conflicts with the live tunnel" if planned.action == "conflict" else "skipped")
+        entry = self.manifest.tunnel(planned.vni)
+        manager = self.manager_factory(entry["type"])
+        try:
+            if entry.get("create_bridge"):
+                manager.ensure_bridge(entry["bridge_name"])
+            manager.create(TunnelSpec.from_entry(entry))
+            if entry.get("address"):
+                AddressInspector(entry["bridge_name"], manager.tunnel.executor).assign(entry["address"])
+            return dict(row, result="created")
+        except OperationCancelled:
+            raise
+        except TunnelManagerError as e:
+            return dict(row, result=f"failed: {e}")
+
+    @staticmethod
+    def aborts(row: Dict[str, Any]) -> bool:
+        # Failed peer updates and conflicts do not abort an atomic apply; conflicts are caught by its pre-validation
+        return row["action"] in ("create", "replace", "delete") and row["result"].startswith("failed")
+
+    def apply(self, plan: List[PlanEntry], atomic: bool = False, parallel: int = 1) -> Tuple[List[Dict[str, Any]], bool]:
+        if parallel > 1:
+            return self.apply_parallel(plan, atomic, parallel)
+        report, created = [], []
+        for index, planned in enumerate(plan):
+            try:
+                row = self.apply_one(planned)
+            except OperationCancelled as e:
+                report.append({"tunnel_type": planned.tunnel_type, "vni": planned.vni, "action": "create", "result": f"cancelled: {e}"})
+                with self.cancel.shielded():
+                    report += self.revert_in_flight(self.manifest.tunnel(planned.vni)) + (self.rollback(created) if atomic else [])
+                report += [{"tunnel_type": rest.tunnel_type, "vni": rest.vni, "action": rest.action, "result": "not started"} for rest in plan[index + 1:]]
+                return report, False
+            report.append(row)
+            if row["result"] == "created":
+                created.append(self.manifest.tunnel(planned.vni))
+            if atomic and self.aborts(row):
+                return report + self.rollback(created), False
+        return report, all(not item["result"].startswith("failed") for item in report)
+
+    def parallel_tasks(self, plan: List[PlanEntry]) -> List[List[Tuple[int, PlanEntry]]]:
+        recorded = {(record["tunnel_type"], record["vni"]): record.get("bridge_name", "") for record in self.recorded()}
+
+        def bridge(planned: PlanEntry) -> str:
+            return recorded.get((planned.tunnel_type, planned.vni), "") if planned.action == "delete" else self.manifest.tunnel(planned.vni)["bridge_name"]
+
+        # Everything on one bridge runs in plan order: the port limit and VLAN checks of a create must see the other
+        # creates on that bridge, and deleting a tunnel can remove its bridge with the last port
+        tasks: List[List[Tuple[int, PlanEntry]]] = []
+        groups: Dict[str, List[Tuple[int, PlanEntry]]] = {}
+        for index, planned in enumerate(plan):
+            name = bridge(planned)
+            if name in groups:
+                groups[name].append((index, planned))
+            else:
+                groups[name] = [(index, planned)]
+                tasks.append(groups[name])
+        return tasks
+
+    def apply_parallel(self, plan: List[PlanEntry], atomic: bool, workers: int) -> Tuple[List[Dict[str, Any]], bool]:
+        # Bridges are created up front, once each, so concurrent tunnels never race to create the same bridge
+        for entry in {entry["bridge_name"]: entry for entry in (self.manifest.tunnel(planned.vni) for planned in plan if planned.action == "create") if entry.get("create_bridge")}.values():
+            try:
+                self.manager_factory(entry["type"]).ensure_bridge(entry["bridge_name"])
+            except TunnelManagerError as e:
+                logger.error(f"Error creating bridge {entry['bridge_name']}: {e}")
+        stop = threading.Event()
+        lock = threading.Lock()
+        created: List[Dict[str, Any]] = []
+        reverted: List[Dict[str, Any]] = []
+
+        # The steps of one tunnel stay in order in its worker: device, bridge attach, then flood entries and routes
+        def run(task: List[Tuple[int, PlanEntry]]) -> List[Tuple[int, Dict[str, Any]]]:
+            rows = []
+            for index, planned in task:
+                if stop.is_set() or self.cancel.cancelled:
+                    rows.append((index, {"tunnel_type": planned.tunnel_type, "vni": planned.vni, "action": planned.action, "result": "not started"}))
+                    continue
+                try:
+                    row = self.apply_one(planned)
+                except OperationCancelled as e:
+                    stop.set()
+                    rows.append((index, {"tunnel_type": planned.tunnel_type, "vni": planned.vni, "action": "create", "result": f"cancelled: {e}"}))
+                    with self.cancel.shielded():
+                        undone = self.revert_in_flight(self.manifest.tunnel(planned.vni))
+                    with lock:
+                        reverted.extend(undone)
+                    continue
+                rows.append((index, row))
+                with lock:
+                    if row["result"] == "created":
+                        created.append(self.manifest.tunnel(planned.vni))
+                if atomic and self.aborts(row):
+                    stop.set()
+            return rows
+
+        with concurrent.futures.ThreadPoolExecutor(max_workers=workers) as pool:
+            rows = [row for rows in pool.map(run, self.parallel_tasks(plan)) for row in rows]
+        report = [row for index, row in sorted(rows, key=lambda item: item[0])] + reverted
+        if stop.is_set():
+            if atomic:
+                with self.cancel.shielded():
+                    report += self.rollback(created)
+            return report, False
+        return report, all(not item["result"].startswith("failed") for item in report)
+
+    def reconcile(self, planned: PlanEntry) -> str:
+        # Replaced and pruned tunnels are not rolled back; their previous state is what apply is correcting
+        manager = self.manager_factory(planned.tunnel_type)
+        try:
+            if planned.action == "delete":
+                record = manager.records.get(planned.tunnel_type, planned.vni) if manager.records else None
+                if record and record.get("ifname"):
+                    manager.tunnel.ifnames[planned.vni] = record["ifname"]
+                manager.cleanup(planned.vni, (record or {}).get("bridge_name", ""))
+                return "deleted"
+            entry = self.manifest.tunnel(planned.vni)
+            if entry.get("create_bridge"):
+                manager.ensure_bridge(entry["bridge_name"])
+            manager.create(TunnelSpec.from_entry(entry), attach_only=True, replace=True)
+            return "replaced"
+        except TunnelManagerError as e:
+            return f"failed: {e}"
+
+    def apply_canary(self, plan: List[PlanEntry], canaries: int, verifier: CanaryVerifier, progress: Callable[[Dict[str, Any]], None] = lambda event: None, parallel: int = 1) -> Tuple[List[Dict[str, Any]], List[Dict[str, Any]], bool]:
+        creates = [planned for planned in plan if planned.action == "create"]
+        canary_plan, remainder = creates[:canaries], [planned for planned in plan if planned not in creates[:canaries]]
+        report, succeeded = self.apply(canary_plan, atomic=True)
+        for item in report:
+            progress(dict(item, phase="canary"))
+        if not succeeded:
+            progress({"phase": "abort", "reason": "a canary could not be created"})
+            return report, [], False
+        verdicts = []
+        for planned in canary_plan:
+            passed, detail = verifier.verify(self.manifest.tunnel(planned.vni))
+            verdicts.append({"tunnel_type": planned.tunnel_type, "vni": planned.vni, "verdict": "pass" if passed else "fail", "detail": detail})
+            progress(dict(verdicts[-1], phase="verify"))
+        if not all(verdict["verdict"] == "pass" for verdict in verdicts):
+            rollback = self.rollback([self.manifest.tunnel(planned.vni) for planned in canary_plan])
+            for item in rollback:
+                progress(dict(item, phase="rollback"))
+            progress({"phase": "abort", "reason": "canary verification failed"})
+            return report + rollback, verdicts, False
+        progress({"phase": "proceed", "remaining": sum(1 for planned in remainder if planned.action == "create")})
+        rest, succeeded = self.apply(remainder, parallel=parallel)
+        for item in rest:
+            progress(dict(item, phase="apply"))
+        return report + rest, verdicts, succeeded
+
+    def revert_in_flight(self, entry: Dict[str, Any]) -> List[Dict[str, Any]]:
+        manager = self.manager_factory(entry["type"])
+        if entry.get("ifname"):
+            manager.tunnel.ifnames[entry["vni"]] = entry["ifname"]
+        # The create may have been interrupted before its first step reached the kernel
+        if manager.tunnel.link_attributes(entry["vni"]) is None:
+            return [{"tunnel_type": entry["type"], "vni": entry["vni"], "action": "rollback", "result": "nothing to revert"}]
+        return self.rollback([entry])
+
+    def rollback(self, created: List[Dict[str, Any]]) -> List[Dict[str, Any]]:
+        report = []
+        for entry in reversed(created):
+            try:
+                self.manager_factory(entry["type"]).cleanup(entry["vni"], entry["bridge_name"])
+                result = "reverted"
+            except TunnelManagerError as e:
+                result = f"revert failed: {e}"
+            report.append({"tunnel_type": entry["type"], "vni": entry["vni"], "action": "rollback", "result": result})
+        return report
+
+
+def parse_flow_map(value: str) -> Dict[str, int]:
+    mappings = {}
+    for entry in value.split(","):
+        match = re.fullmatch(r"(?P<source>[\w.-]+)=vni(?P<vni>\d+)", entry)
+        if not match:
+            raise argparse.ArgumentTypeError(f"Invalid flow mapping: {entry} (expected vlan100=vni10100 or <port>=vni10100)")
+        mappings[match["source"]] = int(match["vni"])
+    return mappings
+
+
+# Collect-metadata ("external") devices: one device carries every VNI, and OVS, tc or eBPF set the VNI and remote per packet
+class ExternalTunnel:
+    KINDS = ("vxlan", "geneve")
+
+    def __init__(self, tunnel: TunnelInterface, store: StateStore) -> None:
+        if tunnel.tunnel_type not in self.KINDS:
+            raise TunnelManagerError(f"External mode needs a vxlan or geneve tunnel, not {tunnel.tunnel_type}")
+        if not getattr(tunnel, "KERNEL_DEVICE", True):
+            raise TunnelManagerError("OVS tunnel ports are made flow-based with options:key=flow; use the flows command with --tunnel-port instead")
+        self.tunnel = tunnel
+        self.store = store
+        self.executor = tunnel.executor
+
+    def default_name(self) -> str:
+        return f"{self.tunnel.tunnel_type}0"
+
+    def create(self, ifname: Optional[str] = None, dst_port: Optional[int] = None, bridge_name: Optional[str] = None) -> Dict[str, Any]:
+        ifname = ifname or self.default_name()
+        dst_port = dst_port or getattr(self.tunnel, "DEFAULT_PORT", None)
+        try:
+            self.executor.run(["ip", "link", "add", ifname, "type", self.tunnel.tunnel_type, "external", "dstport", str(dst_port)] + self.tunnel.header_options())
+        except subprocess.CalledProcessError as e:
+            # The kernel binds one external device per UDP port, and reports a second one as a duplicate VNI
+            logger.error(f"Error creating external {self.tunnel.tunnel_type} device {ifname}: {e}")
+            raise TunnelManagerError(f"Error creating external {self.tunnel.tunnel_type} device {ifname}; only one external device can listen on port {dst_port}") from e
+        try:
+            self.executor.run(["ip", "link", "set", ifname, "up"])
+            if bridge_name:
+                self.tunnel.bridges().add_port(bridge_name, ifname)
+        except subprocess.CalledProcessError as e:
+            logger.error(f"Error attaching external device {ifname}: {e}")
+            self.executor.run(["ip", "link", "del", ifname], check=False)
+            raise TunnelManagerError(f"Error attaching external device {ifname}") from e
+        record = {"ifname": ifname, "tunnel_type": self.tunnel.tunnel_type, "dst_port": dst_port, "bridge_name": bridge_name, "created_at": datetime.datetime.now().isoformat(timespec="seconds")}
+        with self.store.lock:
+            state = self.store.load()
+            state.setdefault("external", {})[ifname] = record
+            self.store.save(state)
+        logger.info(f"External {self.tunnel.tunnel_type} device {ifname} listening on port {dst_port}.")
+        return record
+
+    def delete(self, ifname: Optional[str] = None) -> None:
+        ifname = ifname or self.default_name()
+        record = self.store.load().get("external", {}).get(ifname)
+        try:
+            if record and record.get("bridge_name"):
+                self.tunnel.bridges().remove_port(record["bridge_name"], ifname)
+            self.executor.run(["ip", "link", "del", ifname])
+        except subprocess.CalledProcessError as e:
+            logger.error(f"Error deleting external device {ifname}: {e}")
+            raise TunnelManagerError(f"Error deleting external device {ifname}") from e
+        with self.store.lock:
+            state = self.store.load()
+            if state.get("external", {}).pop(ifname, None) is not None:
+                self.store.save(state)
+
+    def bridged_record(self, ifname: Optional[str]) -> Tuple[str, Dict[str, Any]]:
+        ifname = ifname or self.default_name()
+        record = self.store.load().get("external", {}).get(ifname)
+        if not record:
+            raise TunnelManagerError(f"{ifname} is not an external device created by this tool")
+        if not record.get("bridge_name") or self.tunnel.bridges().TOOL != IpBridgeBackend.TOOL:
+            raise TunnelManagerError(f"VLAN-to-VNI mapping needs {ifname} on a Linux bridge managed with --bridge-tool ip; recreate it with --bridge-name")
+        return ifname, record
+
+    def save_vlans(self, ifname: str, vlans: Dict[str, int]) -> None:
+        with self.store.lock:
+            state = self.store.load()
+            state.setdefault("external", {})[ifname]["vlans"] = vlans
+            self.store.save(state)
+
+    def map_vlan(self, vlan: int, vni: int, ifname: Optional[str] = None) -> None:
+        BridgeVlans.check_vlan(vlan)
+        ifname, record = self.bridged_record(ifname)
+        vlans = dict(record.get("vlans", {}))
+        for other_vlan, other_vni in vlans.items():
+            if other_vni == vni and int(other_vlan) != vlan:
+                raise TunnelManagerError(f"VNI {vni} is already mapped to VLAN {other_vlan} on {ifname}; one VNI carries one VLAN")
+        if str(vlan) in vlans and vlans[str(vlan)] != vni:
+            BridgeVlans(self.executor).unmap_tunnel(ifname, vlan, vlans[str(vlan)])
+        BridgeVlans(self.executor).enable_filtering(record["bridge_name"])
+        BridgeVlans(self.executor).map_tunnel(ifname, vlan, vni)
+        vlans[str(vlan)] = vni
+        self.save_vlans(ifname, vlans)
+        logger.info(f"VLAN {vlan} on {record['bridge_name']} is carried as VNI {vni} by {ifname}.")
+
+    def unmap_vlan(self, vlan: int, ifname: Optional[str] = None) -> None:
+        ifname, record = self.bridged_record(ifname)
+        vlans = dict(record.get("vlans", {}))
+        if str(vlan) not in vlans:
+            raise TunnelManagerError(f"VLAN {vlan} is not mapped on {ifname}")
+        BridgeVlans(self.executor).unmap_tunnel(ifname, vlan, vlans.pop(str(vlan)))
+        self.save_vlans(ifname, vlans)
+
+    def mappings(self, ifname: Optional[str] = None) -> List[Dict[str, Any]]:
+        ifname, record = self.bridged_record(ifname)
+        installed = BridgeVlans(self.executor).tunnels(ifname)
+        recorded = {int(vlan): vni for vlan, vni in record.get("vlans", {}).items()}
+        rows = []
+        for vlan in sorted(set(recorded) | set(installed)):
+            state = "ok" if recorded.get(vlan) == installed.get(vlan) else "missing" if vlan not in installed else "unmanaged" if vlan not in recorded else "drifted"
+            rows.append({"ifname": ifname, "vlan": vlan, "vni": recorded.get(vlan, installed.get(vlan)), "installed_vni": installed.get(vlan, ""), "state": state})
+        return rows
+
+    def list(self) -> List[Dict[str, Any]]:
+        try:
+            links = json.loads(self.executor.run(["ip", "-d", "-j", "link", "show", "type", self.tunnel.tunnel_type]).stdout or "[]")
+        except (subprocess.CalledProcessError, json.JSONDecodeError) as e:
+            logger.error(f"Error collecting external {self.tunnel.tunnel_type} devices: {e}")
+            return []
+        managed = self.store.load().get("external", {})
+        return [{"ifname": link["ifname"], "tunnel_type": self.tunnel.tunnel_type, "dst_port": str(TunnelInterface.info_data(link).get("port", "")), "master": link.get("master", ""), "state": "up" if "UP" in link.get("flags", []) else "down", "managed": "yes" if link["ifname"] in managed else "no"} for link in links if TunnelInterface.info_data(link).get("external")]
+
+
+class OvsFlowManager:
+    # High 16 bits of the cookie mark flows owned by tunnel_manager, the low bits carry the VNI
+    COOKIE_OWNER = 0x544D
+    COOKIE_OWNER_MASK = 0xFFFF000000000000
+
+    def __init__(self, bridge_name: str, tunnel_port: str, executor: Optional[CommandExecutor] = None) -> None:
+        self.bridge_name = bridge_name
+        self.tunnel_port = tunnel_port
+        self.executor = executor or SubprocessExecutor()
+
+    @classmethod
+    def cookie(cls, vni: int) -> int:
+        return (cls.COOKIE_OWNER << 48) | vni
+
+    @classmethod
+    def cookie_match(cls, vni: Optional[int] = None) -> str:
+        if vni is None:
+            return f"cookie={cls.COOKIE_OWNER << 48:#x}/{cls.COOKIE_OWNER_MASK:#x}"
+        return f"cookie={cls.cookie(vni):#x}/-1"
+
+    def build_flows(self, mappings: Dict[str, int], remote: str) -> List[str]:
+        tun_dst = "tun_ipv6_dst" if ":" in remote else "tun_dst"
+        flows = []
+        for source, vni in mappings.items():
+            cookie = f"cookie={self.cookie(vni):#x},priority=100"
+            encap = f"set_field:{vni}->tun_id,set_field:{remote}->{tun_dst},output:{self.tunnel_port}"
+            if vlan := re.fullmatch(r"vlan(\d+)", source):
+                flows.append(f"{cookie},dl_vlan={vlan[1]},actions=strip_vlan,{encap}")
+                flows.append(f"{cookie},in_port={self.tunnel_port},tun_id={vni},actions=mod_vlan_vid:{vlan[1]},NORMAL")
+            else:
+                flows.append(f"{cookie},in_port={source},actions={encap}")
+                flows.append(f"{cookie},in_port={self.tunnel_port},tun_id={vni},actions=output:{source}")
+        return flows
+
+    def apply(self, mappings: Dict[str, int], remote: str) -> None:
+        try:
+            for flow in self.build_flows(mappings, remote):
+                self.executor.run(["ovs-ofctl", "add-flow", self.bridge_name, flow])
+        except subprocess.CalledProcessError as e:
+            logger.error(f"Error installing flows on {self.bridge_name}: {e}")
+            raise TunnelManagerError(f"Error installing flows on {self.bridge_name}") from e
+
+    def show(self, vni: Optional[int] = None) -> str:
+        try:
+            result = self.executor.run(["ovs-ofctl", "dump-flows", self.bridge_name, self.cookie_match(vni)])
+        except subprocess.CalledProcessError as e:
+            logger.error(f"Error dumping flows of {self.bridge_name}: {e}")
+            raise TunnelManagerError(f"Error dumping flows of {self.bridge_name}") from e
+        return result.stdout
+
+    def delete(self, vni: Optional[int] = None) -> None:
+        try:
+            self.executor.run(["ovs-ofctl", "del-flows", self.bridge_name, self.cookie_match(vni)])
+        except subprocess.CalledProcessError as e:
+            logger.error(f"Error deleting flows from {self.bridge_name}: {e}")
+            raise TunnelManagerError(f"Error deleting flows from {self.bridge_name}") from e
+
+
+class WatchSubscription:
+    RESYNC = {"type": "resync"}
+
+    def __init__(self, hub: "TunnelWatchHub", buffer_size: int) -> None:
+        self.hub = hub
+        self.events: "queue.Queue[Dict[str, Any]]" = queue.Queue(buffer_size)
+        self.needs_resync = False
+
+    def deliver(self, event: Dict[str, Any]) -> None:
+        # Runs under the hub's lock and never blocks the publisher: a full buffer is dropped for a single resync marker,
+        # and events are skipped until the client has taken its resync snapshot
+        if self.needs_resync:
+            return
+        try:
+            self.events.put_nowait(event)
+        except queue.Full:
+            self.needs_resync = True
+            while True:
+                try:
+                    self.events.get_nowait()
+                except queue.Empty:
+                    break
+            self.events.put_nowait(self.RESYNC)
+
+    def next_event(self, timeout: Optional[float] = None) -> Dict[str, Any]:
+        try:
+            event = self.events.get(timeout=self.hub.heartbeat_interval if timeout is None else timeout)
+        except queue.Empty:
+            return {"type": "heartbeat", "time": datetime.datetime.now().isoformat(timespec="seconds")}
+        if event is self.RESYNC:
+            return {"type": "resync", "tunnels": self.hub.resync(self)}
+        return event
+
+
+class TunnelWatchHub:
+    def __init__(self, buffer_size: int = 256, heartbeat_interval: float = 30) -> None:
+        self.buffer_size = buffer_size
+        self.heartbeat_interval = heartbeat_interval
+        self.lock = threading.Lock()
+        self.tunnels: Dict[str, Dict[str, Any]] = {}
+        self.subscriptions: List[WatchSubscription] = []
+
+    def resync(self, subscription: WatchSubscription) -> List[Dict[str, Any]]:
+        # The snapshot and the end of skipping happen under the lock, so no event is lost or repeated around it
+        with self.lock:
+            subscription.needs_resync = False
+            return [dict(tunnel) for _, tunnel in sorted(self.tunnels.items())]
+
+    def subscribe(self) -> WatchSubscription:
+        subscription = WatchSubscription(self, self.buffer_size)
+        with self.lock:
+            subscription.deliver({"type": "snapshot", "tunnels": [dict(tunnel) for _, tunnel in sorted(self.tunnels.items())]})
+            self.subscriptions.append(subscription)
+        return subscription
+
+    def unsubscribe(self, subscription: WatchSubscription) -> None:
+        with self.lock:
+            if subscription in self.subscriptions:
+                self.subscriptions.remove(subscription)
+
+    def publish(self, tunnels: List[Dict[str, Any]]) -> List[Dict[str, Any]]:
+        current = {tunnel["ifname"]: dict(tunnel) for tunnel in tunnels}
+        with self.lock:
+            events = [{"type": "removed", "tunnel": tunnel} for ifname, tunnel in sorted(self.tunnels.items()) if ifname not in current]
+            for ifname, tunnel in sorted(current.items()):
+                if ifname not in self.tunnels:
+                    events.append({"type": "added", "tunnel": tunnel})
+                elif self.tunnels[ifname] != tunnel:
+                    events.append({"type": "changed", "tunnel": tunnel})
+            self.tunnels = current
+            for event in events:
+                for subscription in self.subscriptions:
+                    subscription.deliver(event)
+        return events
+
+
+def format_sse(event: Dict[str, Any]) -> str:
+    return f"event: {event['type']}\ndata: {json.dumps(event, sort_keys=True)}\n\n"
+
+
+class TunnelService:
+    METHODS = ("Create", "List", "Cleanup", "Validate")
+
+    def __init__(self, manager_factory: Callable[[str], TunnelManager], default_type: str = TunnelType.VXLAN.value, metrics: MetricRegistry = METRICS, snapshot: Optional[SnapshotExecutor] = None, cancellable: Optional[CancellableExecutor] = None, state_lock: Optional[StateLock] = None, watch: Optional[TunnelWatchHub] = None) -> None:
+        self.manager_factory = manager_factory
+        self.default_type = default_type
+        self.metrics = metrics
+        self.snapshot = snapshot
+        self.cancellable = cancellable
+        self.state_lock = state_lock
+        self.watch = watch
+        # Requests share the executors and the state file, so they run one at a time
+        self.lock = threading.Lock()
+
+    @contextlib.contextmanager
+    def exclusive(self) -> Iterator[None]:
+        # The state lock is held per request, so CLI runs can change tunnels while the daemon is idle
+        with self.lock:
+            if not self.state_lock:
+                yield
+                return
+            with self.state_lock:
+                yield
+
+    def handle(self, method: str, request: Dict[str, Any], cancel: Optional[CancelToken] = None) -> Dict[str, Any]:
+        if method not in self.METHODS:
+            raise ValueError(f"Unknown method {method}")
+        with self.exclusive():
+            # Every request answers from live state, not from what an earlier request read
+            if self.snapshot:
+                self.snapshot.invalidate()
+            self.metrics.inc(OPERATIONS, method=method)
+            try:
+                if not (self.cancellable and cancel):
+                    response = getattr(self, method.lower())(request)
+                else:
+                    self.cancellable.changes = []
+                    with self.cancellable.cancel.follow(cancel):
+                        try:
+                            response = getattr(self, method.lower())(request)
+                        except OperationCancelled as e:
+                            completed = list(self.cancellable.changes)
+                            with self.cancellable.cancel.shielded():
+                                self.revert(method, request)
+                            raise OperationCancelled(str(e), completed, self.cancellable.changes[len(completed):]) from e
+            except Exception:
+                self.metrics.inc(OPERATION_FAILURES, method=method)
+                raise
+            if method in ("Create", "Cleanup"):
+                self.publish()
+            return response
+
+    def watched_tunnels(self) -> List[Dict[str, Any]]:
+        tunnels = []
+        for tunnel_type in TunnelType:
+            manager = self.manager_factory(tunnel_type.value)
+            recorded = [record for record in manager.records.store.load().get("tunnels", {}).values() if record["tunnel_type"] == tunnel_type.value]
+            if not recorded:
+                continue
+            rows = {row["ifname"]: dict(row, tunnel_type=tunnel_type.value) for row in manager.records.annotate(tunnel_type.value, manager.list())}
+            for record in recorded:
+                # A recorded tunnel that is gone from the kernel stays visible until the reconciler brings it back
+                ifname = record.get("ifname") or manager.tunnel.interface_name(record["vni"])
+                rows.setdefault(ifname, {"ifname": ifname, "tunnel_type": tunnel_type.value, "vni": str(record["vni"]), "state": "MISSING"})
+            tunnels.extend(rows.values())
+        return tunnels
+
+    def publish(self) -> None:
+        # Called with exclusive() held, by requests that change tunnels and by the reconciler
+        if not self.watch:
+            return
+        try:
+            self.watch.publish(self.watched_tunnels())
+        except TunnelManagerError as e:
+            logger.warning(f"Error publishing tunnel changes to watchers: {e}")
+
+    def revert(self, method: str, request: Dict[str, Any]) -> None:
+        # A cancelled create leaves no half-built tunnel; a cancelled cleanup is not undone, the tunnel was going away
+        if method != "Create":
+            return
+        manager = self.manager(request)
+        vni = int(request["vni"])
+        if manager.tunnel.link_attributes(vni) is not None:
+            manager.cleanup(vni, request["bridge_name"])
+
+    def collect_metrics(self) -> str:
+        # Per-tunnel series are rebuilt on every scrape so removed tunnels drop out
+        with self.lock:
+            for name in (TUNNEL_UP, TUNNEL_RX_BYTES, TUNNEL_TX_BYTES, TUNNEL_RX_PACKETS, TUNNEL_TX_PACKETS):
+                self.metrics.reset(name)
+            for tunnel_type in TunnelType:
+                manager = self.manager_factory(tunnel_type.value)
+                recorded = [record for record in manager.records.store.load().get("tunnels", {}).values() if record["tunnel_type"] == tunnel_type.value]
+                self.metrics.set(MANAGED_TUNNELS, len(recorded), type=tunnel_type.value)
+                if not recorded:
+                    continue
+                try:
+                    links = {link["ifname"]: link for link in json.loads(manager.tunnel.executor.run(["ip", "-s", "-j", "link", "show", "type", tunnel_type.value]).stdout or "[]")}
+                except (subprocess.CalledProcessError, json.JSONDecodeError, TypeError, KeyError) as e:
+                    logger.warning(f"Error reading counters of {tunnel_type.value} tunnels: {e}")
+                    continue
+                for record in recorded:
+                    vni = record["vni"]
+                    link = links.get(manager.tunnel.interface_name(vni))
+                    self.metrics.set(TUNNEL_UP, int(link is not None), type=tunnel_type.value, vni=vni)
+                    if link is None:
+                        continue
+                    stats = link.get("stats64", link.get("stats", {}))
+                    for name, direction, field in ((TUNNEL_RX_BYTES, "rx", "bytes"), (TUNNEL_TX_BYTES, "tx", "bytes"), (TUNNEL_RX_PACKETS, "rx", "packets"), (TUNNEL_TX_PACKETS, "tx", "packets")):
+                        self.metrics.set(name, stats.get(direction, {}).get(field, 0), type=tunnel_type.value, vni=vni)
+            return self.metrics.render()
+
+    @staticmethod
+    def require(request: Dict[str, Any], *fields: str) -> None:
+        missing = [field for field in fields if request.get(field) in (None, "")]
+        if missing:
+            raise ValueError(f"Missing required field(s): {', '.join(missing)}")
+
+    def manager(self, request: Dict[str, Any]) -> TunnelManager:
+        tunnel_type = request.get("tunnel_type") or self.default_type
+        if tunnel_type not in [item.value for item in TunnelType]:
+            raise ValueError(f"Unknown tunnel type {tunnel_type}")
+        return self.manager_factory(tunnel_type)
+
+    def create(self, request: Dict[str, Any]) -> Dict[str, Any]:
+        self.require(request, "vni", "src_host", "dst_host", "bridge_name")
+        manager = self.manager(request)
+        vni = int(request["vni"])
+        manager.create(TunnelSpec(vni, request["src_host"], request["dst_host"], request["bridge_name"], request.get("src_port"), request.get("dst_port"), request.get("dev")), replace=bool(request.get("replace")))
+        return {"ifname": manager.tunnel.interface_name(vni), "tunnel_type": manager.tunnel.tunnel_type, "vni": vni}
+
+    def list(self, request: Dict[str, Any]) -> Dict[str, Any]:
+        manager = self.manager(request)
+        return {"tunnels": manager.records.annotate(manager.tunnel.tunnel_type, manager.list())}
+
+    def cleanup(self, request: Dict[str, Any]) -> Dict[str, Any]:
+        self.require(request, "vni")
+        manager = self.manager(request)
+        vni = int(request["vni"])
+        # DELETE /tunnels/{vni} carries no body, so the bridge defaults to the recorded one
+        bridge_name = request.get("bridge_name") or (manager.records.get(manager.tunnel.tunnel_type, vni) or {}).get("bridge_name")
+        if not bridge_name:
+            raise ValueError(f"No recorded {manager.tunnel.tunnel_type} tunnel with VNI {vni}; bridge_name is required")
+        return {"report": manager.cleanup(vni, bridge_name)}
+
+    def validate(self, request: Dict[str, Any]) -> Dict[str, Any]:
+        self.require(request, "vni")
+        manager = self.manager(request)
+        vni = int(request["vni"])
+        checks = manager.inspect(vni, request.get("bridge_name"), request.get("src_host"), request.get("dst_host"), request.get("dst_port"))
+        drifted = [check["check"] for check in checks if check["status"] == "drift"]
+        connectivity = "skipped"
+        if not drifted and request.get("src_host") and request.get("dst_host"):
+            try:
+                manager.validate(request["src_host"], request["dst_host"], vni, request.get("dst_port"))
+                connectivity = "ok"
+            except TunnelManagerError as e:
+                connectivity = f"failed: {e}"
+        return {"vni": vni, "checks": checks, "drifted": drifted, "connectivity": connectivity}
+
+
+# The daemon's reconciler is the agent's repair path driven by the state file instead of a manifest: every record is a tunnel to keep
+class TunnelReconciler(TunnelAgent):
+    def __init__(self, service: TunnelService, backoff: float = 5, max_backoff: float = 300, maintenance: Optional[MaintenanceManager] = None, clock: Callable[[], float] = time.monotonic, metrics: MetricRegistry = METRICS, snapshot: Optional[SnapshotExecutor] = None) -> None:
+        super().__init__(Manifest(MonitorSettings(), []), service.manager_factory, maintenance, clock, metrics, snapshot, checks=[], backoff=backoff, max_backoff=max_backoff)
+        self.service = service
+
+    @staticmethod
+    def recreate(manager: TunnelManager, record: Dict[str, Any]) -> None:
+        vni = record["vni"]
+        manager.create(TunnelSpec.from_record(vni, record))
+        # The new record replaces the old one; fields create does not know about, such as the creation time, are kept
+        recreated = manager.records.get(manager.tunnel.tunnel_type, vni) or {}
+        manager.records.record(manager.tunnel.tunnel_type, vni, dict(record, **{key: value for key, value in recreated.items() if key != "created_at"}))
+
+    def reconcile(self) -> List[Dict[str, Any]]:
+        try:
+            # Recreating shares the executors and the state file with API requests and CLI runs
+            with self.service.exclusive():
+                events = self.recreate_missing(self.clock())
+                # Watchers also see links deleted or changed by hand, not only what the API changed
+                self.service.publish()
+        except TunnelManagerError as e:
+            logger.warning(f"Skipping this reconcile cycle: {e}")
+            return []
+        for event in events:
+            self.metrics.inc(RECONCILE_ACTIONS, action=event["action"])
+        return events
+
+    def recreate_missing(self, now: float) -> List[Dict[str, Any]]:
+        events = []
+        # Links deleted by hand since the last tick must not be answered from an old snapshot
+        if self.snapshot:
+            self.snapshot.invalidate()
+        for tunnel_type in TunnelType:
+            manager = self.manager_factory(tunnel_type.value)
+            if not manager.records:
+                continue
+            recorded = [record for record in manager.records.store.load().get("tunnels", {}).values() if record["tunnel_type"] == tunnel_type.value]
+            for record in recorded:
+                vni = record["vni"]
+                key = TunnelRecords.key(tunnel_type.value, vni)
+                if record.get("ifname"):
+                    manager.tunnel.ifnames[vni] = record["ifname"]
+                ifname = manager.tunnel.interface_name(vni)
+                if manager.tunnel.link_attributes(vni) is not None:
+                    self.forget_repairs(key)
+                    continue
+                if "dst_host" not in record or (self.maintenance and self.maintenance.covers(vni)):
+                    continue
+                outcome = self.attempt_repair(key, now, lambda: self.recreate(manager, record))
+                if outcome is None:
+                    continue
+                if outcome["action"] == "repair failed":
+                    self.metrics.inc(RECONCILE_ERRORS, type=tunnel_type.value, vni=vni)
+                    logger.error(f"Error re-creating {ifname}: {outcome['error']}; retrying in {outcome['retry_in']:g}s")
+                    events.append({"ifname": ifname, "tunnel_type": tunnel_type.value, "vni": vni, "action": "recreate failed", "retry_in": outcome["retry_in"]})
+                    continue
+                self.metrics.inc(RECREATIONS, type=tunnel_type.value, vni=vni)
+                logger.warning(f"Re-created {ifname}, which was missing from the kernel.")
+                events.append({"ifname": ifname, "tunnel_type": tunnel_type.value, "vni": vni, "action": "recreated"})
+        return events
+
+
+# REST bodies are JSON objects with the same fields as the gRPC Structs
+def encode_message(message: Dict[str, Any]) -> bytes:
+    return json.dumps(message, sort_keys=True).encode()
+
+
+def decode_message(data: bytes) -> Dict[str, Any]:
+    message = json.loads(data.decode() or "{}")
+    if not isinstance(message, dict):
+        raise ValueError("Request must be a JSON object")
+    return message
+
+
+def whole_numbers(value: Any) -> Any:
+    # Struct numbers are doubles, so a VNI sent as 100 arrives as 100.0
+    if isinstance(value, float) and value.is_integer():
+        return int(value)
+    if isinstance(value, dict):
+        return {key: whole_numbers(item) for key, item in value.items()}
+    if isinstance(value, list):
+        return [whole_numbers(item) for item in value]
+    return value
+
+
+# Serves proto/tunnelmgr/v1/tunnel_manager.proto; requests and responses are google.protobuf.Struct, so the server needs no generated code
+class GrpcDaemon:
+    SERVICE = "tunnelmgr.v1.TunnelManager"
+
+    def __init__(self, service: TunnelService, listen: str, max_workers: int = 4, grace: float = 10) -> None:
+        self.service = service
+        self.listen = listen
+        self.max_workers = max_workers
+        self.grace = grace
+        self.server: Any = None
+
+    def rpc(self, grpc: Any, method: str) -> Callable[[Dict[str, Any], Any], Dict[str, Any]]:
+        def call(request: Dict[str, Any], context: Any) -> Dict[str, Any]:
+            cancel = CancelToken()
+            # The callback runs when the client cancels, the deadline passes or shutdown outlasts the grace period
+            if not context.add_callback(cancel.cancel) or not context.is_active():
+                cancel.cancel()
+            try:
+                return self.service.handle(method, request, cancel)
+            except OperationCancelled as e:
+                context.abort(grpc.StatusCode.CANCELLED, json.dumps(e.report(), sort_keys=True))
+            except ValueError as e:
+                context.abort(grpc.StatusCode.INVALID_ARGUMENT, str(e))
+            except TunnelManagerError as e:
+                context.abort(grpc.StatusCode.FAILED_PRECONDITION, str(e))
+            except Exception as e:
+                logger.error(f"{method} failed: {e}")
+                context.abort(grpc.StatusCode.INTERNAL, str(e))
+
+        return call
+
+    def watch(self, request: Dict[str, Any], context: Any) -> Iterator[Dict[str, Any]]:
+        subscription = self.service.watch.subscribe()
+        try:
+            while context.is_active():
+                yield subscription.next_event()
+        finally:
+            self.service.watch.unsubscribe(subscription)
+
+    def start(self) -> None:
+        try:
+            import grpc
+            from google.protobuf import json_format, struct_pb2
+        except ImportError as e:
+            raise TunnelManagerError("grpcio and protobuf are not installed; install them to serve the gRPC API") from e
+
+        def decode(data: bytes) -> Dict[str, Any]:
+            return whole_numbers(json_format.MessageToDict(struct_pb2.Struct.FromString(data)))
+
+        def encode(message: Dict[str, Any]) -> bytes:
+            return json_format.ParseDict(message, struct_pb2.Struct()).SerializeToString()
+
+        handlers = {method: grpc.unary_unary_rpc_method_handler(self.rpc(grpc, method), request_deserializer=decode, response_serializer=encode) for method in TunnelService.METHODS}
+        if self.service.watch:
+            handlers["Watch"] = grpc.unary_stream_rpc_method_handler(self.watch, request_deserializer=decode, response_serializer=encode)
+        self.server = grpc.server(concurrent.futures.ThreadPoolExecutor(max_workers=self.max_workers))
+        self.server.add_generic_rpc_handlers((grpc.method_handlers_generic_handler(self.SERVICE, handlers),))
+        if not self.server.add_insecure_port(self.listen):
+            raise TunnelManagerError(f"Cannot listen on {self.listen}")
+        self.server.start()
+        logger.info(f"Serving the gRPC API on {self.listen}.")
+
+    def stop(self) -> None:
+        if self.server:
+            self.server.stop(self.grace).wait()
+
+
+def parse_listen(value: str) -> Tuple[str, int]:
+    host, _, port = value.rpartition(":")
+    if not host or not port.isdigit():
+        raise argparse.ArgumentTypeError(f"Expected HOST:PORT, got {value}")
+    return host.strip("[]"), int(port)
+
+
+class HttpDaemon:
+    # nginx's status for a client that closed the connection before the response
+    CLIENT_CLOSED = 499
+
+    def __init__(self, service: TunnelService, listen: Tuple[str, int], api: bool = True, grace: float = 10, poll_interval: float = 0.2) -> None:
+        self.service = service
+        self.listen = listen
+        # A metrics-only listener can be exposed more widely than the API that changes tunnels
+        self.api = api
+        self.grace = grace
+        self.poll_interval = poll_interval
+        self.server: Optional[http.server.ThreadingHTTPServer] = None
+        self.in_flight: List[CancelToken] = []
+        self.drained = threading.Condition()
+
+    def route(self, method: str, path: str, query: Dict[str, Any], body: Dict[str, Any], cancel: Optional[CancelToken] = None) -> Tuple[int, Any]:
+        parts = [part for part in path.split("/") if part]
+        if parts == ["metrics"] and method == "GET":
+            return 200, self.service.collect_metrics()
+        if not self.api:
+            return 404, {"error": f"No route for {method} {path}"}
+        if parts == ["tunnels"] and method == "GET":
+            return 200, self.service.handle("List", query, cancel)
+        if parts == ["tunnels"] and method == "POST":
+            return 201, self.service.handle("Create", dict(query, **body), cancel)
+        if len(parts) == 2 and parts[0] == "tunnels" and method == "DELETE":
+            if not parts[1].isdigit():
+                raise ValueError(f"Invalid VNI {parts[1]}")
+            return 200, self.service.handle("Cleanup", dict(query, vni=int(parts[1])), cancel)
+        return 404, {"error": f"No route for {method} {path}"}
+
+    def respond(self, method: str, target: str, data: bytes, cancel: Optional[CancelToken] = None) -> Tuple[int, Any]:
+        url = urllib.parse.urlsplit(target)
+        query = {key: values[-1] for key, values in urllib.parse.parse_qs(url.query).items()}
+        try:
+            return self.route(method, url.path, query, decode_message(data) if data else {}, cancel)
+        except OperationCancelled as e:
+            return self.CLIENT_CLOSED, e.report()
+        except ValueError as e:
+            return 400, {"error": str(e)}
+        except TunnelManagerError as e:
+            return 409, {"error": str(e)}
+        except Exception as e:
+            logger.error(f"{method} {url.path} failed: {e}")
+            return 500, {"error": str(e)}
+
+    def watch(self, connection: socket.socket, cancel: CancelToken, done: threading.Event) -> None:
+        # A client that hangs up leaves its socket readable with nothing to read
+        while not done.wait(self.poll_interval):
+            try:
+                readable, _, _ = select.select([connection], [], [], 0)
+                if readable and not connection.recv(1, socket.MSG_PEEK):
+                    cancel.cancel()
+                    return
+            except OSError:
+                cancel.cancel()
+                return
+
+    def stream(self, handler: http.server.BaseHTTPRequestHandler) -> None:
+        # Server-sent events: a snapshot, then added, changed and removed events, with heartbeats in between.
+        # A stream is not a request in flight; it ends when the client goes away
+        subscription = self.service.watch.subscribe()
+        try:
+            handler.send_response(200)
+            handler.send_header("Content-Type", "text/event-stream")
+            handler.send_header("Cache-Control", "no-cache")
+            handler.end_headers()
+            while True:
+                handler.wfile.write(format_sse(subscription.next_event()).encode())
+                handler.wfile.flush()
+        except OSError as e:
+            logger.info(f"{handler.address_string()} stopped watching: {e}")
+        finally:
+            self.service.watch.unsubscribe(subscription)
+
+    def serve(self, method: str, target: str, data: bytes, connection: socket.socket) -> Tuple[int, Any]:
+        cancel, done = CancelToken(), threading.Event()
+        with self.drained:
+            self.in_flight.append(cancel)
+        threading.Thread(target=self.watch, args=(connection, cancel, done), daemon=True).start()
+        try:
+            return self.respond(method, target, data, cancel)
+        finally:
+            done.set()
+            with self.drained:
+                self.in_flight.remove(cancel)
+                self.drained.notify_all()
+
+    def handler(self) -> Type[http.server.BaseHTTPRequestHandler]:
+        daemon = self
+
+        class Handler(http.server.BaseHTTPRequestHandler):
+            def dispatch(self) -> None:
+                if daemon.api and daemon.service.watch and self.command == "GET" and urllib.parse.urlsplit(self.path).path.rstrip("/") == "/tunnels/watch":
+                    daemon.stream(self)
+                    return
+                length = int(self.headers.get("Content-Length") or 0)
+                status, response = daemon.serve(self.command, self.path, self.rfile.read(length), self.connection)
+                text = isinstance(response, str)
+                data = response.encode() if text else encode_message(response)
+                try:
+                    self.send_response(status)
+                    self.send_header("Content-Type", "text/plain; version=0.0.4" if text else "application/json")
+                    self.send_header("Content-Length", str(len(data)))
+                    self.end_headers()
+                    self.wfile.write(data)
+                except OSError as e:
+                    logger.info(f"{self.address_string()} went away before the {status} response: {e}")
+
+            do_GET = do_POST = do_DELETE = dispatch
+
+            def log_message(self, format: str, *args: Any) -> None:
+                logger.info(f"{self.address_string()} {format % args}")
+
+        return Handler
+
+    def start(self) -> None:
+        server_class = http.server.ThreadingHTTPServer
+        if ":" in self.listen[0]:
+            server_class = type("ThreadingHTTPServer6", (server_class,), {"address_family": socket.AF_INET6})
+        try:
+            self.server = server_class(self.listen, self.handler())
+        except OSError as e:
+            raise TunnelManagerError(f"Cannot listen on {self.listen[0]}:{self.listen[1]}: {e}") from e
+        threading.Thread(target=self.server.serve_forever, daemon=True).start()
+        logger.info(f"Serving the REST API on {self.listen[0]}:{self.server.server_address[1]}.")
+
+    def stop(self) -> None:
+        if self.server:
+            self.server.shutdown()
+            # Requests in flight get the grace period to finish; whatever still runs then is cancelled and rolled back
+            with self.drained:
+                if not self.drained.wait_for(lambda: not self.in_flight, self.grace):
+                    for cancel in self.in_flight:
+                        cancel.cancel()
+                    self.drained.wait_for(lambda: not self.in_flight, self.grace)
+            self.server.server_close()
+
+
+# Commands and subcommands that only read; every other command changes tunnels or state, so it takes the state lock
+# and recovers interrupted operations first. A new command is locked until it is listed here
+READ_ONLY_COMMANDS = ("state", "validate", "show", "describe", "status", "stats", "watch", "list", "doctor", "bridges", "fleet", "mesh", "export", "plan", "diff", "wait-ready", "explain", "manifest")
+READ_ONLY_SUBCOMMANDS = {"bridge": ("list",), "port": ("show",), "fdb": ("list",), "neigh": ("list",), "flowsample": ("show",), "maintenance": ("status",), "agent": ("effective-config",), "flows": ("show",), "external": ("mappings", "list"), "wireguard": ("show",)}
+
+
+def mutates(args: argparse.Namespace) -> bool:
+    if args.command in READ_ONLY_COMMANDS:
+        return False
+    if args.command == "addr":
+        return bool(args.renew)
+    if args.command == "wireguard" and args.wireguard_command == "keys":
+        return args.keys_command != "list"
+    return getattr(args, f"{args.command.replace('-', '_')}_command", None) not in READ_ONLY_SUBCOMMANDS.get(args.command, ())
+
+
+def confirm(question: str) -> bool:
+    try:
+        return input(f"{question} [y/N] ").strip().lower() in ("y", "yes")
+    except EOFError:
+        return False
+
+
+def port_flags_from_args(args: argparse.Namespace) -> Dict[str, str]:
+    return {flag: getattr(args, f"port_{flag}") for flag in BridgePort.FLAGS if getattr(args, f"port_{flag}", None)}
+
+
+def checksums_from_args(args: argparse.Namespace) -> Dict[str, bool]:
+    return {name: getattr(args, name) == "on" for name in TunnelInterface.CHECKSUMS if getattr(args, name, None)}
+
+
+def gre_options_from_args(args: argparse.Namespace) -> Dict[str, Any]:
+    key = getattr(args, "gre_key", None)
+    keys = {"ikey": getattr(args, "gre_ikey", None), "okey": getattr(args, "gre_okey", None)}
+    options: Dict[str, Any] = {name: value if value is not None else key for name, value in keys.items() if value is not None or key is not None}
+    return dict(options, **{option: True for option in ("csum", "seq") if getattr(args, f"gre_{option}", False)})
+
+
+def vxlan_flags_from_args(args: argparse.Namespace) -> Dict[str, bool]:
+    return {flag: getattr(args, f"vxlan_{flag}") == "on" for flag in VXLANTunnel.FLAGS if getattr(args, f"vxlan_{flag}", None)}
+
+
+def add_bridge_options(parser: argparse.ArgumentParser, prefix: str) -> None:
+    parser.add_argument(f"{prefix}mtu", dest="bridge_mtu", type=int, help="MTU of the bridge (default: kernel default)")
+    parser.add_argument(f"{prefix}stp", dest="bridge_stp", choices=["on", "off"], help="Run the spanning tree protocol on the bridge (default: kernel default, off)")
+    parser.add_argument(f"{prefix}forward-delay", dest="bridge_forward_delay", type=int, metavar="SECONDS", help="STP forward delay of the bridge (default: kernel default, 15)")
+
+
+def bridge_options_from_args(args: argparse.Namespace) -> Dict[str, Any]:
+    return {"mtu": args.bridge_mtu, "stp": None if args.bridge_stp is None else args.bridge_stp == "on", "forward_delay": args.bridge_forward_delay}
+
+
+def main() -> None:
+    parser = argparse.ArgumentParser(description="Manage VXLAN, GENEVE and GRE tunnels between bridges.")
+    parser.add_argument("--tunnel-type", choices=[tunnel_type.value for tunnel_type in TunnelType], default=TunnelType.VXLAN.value, help="Type of tunnel to create (default: %(default)s)")
+    parser.add_argument("--bridge-tool", choices=list(BRIDGE_BACKENDS), default=os.environ.get("TUNNELMGR_BRIDGE_TOOL", IpBridgeBackend.TOOL), help="Tool that creates bridges and attaches ports: ip, brctl, or ovs-vsctl for Open vSwitch bridges (default: %(default)s, or $TUNNELMGR_BRIDGE_TOOL)")
+    parser.add_argument("--frr-asn", type=int, default=int(os.environ["TUNNELMGR_FRR_ASN"]) if os.environ.get("TUNNELMGR_FRR_ASN") else None, help="Configure each created VXLAN VNI for BGP EVPN in the running FRR's router bgp with this AS, and remove it on cleanup")
+    parser.add_argument("--netns", default=os.environ.get("TUNNELMGR_NETNS"), help="Named network namespace to manage tunnels and bridges in; tunnel devices are created outside, where the underlay is, and moved in (default: $TUNNELMGR_NETNS, or the current namespace)")
+    parser.add_argument("--backend", choices=["ip", "netlink", "ovs"], default="ip", help="Create, list and remove links by running ip or over netlink with pyroute2, or manage Open vSwitch tunnel ports instead of kernel devices with ovs; other commands still run ip (default: %(default)s)")
+    parser.add_argument("--ttl", type=parse_ttl, help="Underlay TTL of created tunnels, 1-255 or 'inherit' to copy it from the inner packet (default: kernel default)")
+    parser.add_argument("--tos", type=parse_tos, help="Underlay TOS byte of created tunnels, e.g. 0xb8, or 'inherit' to keep the DSCP of the inner packet (default: 0)")
+    parser.add_argument("--df", choices=["set", "unset", "inherit"], help="Don't Fragment bit of the outer header: always set, never set, or copied from the inner packet, which GRE and OVS ports cannot do (default: kernel default)")
+    parser.add_argument("--udp6-zero-csum", action="store_true", help="Send and accept zero UDP checksums on VXLAN and GENEVE tunnels over an IPv6 underlay, for peers that require it")
+    parser.add_argument("--resolve", choices=[policy.value for policy in ResolvePolicy], help="How to pick an address when a host name resolves to several (default: fail on ambiguity)")
+    parser.add_argument("--max-tunnels-per-bridge", type=int, help="Refuse to add tunnels to bridges that already carry this many tunnel ports (default: no limit)")
+    parser.add_argument("--state-file", default=StateStore.DEFAULT_PATH, help="Path of the state file (default: %(default)s)")
+    parser.add_argument("--dry-run", dest="global_dry_run", action="store_true", help="Print the commands that would change the system, such as create, cleanup or apply would run, without running them; queries still run")
+    subparsers = parser.add_subparsers(dest="command", help="sub-command help")
+
+    # Create the parser for the "create" command
+    parser_create = subparsers.add_parser("create", help="create a tunnel interface")
+    create_scope = parser_create.add_mutually_exclusive_group(required=True)
+    create_scope.add_argument("--vni", type=int, help="VNI (Virtual Network Identifier)")
+    create_scope.add_argument("--vni-range", type=parse_vni_range, metavar="START-END", help="Create one tunnel per VNI of this range, e.g. 100-150; {vni} and {index} in --src-host, --dst-host and --bridge-name are replaced per tunnel")
+    parser_create.add_argument("--vni-map", help="YAML or JSON file mapping VNIs to src_host, dst_host, bridge_name, dev, src_port, dst_port and ifname, overriding the command line")
+    parser_create.add_argument("--src-host", required=True, help="Source host IP address or name")
+    create_remote = parser_create.add_mutually_exclusive_group()
+    create_remote.add_argument("--dst-host", action="extend", type=parse_host_list, dest="dst_hosts", help="Destination host IP address or name; repeat it or pass a comma-separated list to replicate flooded traffic to several VXLAN peers")
+    create_remote.add_argument("--group", type=parse_multicast_group, help="VXLAN multicast group to flood to instead of a unicast remote, e.g. 239.1.1.1 (needs --dev)")
+    parser_create.add_argument("--bridge-name", help="Bridge name to associate with the tunnel interface (required unless given by --vni-map)")
+    parser_create.add_argument("--ifname-template", metavar="TEMPLATE", help="Name the tunnel interface after a template, e.g. 'vx-{vni}-{bridge}' ({type} and {index} also work; default: <type><vni>)")
+    parser_create.add_argument("--src-port", type=parse_port_range, metavar="MIN-MAX", help="UDP source port range of VXLAN packets, e.g. 49152-65535; like ip, MAX itself is not used (default: the kernel's ephemeral port range)")
+    parser_create.add_argument("--dst-port", type=int, help="Destination port (optional)")
+    parser_create.add_argument("--dev", help="Device (optional)")
+    for flag in BridgePort.FLAGS:
+        parser_create.add_argument(f"--port-{flag.replace('_', '-')}", dest=f"port_{flag}", choices=["on", "off"], help=f"Set the bridge port {flag} flag (default: kernel default)")
+    for flag in VXLANTunnel.FLAGS:
+        if flag != "gbp":
+            parser_create.add_argument(f"--{flag}", dest=f"vxlan_{flag}", choices=["on", "off"], help=f"Set the VXLAN device {flag} flag (default: {'on' if VXLANTunnel.FLAGS[flag] else 'off'})")
+    parser_create.add_argument("--gbp", dest="vxlan_gbp", action="store_const", const="on", help="Enable the Group-Based Policy extension, which carries a security group tag in the VXLAN header")
+    parser_create.add_argument("--udpcsum", choices=["on", "off"], help="Checksum the outer UDP header of VXLAN and Geneve packets over IPv4 (default: kernel default)")
+    parser_create.add_argument("--udp6zerocsumtx", choices=["on", "off"], help="Send zero UDP checksums over IPv6 instead of computing them (default: off, or on with --udp6-zero-csum)")
+    parser_create.add_argument("--udp6zerocsumrx", choices=["on", "off"], help="Accept received packets with zero UDP checksums over IPv6 (default: off, or on with --udp6-zero-csum)")
+    parser_create.add_argument("--key", dest="gre_key", type=parse_gre_key, help="GRE key in both directions, as a number or dotted quad (default: the VNI)")
+    parser_create.add_argument("--ikey", dest="gre_ikey", type=parse_gre_key, help="GRE key expected on received packets (default: --key)")
+    parser_create.add_argument("--okey", dest="gre_okey", type=parse_gre_key, help="GRE key put on sent packets (default: --key)")
+    parser_create.add_argument("--csum", dest="gre_csum", action="store_true", help="Checksum GRE packets and require checksums on received ones")
+    parser_create.add_argument("--seq", dest="gre_seq", action="store_true", help="Number GRE packets and drop received ones that arrive out of order")
+    parser_create.add_argument("--encrypt-key-file", metavar="FILE", help="Encrypt the tunnel's UDP traffic with IPsec ESP, keyed from a secret both hosts share in FILE")
+    parser_create.add_argument("--vrf", help="Put the bridge, or a layer 3 GRE device itself, into this VRF")
+    parser_create.add_argument("--vrf-table", type=int, help="Create the --vrf device with this routing table if it does not exist")
+    parser_create.add_argument("--dev-vlan", metavar="VID[.VID]", help="Run the tunnel over a VLAN sub-interface of --dev, or two stacked ones (S-tag.C-tag), creating them if absent")
+    parser_create.add_argument("--dev-vlan-protocol", choices=UnderlayVlan.PROTOCOLS, help="Protocol of the outer --dev-vlan tag (default: 802.1ad for two tags, 802.1Q for one)")
+    parser_create.add_argument("--vlan", type=int, metavar="VID", help="Make the tunnel an untagged access port of this VLAN on a VLAN-filtering bridge")
+    parser_create.add_argument("--macsec-key-file", metavar="FILE", help="Put a MACsec device on the tunnel and bridge it instead, keyed from a secret both hosts share in FILE")
+    parser_create.add_argument("--macsec-cipher", choices=list(TunnelMacsec.CIPHERS), help=f"MACsec cipher suite (default: {TunnelMacsec.DEFAULT_CIPHER})")
+    parser_create.add_argument("--peers-from-dns", help="SRV or TXT record listing head-end replication peers, e.g. _vxlan._udp.dc1.example.com")
+    parser_create.add_argument("--route", action="append", dest="routes", metavar="PREFIX", help="Remote prefix to route over the tunnel's bridge (repeatable)")
+    parser_create.add_argument("--route-mtu", type=parse_route_mtu, help="Lock the MTU of the added routes to <n>, or 'auto' for the tunnel MTU")
+    mtu_group = parser_create.add_mutually_exclusive_group()
+    mtu_group.add_argument("--mtu", type=parse_mtu, help="MTU of the tunnel interface (default: kernel default)")
+    mtu_group.add_argument("--auto-mtu", action="store_true", help="Set the tunnel MTU to the underlay device MTU (--dev, or the route to the remote) minus the encapsulation overhead, 20 bytes more over IPv6")
+    parser_create.add_argument("--attach-only", action="store_true", help="Attach an existing identical tunnel device to the bridge instead of failing")
+    parser_create.add_argument("--replace", "--force", action="store_true", help="Recreate an existing tunnel device whose attributes differ, or move it to --bridge-name")
+    parser_create.add_argument("--auto-create-bridge", action="store_true", help="Create --bridge-name if it is missing, and delete it again when cleanup removes its last port")
+    add_bridge_options(parser_create, "--bridge-")
+    parser_create.add_argument("--label", action="append", dest="labels", type=parse_label, metavar="KEY=VALUE", help="Record a label with the tunnel, shown and filtered on by list (repeatable)")
+    parser_create.add_argument("--link-group", type=int, default=LinkGroup.DEFAULT_GROUP, help="Kernel link group of the tunnel interface (default: %(default)s, registered as 'tunnelmgr')")
+    parser_create.add_argument("--policy-override", action="store_true", help="Bypass the per-bridge tunnel limit (recorded in the audit log)")
+    parser_create.add_argument("--skip-rpfilter-check", action="store_true", help="Do not check reverse path filtering on --dev")
+    parser_create.add_argument("--fix-rpfilter", action="store_true", help="Set rp_filter on --dev to loose when strict mode would drop traffic from the remote")
+    parser_create.add_argument("--persist", action="store_true", help="With --fix-rpfilter, also write the setting to /etc/sysctl.d")
+
+    # Create the parser for the "cleanup" command
+    parser_cleanup = subparsers.add_parser("cleanup", help="cleanup a tunnel interface")
+    cleanup_scope = parser_cleanup.add_mutually_exclusive_group(required=True)
+    cleanup_scope.add_argument("--vni", type=int, help="VNI (Virtual Network Identifier)")
+    cleanup_scope.add_argument("--site", help="Remove every service tunnel recorded for this manifest site")
+    cleanup_scope.add_argument("--all", action="store_true", help="Remove every managed tunnel of every type")
+    cleanup_scope.add_argument("--all-vnis", action="store_true", help="Remove every tunnel attached to --bridge-name")
+    cleanup_scope.add_argument("--prune", action="store_true", help="Remove VXLAN and GENEVE interfaces that are not recorded in the state file")
+    parser_cleanup.add_argument("--bridge-name", help="Bridge name associated with the tunnel interface (default: the recorded bridge)")
+    parser_cleanup.add_argument("-y", "--yes", action="store_true", help="Do not ask for confirmation before removing several tunnels")
+    parser_cleanup.add_argument("--force", action="store_true", help="Remove the interface even if it is not recorded in the state file")
+
+    # Create the parser for the "state" command
+    parser_state = subparsers.add_parser("state", help="inspect recorded tunnel state")
+    state_subparsers = parser_state.add_subparsers(dest="state_command", required=True)
+    parser_state_show = state_subparsers.add_parser("show", help="show a tunnel's record and the ancillary objects cleanup will remove")
+    parser_state_show.add_argument("--vni", type=int, required=True, help="VNI (Virtual Network Identifier)")
+
+    # Create the parser for the "validate" command
+    parser_validate = subparsers.add_parser("validate", help="check a tunnel interface against its expected configuration and validate connectivity")
+    parser_validate.add_argument("--src-host", help="Expected local address or name (default: recorded)")
+    parser_validate.add_argument("--dst-host", help="Expected remote address or name; with --src-host, also validates connectivity (default: recorded)")
+    parser_validate.add_argument("--vni", type=int, required=True, help="VNI (Virtual Network Identifier)")
+    parser_validate.add_argument("--bridge-name", help="Bridge the interface should be attached to (default: recorded)")
+    parser_validate.add_argument("--port", type=int, help="Expected destination port (default: recorded or the tunnel type's default)")
+    parser_validate.add_argument("--retries", type=int, default=3, help="Number of retries for connectivity validation (default: %(default)s)")
+    parser_validate.add_argument("--timeout", type=int, default=3, help="Timeout in seconds for connectivity validation (default: %(default)s)")
+    parser_validate.add_argument("--skip-rpfilter-check", action="store_true", help="Do not check reverse path filtering on the recorded underlay device")
+    parser_validate.add_argument("-fo", "--format", choices=["text", "json"], default="text", help="Output format; json prints the checks, connectivity and rp_filter results (default: %(default)s)")
+
+    # Create the parser for the "show" command
+    parser_show = subparsers.add_parser("show", aliases=["describe"], help="show everything about one tunnel: kernel parameters, bridge port, forwarding entries, statistics, record and checks")
+    parser_show.add_argument("--vni", type=int, required=True, help="VNI (Virtual Network Identifier)")
+    parser_show.add_argument("-fo", "--format", choices=["text", "json"], default="text", help="Output format (default: %(default)s)")
+
+    # Create the parser for the "status" command
+    parser_status = subparsers.add_parser("status", help="show link health of every tunnel of --tunnel-type: carrier, last change, MTU and remote reachability")
+    parser_status.add_argument("--exit-code", action="store_true", help="Exit with 1 if any tunnel is degraded and 2 if any is down, for use as a health probe")
+    parser_status.add_argument("--no-ping", action="store_true", help="Do not ping the remote endpoints")
+    parser_status.add_argument("-fo", "--format", choices=[format_type.value for format_type in OutputFormatType], default=OutputFormatType.TABLE.value, help="Output format (default: %(default)s)")
+
+    # Create the parser for the "stats" command
+    parser_stats = subparsers.add_parser("stats", help="show rx/tx bytes, packets, drops and errors of the tunnel interfaces of --tunnel-type")
+    parser_stats.add_argument("--vni", type=parse_vni_list, action="extend", dest="vnis", help="Only show these VNIs (comma-separated, repeatable)")
+    parser_stats.add_argument("--watch", type=parse_duration, metavar="INTERVAL", help="Sample every INTERVAL (e.g. 2s) and print rates and new drops and errors until interrupted")
+    parser_stats.add_argument("--analyze", action="store_true", help="Sample counters twice and report likely causes of drops")
+    parser_stats.add_argument("--interval", type=int, default=5, help="Seconds between samples when analyzing (default: %(default)s)")
+    parser_stats.add_argument("-fo", "--format", choices=[format_type.value for format_type in OutputFormatType], default=OutputFormatType.TABLE.value, help="Output format (default: %(default)s)")
+
+    # Create the parser for the "watch" command
+    parser_watch = subparsers.add_parser("watch", help="stream up, down, created and deleted events of managed tunnel interfaces from netlink")
+    parser_watch.add_argument("--all", action="store_true", help="Also follow tunnel interfaces that are not managed")
+    parser_watch.add_argument("-fo", "--format", choices=["text", "json"], default="text", help="Print a line of text or a JSON object per event (default: %(default)s)")
+
+    # Create the parser for the "list" command
+    parser_list = subparsers.add_parser("list", help="list all tunnel interfaces")
+    parser_list.add_argument("-fo", "--format", choices=[format_type.value for format_type in OutputFormatType] + ["plain"], default=OutputFormatType.TABLE.value, help="Output format for listing tunnels; plain prints the raw ip -d link show output (default: %(default)s)")
+    parser_list.add_argument("-fi", "--fields", nargs="+", default=["all"], help=f"Fields to display for listing tunnel interfaces: {', '.join(TunnelManager.LIST_FIELDS)}, or all (default: all)")
+    parser_list.add_argument("--kernel-group", type=int, help="Only list interfaces in this kernel link group")
+    parser_list.add_argument("--vni", type=parse_vni_list, action="extend", dest="vnis", help="Only list these VNIs (comma-separated, repeatable)")
+    parser_list.add_argument("--bridge", metavar="GLOB", help="Only list tunnels on a bridge matching this glob, e.g. br-tenant*")
+    parser_list.add_argument("--remote", metavar="HOST", help="Only list tunnels to this remote address or host name")
+    parser_list.add_argument("--ifname", metavar="GLOB", help="Only list interfaces whose name matches this glob, e.g. 'vx-*'")
+    parser_list.add_argument("--label", action="append", dest="labels", type=parse_label, metavar="KEY=VALUE", help="Only list tunnels recorded with this label (repeatable; all must match)")
+    parser_list.add_argument("--owner", choices=["all", "managed", "foreign"], default="all", help="Only list interfaces recorded in the state file (managed) or only the others (foreign) (default: %(default)s)")
+
+    # Create the parser for the "import" command
+    parser_import = subparsers.add_parser("import", help="record existing tunnel interfaces of --tunnel-type so they are managed without being recreated")
+    parser_import.add_argument("--vni", type=int, action="append", dest="vnis", help="Only import the tunnel with this VNI (repeatable; default: every unmanaged one)")
+    parser_import.add_argument("--format", choices=["state", "manifest"], default="state", help="Record the tunnels in the state file, or print them as manifest entries without recording them (default: %(default)s)")
+
+    # Create the parser for the "group" command
+    parser_group = subparsers.add_parser("group", help="manage the kernel link group of managed tunnels")
+    group_subparsers = parser_group.add_subparsers(dest="group_command", required=True)
+    parser_group_default = group_subparsers.add_parser("set-default", help="move all managed tunnel interfaces into a link group")
+    parser_group_default.add_argument("--link-group", type=int, default=LinkGroup.DEFAULT_GROUP, help="Link group number (default: %(default)s)")
+
+    # Create the parser for the "doctor" command
+    parser_doctor = subparsers.add_parser("doctor", help="check the host for problems affecting managed tunnels")
+    parser_doctor.add_argument("--link-group", type=int, default=LinkGroup.DEFAULT_GROUP, help="Link group managed tunnels are placed in (default: %(default)s)")
+    parser_doctor.add_argument("--skip-rpfilter-check", action="store_true", help="Do not check reverse path filtering on the underlay devices of managed tunnels")
+
+    # Create the parser for the "bridge" command
+    parser_bridge = subparsers.add_parser("bridge", help="create, delete or list bridges")
+    bridge_subparsers = parser_bridge.add_subparsers(dest="bridge_command", required=True)
+    parser_bridge_create = bridge_subparsers.add_parser("create", help="create a bridge and bring it up")
+    parser_bridge_delete = bridge_subparsers.add_parser("delete", help="delete a bridge that has no ports")
+    parser_bridge_list = bridge_subparsers.add_parser("list", help="list bridges with their MTU, STP state and ports")
+    for parser_bridge_command in (parser_bridge_create, parser_bridge_delete):
+        parser_bridge_command.add_argument("--bridge-name", required=True, help="Bridge name")
+    add_bridge_options(parser_bridge_create, "--")
+    parser_bridge_list.add_argument("-fo", "--format", choices=[format_type.value for format_type in OutputFormatType], default=OutputFormatType.TABLE.value, help="Output format (default: %(default)s)")
+
+    # Create the parser for the "bridges" command
+    parser_bridges = subparsers.add_parser("bridges", help="list bridges and their tunnel ports")
+    parser_bridges.add_argument("--show-usage", action="store_true", help="Show tunnel port counts against the per-bridge limit")
+    parser_bridges.add_argument("-fo", "--format", choices=[format_type.value for format_type in OutputFormatType], default=OutputFormatType.TABLE.value, help="Output format (default: %(default)s)")
+
+    # Create the parser for the "port" command
+    parser_port = subparsers.add_parser("port", help="manage bridge port flags of a tunnel")
+    port_subparsers = parser_port.add_subparsers(dest="port_command", required=True)
+    parser_port_set = port_subparsers.add_parser("set", help="change bridge port flags")
+    parser_port_show = port_subparsers.add_parser("show", help="show bridge port flags")
+    for parser_port_command in (parser_port_set, parser_port_show):
+        parser_port_command.add_argument("--vni", type=int, required=True, help="VNI (Virtual Network Identifier)")
+    for flag in BridgePort.FLAGS:
+        parser_port_set.add_argument(f"--port-{flag.replace('_', '-')}", dest=f"port_{flag}", choices=["on", "off"], help=f"Set the bridge port {flag} flag")
+
+    # Create the parser for the "mtu" command
+    parser_mtu = subparsers.add_parser("mtu", help="change the MTU of a tunnel")
+    parser_mtu.add_argument("--vni", type=int, required=True, help="VNI (Virtual Network Identifier)")
+    parser_mtu.add_argument("--mtu", type=parse_mtu, required=True, help="New MTU of the tunnel interface")
+    parser_mtu.add_argument("--relock-routes", action="store_true", help="Lock the tunnel's routes to the new MTU as well")
+
+    # Create the parser for the "fdb" command
+    parser_fdb = subparsers.add_parser("fdb", help="manage forwarding entries of a tunnel")
+    fdb_subparsers = parser_fdb.add_subparsers(dest="fdb_command", required=True)
+    parser_fdb_add = fdb_subparsers.add_parser("add", help="send a MAC, or flooded traffic with --flood, to a remote VTEP")
+    parser_fdb_del = fdb_subparsers.add_parser("del", help="remove a forwarding or flood entry")
+    parser_fdb_list = fdb_subparsers.add_parser("list", help="list the forwarding entries of a tunnel")
+    for parser_fdb_command in (parser_fdb_add, parser_fdb_del, parser_fdb_list):
+        parser_fdb_command.add_argument("--vni", type=int, required=True, help="VNI (Virtual Network Identifier)")
+    for parser_fdb_command in (parser_fdb_add, parser_fdb_del):
+        fdb_target = parser_fdb_command.add_mutually_exclusive_group(required=True)
+        fdb_target.add_argument("--mac", type=parse_mac, help="MAC address behind the remote VTEP")
+        fdb_target.add_argument("--flood", action="store_const", dest="mac", const=FloodList.ALL_ZEROS_MAC, help=f"Use the all-zeros MAC ({FloodList.ALL_ZEROS_MAC}), which floods broadcast and unknown traffic to the remote")
+        parser_fdb_command.add_argument("--remote", required=True, help="Remote VTEP IP address or name")
+    parser_fdb_list.add_argument("-fo", "--format", choices=[format_type.value for format_type in OutputFormatType], default=OutputFormatType.TABLE.value, help="Output format (default: %(default)s)")
+
+    # Create the parser for the "neigh" command
+    parser_neigh = subparsers.add_parser("neigh", help="manage static ARP/ND entries on a tunnel's bridge")
+    neigh_subparsers = parser_neigh.add_subparsers(dest="neigh_command", required=True)
+    parser_neigh_add = neigh_subparsers.add_parser("add", help="map an overlay IP address to the MAC of its host")
+    parser_neigh_del = neigh_subparsers.add_parser("del", help="remove a static neighbour entry")
+    parser_neigh_list = neigh_subparsers.add_parser("list", help="list the neighbour entries of a tunnel's bridge")
+    for parser_neigh_command in (parser_neigh_add, parser_neigh_del, parser_neigh_list):
+        parser_neigh_command.add_argument("--vni", type=int, required=True, help="VNI (Virtual Network Identifier)")
+    for parser_neigh_command in (parser_neigh_add, parser_neigh_del):
+        parser_neigh_command.add_argument("--address", type=parse_ip_address, required=True, help="IPv4 or IPv6 address of the host in the overlay")
+    parser_neigh_add.add_argument("--mac", type=parse_mac, required=True, help="MAC address of the host")
+    parser_neigh_list.add_argument("-fo", "--format", choices=[format_type.value for format_type in OutputFormatType], default=OutputFormatType.TABLE.value, help="Output format (default: %(default)s)")
+
+    # Create the parser for the "flowsample" command
+    parser_flowsample = subparsers.add_parser("flowsample", help="export sampled tunnel traffic to an sFlow or IPFIX collector")
+    flowsample_subparsers = parser_flowsample.add_subparsers(dest="flowsample_command", required=True)
+    parser_flowsample_enable = flowsample_subparsers.add_parser("enable", help="start sampling a tunnel's traffic")
+    parser_flowsample_enable.add_argument("--vni", type=int, required=True, help="VNI (Virtual Network Identifier)")
+    parser_flowsample_enable.add_argument("--collector", type=parse_collector, required=True, help="Collector as host[:port] (default port 6343 for sFlow, 4739 for IPFIX)")
+    parser_flowsample_enable.add_argument("--rate", type=int, default=1024, help="Sample one in <rate> packets (default: %(default)s)")
+    parser_flowsample_enable.add_argument("--protocol", choices=list(FlowSampler.DEFAULT_PORTS), default="sflow", help="Export protocol; IPFIX needs an OVS bridge (default: %(default)s)")
+    parser_flowsample_enable.add_argument("--group", type=int, default=FlowSampler.DEFAULT_GROUP, help="psample group for tc sampling on kernel bridges (default: %(default)s)")
+    parser_flowsample_enable.add_argument("--check-collector", action="store_true", help="Refuse to enable sampling if the collector does not answer a ping")
+    parser_flowsample_disable = flowsample_subparsers.add_parser("disable", help="stop sampling a tunnel's traffic")
+    parser_flowsample_disable.add_argument("--vni", type=int, required=True, help="VNI (Virtual Network Identifier)")
+    flowsample_subparsers.add_parser("show", help="show sampling configured on managed tunnels")
+
+    # Create the parser for the "migrate-endpoint" command
+    parser_migrate = subparsers.add_parser("migrate-endpoint", help="repoint tunnels and flood entries from an old VTEP address to a new one")
+    parser_migrate.add_argument("--old", required=True, help="Previous VTEP address")
+    parser_migrate.add_argument("--new", required=True, help="New VTEP address")
+    parser_migrate.add_argument("--hosts-file", help="YAML inventory of peer hosts reached over SSH (default: this host only)")
+    parser_migrate.add_argument("-y", "--yes", action="store_true", help="Apply the changes after listing them (default: list only)")
+
+    # Create the parser for the "fleet" command
+    parser_fleet = subparsers.add_parser("fleet", help="aggregate tunnels across an SSH inventory")
+    fleet_subparsers = parser_fleet.add_subparsers(dest="fleet_command", required=True)
+    parser_fleet_list = fleet_subparsers.add_parser("list", help="list tunnels of every inventory host and flag asymmetric ones")
+    parser_fleet_list.add_argument("--inventory", required=True, help="YAML inventory of hosts reached over SSH")
+    parser_fleet_list.add_argument("--limit", help="Only hosts with this name or label value, e.g. dc1")
+    parser_fleet_list.add_argument("--parallel", type=int, default=8, help="Maximum number of hosts queried at once (default: %(default)s)")
+    parser_fleet_list.add_argument("-fo", "--format", choices=[format_type.value for format_type in OutputFormatType], default=OutputFormatType.TABLE.value, help="Output format (default: %(default)s)")
+
+    # Create the parser for the "pair" command
+    parser_pair = subparsers.add_parser("pair", help="create mirrored tunnels on two hosts over SSH")
+    pair_subparsers = parser_pair.add_subparsers(dest="pair_command", required=True)
+    parser_pair_create = pair_subparsers.add_parser("create", help="create a tunnel on both hosts, each pointing at the other")
+    parser_pair_create.add_argument("--vni", type=int, required=True, help="VNI (Virtual Network Identifier)")
+    parser_pair_create.add_argument("--bridge-name", required=True, help="Bridge name on both hosts")
+    for side in ("a", "b"):
+        parser_pair_create.add_argument(f"--host-{side}", required=True, help=f"SSH target of host {side.upper()}")
+        parser_pair_create.add_argument(f"--address-{side}", required=True, help=f"VTEP address of host {side.upper()}")
+    parser_pair_create.add_argument("--dst-port", type=int, help="Destination port (optional)")
+    parser_pair_create.add_argument("--dev", help="Underlay device on both hosts (optional)")
+    parser_pair_create.add_argument("--dry-run", action="store_true", help="Show both hosts' plans side by side; exit 0 if nothing to do, 2 if changes are planned, 3 on conflicts")
+
+    # Create the parser for the "lab" command
+    parser_lab = subparsers.add_parser("lab", help="bring a point-to-point lab tunnel up or down between this host and an SSH peer")
+    lab_subparsers = parser_lab.add_subparsers(dest="lab_command", required=True)
+    for lab_command, lab_help in (("up", "create the tunnel on both ends, address both bridges from the prefix and ping across"), ("down", "remove the addresses and the tunnel on both ends")):
+        parser_lab_command = lab_subparsers.add_parser(lab_command, help=lab_help)
+        parser_lab_command.add_argument("--cidr", required=True, help="Overlay prefix holding both bridge addresses, e.g. 10.77.0.0/30")
+        parser_lab_command.add_argument("--vni", type=int, required=True, help="VNI (Virtual Network Identifier)")
+        parser_lab_command.add_argument("--bridge", required=True, help="Bridge name on both ends (created if missing)")
+        parser_lab_command.add_argument("--peer", required=True, help="SSH target of the peer; its host part is the remote VTEP address")
+        parser_lab_command.add_argument("--local-address", help="Local VTEP address (default: the source address routed towards the peer)")
+        parser_lab_command.add_argument("--dst-port", type=int, help="Destination port (optional)")
+
+    # Create the parser for the "mesh" command
+    parser_mesh = subparsers.add_parser("mesh", help="generate full-mesh topologies")
+    mesh_subparsers = parser_mesh.add_subparsers(dest="mesh_command", required=True)
+    parser_mesh_generate = mesh_subparsers.add_parser("generate", help="emit the point-to-point tunnels every node needs for a full mesh")
+    parser_mesh_generate.add_argument("--nodes", type=parse_mesh_nodes, required=True, help="Mesh members as name=address pairs, e.g. node1=10.0.0.1,node2=10.0.0.2,node3=10.0.0.3")
+    parser_mesh_generate.add_argument("--type", choices=[tunnel_type.value for tunnel_type in TunnelType] + ["wireguard"], help="Link nodes with tunnels of this type, or with one WireGuard interface per node (default: --tunnel-type)")
+    parser_mesh_generate.add_argument("--vni-base", type=int, help="VNI of the first link; each further link takes the next VNI (required unless --type wireguard)")
+    parser_mesh_generate.add_argument("--format", choices=["manifest", "commands", "wg-quick"], help="Emit apply manifests or ip commands, or wg-quick configs for --type wireguard (default: manifest, or wg-quick)")
+    parser_mesh_generate.add_argument("--output-dir", help="Write one <node>.yaml, <node>.sh or <node>.conf per node here instead of printing everything")
+    parser_mesh_generate.add_argument("--overlay-supernet", help="Assign each link an overlay subnet from this supernet, e.g. 10.200.0.0/16")
+    parser_mesh_generate.add_argument("--link-prefix", type=parse_link_prefix, default=31, help="Prefix length of each link's overlay subnet (default: /%(default)s)")
+    parser_mesh_generate.add_argument("--ipam-file", help="Keep overlay assignments in this file, so links keep their subnets when nodes are added or removed")
+    parser_mesh_generate.add_argument("--dst-port", type=int, help="Destination port (optional)")
+    parser_mesh_generate.add_argument("--dev", help="Underlay device (optional)")
+    parser_mesh_generate.add_argument("--keys-dir", help="Keep each node's WireGuard private key in <node>.key here, so regenerating keeps the keys (default: wireguard/ next to the state file)")
+    parser_mesh_generate.add_argument("--preshared-keys", action="store_true", help="Give every pair of WireGuard nodes its own preshared key")
+    parser_mesh_generate.add_argument("--keepalive", type=int, metavar="SECONDS", help="WireGuard persistent keepalive between peers, for nodes behind NAT (default: off)")
+    parser_mesh_generate.add_argument("--apply", metavar="NODE", help="Create this node's WireGuard interface on this host instead of writing configs")
+    parser_mesh_generate.add_argument("--ifname", default="wg0", help="WireGuard interface name for --apply (default: %(default)s)")
+
+    # Create the parser for the "recover" command
+    subparsers.add_parser("recover", help="finish or roll back operations interrupted by a crash (also run automatically)")
+
+    # Create the parser for the "repair" command
+    parser_repair = subparsers.add_parser("repair", help="re-attach a tunnel that lost its bridge, as the agent does")
+    parser_repair.add_argument("--vni", type=int, required=True, help="VNI (Virtual Network Identifier)")
+    parser_repair.add_argument("--bridge-name", help="Bridge to attach to (default: the recorded bridge)")
+    parser_repair.add_argument("--create-bridge", action="store_true", help="Create the bridge if it does not exist")
+
+    # Create the parser for the "undo" command
+    parser_undo = subparsers.add_parser("undo", help="revert the most recent create or cleanup")
+    parser_undo.add_argument("--id", type=int, help="Audit log id of the operation to revert (default: the most recent)")
+    parser_undo.add_argument("-y", "--yes", action="store_true", help="Do not ask for confirmation")
+
+    # Create the parser for the "addr" command
+    parser_addr = subparsers.add_parser("addr", help="inspect overlay addresses of a tunnel")
+    addr_subparsers = parser_addr.add_subparsers(dest="addr_command", required=True)
+    parser_addr_show = addr_subparsers.add_parser("show", help="show addresses with their lifetime and origin")
+    parser_addr_show.add_argument("--vni", type=int, required=True, help="VNI (Virtual Network Identifier)")
+    parser_addr_show.add_argument("--warn-within", type=parse_duration, default=300, help="Warn about DHCP addresses expiring within this duration (default: %(default)ss)")
+    parser_addr_show.add_argument("--renew", action="store_true", help="Restart the recorded DHCP client of expiring addresses, or start one if none is running")
+    parser_addr_show.add_argument("-fo", "--format", choices=[format_type.value for format_type in OutputFormatType], default=OutputFormatType.TABLE.value, help="Output format (default: %(default)s)")
+
+    # Create the parser for the "maintenance" command
+    parser_maintenance = subparsers.add_parser("maintenance", help="manage maintenance windows")
+    maintenance_subparsers = parser_maintenance.add_subparsers(dest="maintenance_command", required=True)
+    parser_maintenance_start = maintenance_subparsers.add_parser("start", help="start a maintenance window")
+    parser_maintenance_start.add_argument("--duration", type=parse_duration, required=True, help="Duration of the window, e.g. 30m or 2h")
+    maintenance_scope = parser_maintenance_start.add_mutually_exclusive_group(required=True)
+    maintenance_scope.add_argument("--vni", type=parse_vni_list, help="Comma-separated VNIs covered by the window")
+    maintenance_scope.add_argument("--all", action="store_true", help="Cover all tunnels")
+    parser_maintenance_start.add_argument("--reason", default="", help="Reason recorded with the window")
+    maintenance_subparsers.add_parser("status", help="show active maintenance windows")
+    parser_maintenance_end = maintenance_subparsers.add_parser("end", help="end maintenance windows")
+    parser_maintenance_end.add_argument("--vni", type=parse_vni_list, help="Comma-separated VNIs to end the window for (default: all windows)")
+
+    # Create the parser for the "agent" command
+    parser_agent = subparsers.add_parser("agent", help="monitor and repair the tunnels declared in a manifest")
+    parser_agent.add_argument("--manifest", default="/etc/tunnel_manager/manifest.yaml", help="Path of the tunnel manifest (default: %(default)s)")
+    agent_subparsers = parser_agent.add_subparsers(dest="agent_command", required=True)
+    parser_agent_run = agent_subparsers.add_parser("run", help="probe declared tunnels and repair failed ones")
+    parser_agent_run.add_argument("--metrics-file", help="Write Prometheus metrics to this file for the node_exporter textfile collector")
+    parser_agent_run.add_argument("--report", action="store_true", help="Print a resource report after every cycle")
+    parser_agent_run.add_argument("--report-format", choices=["table", "json"], default="table", help="Format of the resource report; json prints one object per line (default: %(default)s)")
+    parser_agent_run.add_argument("--webhook", help="POST a JSON payload to this URL for every drift event raised or cleared")
+    parser_agent_config = agent_subparsers.add_parser("effective-config", help="show the monitor settings of one tunnel after overrides")
+    parser_agent_config.add_argument("--vni", type=int, required=True, help="VNI (Virtual Network Identifier)")
+
+    # Create the parser for the "daemon" command
+    parser_daemon = subparsers.add_parser("daemon", help="serve Create/List/Cleanup/Validate over gRPC and REST")
+    parser_daemon.add_argument("--grpc-listen", default="127.0.0.1:50051", help="Address to serve the gRPC API on (default: %(default)s)")
+    parser_daemon.add_argument("--no-grpc", action="store_true", help="Do not serve the gRPC API")
+    parser_daemon.add_argument("--http-listen", type=parse_listen, help="Also serve the REST API on this HOST:PORT, e.g. 127.0.0.1:8080")
+    parser_daemon.add_argument("--metrics-listen", type=parse_listen, help="Serve only /metrics on this HOST:PORT, e.g. 0.0.0.0:9469 (the REST listener serves /metrics as well)")
+    parser_daemon.add_argument("--reconcile-interval", type=parse_duration, default=30, help="Re-create recorded tunnels missing from the kernel this often, e.g. 30s; 0 turns it off (default: %(default)ss)")
+    parser_daemon.add_argument("--reconcile-backoff", type=parse_duration, default=5, help="Wait after a failed re-create, doubled on every further failure, e.g. 5s (default: %(default)ss)")
+    parser_daemon.add_argument("--reconcile-max-backoff", type=parse_duration, default=300, help="Longest wait between attempts to re-create one tunnel, e.g. 5m (default: %(default)ss)")
+    parser_daemon.add_argument("--workers", type=int, default=4, help="Requests handled concurrently; changes still run one at a time (default: %(default)s)")
+    parser_daemon.add_argument("--shutdown-grace", type=parse_duration, default=10, help="On SIGTERM, let requests in flight finish for this long before cancelling and rolling them back, e.g. 30s (default: %(default)ss)")
+
+    # Create the parser for the "export" command
+    parser_export = subparsers.add_parser("export", help="export artifacts derived from the tool's metrics and state")
+    export_subparsers = parser_export.add_subparsers(dest="export_command", required=True)
+    parser_export_grafana = export_subparsers.add_parser("grafana-dashboard", help="generate a Grafana dashboard for the agent's metrics")
+    parser_export_grafana.add_argument("--output", default="-", help="File to write the dashboard JSON to (default: stdout)")
+    parser_export_networkd = export_subparsers.add_parser("systemd-networkd", help="render the recorded tunnels and their bridges as systemd-networkd .netdev and .network units")
+    parser_export_networkd.add_argument("--output-dir", help="Directory to write the units to, e.g. /etc/systemd/network (default: print them)")
+    parser_export_netplan = export_subparsers.add_parser("netplan", help="render the recorded tunnels, or those declared in a manifest, as a netplan document")
+    parser_export_netplan.add_argument("--manifest", help="Export the tunnels declared in this manifest instead of the recorded ones")
+    parser_export_netplan.add_argument("--output", default="-", help="File to write the netplan YAML to, e.g. /etc/netplan/60-tunnelmgr.yaml (default: stdout)")
+    parser_export_ifupdown = export_subparsers.add_parser("ifupdown", help="render the recorded tunnels and their bridges as /etc/network/interfaces stanzas")
+    parser_export_ifupdown.add_argument("--output", default="-", help="File to write the stanzas to, e.g. /etc/network/interfaces.d/tunnelmgr (default: stdout)")
+    parser_export_networkmanager = export_subparsers.add_parser("networkmanager", help="render the recorded VXLAN and GENEVE tunnels and their bridges as NetworkManager keyfile profiles")
+    parser_export_networkmanager.add_argument("--output-dir", help="Directory to write the profiles to, e.g. /etc/NetworkManager/system-connections (default: print them)")
+    parser_export_frr = export_subparsers.add_parser("frr", help="render FRR bgpd configuration that advertises the recorded VXLAN VNIs over BGP EVPN")
+    parser_export_frr.add_argument("--asn", type=int, required=True, help="Local AS number")
+    parser_export_frr.add_argument("--router-id", help="BGP router ID (default: the local VTEP address of the tunnels)")
+    parser_export_frr.add_argument("--neighbor", dest="neighbors", action="append", metavar="ADDRESS", help="BGP peer, repeatable (default: the remotes of the recorded tunnels)")
+    parser_export_frr.add_argument("--remote-as", default="internal", help="AS of the peers: internal, external or a number (default: internal)")
+    parser_export_frr.add_argument("--output", default="-", help="File to write the configuration to, e.g. /etc/frr/frr.conf (default: stdout)")
+    parser_export_bird = export_subparsers.add_parser("bird", help="render a BIRD configuration that announces the VTEP addresses and overlay routes over BGP")
+    parser_export_bird.add_argument("--asn", type=int, required=True, help="Local AS number")
+    parser_export_bird.add_argument("--router-id", help="BGP router ID (default: the local VTEP address of the tunnels)")
+    parser_export_bird.add_argument("--neighbor", dest="neighbors", action="append", required=True, metavar="ADDRESS", help="Underlay BGP peer, repeatable")
+    parser_export_bird.add_argument("--remote-as", default="internal", help="AS of the peers: internal, external or a number (default: internal)")
+    parser_export_bird.add_argument("--output", default="-", help="File to write the configuration to, e.g. /etc/bird/bird.conf (default: stdout)")
+
+    # Create the parser for the "apply" command
+    parser_apply = subparsers.add_parser("apply", help="create the tunnels declared in a manifest")
+    parser_apply.add_argument("-f", "--manifest", required=True, help="Path of the manifest")
+    parser_apply.add_argument("--atomic", action="store_true", help="Validate every entry first and roll back everything created by this run if any entry fails")
+    parser_apply.add_argument("--check-connectivity", action="store_true", help="Also check that each remote underlay endpoint is reachable before applying")
+    parser_apply.add_argument("--dry-run", action="store_true", help="Show the plan without applying it")
+    parser_apply.add_argument("--replace", action="store_true", help="Fix tunnels whose live attributes differ from the manifest: move them to the declared bridge or recreate them")
+    parser_apply.add_argument("--prune", action="store_true", help="Delete recorded tunnels that are no longer declared in the manifest")
+    parser_apply.add_argument("--parallel", type=int, default=1, metavar="N", help="Apply up to N tunnels at once; the steps of one tunnel, and changes to a bridge a deleted tunnel may remove, stay in order (default: %(default)s)")
+    parser_apply.add_argument("--canary", type=int, help="Create this many tunnels first, verify them, and only then apply the rest; failed canaries are rolled back")
+    parser_apply.add_argument("--verify-cmd", help="Command verifying each canary, e.g. \"check-overlay.sh {{.IfName}}\" (fields: IfName, VNI, Type, Bridge, Local, Remote, Site; default: built-in validate and probe)")
+    parser_apply.add_argument("--report-format", choices=["table", "json"], default="table", help="Format of progress and the final report; json prints one progress event per line, then a summary (default: %(default)s)")
+    parser_apply.add_argument("--report", action="store_true", help="End with a resource report: commands run, managed objects and their change, and bridges near their port limits")
+    parser_apply.add_argument("--plan-format", choices=[format_type.value for format_type in PlanFormatType], default=PlanFormatType.TEXT.value, help="Format of the printed plan (default: %(default)s)")
+
+    # Create the parser for the "plan" command
+    parser_plan = subparsers.add_parser("plan", aliases=["diff"], help="show what apply --replace --prune would change, without changing anything")
+    parser_plan.add_argument("-f", "--manifest", required=True, help="Path of the manifest")
+    parser_plan.add_argument("--plan-format", choices=[format_type.value for format_type in PlanFormatType], default=PlanFormatType.TEXT.value, help="Format of the printed plan (default: %(default)s)")
+
+    # Create the parser for the "wait-ready" command
+    parser_wait_ready = subparsers.add_parser("wait-ready", help="block until tunnels exist and are up, for ExecStartPre= or init containers")
+    parser_wait_ready.add_argument("--vni", type=int, action="append", required=True, help="VNI to wait for (repeatable)")
+    parser_wait_ready.add_argument("--timeout", type=parse_duration, default=60, help="Give up after this duration, e.g. 60s or 2m (default: %(default)ss)")
+    parser_wait_ready.add_argument("--interval", type=float, default=1, help="Seconds between checks (default: %(default)s)")
+    parser_wait_ready.add_argument("--probe", action="store_true", help="Also require the recorded remote endpoint of each tunnel to answer")
+
+    # Create the parser for the "explain" command
+    parser_explain = subparsers.add_parser("explain", help="print the commands create would run, with explanations, without touching the system")
+    parser_explain.add_argument("--vni", type=int, required=True, help="VNI (Virtual Network Identifier)")
+    parser_explain.add_argument("--src-host", required=True, help="Source host IP address or name")
+    parser_explain.add_argument("--dst-host", required=True, help="Destination host IP address or name")
+    parser_explain.add_argument("--bridge-name", required=True, help="Bridge name to associate with the tunnel interface")
+    parser_explain.add_argument("--dst-port", type=int, help="Destination port (optional)")
+    parser_explain.add_argument("--dev", help="Device (optional)")
+    parser_explain.add_argument("--route", action="append", dest="routes", metavar="PREFIX", help="Remote prefix to route over the tunnel's bridge (repeatable)")
+    parser_explain.add_argument("--link-group", type=int, default=LinkGroup.DEFAULT_GROUP, help="Kernel link group of the tunnel interface (default: %(default)s)")
+    parser_explain.add_argument("--distro", choices=sorted(DISTRO_HINTS), help="Add module loading and firewall steps for this distribution")
+    parser_explain.add_argument("-fo", "--format", choices=["text", "markdown"], default="text", help="Output format (default: %(default)s)")
+
+    # Create the parser for the "manifest" command
+    parser_manifest = subparsers.add_parser("manifest", help="inspect tunnel manifests")
+    manifest_subparsers = parser_manifest.add_subparsers(dest="manifest_command", required=True)
+    parser_manifest_render = manifest_subparsers.add_parser("render", help="show the manifest with includes merged and each entry's source file")
+    parser_manifest_render.add_argument("-f", "--manifest", required=True, help="Path of the top-level manifest")
+
+    # Create the parser for the "flows" command
+    parser_flows = subparsers.add_parser("flows", help="manage OVS flows mapping VLANs or ports to VNIs")
+    flows_subparsers = parser_flows.add_subparsers(dest="flows_command", required=True)
+    parser_flows_apply = flows_subparsers.add_parser("apply", help="install flows for VLAN/port to VNI mappings")
+    parser_flows_apply.add_argument("--map", type=parse_flow_map, required=True, help="Comma-separated mappings, e.g. vlan100=vni10100,tap0=vni10200")
+    parser_flows_apply.add_argument("--remote", required=True, help="Remote tunnel endpoint IP address")
+    for parser_flows_command in (parser_flows_apply, flows_subparsers.add_parser("show", help="show flows installed by this tool"), flows_subparsers.add_parser("delete", help="delete flows installed by this tool")):
+        parser_flows_command.add_argument("--bridge", required=True, help="OVS bridge name")
+        parser_flows_command.add_argument("--tunnel-port", help="Metadata-mode tunnel port on the bridge (default: <tunnel-type>0)")
+        if parser_flows_command is not parser_flows_apply:
+            parser_flows_command.add_argument("--vni", type=int, help="Restrict to flows of one VNI")
+
+    # Create the parser for the "external" command
+    parser_external = subparsers.add_parser("external", help="manage collect-metadata devices that carry every VNI for OVS, tc or eBPF")
+    external_subparsers = parser_external.add_subparsers(dest="external_command", required=True)
+    parser_external_create = external_subparsers.add_parser("create", help="create an external-mode vxlan or geneve device")
+    parser_external_create.add_argument("--dst-port", type=int, help="UDP port the device listens on (default: the tunnel type's port)")
+    parser_external_create.add_argument("--bridge-name", help="Bridge to attach the device to (optional)")
+    parser_external_delete = external_subparsers.add_parser("delete", help="delete an external-mode device")
+    parser_external_map = external_subparsers.add_parser("map", help="carry a VLAN of the device's bridge as a VNI")
+    parser_external_map.add_argument("--vni", type=int, required=True, help="VNI the VLAN is carried as")
+    parser_external_unmap = external_subparsers.add_parser("unmap", help="stop carrying a VLAN of the device's bridge")
+    for parser_external_command in (parser_external_map, parser_external_unmap):
+        parser_external_command.add_argument("--vlan", type=int, required=True, metavar="VID", help="VLAN ID on the bridge")
+    parser_external_mappings = external_subparsers.add_parser("mappings", help="list the VLAN-to-VNI mappings of a device")
+    for parser_external_command in (parser_external_create, parser_external_delete, parser_external_map, parser_external_unmap, parser_external_mappings):
+        parser_external_command.add_argument("--name", help="Device name (default: <tunnel-type>0)")
+    parser_external_list = external_subparsers.add_parser("list", help="list external-mode devices of the tunnel type")
+    for parser_external_command in (parser_external_list, parser_external_mappings):
+        parser_external_command.add_argument("-fo", "--format", choices=[format_type.value for format_type in OutputFormatType], default=OutputFormatType.TABLE.value, help="Output format (default: %(default)s)")
+
+    # Create the parser for the "wireguard" command
+    parser_wireguard = subparsers.add_parser("wireguard", help="manage WireGuard interfaces, their peers and keys")
+    parser_wireguard.add_argument("--keys-dir", help="Directory of the key store (default: wireguard/ next to the state file)")
+    wireguard_subparsers = parser_wireguard.add_subparsers(dest="wireguard_command", required=True)
+    parser_wireguard_create = wireguard_subparsers.add_parser("create", help="create a WireGuard interface and print its public key")
+    parser_wireguard_create.add_argument("--private-key", metavar="FILE", help="Private key file; generated with mode 0600 if it does not exist (default: the key store's <name>.key)")
+    parser_wireguard_create.add_argument("--listen-port", type=int, help=f"UDP port to listen on (default: {WireGuardInterface.DEFAULT_PORT})")
+    parser_wireguard_create.add_argument("--address", help="Overlay address of the interface, e.g. 10.200.0.1/24 (optional)")
+    parser_wireguard_peer_add = wireguard_subparsers.add_parser("peer-add", help="add or update a peer")
+    parser_wireguard_peer_add.add_argument("--endpoint", metavar="HOST:PORT", help="Underlay address of the peer (optional for peers that connect in)")
+    parser_wireguard_peer_add.add_argument("--allowed-ips", type=parse_allowed_ips, required=True, help="Comma-separated overlay prefixes routed to the peer, e.g. 10.200.0.2/32")
+    parser_wireguard_peer_add.add_argument("--keepalive", type=int, metavar="SECONDS", help="Persistent keepalive, for peers behind NAT (default: off)")
+    parser_wireguard_peer_add.add_argument("--preshared-key", metavar="FILE", help="Preshared key file shared with the peer, e.g. from keys psk (optional)")
+    parser_wireguard_peer_remove = wireguard_subparsers.add_parser("peer-remove", help="remove a peer")
+    for parser_wireguard_peer in (parser_wireguard_peer_add, parser_wireguard_peer_remove):
+        parser_wireguard_peer.add_argument("--public-key", required=True, help="Public key of the peer")
+    parser_wireguard_show = wireguard_subparsers.add_parser("show", help="show the peers of a WireGuard interface with their last handshake")
+    parser_wireguard_show.add_argument("-fo", "--format", choices=[format_type.value for format_type in OutputFormatType], default=OutputFormatType.TABLE.value, help="Output format (default: %(default)s)")
+    for parser_wireguard_command in (parser_wireguard_create, parser_wireguard_peer_add, parser_wireguard_peer_remove, parser_wireguard_show, wireguard_subparsers.add_parser("delete", help="delete a WireGuard interface")):
+        parser_wireguard_command.add_argument("--name", default="wg0", help="Interface name (default: %(default)s)")
+    parser_wireguard_keys = wireguard_subparsers.add_parser("keys", help="generate, rotate and list keys in the key store")
+    wireguard_keys_subparsers = parser_wireguard_keys.add_subparsers(dest="keys_command", required=True)
+    parser_wireguard_keys_generate = wireguard_keys_subparsers.add_parser("generate", help="generate a keypair, or keep the existing one, and print the public key")
+    parser_wireguard_keys_rotate = wireguard_keys_subparsers.add_parser("rotate", help="replace a keypair and update local interfaces and peers that use it")
+    for parser_wireguard_keys_command in (parser_wireguard_keys_generate, parser_wireguard_keys_rotate):
+        parser_wireguard_keys_command.add_argument("--name", required=True, help="Key name, e.g. an interface or mesh node name")
+    parser_wireguard_keys_psk = wireguard_keys_subparsers.add_parser("psk", help="generate the preshared key of two peers, or keep the existing one, and print its path")
+    parser_wireguard_keys_psk.add_argument("--pair", type=parse_host_list, required=True, metavar="A,B", help="The two peers sharing the key, e.g. node1,node2")
+    parser_wireguard_keys_list = wireguard_keys_subparsers.add_parser("list", help="list keypairs with their public keys")
+    parser_wireguard_keys_list.add_argument("-fo", "--format", choices=[format_type.value for format_type in OutputFormatType], default=OutputFormatType.TABLE.value, help="Output format (default: %(default)s)")
+
+    # Create the parser for the "frr" command
+    parser_frr = subparsers.add_parser("frr", help="keep the BGP EVPN configuration of the running FRR in step with the recorded tunnels")
+    frr_subparsers = parser_frr.add_subparsers(dest="frr_command", required=True)
+    parser_frr_sync = frr_subparsers.add_parser("sync", help="add the recorded VXLAN VNIs missing from FRR and remove those no longer recorded (needs --frr-asn)")
+    parser_frr_sync.add_argument("-fo", "--format", choices=[format_type.value for format_type in OutputFormatType], default=OutputFormatType.TABLE.value, help="Output format (default: %(default)s)")
+
+    # Developer-only fault injection, never shown in --help
+    if os.environ.get("TUNNELMGR_CHAOS") == "1":
+        parser.add_argument("--fail-after-step", type=int, help=argparse.SUPPRESS)
+
+    args = parser.parse_args()
+    command_validator = SystemCommandValidator()
+    if args.backend == "ovs":
+        args.bridge_tool = OvsBridgeBackend.TOOL
+    if args.backend == "ip" or args.bridge_tool != "ip":
+        command_validator.check_bridge_tool_existence(args.bridge_tool)
+
+    if args.netns and args.backend != "ip":
+        parser.error(f"--netns works with --backend ip only, not {args.backend}")
+
+    cancel = CancelToken()
+    executor: CommandExecutor = SubprocessExecutor(cancel)
+    if args.netns:
+        executor = NetnsExecutor(executor, args.netns)
+    if args.backend == "netlink":
+        executor = NetlinkExecutor(executor)
+    if getattr(args, "fail_after_step", None) is not None:
+        executor = FaultInjectingExecutor(executor, fail_after_step=args.fail_after_step)
+    if args.global_dry_run:
+        executor = DryRunExecutor(executor)
+    files = FileWriter(args.global_dry_run)
+    cancellable = CancellableExecutor(executor, cancel)
+    counter = OperationCounter(cancellable)
+    executor = counter
+
+    lock = None
+    scratch = tempfile.TemporaryDirectory() if args.global_dry_run else None
+    try:
+        store = StateStore(args.state_file)
+        if scratch:
+            store = store.scratch_copy(scratch.name)
+        journal = IntentJournal.beside(store)
+        iproute2 = Iproute2Version.detect(executor)
+        if iproute2 and not iproute2.supports("json"):
+            logger.info("iproute2 has no JSON output; reading links from text output and sysfs.")
+            executor = TextLinkExecutor(executor, TextLinkReader(executor, netns=args.netns))
+        snapshot = SnapshotExecutor(JournalingExecutor(executor, journal))
+        executor = snapshot
+        tunnel_options = dict(bridge_tool=args.bridge_tool, executor=executor, ttl=args.ttl, tos=args.tos, df=args.df, udp6_zero_csum=args.udp6_zero_csum, ovs=args.backend == "ovs")
+        tunnel = TunnelFactory.create_tunnel(TunnelType(args.tunnel_type), **tunnel_options)
+        policy = BridgePolicy(args.max_tunnels_per_bridge, executor, AuditLog.beside(store))
+        audit = AuditLog.beside(store)
+        resolver = HostResolver(ResolvePolicy(args.resolve) if args.resolve else None)
+        frr = FrrEvpnSync(args.frr_asn, executor) if args.frr_asn else None
+        manager = TunnelManager(tunnel, TunnelRecords(store), resolver, policy, audit, journal, frr)
+        manager_factory = lambda tunnel_type: TunnelManager(TunnelFactory.create_tunnel(TunnelType(tunnel_type), **tunnel_options), TunnelRecords(store), resolver, policy, audit, journal, frr)
+        recovered = []
+        if mutates(args):
+            lock = StateLock.beside(store)
+            lock.acquire()
+            if journal.incomplete():
+                recovered = journal.recover(manager_factory, executor)
+                logger.warning(f"Recovered {len(recovered)} interrupted operation(s)" + (f" after a crash of pid {lock.stale_pid}" if lock.stale_pid else "") + ".")
+                print(OutputFormatterFactory.get_formatter(OutputFormatType.TABLE).format(recovered))
+            if args.command == "daemon":
+                # The daemon takes the lock again for each request and reconcile cycle
+                lock.release()
+                lock = None
+        if args.command == "recover":
+            if not recovered:
+                logger.info("Nothing to recover.")
+        elif args.command == "create":
+            LinkGroup(executor, files=files).register(args.link_group)
+            if not args.vni_map and not (args.dst_hosts or args.group):
+                parser.error("one of the arguments --dst-host --group is required")
+            if not args.vni_map and not args.bridge_name:
+                parser.error("the following arguments are required: --bridge-name")
+            defaults = {"src_host": args.src_host, "dst_hosts": [args.group] if args.group else args.dst_hosts, "bridge_name": args.bridge_name, "dev": args.dev, "src_port": args.src_port, "dst_port": args.dst_port}
+            entries = expand_vni_range(args.vni_range or [args.vni], defaults, load_vni_map(args.vni_map) if args.vni_map else {})
+            for index, entry in enumerate(entries):
+                # A name from the VNI map wins over the template
+                if args.ifname_template and not entry.get("ifname"):
+                    entry["ifname"] = render_ifname(args.ifname_template, entry["vni"], entry["bridge_name"], tunnel.tunnel_type, index)
+            if len({entry.get("ifname") or tunnel.interface_name(entry["vni"]) for entry in entries}) < len(entries):
+                parser.error("the interface name template gives several tunnels the same name; include {vni} in it")
+            if args.peers_from_dns and any(len(entry["dst_hosts"]) > 1 for entry in entries):
+                parser.error("--peers-from-dns cannot be combined with several --dst-host values")
+            if args.vrf_table is not None and not args.vrf:
+                parser.error("--vrf-table needs --vrf")
+            if args.macsec_cipher and not args.macsec_key_file:
+                parser.error("--macsec-cipher needs --macsec-key-file")
+            if args.dev_vlan_protocol and not args.dev_vlan:
+                parser.error("--dev-vlan-protocol needs --dev-vlan")
+            if args.dev_vlan and not all(entry["dev"] for entry in entries):
+                parser.error("--dev-vlan needs --dev")
+            try:
+                dev_vlans = UnderlayVlan.parse(args.dev_vlan) if args.dev_vlan else []
+            except TunnelManagerError as e:
+                parser.error(str(e))
+            if len(entries) > 1 and (args.gre_key is not None or args.gre_ikey is not None or args.gre_okey is not None):
+                parser.error("--key, --ikey and --okey name one tunnel; leave them out for a VNI range, whose keys are the VNIs")
+            report = []
+            for entry in entries:
+                # The first remote is the device's own; the rest become head-end replication peers
+                dst_host, peers = entry["dst_hosts"][0], entry["dst_hosts"][1:]
+                try:
+                    spec = TunnelSpec(entry["vni"], entry["src_host"], dst_host, entry["bridge_name"], entry["src_port"], entry["dst_port"], entry["dev"], port_flags=port_flags_from_args(args), peers_from_dns=args.peers_from_dns, routes=args.routes, route_mtu=args.route_mtu, link_group=args.link_group, ifname=entry.get("ifname"), peers=peers, bridge_options=bridge_options_from_args(args) if args.auto_create_bridge else None, labels=dict(args.labels or []), mtu="auto" if args.auto_mtu else str(args.mtu) if args.mtu else None, vxlan_flags=vxlan_flags_from_args(args) or None, udp_checksums=checksums_from_args(args) or None, gre_options=gre_options_from_args(args) or None, encrypt_key_file=args.encrypt_key_file, macsec={"key_file": args.macsec_key_file, "cipher": args.macsec_cipher} if args.macsec_key_file else None, vrf=args.vrf, vrf_table=args.vrf_table, vlan=args.vlan, dev_vlan={"parent": entry["dev"], "vlans": dev_vlans, "protocol": args.dev_vlan_protocol} if dev_vlans else None)
+                    manager.create(spec, args.policy_override, args.attach_only, args.replace)
+                except TunnelManagerError as e:
+                    # A failed tunnel of a range is rolled back on its own; the others are still created
+                    if len(entries) == 1:
+                        raise
+                    report.append({"ifname": tunnel.interface_name(entry["vni"]), "vni": entry["vni"], "dst_host": dst_host, "bridge_name": entry["bridge_name"], "result": f"failed: {e}"})
+                    continue
+                if entry["dev"] and not args.skip_rpfilter_check and not args.group:
+                    manager.check_rp_filter(UnderlayVlan.interface_name(entry["dev"], dev_vlans) if dev_vlans else entry["dev"], manager.resolver.resolve(dst_host), args.fix_rpfilter, args.persist, files)
+                report.append({"ifname": tunnel.interface_name(entry["vni"]), "vni": entry["vni"], "dst_host": dst_host, "bridge_name": entry["bridge_name"], "result": "created"})
+            if len(entries) > 1:
+                print(OutputFormatterFactory.get_formatter(OutputFormatType.TABLE).format(report))
+                if any(row["result"] != "created" for row in report):
+                    sys.exit(1)
+        elif args.command == "cleanup" and (args.site or args.all):
+            services = manager.records.site(args.site) if args.site else manager.records.tunnels()
+            if not services:
+                raise TunnelManagerError(f"No recorded tunnels for site {args.site}" if args.site else f"No tunnels recorded in {store.path}")
+            print(OutputFormatterFactory.get_formatter(OutputFormatType.TABLE).format([{"ifname": record.get("ifname") or manager_factory(record["tunnel_type"]).tunnel.interface_name(record["vni"]), "tunnel_type": record["tunnel_type"], "vni": record["vni"], "bridge_name": record["bridge_name"]} for record in services]))
+            if not args.yes and not confirm(f"Remove all {len(services)} tunnels of site {args.site}?" if args.site else f"Remove all {len(services)} managed tunnels?"):
+                logger.info("Cleanup cancelled.")
+                return
+            report = [row for record in services for row in manager_factory(record["tunnel_type"]).cleanup(record["vni"], record["bridge_name"])]
+            if report:
+                print(OutputFormatterFactory.get_formatter(OutputFormatType.TABLE).format(report))
+        elif args.command == "cleanup" and args.all_vnis:
+            if not args.bridge_name:
+                parser.error("--all-vnis requires --bridge-name")
+            ports = [(tunnel_type.value, item) for tunnel_type in TunnelType for item in manager_factory(tunnel_type.value).on_bridge(args.bridge_name)]
+            if not ports:
+                raise TunnelManagerError(f"No tunnels attached to {args.bridge_name}")
+            rows = [{"ifname": item["ifname"], "tunnel_type": tunnel_type, "vni": item["vni"], "managed": "yes" if manager.records.is_managed(tunnel_type, int(item["vni"]), item["ifname"]) else "no"} for tunnel_type, item in ports]
+            print(OutputFormatterFactory.get_formatter(OutputFormatType.TABLE).format(rows))
+            foreign = [row["ifname"] for row in rows if row["managed"] == "no"]
+            if foreign and not args.force:
+                raise TunnelManagerError(f"{', '.join(foreign)} on {args.bridge_name} {'is' if len(foreign) == 1 else 'are'} not managed by tunnel_manager; pass --force to remove {'it' if len(foreign) == 1 else 'them'} too")
+            if not args.yes and not confirm(f"Remove all {len(rows)} tunnels on {args.bridge_name}?"):
+                logger.info("Cleanup cancelled.")
+                return
+            report = []
+            for (tunnel_type, item), row in zip(ports, rows):
+                if row["managed"] == "yes":
+                    report += manager_factory(tunnel_type).cleanup(int(item["vni"]), args.bridge_name)
+                else:
+                    manager_factory(tunnel_type).remove_orphan(item)
+            if report:
+                print(OutputFormatterFactory.get_formatter(OutputFormatType.TABLE).format(report))
+            logger.info(f"Removed {len(rows)} tunnels from {args.bridge_name}.")
+        elif args.command == "cleanup" and args.prune:
+            orphans = [(tunnel_type, item) for tunnel_type in ("vxlan", "geneve") for item in manager_factory(tunnel_type).orphans()]
+            if not orphans:
+                logger.info("No unmanaged VXLAN or GENEVE interfaces.")
+                return
+            print(OutputFormatterFactory.get_formatter(OutputFormatType.TABLE).format([{"ifname": item["ifname"], "tunnel_type": tunnel_type, "vni": item["vni"], "dst_host": item["dst_host"], "master": item["master"]} for tunnel_type, item in orphans]))
+            if not args.yes and not confirm(f"Remove {len(orphans)} interfaces not recorded in {store.path}?"):
+                logger.info("Cleanup cancelled.")
+                return
+            print(OutputFormatterFactory.get_formatter(OutputFormatType.TABLE).format([manager_factory(tunnel_type).remove_orphan(item) for tunnel_type, item in orphans]))
+        elif args.command == "cleanup":
+            record = manager.records.get(tunnel.tunnel_type, args.vni)
+            # Interfaces created by hand or by other tools are only removed on request
+            if not manager.records.is_managed(tunnel.tunnel_type, args.vni, tunnel.interface_name(args.vni)) and not args.force:
+                raise TunnelManagerError(f"{tunnel.interface_name(args.vni)} is not managed by tunnel_manager (not in {store.path}); pass --force to remove it anyway, or import it first")
+            bridge_name = args.bridge_name or (record or {}).get("bridge_name")
+            if not bridge_name:
+                parser.error("--bridge-name is required for a tunnel without a record")
+            report = manager.cleanup(args.vni, bridge_name)
+            if report:
+                print(OutputFormatterFactory.get_formatter(OutputFormatType.TABLE).format(report))
+            if any(item["result"].startswith("failed") for item in report):
+                sys.exit(1)
+        elif args.command == "state":
+            record = manager.records.get(tunnel.tunnel_type, args.vni)
+            if not record:
+                raise TunnelManagerError(f"No recorded {tunnel.tunnel_type} tunnel with VNI {args.vni}")
+            print(OutputFormatterFactory.get_formatter(OutputFormatType.YAML).format({key: value for key, value in record.items() if key != "ancillary"}), end="")
+            ancillary = [{"kind": obj["kind"], "object": ANCILLARY_KINDS[obj["kind"]].describe(obj)} for obj in record.get("ancillary", [])]
+            print(OutputFormatterFactory.get_formatter(OutputFormatType.TABLE).format(ancillary) if ancillary else "No ancillary objects.")
+        elif args.command == "validate":
+            checks = manager.inspect(args.vni, args.bridge_name, args.src_host, args.dst_host, args.port)
+            drifted = [check["check"] for check in checks if check["status"] == "drift"]
+            connectivity = "skipped"
+            if not drifted and args.src_host and args.dst_host:
+                manager.validate(args.src_host, args.dst_host, args.vni, args.port, args.timeout, args.retries)
+                connectivity = "ok"
+            record = manager.records.get(tunnel.tunnel_type, args.vni) or {}
+            remote = manager.resolver.resolve(args.dst_host) if args.dst_host else record.get("dst_host")
+            rp_filter = manager.check_rp_filter(record["dev"], remote) if record.get("dev") and remote and not args.skip_rpfilter_check else {"status": "skipped"}
+            managed = manager.records.is_managed(tunnel.tunnel_type, args.vni, tunnel.interface_name(args.vni))
+            if args.format == "json":
+                print(json.dumps({"vni": args.vni, "managed": managed, "checks": checks, "connectivity": connectivity, "rp_filter": rp_filter}, indent=2))
+            else:
+                if not managed:
+                    logger.info(f"{tunnel.interface_name(args.vni)} is not managed by tunnel_manager; checked against the given arguments only.")
+                print(OutputFormatterFactory.get_formatter(OutputFormatType.TABLE).format(checks), end="")
+            if drifted:
+                logger.error(f"{tunnel.interface_name(args.vni)} drifted: {', '.join(drifted)}")
+                sys.exit(1)
+        elif args.command in ("show", "describe"):
+            detail = manager.describe(args.vni)
+            print(json.dumps(detail, indent=2) if args.format == "json" else TunnelManager.format_description(detail), end="\n" if args.format == "json" else "")
+            if detail["status"] != "ok":
+                sys.exit(1)
+        elif args.command == "status":
+            rows = LinkHealth(manager, store, ping_remote=not args.no_ping).status()
+            print(OutputFormatterFactory.get_formatter(OutputFormatType(args.format)).format(rows))
+            if args.exit_code:
+                sys.exit(2 if any(row["health"] == "down" for row in rows) else 1 if any(row["health"] == "degraded" for row in rows) else 0)
+        elif args.command == "stats" and args.analyze:
+            collector = CounterSnapshotCollector(tunnel.tunnel_type, executor)
+            before = collector.collect()
+            time.sleep(args.interval)
+            findings = DropAnalyzer(tunnel.tunnel_type).analyze(before, collector.collect())
+            if not findings:
+                logger.info("No drop patterns detected.")
+            print(OutputFormatterFactory.get_formatter(OutputFormatType(args.format)).format(findings))
+        elif args.command == "stats":
+            stats = TrafficStats(CounterSnapshotCollector(tunnel.tunnel_type, executor), args.vnis)
+            formatter = OutputFormatterFactory.get_formatter(OutputFormatType(args.format))
+            previous, sampled = stats.sample(), time.monotonic()
+            if not args.watch:
+                print(formatter.format(TrafficStats.totals(previous)))
+            stop = threading.Event()
+            signal.signal(signal.SIGTERM, lambda signum, frame: stop.set())
+            try:
+                while args.watch and not stop.wait(args.watch):
+                    current, now = stats.sample(), time.monotonic()
+                    print(f"{datetime.datetime.now().isoformat(timespec='seconds')}\n{formatter.format(TrafficStats.rates(previous, current, now - sampled))}", flush=True)
+                    previous, sampled = current, now
+            except KeyboardInterrupt:
+                pass
+        elif args.command == "watch":
+            watcher = LinkEventWatcher(manager.managed_interfaces, args.all)
+            stop = threading.Event()
+            signal.signal(signal.SIGTERM, lambda signum, frame: stop.set())
+            # Subscribe before taking the snapshot, so no change falls between the two
+            with LinkEventWatcher.open_socket() as sock:
+                sock.settimeout(1)
+                watcher.seed(json.loads(executor.run(["ip", "-d", "-j", "link", "show"]).stdout or "[]"))
+                try:
+                    while not stop.is_set():
+                        try:
+                            data = sock.recv(65536)
+                        except socket.timeout:
+                            continue
+                        for event in filter(None, map(watcher.handle, LinkEventWatcher.parse(data))):
+                            print(json.dumps(event) if args.format == "json" else LinkEventWatcher.format(event), flush=True)
+                except KeyboardInterrupt:
+                    pass
+        elif args.command == "list" and args.format == "plain":
+            print(manager.list_text(args.kernel_group), end="")
+        elif args.command == "list":
+            try:
+                fields = expand_fields(args.fields)
+            except TunnelManagerError as e:
+                parser.error(str(e))
+            data = manager.records.mark_labels(tunnel.tunnel_type, manager.records.mark_managed(tunnel.tunnel_type, manager.list(args.kernel_group)))
+            data = MaintenanceManager(store).annotate(manager.records.annotate(tunnel.tunnel_type, data))
+            if args.owner != "all":
+                data = [item for item in data if item["managed"] == ("yes" if args.owner == "managed" else "no")]
+            data = select_tunnels(data, args.vnis, args.bridge, manager.resolver.resolve(args.remote) if args.remote else None, args.ifname, dict(args.labels or []))
+            if args.fields != ["all"]:
+                data = [{field: item.get(field, "") for field in fields} for item in data]
+            formatter = OutputFormatterFactory.get_formatter(OutputFormatType(args.format))
+            print(formatter.format(data))
+        elif args.command == "import":
+            adopted = manager.adopt(args.vnis, record=args.format == "state")
+            if args.format == "manifest":
+                entries = [dict({"vni": row["vni"], "type": tunnel.tunnel_type, "src_host": row["attributes"]["src_host"], "dst_host": row["attributes"]["dst_host"], "bridge_name": row["bridge_name"], "ifname": row["ifname"]}, **{field: row["attributes"][field] for field in ("dst_port", "dev", "peers") if row["attributes"][field]}) for row in adopted if row["result"] == "imported"]
+                print(yaml.dump({"tunnels": entries}, default_flow_style=False, sort_keys=False), end="")
+            else:
+                print(OutputFormatterFactory.get_formatter(OutputFormatType.TABLE).format([{key: value for key, value in row.items() if key != "attributes"} for row in adopted]))
+        elif args.command == "group":
+            LinkGroup(executor, files=files).register(args.link_group)
+            print(OutputFormatterFactory.get_formatter(OutputFormatType.TABLE).format(manager.move_to_group(args.link_group)))
+        elif args.command == "doctor":
+            problems = [f"Link group: {problem}" for problem in LinkGroup(executor).conflicts(args.link_group, manager.managed_interfaces())]
+            for record in (manager.records.store.load().get("tunnels", {}).values() if not args.skip_rpfilter_check else []):
+                if record.get("dev") and (result := RpFilter(executor).check(record["dev"], record["dst_host"]))["status"] == "at risk":
+                    problems.append(f"rp_filter: {record['tunnel_type']} VNI {record['vni']}: {result['message']}")
+            for problem in problems:
+                logger.warning(problem)
+            if problems:
+                sys.exit(1)
+            logger.info("No problems found.")
+        elif args.command == "bridge":
+            bridges = BRIDGE_BACKENDS[args.bridge_tool](executor)
+            if args.bridge_command == "create":
+                if not bridges.create(args.bridge_name, **bridge_options_from_args(args)):
+                    logger.info(f"Bridge {args.bridge_name} already exists; nothing to do.")
+            elif args.bridge_command == "delete":
+                bridges.delete(args.bridge_name)
+            else:
+                print(OutputFormatterFactory.get_formatter(OutputFormatType(args.format)).format(bridges.list()))
+        elif args.command == "bridges":
+            usage = policy.usage(manager.records)
+            if not args.show_usage:
+                usage = [{"bridge": item["bridge"], "tunnels": item["tunnels"]} for item in usage]
+            print(OutputFormatterFactory.get_formatter(OutputFormatType(args.format)).format(usage))
+        elif args.command == "port":
+            if args.port_command == "set":
+                manager.set_port_flags(args.vni, port_flags_from_args(args))
+            print(OutputFormatterFactory.get_formatter(OutputFormatType.TABLE).format([dict(ifname=tunnel.interface_name(args.vni), **manager.port_flags(args.vni))]))
+        elif args.command == "mtu":
+            manager.set_mtu(args.vni, args.mtu, args.relock_routes)
+        elif args.command == "fdb":
+            if args.fdb_command == "add":
+                manager.add_fdb_entry(args.vni, args.mac, args.remote)
+            elif args.fdb_command == "del":
+                manager.remove_fdb_entry(args.vni, args.mac, args.remote)
+            else:
+                print(OutputFormatterFactory.get_formatter(OutputFormatType(args.format)).format(manager.fdb_entries(args.vni)))
+        elif args.command == "neigh":
+            if args.neigh_command == "add":
+                manager.add_neigh_entry(args.vni, args.address, args.mac)
+            elif args.neigh_command == "del":
+                manager.remove_neigh_entry(args.vni, args.address)
+            else:
+                print(OutputFormatterFactory.get_formatter(OutputFormatType(args.format)).format(manager.neigh_entries(args.vni)))
+        elif args.command == "flowsample":
+            table = OutputFormatterFactory.get_formatter(OutputFormatType.TABLE)
+            if args.flowsample_command == "enable":
+                collector, port = args.collector
+                manager.enable_flow_sampling(args.vni, collector, port, args.rate, args.protocol, args.group, args.check_collector)
+            elif args.flowsample_command == "disable":
+                print(table.format(manager.disable_flow_sampling(args.vni)))
+            rows = manager.flow_sampling()
+            print(table.format(rows) if rows else "No flow sampling configured.")
+        elif args.command == "migrate-endpoint":
+            migrations = [EndpointMigration(args.old, args.new, SshExecutor(host["ssh"]), host["name"]) for host in load_inventory(args.hosts_file)] if args.hosts_file else [EndpointMigration(args.old, args.new, executor)]
+            affected = {migration.host: migration.affected() for migration in migrations}
+            table = OutputFormatterFactory.get_formatter(OutputFormatType.TABLE)
+            print(table.format([{key: item[key] for key in ("host", "object", "ifname", "vni")} for items in affected.values() for item in items]))
+            if not args.yes:
+                logger.info("Dry run only; pass --yes to apply these changes.")
+                return
+            results = [result for migration in migrations for result in migration.apply(affected[migration.host])]
+            state = store.load()
+            for record in state.get("tunnels", {}).values():
+                if record.get("dst_host") == args.old:
+                    record["dst_host"] = args.new
+                record["peers"] = [args.new if peer == args.old else peer for peer in record.get("peers", [])]
+                for obj in record.get("ancillary", []):
+                    if obj["kind"] == "fdb" and obj["dst"] == args.old:
+                        obj["dst"] = args.new
+            store.save(state)
+            print(table.format(results))
+            if any(result["result"].startswith("failed") for result in results):
+                sys.exit(1)
+        elif args.command == "fleet":
+            rows = FleetCollector(select_hosts(load_inventory(args.inventory), args.limit), max_workers=args.parallel).collect()
+            print(OutputFormatterFactory.get_formatter(OutputFormatType(args.format)).format(rows))
+            if any(row["status"].startswith("error") for row in rows):
+                sys.exit(1)
+        elif args.command == "pair":
+            planner = PairPlanner(TunnelType(args.tunnel_type), args.vni, args.bridge_name, args.dst_port, args.dev)
+            sides = [(args.host_a, args.address_a, args.address_b), (args.host_b, args.address_b, args.address_a)]
+            plans = {host: planner.plan_host(SshExecutor(host), local, remote) for host, local, remote in sides}
+            text = PlanFormatterFactory.get_formatter(PlanFormatType.TEXT)
+            print(side_by_side({host: text.format([plan]) for host, plan in plans.items()}))
+            if args.dry_run:
+                sys.exit(planner.exit_code(list(plans.values())))
+            if planner.exit_code(list(plans.values())) == PairPlanner.EXIT_CONFLICTS:
+                raise TunnelManagerError("Refusing to create the pair: resolve the conflicts above first")
+            for host, local, remote in sides:
+                if planner.apply_host(TunnelManager(TunnelFactory.create_tunnel(TunnelType(args.tunnel_type), bridge_tool=args.bridge_tool, executor=SshExecutor(host))), plans[host], local, remote):
+                    logger.info(f"Created {tunnel.interface_name(args.vni)} on {host}.")
+        elif args.command == "lab":
+            lab = LabPair(args.cidr, args.vni, args.bridge, args.peer, TunnelType(args.tunnel_type), local_manager=manager, local_address=args.local_address, dst_port=args.dst_port, bridge_tool=args.bridge_tool)
+            if args.lab_command == "up":
+                rows = lab.up()
+                print(lab.summary(rows))
+                if any(row["ping"] != "ok" for row in rows):
+                    raise TunnelManagerError(f"Lab VNI {args.vni} is up but the overlay does not pass traffic both ways")
+            else:
+                print(OutputFormatterFactory.get_formatter(OutputFormatType.TABLE).format(lab.down()))
+        elif args.command == "mesh" and args.type == "wireguard":
+            if not args.overlay_supernet:
+                parser.error("--type wireguard needs --overlay-supernet to address the nodes")
+            if args.format not in (None, "wg-quick"):
+                parser.error("--type wireguard writes wg-quick configs; leave out --format or pass --format wg-quick")
+            mesh = WireGuardMesh(args.nodes, args.overlay_supernet, WireGuardKeyStore(args.keys_dir, executor, files) if args.keys_dir else WireGuardKeyStore.beside(args.state_file, executor, files), args.dst_port, args.keepalive, args.preshared_keys)
+            configs = mesh.configs()
+            if args.apply:
+                if args.apply not in configs:
+                    parser.error(f"--apply {args.apply} is not one of the --nodes")
+                WireGuardInterface(store, executor, files).apply(args.ifname, configs[args.apply], mesh.key_file(args.apply))
+            else:
+                for node, config in configs.items():
+                    if args.output_dir:
+                        # The configs hold private keys, so only their owner may read them
+                        path = os.path.join(args.output_dir, f"{node}.conf")
+                        with os.fdopen(os.open(path, os.O_WRONLY | os.O_CREAT | os.O_TRUNC, 0o600), "w") as f:
+                            f.write(WireGuardMesh.wg_quick(config))
+                        logger.info(f"Wrote {len(config['peers'])} peer(s) for {node} to {path}.")
+                    else:
+                        print(f"# {node}\n{WireGuardMesh.wg_quick(config)}", end="")
+        elif args.command == "mesh":
+            if args.vni_base is None:
+                parser.error("the following arguments are required: --vni-base")
+            if args.format == "wg-quick":
+                parser.error("--format wg-quick needs --type wireguard")
+            args.format = args.format or "manifest"
+            ipam = (ReservationIpam(args.ipam_file, args.overlay_supernet, args.link_prefix, files) if args.ipam_file else SequentialIpam(args.overlay_supernet, args.link_prefix)) if args.overlay_supernet else None
+            generator = MeshGenerator(args.nodes, args.vni_base, TunnelType(args.type or args.tunnel_type), ipam, args.dst_port, args.dev)
+            for node, node_manifest in generator.manifests().items():
+                text = yaml.dump(node_manifest, default_flow_style=False, sort_keys=False) if args.format == "manifest" else "".join(shlex.join(command) + "\n" for command in generator.commands(node_manifest))
+                if args.output_dir:
+                    os.makedirs(args.output_dir, exist_ok=True)
+                    path = os.path.join(args.output_dir, f"{node}.{'yaml' if args.format == 'manifest' else 'sh'}")
+                    with open(path, "w") as f:
+                        f.write(text)
+                    logger.info(f"Wrote {len(node_manifest['tunnels'])} tunnel(s) for {node} to {path}.")
+                else:
+                    print(f"# {node}\n{text}", end="")
+        elif args.command == "repair":
+            outcome = manager.repair_attachment(args.vni, args.bridge_name, args.create_bridge)
+            logger.info(f"{tunnel.interface_name(args.vni)}: {outcome}.")
+            if outcome in ("missing", "degraded"):
+                sys.exit(1)
+        elif args.command == "undo":
+            history = OperationHistory(audit, lambda tunnel_type: TunnelManager(TunnelFactory.create_tunnel(TunnelType(tunnel_type), **tunnel_options), TunnelRecords(store), resolver, journal=journal))
+            target = history.target(args.id)
+            if not args.yes and not confirm(f"Undo {history.describe(target)}?"):
+                logger.info("Undo cancelled.")
+                return
+            logger.info(history.undo(target))
+        elif args.command == "addr":
+            inspector = AddressInspector(tunnel.interface_name(args.vni), executor)
+            addresses = inspector.collect()
+            expiring = inspector.check_expiry(addresses, args.warn_within)
+            for ifname in sorted({address["ifname"] for address in expiring}) if args.renew else []:
+                record = manager.records.get(tunnel.tunnel_type, args.vni)
+                client = next((tracked for tracked in (record or {}).get("ancillary", []) if tracked["kind"] == "dhcp_client" and tracked["ifname"] == ifname), None)
+                if client:
+                    inspector.renew(ifname, client["pidfile"])
+                elif not inspector.dhcp_client_running(ifname):
+                    pidfile = inspector.renew(ifname)
+                    if record:
+                        TunnelRecords.track(record, "dhcp_client", pidfile=pidfile, ifname=ifname)
+                        manager.records.record(tunnel.tunnel_type, args.vni, record)
+            print(OutputFormatterFactory.get_formatter(OutputFormatType(args.format)).format(addresses))
+        elif args.command == "flows":
+            flows = OvsFlowManager(args.bridge, args.tunnel_port or f"{tunnel.tunnel_type}0", executor)
+            if args.flows_command == "apply":
+                flows.apply(args.map, args.remote)
+            elif args.flows_command == "show":
+                print(flows.show(args.vni), end="")
+            elif args.flows_command == "delete":
+                flows.delete(args.vni)
+        elif args.command == "external":
+            external = ExternalTunnel(tunnel, store)
+            if args.external_command == "create":
+                external.create(args.name, args.dst_port, args.bridge_name)
+            elif args.external_command == "delete":
+                external.delete(args.name)
+            elif args.external_command == "map":
+                external.map_vlan(args.vlan, args.vni, args.name)
+            elif args.external_command == "unmap":
+                external.unmap_vlan(args.vlan, args.name)
+            elif args.external_command == "mappings":
+                print(OutputFormatterFactory.get_formatter(OutputFormatType(args.format)).format(external.mappings(args.name)))
+            elif args.external_command == "list":
+                print(OutputFormatterFactory.get_formatter(OutputFormatType(args.format)).format(external.list()))
+        elif args.command == "frr":
+            if not frr:
+                parser.error("frr sync needs --frr-asn (or TUNNELMGR_FRR_ASN)")
+            print(OutputFormatterFactory.get_formatter(OutputFormatType(args.format)).format(frr.sync(list(store.load().get("tunnels", {}).values()))))
+        elif args.command == "wireguard":
+            wireguard = WireGuardInterface(store, executor, files)
+            keys = WireGuardKeyStore(args.keys_dir, executor, files) if args.keys_dir else WireGuardKeyStore.beside(args.state_file, executor, files)
+            if args.wireguard_command == "create":
+                if not args.private_key:
+                    keys.private(args.name)
+                print(wireguard.create(args.name, args.private_key or keys.path(args.name), args.listen_port, args.address))
+            elif args.wireguard_command == "peer-add":
+                wireguard.set_peer(args.name, args.public_key, args.endpoint, args.allowed_ips, args.keepalive, args.preshared_key)
+            elif args.wireguard_command == "peer-remove":
+                wireguard.remove_peer(args.name, args.public_key)
+            elif args.wireguard_command == "show":
+                print(OutputFormatterFactory.get_formatter(OutputFormatType(args.format)).format(wireguard.show(args.name)))
+            elif args.wireguard_command == "delete":
+                wireguard.delete(args.name)
+            elif args.keys_command == "generate":
+                print(keys.public(args.name))
+            elif args.keys_command == "psk":
+                if len(args.pair) != 2:
+                    parser.error("--pair takes exactly two peers, e.g. node1,node2")
+                keys.preshared(*args.pair)
+                print(keys.psk_path(*args.pair))
+            elif args.keys_command == "rotate":
+                old, new = keys.rotate(args.name)
+                reloaded = wireguard.reload_key(keys.path(args.name))
+                replaced = wireguard.replace_peer_key(old, new) if old else []
+                logger.info(f"Rotated {args.name}: reloaded {', '.join(reloaded) or 'no interface'}, updated the peer on {', '.join(replaced) or 'no interface'}. Regenerate the configs of remote peers, e.g. with mesh generate --type wireguard.")
+                print(new)
+            elif args.keys_command == "list":
+                print(OutputFormatterFactory.get_formatter(OutputFormatType(args.format)).format(keys.list()))
+        elif args.command == "agent":
+            manifest = Manifest.load(args.manifest)
+            if args.agent_command == "effective-config":
+                print(OutputFormatterFactory.get_formatter(OutputFormatType.YAML).format(manifest.settings(args.vni)._asdict()), end="")
+            elif args.agent_command == "run":
+                resources = ResourceReport(TunnelRecords(store), policy, counter) if args.report else None
+
+                def report_cycle() -> None:
+                    print(json.dumps(resources.build()) if args.report_format == "json" else ResourceReport.format_text(resources.build()), flush=True)
+                    resources.begin()
+
+                TunnelAgent(manifest, manager_factory, MaintenanceManager(store), snapshot=snapshot, notify=WebhookNotifier(args.webhook) if args.webhook else None, policy=policy).run(metrics_file=args.metrics_file, report=report_cycle if resources else None)
+        elif args.command == "daemon":
+            service = TunnelService(manager_factory, args.tunnel_type, snapshot=snapshot, cancellable=cancellable, state_lock=StateLock.beside(store), watch=TunnelWatchHub())
+            servers = ([] if args.no_grpc else [GrpcDaemon(service, args.grpc_listen, args.workers, args.shutdown_grace)]) + ([HttpDaemon(service, args.http_listen, grace=args.shutdown_grace)] if args.http_listen else []) + ([HttpDaemon(service, args.metrics_listen, api=False, grace=args.shutdown_grace)] if args.metrics_listen else [])
+            if not servers:
+                parser.error("--no-grpc requires --http-listen")
+            reconciler = TunnelReconciler(service, args.reconcile_backoff, args.reconcile_max_backoff, MaintenanceManager(store), snapshot=snapshot) if args.reconcile_interval else None
+            stop = threading.Event()
+            signal.signal(signal.SIGTERM, lambda signum, frame: stop.set())
+            try:
+                # Watchers connecting before the first change or reconcile still get the tunnels in their snapshot
+                with service.exclusive():
+                    service.publish()
+                for server in servers:
+                    server.start()
+                while not stop.wait(args.reconcile_interval or 1):
+                    if reconciler:
+                        reconciler.tick()
+            except KeyboardInterrupt:
+                pass
+            finally:
+                for server in servers:
+                    server.stop()
+        elif args.command == "apply":
+            # SIGTERM stops after the current step and reverts the tunnel that was being created
+            signal.signal(signal.SIGTERM, lambda signum, frame: cancel.cancel())
+            resources = ResourceReport(TunnelRecords(store), policy, counter)
+            applier = ManifestApplier(Manifest.load(args.manifest), manager_factory, policy, cancel)
+            plan = applier.plan(args.replace, args.prune)
+            print(PlanFormatterFactory.get_formatter(PlanFormatType(args.plan_format)).format(plan))
+            if args.dry_run:
+                return
+            problems = applier.validate(plan, args.check_connectivity) if args.atomic else []
+            if problems:
+                raise TunnelManagerError("Refusing to apply; pre-validation failed:\n  " + "\n  ".join(problems))
+            verdicts = []
+            # Records before and after, so undo can revert the whole apply from one history entry
+            before = store.load().get("tunnels", {})
+            if args.canary:
+                progress = (lambda event: print(json.dumps(event), flush=True)) if args.report_format == "json" else (lambda event: logger.info(f"{event['phase']}: " + ", ".join(f"{key}={value}" for key, value in event.items() if key != "phase")))
+                report, verdicts, succeeded = applier.apply_canary(plan, args.canary, CanaryVerifier(manager_factory, args.verify_cmd), progress, args.parallel)
+            else:
+                report, succeeded = applier.apply(plan, args.atomic, args.parallel)
+            OperationHistory.record_apply(audit, args.manifest, before, store.load().get("tunnels", {}))
+            if args.report_format == "json":
+                summary = {result: sum(1 for item in report if item["result"].split(":")[0] == result) for result in ("created", "replaced", "deleted", "skipped", "failed", "reverted")}
+                print(json.dumps(dict({"canaries": verdicts, "report": report, "summary": dict(summary, succeeded=succeeded)}, **({"resources": resources.build()} if args.report else {})), indent=2))
+            else:
+                if verdicts:
+                    print(OutputFormatterFactory.get_formatter(OutputFormatType.TABLE).format(verdicts))
+                print(OutputFormatterFactory.get_formatter(OutputFormatType.TABLE).format(report))
+                if args.report:
+                    print(ResourceReport.format_text(resources.build()))
+            if not succeeded:
+                sys.exit(1)
+        elif args.command in ("plan", "diff"):
+            plan = ManifestApplier(Manifest.load(args.manifest), manager_factory, policy).plan(replace=True, prune=True)
+            print(PlanFormatterFactory.get_formatter(PlanFormatType(args.plan_format)).format(plan))
+            if any(entry.action != "noop" for entry in plan):
+                sys.exit(PairPlanner.EXIT_CHANGES)
+        elif args.command == "wait-ready":
+            stop = threading.Event()
+            signal.signal(signal.SIGTERM, lambda signum, frame: stop.set())
+            ready, rows = ReadinessGate(manager, args.vni, args.probe, snapshot).wait(args.timeout, args.interval, stop)
+            if not ready:
+                print(OutputFormatterFactory.get_formatter(OutputFormatType.TABLE).format(rows))
+                raise TunnelManagerError("Interrupted while waiting for tunnels" if stop.is_set() else f"Tunnels not ready after {args.timeout}s")
+            logger.info(f"{len(rows)} tunnel(s) ready.")
+        elif args.command == "explain":
+            steps = CreateExplainer(TunnelType(args.tunnel_type), args.bridge_tool, resolver).explain(TunnelSpec(args.vni, args.src_host, args.dst_host, args.bridge_name, dst_port=args.dst_port, dev=args.dev, routes=args.routes, link_group=args.link_group), args.distro)
+            print(CreateExplainer.format(steps, args.format == "markdown"))
+        elif args.command == "manifest":
+            print(Manifest.load(args.manifest).render(), end="")
+        elif args.command == "export" and args.export_command == "systemd-networkd":
+            units = NetworkdExporter(list(store.load().get("tunnels", {}).values())).units()
+            for name, text in units.items():
+                if args.output_dir:
+                    os.makedirs(args.output_dir, exist_ok=True)
+                    with open(os.path.join(args.output_dir, name), "w") as f:
+                        f.write(text)
+                else:
+                    print(f"# {name}\n{text}")
+            if args.output_dir:
+                logger.info(f"Wrote {len(units)} unit(s) to {args.output_dir}; run networkctl reload to apply them.")
+        elif args.command == "export" and args.export_command == "ifupdown":
+            stanzas = IfupdownExporter(list(store.load().get("tunnels", {}).values()), args.bridge_tool).render()
+            if args.output == "-":
+                print(stanzas, end="")
+            else:
+                with open(args.output, "w") as f:
+                    f.write(stanzas)
+                logger.info(f"Wrote interfaces stanzas to {args.output}; run ifup -a to bring them up.")
+        elif args.command == "export" and args.export_command == "networkmanager":
+            exporter = NetworkManagerExporter(list(store.load().get("tunnels", {}).values()))
+            profiles = exporter.profiles()
+            for reason in exporter.skipped:
+                logger.warning(f"Not exported: {reason}")
+            for name, text in profiles.items():
+                if args.output_dir:
+                    os.makedirs(args.output_dir, exist_ok=True)
+                    path = os.path.join(args.output_dir, name)
+                    with open(path, "w") as f:
+                        f.write(text)
+                    # NetworkManager ignores keyfiles that other users can read
+                    os.chmod(path, 0o600)
+                else:
+                    print(f"# {name}\n{text}")
+            if args.output_dir:
+                logger.info(f"Wrote {len(profiles)} profile(s) to {args.output_dir}; run nmcli connection reload to load them.")
+        elif args.command == "export" and args.export_command in ("frr", "bird"):
+            exporter = (FrrEvpnExporter if args.export_command == "frr" else BirdExporter)(list(store.load().get("tunnels", {}).values()), args.asn, args.router_id, args.neighbors, args.remote_as)
+            config = exporter.render()
+            for reason in exporter.skipped:
+                logger.warning(f"Not exported: {reason}")
+            for warning in exporter.warnings:
+                logger.warning(warning)
+            if args.output == "-":
+                print(config, end="")
+            else:
+                with open(args.output, "w") as f:
+                    f.write(config)
+                logger.info(f"Wrote {'FRR' if args.export_command == 'frr' else 'BIRD'} configuration to {args.output}; " + ("run vtysh -b or reload frr to apply it." if args.export_command == "frr" else "run birdc configure to apply it."))
+        elif args.command == "export" and args.export_command == "netplan":
+            exporter = NetplanExporter(NetplanExporter.from_manifest(Manifest.load(args.manifest), resolver) if args.manifest else list(store.load().get("tunnels", {}).values()))
+            document = exporter.render()
+            for reason in exporter.skipped:
+                logger.warning(f"Not exported: {reason}")
+            if args.output == "-":
+                print(document, end="")
+            else:
+                with open(args.output, "w") as f:
+                    f.write(document)
+                # netplan refuses configuration other users can read
+                os.chmod(args.output, 0o600)
+                logger.info(f"Wrote netplan document to {args.output}; run netplan apply to use it.")
+        elif args.command == "export":
+            dashboard = json.dumps(GrafanaDashboard().build(), indent=2) + "\n"
+            if args.output == "-":
+                print(dashboard, end="")
+            else:
+                with open(args.output, "w") as f:
+                    f.write(dashboard)
+                logger.info(f"Wrote Grafana dashboard to {args.output}.")
+        elif args.command == "maintenance":
+            maintenance = MaintenanceManager(store)
+            if args.maintenance_command == "start":
+                maintenance.start(args.duration, None if args.all else args.vni, args.reason)
+            elif args.maintenance_command == "end":
+                maintenance.end(args.vni)
+            print(OutputFormatterFactory.get_formatter(OutputFormatType.TABLE).format(maintenance.status()))
         else:
             parser.print_help()
     except Exception as e:
         logger.error(str(e))
         sys.exit(1)
+    finally:
+        if lock:
+            lock.release()
+        if scratch:
+            scratch.cleanup()
 
 
 if __name__ == "__main__":
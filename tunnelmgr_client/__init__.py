@@ -0,0 +1,61 @@
+from typing import Any, Dict, Iterator, Optional
+
+# The service in proto/tunnelmgr/v1/tunnel_manager.proto; this package needs grpcio and protobuf, not tunnel_manager
+SERVICE = "tunnelmgr.v1.TunnelManager"
+
+
+def whole_numbers(value: Any) -> Any:
+    # Struct numbers are doubles, so a VNI sent as 100 comes back as 100.0
+    if isinstance(value, float) and value.is_integer():
+        return int(value)
+    if isinstance(value, dict):
+        return {key: whole_numbers(item) for key, item in value.items()}
+    if isinstance(value, list):
+        return [whole_numbers(item) for item in value]
+    return value
+
+
+def encode(message: Dict[str, Any]) -> bytes:
+    from google.protobuf import json_format, struct_pb2
+
+    return json_format.ParseDict(message, struct_pb2.Struct()).SerializeToString()
+
+
+def decode(data: bytes) -> Dict[str, Any]:
+    from google.protobuf import json_format, struct_pb2
+
+    return whole_numbers(json_format.MessageToDict(struct_pb2.Struct.FromString(data)))
+
+
+class TunnelClient:
+    def __init__(self, target: str, timeout: Optional[float] = None, channel: Any = None) -> None:
+        if channel is None:
+            import grpc
+
+            channel = grpc.insecure_channel(target)
+        self.channel = channel
+        self.timeout = timeout
+
+    def call(self, method: str, **request: Any) -> Dict[str, Any]:
+        stub = self.channel.unary_unary(f"/{SERVICE}/{method}", request_serializer=encode, response_deserializer=decode)
+        return stub({key: value for key, value in request.items() if value is not None}, timeout=self.timeout)
+
+    def create(self, **request: Any) -> Dict[str, Any]:
+        return self.call("Create", **request)
+
+    def list(self, **request: Any) -> Dict[str, Any]:
+        return self.call("List", **request)
+
+    def cleanup(self, **request: Any) -> Dict[str, Any]:
+        return self.call("Cleanup", **request)
+
+    def validate(self, **request: Any) -> Dict[str, Any]:
+        return self.call("Validate", **request)
+
+    def watch(self) -> Iterator[Dict[str, Any]]:
+        # No timeout: the stream lasts until the client cancels it or the daemon stops
+        stub = self.channel.unary_stream(f"/{SERVICE}/Watch", request_serializer=encode, response_deserializer=decode)
+        return stub({})
+
+    def close(self) -> None:
+        self.channel.close()